@@ -0,0 +1,87 @@
+// Command accrual-mock runs the accrual system simulator, so the service
+// can be run end to end locally.
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/paramonies/ya-gophermart/internal/accrualmock"
+	"github.com/paramonies/ya-gophermart/pkg/lifecycle"
+	"github.com/paramonies/ya-gophermart/pkg/log"
+)
+
+const (
+	errorExitCode = 1
+)
+
+func main() {
+	log.Init(os.Stdout, &log.Config{
+		WithCaller: true,
+	})
+
+	addr := pflag.String("a", ":9000", "address to listen")
+	progression := pflag.String("progression", "REGISTERED,PROCESSING", "intermediate statuses an order goes through, one per request")
+	rules := pflag.StringSlice("rule", nil, "final state of orders by number suffix: <suffix>=<STATUS>[:<accrual>], repeatable")
+	throttleEvery := pflag.Int("throttle-every", 0, "answer every n-th request with 429")
+	retryAfter := pflag.Duration("retry-after", 60*time.Second, "Retry-After sent along with 429")
+	errorEvery := pflag.Int("error-every", 0, "answer every n-th request with 500")
+	latency := pflag.Duration("latency", 0, "delay of every response")
+	pflag.Parse()
+
+	cfg := accrualmock.Config{
+		ThrottleEvery: *throttleEvery,
+		RetryAfter:    *retryAfter,
+		ErrorEvery:    *errorEvery,
+		Latency:       *latency,
+	}
+	cfg.Progression = []accrualmock.Status{}
+	for _, s := range strings.Split(*progression, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			cfg.Progression = append(cfg.Progression, accrualmock.Status(strings.ToUpper(s)))
+		}
+	}
+	for _, s := range *rules {
+		rule, err := accrualmock.ParseRule(s)
+		if err != nil {
+			log.Error(context.Background(), "failed to parse rule", err)
+			os.Exit(errorExitCode)
+		}
+		cfg.Rules = append(cfg.Rules, rule)
+	}
+
+	srv := http.Server{
+		Addr:    *addr,
+		Handler: accrualmock.New(cfg),
+	}
+
+	lc := lifecycle.New(0)
+	lc.Register(lifecycle.Hook{
+		Name: "http server",
+		Start: func(ctx context.Context) error {
+			go func() {
+				if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+					lc.Fail("http server", err)
+				}
+			}()
+			log.Info(ctx, "accrual mock is listening", "address", *addr)
+			return nil
+		},
+		Stop: srv.Shutdown,
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := lc.Run(ctx); err != nil {
+		log.Error(context.Background(), "accrual mock stopped with error", err)
+		os.Exit(errorExitCode)
+	}
+}
@@ -0,0 +1,58 @@
+// Command audit-verify checks the hash chain of the audit log. It exits
+// with a non-zero code if an entry was modified, removed or inserted.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/spf13/pflag"
+
+	"github.com/paramonies/ya-gophermart/internal/audit"
+	"github.com/paramonies/ya-gophermart/internal/storage/postgres"
+)
+
+const (
+	errorExitCode  = 1
+	brokenExitCode = 2
+)
+
+func main() {
+	databaseURI := pflag.StringP("database-uri", "d", os.Getenv("DATABASE_URI"), "the database connection URL (env: DATABASE_URI)")
+	timeout := pflag.Duration("query-timeout", 10*time.Second, "the timeout of each query")
+	pflag.Parse()
+
+	if *databaseURI == "" {
+		fmt.Fprintln(os.Stderr, "the database connection URL is required")
+		os.Exit(errorExitCode)
+	}
+
+	// The schema is left as it is: the check must not migrate the
+	// database it inspects.
+	ctx := context.Background()
+	pool, err := pgxpool.Connect(ctx, *databaseURI)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to connect to database:", err)
+		os.Exit(errorExitCode)
+	}
+	defer pool.Close()
+
+	checked, err := audit.Verify(ctx, postgres.NewAuditRepository(pool, *timeout))
+	var chainErr *audit.ChainError
+	if errors.As(err, &chainErr) {
+		fmt.Printf("audit log is broken after %d valid entries: %s\n", checked, chainErr)
+		pool.Close()
+		os.Exit(brokenExitCode)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to verify audit log:", err)
+		pool.Close()
+		os.Exit(errorExitCode)
+	}
+
+	fmt.Printf("audit log is intact, %d entries checked\n", checked)
+}
@@ -2,16 +2,34 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
-	"github.com/go-chi/chi/v5"
-
+	"github.com/paramonies/ya-gophermart/internal/accrual"
+	"github.com/paramonies/ya-gophermart/internal/accrualsync"
+	"github.com/paramonies/ya-gophermart/internal/audit"
+	"github.com/paramonies/ya-gophermart/internal/auth"
+	"github.com/paramonies/ya-gophermart/internal/balance"
+	"github.com/paramonies/ya-gophermart/internal/bruteforce"
+	"github.com/paramonies/ya-gophermart/internal/certs"
 	"github.com/paramonies/ya-gophermart/internal/config"
+	"github.com/paramonies/ya-gophermart/internal/events"
+	"github.com/paramonies/ya-gophermart/internal/expiry"
 	"github.com/paramonies/ya-gophermart/internal/handlers"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/outbox"
+	"github.com/paramonies/ya-gophermart/internal/promo"
+	"github.com/paramonies/ya-gophermart/internal/reconcile"
+	"github.com/paramonies/ya-gophermart/internal/referral"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/internal/storage/memory"
+	"github.com/paramonies/ya-gophermart/internal/storage/postgres"
+	"github.com/paramonies/ya-gophermart/internal/webhooks"
+	"github.com/paramonies/ya-gophermart/pkg/lifecycle"
 	"github.com/paramonies/ya-gophermart/pkg/log"
 )
 
@@ -42,45 +60,326 @@ func main() {
 
 	log.Debug(context.Background(), "config params", "run_address", cfg.App.RunAddress,
 		"log_level", cfg.App.LogLevel, "database_uri", cfg.Database.DatabaseURI, "query_timeout",
-		cfg.Database.QueryTimeout, "accrual_system_address", cfg.ExtApp.AccrualSystemAddress)
+		cfg.Database.QueryTimeout, "accrual_system_address", cfg.ExtApp.AccrualSystemAddress,
+		"tls_enabled", cfg.App.TLS.Enabled())
 
 	logLevel := convertLogLevel(cfg.App.LogLevel)
 	log.SetGlobalLevel(logLevel)
 	log.Info(context.Background(), "updated global logging level", "newLevel", logLevel)
 
 	addr := cfg.App.RunAddress
-	log.Info(context.Background(), "start listening API server", "address", addr)
+	log.Info(context.Background(), "start listening API server", "address", addr, "tls", cfg.App.TLS.Enabled())
+
+	store, err := openStorage(context.Background(), cfg.Database)
+	if err != nil {
+		log.Error(context.Background(), "failed to open storage", err)
+		os.Exit(errorExitCode)
+	}
+
+	auditLog := audit.New(store.Audit)
+	if err := auditLog.RecordConfig(context.Background(), config.Settings()); err != nil {
+		log.Error(context.Background(), "failed to record configuration", err)
+		os.Exit(errorExitCode)
+	}
+
+	secret, err := authSecret(cfg.Auth)
+	if err != nil {
+		log.Error(context.Background(), "failed to generate auth secret", err)
+		os.Exit(errorExitCode)
+	}
+	authService := auth.NewService(store.Users, store.Sessions, auth.Config{
+		Secret:     secret,
+		AccessTTL:  cfg.Auth.AccessTTL,
+		RefreshTTL: cfg.Auth.RefreshTTL,
+		Hash: auth.HashParams{
+			Algorithm:     cfg.Auth.Password.HashAlgorithm,
+			BcryptCost:    cfg.Auth.Password.BcryptCost,
+			Argon2Time:    uint32(cfg.Auth.Password.Argon2Time),
+			Argon2Memory:  uint32(cfg.Auth.Password.Argon2Memory),
+			Argon2Threads: uint8(cfg.Auth.Password.Argon2Threads),
+		},
+		Policy: auth.PasswordPolicy{
+			MinLength:    cfg.Auth.Password.MinLength,
+			MinClasses:   cfg.Auth.Password.MinClasses,
+			RejectCommon: cfg.Auth.Password.RejectCommon,
+		},
+	})
+
+	attempts := store.Attempts
+	if cfg.BruteForce.Backend == "memory" {
+		attempts = memory.NewAttemptRepository()
+	}
+	guard := bruteforce.NewGuard(attempts, bruteforce.Config{
+		LoginThreshold: cfg.BruteForce.LoginThreshold,
+		IPThreshold:    cfg.BruteForce.IPThreshold,
+		Window:         cfg.BruteForce.Window,
+		BaseDelay:      cfg.BruteForce.BaseDelay,
+		MaxDelay:       cfg.BruteForce.MaxDelay,
+		RegisterLimit:  cfg.BruteForce.RegisterLimit,
+		RegisterWindow: cfg.BruteForce.RegisterWindow,
+	})
+
+	accrualClient := accrual.NewClient(cfg.ExtApp.AccrualSystemAddress, accrual.DefaultTimeout)
+	var reconciler *reconcile.Reconciler
+	if cfg.Reconciliation.Interval > 0 {
+		reconciler = reconcile.New(store.Orders, store.Ledger, accrualClient, auditLog,
+			reconcile.Config{
+				Window:  cfg.Reconciliation.Window,
+				AutoFix: cfg.Reconciliation.AutoFix,
+			})
+	}
+
+	balances := balance.New(store.Ledger, balance.Config{
+		Lag:       cfg.Balance.SnapshotLag,
+		BatchSize: cfg.Balance.SnapshotBatchSize,
+	})
+	expiration := expiry.New(store.Ledger, expiry.Config{
+		After: cfg.Expiration.After,
+		Soon:  cfg.Expiration.Soon,
+	})
 
+	specs := make([]promo.Spec, 0, len(cfg.Promotions.Rules))
+	for _, r := range cfg.Promotions.Rules {
+		specs = append(specs, promo.Spec{
+			ID:         r.ID,
+			Trigger:    r.Trigger,
+			Bonus:      r.Bonus,
+			Multiplier: r.Multiplier,
+			FirstOrder: r.FirstOrder,
+			From:       r.From,
+			To:         r.To,
+		})
+	}
+	rules, err := promo.ParseRules(specs)
+	if err != nil {
+		log.Error(context.Background(), "failed to parse promotion rules", err)
+		os.Exit(errorExitCode)
+	}
+	promotions := promo.New(rules)
+	syncer := accrualsync.New(store.Orders, accrualClient, promotions, accrualsync.Config{
+		BatchSize: cfg.AccrualSync.BatchSize,
+	})
+	// The bonuses are valid, see config.ReferralsConfig.validate.
+	referrals := referral.New(store.Referrals, store.Orders, referral.Config{
+		ReferrerBonus: money.MustParse(cfg.Referrals.ReferrerBonus),
+		ReferredBonus: money.MustParse(cfg.Referrals.ReferredBonus),
+		Cap:           cfg.Referrals.Cap,
+	})
+
+	hub := events.NewHub()
 	var srv http.Server = http.Server{
-		Addr:    addr,
-		Handler: newRouter(),
-	}
-	done := make(chan struct{})
-	go func() {
-		sigCh := make(chan os.Signal, 1)
-		signal.Notify(sigCh, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
-		<-sigCh
-
-		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		defer func() {
-			cancel()
-			close(sigCh)
-		}()
-
-		if err := srv.Shutdown(ctx); err != nil {
-			log.Error(context.Background(), "failed to shut down server gracefully", err)
+		Addr: addr,
+		Handler: handlers.NewRouter(handlers.Deps{
+			Storage:          store,
+			Auth:             authService,
+			Guard:            guard,
+			Audit:            auditLog,
+			Balances:         balances,
+			Expiration:       expiration,
+			Promotions:       promotions,
+			Referrals:        referrals,
+			Events:           hub,
+			IdempotencyTTL:   cfg.Idempotency.TTL,
+			IdempotencyLease: cfg.Idempotency.Lease,
+
+			AdminToken:             cfg.Admin.Token,
+			AdminRequireClientCert: cfg.Admin.RequireClientCert,
+			Reconciler:             reconciler,
+
+			WebhooksAllowPrivateNetworks: cfg.Webhooks.AllowPrivateNetworks,
+		}),
+	}
+	// Event streams never end on their own, close them or Shutdown
+	// waits for the whole timeout.
+	srv.RegisterOnShutdown(hub.Close)
+	if cfg.App.TLS.Enabled() {
+		srv.TLSConfig, err = certs.NewTLSConfig(cfg.App.TLS)
+		if err != nil {
+			log.Error(context.Background(), "failed to configure TLS", err)
 			os.Exit(errorExitCode)
 		}
-		close(done)
-	}()
+		if cfg.App.TLS.SelfSigned {
+			log.Warning(context.Background(), "serving a self-signed certificate, do not use it in production")
+		}
+	}
+
+	lc := lifecycle.New(cfg.App.ShutdownTimeout)
+	lc.Register(lifecycle.Hook{
+		Name: "storage",
+		Stop: store.Close,
+	})
+
+	if cfg.Outbox.Sink != "" {
+		sink, closeSink, err := newOutboxSink(cfg.Outbox)
+		if err != nil {
+			log.Error(context.Background(), "failed to create outbox sink", err)
+			os.Exit(errorExitCode)
+		}
+		lc.Register(lifecycle.Hook{
+			Name: "outbox sink",
+			Stop: closeSink,
+		})
+
+		dispatcher := outbox.NewDispatcher(store.Outbox, sink, cfg.Outbox.PollInterval, cfg.Outbox.BatchSize,
+			cfg.Outbox.MaxAttempts)
+		lc.Register(lifecycle.Hook{
+			Name:  "outbox dispatcher",
+			Start: dispatcher.Start,
+			Stop:  dispatcher.Stop,
+		})
+	}
+
+	listenCtx, stopListening := context.WithCancel(context.Background())
+	lc.Register(lifecycle.Hook{
+		Name: "event notifier",
+		Start: func(context.Context) error {
+			go func() {
+				if err := store.Notifier.Listen(listenCtx, hub.Notify); err != nil {
+					lc.Fail("event notifier", err)
+				}
+			}()
+			return nil
+		},
+		Stop: func(context.Context) error {
+			stopListening()
+			return nil
+		},
+	})
+
+	deliverer := webhooks.NewDeliverer(store.Webhooks, webhooks.Config{
+		PollInterval: cfg.Webhooks.PollInterval,
+		BatchSize:    cfg.Webhooks.BatchSize,
+		MaxAttempts:  cfg.Webhooks.MaxAttempts,
+		Timeout:      cfg.Webhooks.Timeout,
+
+		AllowPrivateNetworks: cfg.Webhooks.AllowPrivateNetworks,
+	})
+	lc.Register(lifecycle.Hook{
+		Name:  "webhook deliverer",
+		Start: deliverer.Start,
+		Stop:  deliverer.Stop,
+	})
+
+	// background gives the queries of a periodic job their own timeout.
+	background := func(fn func(ctx context.Context) error) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			return fn(storage.WithQueryTimeout(ctx, cfg.Database.BackgroundTimeout))
+		}
+	}
+
+	lc.Register(lifecycle.Periodic("idempotency cleanup", cfg.Idempotency.CleanupInterval,
+		background(func(ctx context.Context) error {
+			n, err := store.Idempotency.DeleteExpired(ctx, time.Now())
+			if n > 0 {
+				log.Debug(ctx, "deleted expired idempotency keys", "count", n)
+			}
+			return err
+		})))
+
+	lc.Register(lifecycle.Periodic("session revocation poll", cfg.Auth.RevocationPollInterval,
+		authService.PollRevocations))
+
+	lc.Register(lifecycle.Periodic("attempt counter cleanup", cfg.BruteForce.CleanupInterval,
+		background(func(ctx context.Context) error {
+			n, err := guard.DeleteStale(ctx)
+			if n > 0 {
+				log.Debug(ctx, "deleted stale attempt counters", "count", n)
+			}
+			return err
+		})))
+
+	if cfg.AccrualSync.Interval > 0 {
+		lc.Register(lifecycle.Periodic("accrual sync", cfg.AccrualSync.Interval, background(syncer.Run)))
+	}
+
+	if cfg.Balance.SnapshotInterval > 0 {
+		lc.Register(lifecycle.Periodic("balance compaction", cfg.Balance.SnapshotInterval, background(balances.Compact)))
+	}
+
+	if expiration.Enabled() {
+		lc.Register(lifecycle.Periodic("points expiration", cfg.Expiration.Interval, background(expiration.Run)))
+	}
+
+	if cfg.Referrals.Interval > 0 {
+		lc.Register(lifecycle.Periodic("referral rewards", cfg.Referrals.Interval, background(referrals.Run)))
+	}
+
+	if reconciler != nil {
+		lc.Register(lifecycle.Periodic("reconciliation", cfg.Reconciliation.Interval, background(reconciler.Run)))
+	}
 
-	if err = srv.ListenAndServe(); err != http.ErrServerClosed {
-		log.Error(context.Background(), "failed to run API server", err)
+	lc.Register(lifecycle.Hook{
+		Name: "http server",
+		Start: func(ctx context.Context) error {
+			go func() {
+				var err error
+				if srv.TLSConfig != nil {
+					// Certificates are provided by srv.TLSConfig.
+					err = srv.ListenAndServeTLS("", "")
+				} else {
+					err = srv.ListenAndServe()
+				}
+				if err != http.ErrServerClosed {
+					lc.Fail("http server", err)
+				}
+			}()
+			return nil
+		},
+		Stop: srv.Shutdown,
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err = lc.Run(ctx); err != nil {
+		log.Error(context.Background(), "service stopped with error", err)
 		os.Exit(errorExitCode)
 	}
 
-	<-done
-	log.Info(context.Background(), "server was shut down gracefully")
+	log.Info(context.Background(), "service was shut down gracefully")
+}
+
+// openStorage returns the in-memory storage for storage.MemoryURI and
+// the migrated PostgreSQL storage otherwise.
+func openStorage(ctx context.Context, cfg config.DatabaseConfig) (*storage.Storage, error) {
+	if cfg.DatabaseURI == storage.MemoryURI {
+		log.Warning(ctx, "using in-memory storage, data will be lost on exit")
+		return memory.NewStorage(), nil
+	}
+
+	return postgres.NewStorage(ctx, cfg.DatabaseURI, cfg.QueryTimeout)
+}
+
+// authSecret returns the configured secret or a random one.
+func authSecret(cfg config.AuthConfig) ([]byte, error) {
+	if cfg.Secret != "" {
+		return []byte(cfg.Secret), nil
+	}
+
+	log.Warning(context.Background(), "auth secret is not set, sessions will not survive a restart")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// newOutboxSink returns the configured sink and the function releasing it.
+func newOutboxSink(cfg config.OutboxConfig) (outbox.Sink, func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+
+	switch cfg.Sink {
+	case "webhook":
+		return outbox.NewWebhookSink(cfg.WebhookURL), noop, nil
+	case "nats":
+		sink, err := outbox.NewNATSSink(cfg.NATSURL, cfg.NATSSubject)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sink, sink.Close, nil
+	default:
+		return outbox.NewWriterSink(os.Stdout), noop, nil
+	}
 }
 
 func convertLogLevel(lvl string) log.Level {
@@ -92,11 +391,3 @@ func convertLogLevel(lvl string) log.Level {
 
 	return parsed
 }
-
-func newRouter() *chi.Mux {
-	r := chi.NewRouter()
-
-	r.Get("/auth", handlers.Auth())
-	r.Method("GET", "/login", handlers.Login())
-	return r
-}
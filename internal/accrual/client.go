@@ -0,0 +1,115 @@
+// Package accrual is the client of the external accrual system, which
+// computes the points awarded for orders.
+package accrual
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/money"
+)
+
+// DefaultTimeout is the timeout of a request when none is given.
+const DefaultTimeout = 5 * time.Second
+
+// Status is the status of an order in the accrual system.
+type Status string
+
+const (
+	StatusRegistered Status = "REGISTERED"
+	StatusInvalid    Status = "INVALID"
+	StatusProcessing Status = "PROCESSING"
+	StatusProcessed  Status = "PROCESSED"
+)
+
+// Result is the state of an order in the accrual system. Accrual is only
+// set once the order is PROCESSED.
+type Result struct {
+	Order   string       `json:"order"`
+	Status  Status       `json:"status"`
+	Accrual money.Amount `json:"accrual"`
+}
+
+// ErrNotRegistered is returned for orders unknown to the accrual system.
+var ErrNotRegistered = errors.New("order is not registered in the accrual system")
+
+// RateLimitError is returned when the accrual system refuses more requests
+// until RetryAfter has passed.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("accrual system rate limit, retry after %s", e.RetryAfter)
+}
+
+// Client requests the accrual of orders.
+type Client struct {
+	baseURL string
+	http    *http.Client
+}
+
+// NewClient returns a client of the accrual system at address, a URL or
+// a host:port as in SPECIFICATION.md, e.g. ":9000".
+func NewClient(address string, timeout time.Duration) *Client {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Client{
+		baseURL: baseURL(address),
+		http:    &http.Client{Timeout: timeout},
+	}
+}
+
+// Order returns the state of the order. It returns ErrNotRegistered or a
+// *RateLimitError when the accrual system answers so.
+func (c *Client) Order(ctx context.Context, number string) (Result, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/api/orders/"+url.PathEscape(number), nil)
+	if err != nil {
+		return Result{}, err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to request accrual: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return Result{}, ErrNotRegistered
+	case http.StatusTooManyRequests:
+		retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return Result{}, &RateLimitError{RetryAfter: time.Duration(retryAfter) * time.Second}
+	default:
+		return Result{}, fmt.Errorf("accrual system responded with status %d", resp.StatusCode)
+	}
+
+	var res Result
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return Result{}, fmt.Errorf("failed to decode accrual: %w", err)
+	}
+	if res.Status != StatusProcessed {
+		res.Accrual = 0
+	}
+	return res, nil
+}
+
+// baseURL returns the URL of the accrual system at address.
+func baseURL(address string) string {
+	if !strings.Contains(address, "://") {
+		if strings.HasPrefix(address, ":") {
+			address = "localhost" + address
+		}
+		address = "http://" + address
+	}
+	return strings.TrimRight(address, "/")
+}
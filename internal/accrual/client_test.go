@@ -0,0 +1,62 @@
+package accrual
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/accrualmock"
+	"github.com/paramonies/ya-gophermart/internal/money"
+)
+
+func TestClient_Order(t *testing.T) {
+	ts, mock := accrualmock.NewTestServer(accrualmock.Config{Progression: []accrualmock.Status{}})
+	defer ts.Close()
+	mock.Script("2377225624",
+		accrualmock.Step{Status: accrualmock.StatusProcessing},
+		accrualmock.Step{Status: accrualmock.StatusProcessed, Accrual: money.MustParse("729.98")})
+
+	c := NewClient(ts.URL, time.Second)
+	ctx := context.Background()
+
+	res, err := c.Order(ctx, "2377225624")
+	require.NoError(t, err)
+	assert.Equal(t, Result{Order: "2377225624", Status: StatusProcessing}, res)
+
+	res, err = c.Order(ctx, "2377225624")
+	require.NoError(t, err)
+	assert.Equal(t, Result{Order: "2377225624", Status: StatusProcessed, Accrual: money.MustParse("729.98")}, res)
+
+	mock.Throttle(1)
+	_, err = c.Order(ctx, "2377225624")
+	var rateLimit *RateLimitError
+	if assert.True(t, errors.As(err, &rateLimit)) {
+		assert.Equal(t, time.Second, rateLimit.RetryAfter)
+	}
+
+	mock.Fail(1)
+	_, err = c.Order(ctx, "2377225624")
+	assert.Error(t, err)
+}
+
+func TestClient_NotRegistered(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	_, err := NewClient(ts.URL, 0).Order(context.Background(), "12345678903")
+	assert.ErrorIs(t, err, ErrNotRegistered)
+}
+
+func TestBaseURL(t *testing.T) {
+	assert.Equal(t, "http://localhost:9000", baseURL(":9000"))
+	assert.Equal(t, "http://accrual:8080", baseURL("accrual:8080"))
+	assert.Equal(t, "https://accrual.example.com", baseURL("https://accrual.example.com/"))
+}
@@ -0,0 +1,280 @@
+// Package accrualmock simulates the external accrual system of
+// SPECIFICATION.md: GET /api/orders/{number} walks every order through a
+// scripted status progression and answers with deterministic accruals.
+// Rate limiting, server errors and latency can be injected to exercise
+// the client side.
+package accrualmock
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/paramonies/ya-gophermart/internal/money"
+)
+
+// Status is the accrual status of an order.
+type Status string
+
+const (
+	StatusRegistered Status = "REGISTERED"
+	StatusInvalid    Status = "INVALID"
+	StatusProcessing Status = "PROCESSING"
+	StatusProcessed  Status = "PROCESSED"
+)
+
+// Final reports whether the status can no longer change.
+func (s Status) Final() bool {
+	return s == StatusInvalid || s == StatusProcessed
+}
+
+// Step is one state of an order as seen by the client.
+type Step struct {
+	Status  Status
+	Accrual money.Amount
+}
+
+// Rule decides the final state of the orders whose number ends with Suffix.
+type Rule struct {
+	Suffix  string
+	Status  Status
+	Accrual money.Amount
+}
+
+// Config configures the simulator.
+type Config struct {
+	// Progression lists the intermediate statuses an order goes through,
+	// one per request, before its final status. Defaults to
+	// REGISTERED, PROCESSING.
+	Progression []Status
+	// Rules are checked in order; the first matching one decides the final
+	// status and accrual. Without a match the order is PROCESSED with an
+	// accrual of ten points per digit sum.
+	Rules []Rule
+	// ThrottleEvery makes every n-th request fail with 429. Zero disables it.
+	ThrottleEvery int
+	// RetryAfter is sent along with 429 responses.
+	RetryAfter time.Duration
+	// ErrorEvery makes every n-th request fail with 500. Zero disables it.
+	ErrorEvery int
+	// Latency delays every response.
+	Latency time.Duration
+}
+
+// Server implements the accrual system API.
+type Server struct {
+	cfg    Config
+	router chi.Router
+
+	mu         sync.Mutex
+	requests   int
+	throttled  int
+	failing    int
+	scripts    map[string][]Step
+	progress   map[string]int
+	queryCount map[string]int
+}
+
+// New returns a simulator configured by cfg.
+func New(cfg Config) *Server {
+	if cfg.Progression == nil {
+		cfg.Progression = []Status{StatusRegistered, StatusProcessing}
+	}
+	if cfg.RetryAfter == 0 {
+		cfg.RetryAfter = time.Second
+	}
+
+	s := &Server{
+		cfg:        cfg,
+		scripts:    make(map[string][]Step),
+		progress:   make(map[string]int),
+		queryCount: make(map[string]int),
+	}
+
+	r := chi.NewRouter()
+	r.Get("/api/orders/{number}", s.getOrder)
+	s.router = r
+
+	return s
+}
+
+// NewTestServer starts the simulator on a loopback address, for tests.
+// The caller closes the returned httptest.Server.
+func NewTestServer(cfg Config) (*httptest.Server, *Server) {
+	s := New(cfg)
+	return httptest.NewServer(s), s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+// Script replaces the progression of a single order. The last step is
+// repeated once reached.
+func (s *Server) Script(number string, steps ...Step) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.scripts[number] = steps
+	s.progress[number] = 0
+}
+
+// Throttle makes the next n requests fail with 429.
+func (s *Server) Throttle(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.throttled += n
+}
+
+// Fail makes the next n requests fail with 500.
+func (s *Server) Fail(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failing += n
+}
+
+// Queries returns how many times the order was requested, faults included.
+func (s *Server) Queries(number string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.queryCount[number]
+}
+
+type orderResponse struct {
+	Order   string        `json:"order"`
+	Status  Status        `json:"status"`
+	Accrual *money.Amount `json:"accrual,omitempty"`
+}
+
+func (s *Server) getOrder(w http.ResponseWriter, r *http.Request) {
+	number := chi.URLParam(r, "number")
+
+	if s.cfg.Latency > 0 {
+		select {
+		case <-time.After(s.cfg.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	step, fault := s.next(number)
+	switch fault {
+	case http.StatusTooManyRequests:
+		w.Header().Set("Retry-After", strconv.Itoa(int(s.cfg.RetryAfter.Seconds())))
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintf(w, "No more than %d requests per minute allowed", s.cfg.ThrottleEvery)
+		return
+	case http.StatusInternalServerError:
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := orderResponse{Order: number, Status: step.Status}
+	if step.Status == StatusProcessed {
+		accrual := step.Accrual
+		resp.Accrual = &accrual
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// next advances the order by one step, unless the request is faulted,
+// in which case the status code of the fault is returned.
+func (s *Server) next(number string) (Step, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	s.queryCount[number]++
+
+	switch {
+	case s.throttled > 0:
+		s.throttled--
+		return Step{}, http.StatusTooManyRequests
+	case s.failing > 0:
+		s.failing--
+		return Step{}, http.StatusInternalServerError
+	case s.cfg.ThrottleEvery > 0 && s.requests%s.cfg.ThrottleEvery == 0:
+		return Step{}, http.StatusTooManyRequests
+	case s.cfg.ErrorEvery > 0 && s.requests%s.cfg.ErrorEvery == 0:
+		return Step{}, http.StatusInternalServerError
+	}
+
+	steps, ok := s.scripts[number]
+	if !ok {
+		steps = s.defaultSteps(number)
+		s.scripts[number] = steps
+	}
+
+	i := s.progress[number]
+	if i < len(steps)-1 {
+		s.progress[number] = i + 1
+	}
+	return steps[i], 0
+}
+
+func (s *Server) defaultSteps(number string) []Step {
+	steps := make([]Step, 0, len(s.cfg.Progression)+1)
+	for _, status := range s.cfg.Progression {
+		steps = append(steps, Step{Status: status})
+	}
+
+	for _, rule := range s.cfg.Rules {
+		if strings.HasSuffix(number, rule.Suffix) {
+			return append(steps, Step{Status: rule.Status, Accrual: rule.Accrual})
+		}
+	}
+
+	return append(steps, Step{Status: StatusProcessed, Accrual: DefaultAccrual(number)})
+}
+
+// DefaultAccrual is the accrual of orders not matched by any rule:
+// ten points per digit sum of the number.
+func DefaultAccrual(number string) money.Amount {
+	sum := 0
+	for _, c := range number {
+		if c >= '0' && c <= '9' {
+			sum += int(c - '0')
+		}
+	}
+	return money.FromUnits(int64(sum * 10))
+}
+
+// ParseRule parses a rule written as "<suffix>=<STATUS>[:<accrual>]",
+// e.g. "0=INVALID" or "42=PROCESSED:500.5".
+func ParseRule(s string) (Rule, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return Rule{}, fmt.Errorf("rule %q: expected <suffix>=<STATUS>[:<accrual>]", s)
+	}
+
+	rule := Rule{Suffix: parts[0]}
+	statusAccrual := strings.SplitN(parts[1], ":", 2)
+	rule.Status = Status(strings.ToUpper(statusAccrual[0]))
+	if !rule.Status.Final() {
+		return Rule{}, fmt.Errorf("rule %q: final status must be %s or %s", s, StatusProcessed, StatusInvalid)
+	}
+
+	if len(statusAccrual) == 2 {
+		accrual, err := money.Parse(statusAccrual[1])
+		if err != nil {
+			return Rule{}, fmt.Errorf("rule %q: bad accrual: %w", s, err)
+		}
+		rule.Accrual = accrual
+	}
+
+	return rule, nil
+}
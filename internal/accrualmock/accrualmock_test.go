@@ -0,0 +1,105 @@
+package accrualmock
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/money"
+)
+
+func getOrder(t *testing.T, baseURL, number string) (*http.Response, map[string]interface{}) {
+	t.Helper()
+
+	resp, err := http.Get(baseURL + "/api/orders/" + number)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var body map[string]interface{}
+	if resp.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	}
+	return resp, body
+}
+
+func TestServer_DefaultProgression(t *testing.T) {
+	ts, _ := NewTestServer(Config{})
+	defer ts.Close()
+
+	var statuses []interface{}
+	for i := 0; i < 4; i++ {
+		_, body := getOrder(t, ts.URL, "12345678903")
+		statuses = append(statuses, body["status"])
+		if body["status"] == string(StatusProcessed) {
+			assert.Equal(t, 480.0, body["accrual"])
+		} else {
+			assert.NotContains(t, body, "accrual")
+		}
+	}
+
+	assert.Equal(t, []interface{}{"REGISTERED", "PROCESSING", "PROCESSED", "PROCESSED"}, statuses)
+}
+
+func TestServer_Rules(t *testing.T) {
+	rule, err := ParseRule("0=invalid")
+	require.NoError(t, err)
+
+	ts, _ := NewTestServer(Config{Progression: []Status{}, Rules: []Rule{rule}})
+	defer ts.Close()
+
+	_, body := getOrder(t, ts.URL, "346436439")
+	assert.Equal(t, "PROCESSED", body["status"])
+
+	_, body = getOrder(t, ts.URL, "9278923470")
+	assert.Equal(t, "INVALID", body["status"])
+}
+
+func TestServer_Script(t *testing.T) {
+	ts, s := NewTestServer(Config{})
+	defer ts.Close()
+
+	s.Script("2377225624", Step{Status: StatusProcessing}, Step{Status: StatusProcessed, Accrual: money.MustParse("500.5")})
+
+	_, body := getOrder(t, ts.URL, "2377225624")
+	assert.Equal(t, "PROCESSING", body["status"])
+	_, body = getOrder(t, ts.URL, "2377225624")
+	assert.Equal(t, 500.5, body["accrual"])
+}
+
+func TestServer_Faults(t *testing.T) {
+	ts, s := NewTestServer(Config{RetryAfter: 60 * time.Second, ThrottleEvery: 3})
+	defer ts.Close()
+
+	s.Throttle(1)
+	s.Fail(1)
+
+	resp, _ := getOrder(t, ts.URL, "1")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "60", resp.Header.Get("Retry-After"))
+
+	resp, _ = getOrder(t, ts.URL, "1")
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+	resp, _ = getOrder(t, ts.URL, "1")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	resp, body := getOrder(t, ts.URL, "1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "REGISTERED", body["status"])
+	assert.Equal(t, 4, s.Queries("1"))
+}
+
+func TestParseRule(t *testing.T) {
+	rule, err := ParseRule("42=PROCESSED:500.5")
+	require.NoError(t, err)
+	assert.Equal(t, Rule{Suffix: "42", Status: StatusProcessed, Accrual: money.MustParse("500.5")}, rule)
+
+	_, err = ParseRule("42=PROCESSING")
+	assert.Error(t, err)
+	_, err = ParseRule("42")
+	assert.Error(t, err)
+}
@@ -0,0 +1,179 @@
+// Package accrualsync moves uploaded orders along with the accrual system.
+//
+// Each Run pages through the orders that are not final yet, oldest first,
+// requests their state from the accrual system and records the changes
+// with OrderRepository.Update: PROCESSED orders are credited along with
+// their promotional bonuses, and the outbox events, webhooks and event
+// streams of the change follow from there. Orders the accrual system does not know yet stay NEW. When the
+// accrual system answers 429, the run stops and the next ones are skipped
+// until its Retry-After has passed.
+package accrualsync
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/accrual"
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/pkg/log"
+)
+
+const (
+	defaultBatchSize = 100
+	// defaultRetryAfter is the pause after a 429 without Retry-After.
+	defaultRetryAfter = time.Minute
+)
+
+// Metrics of the synchronization, published by expvar.
+var (
+	metricUpdated     = new(expvar.Int)
+	metricFailed      = new(expvar.Int)
+	metricRateLimited = new(expvar.Int)
+)
+
+func init() {
+	m := expvar.NewMap("accrual_sync")
+	m.Set("updated_orders_total", metricUpdated)
+	m.Set("failed_orders_total", metricFailed)
+	m.Set("rate_limited_total", metricRateLimited)
+}
+
+// Source returns the state of orders, see accrual.Client.
+type Source interface {
+	Order(ctx context.Context, number string) (accrual.Result, error)
+}
+
+// Promotions returns the bonuses of an order reaching PROCESSED, see
+// promo.Engine.
+type Promotions interface {
+	OrderBonuses(o domain.Order) ([]domain.Bonus, error)
+}
+
+// Config tunes the Syncer. Zero values select the defaults.
+type Config struct {
+	// BatchSize is how many pending orders a run reads at once.
+	BatchSize int
+}
+
+// Syncer synchronizes the status of the pending orders.
+type Syncer struct {
+	orders     storage.OrderRepository
+	source     Source
+	promotions Promotions
+	cfg        Config
+	now        func() time.Time
+
+	// pausedUntil is when the accrual system accepts requests again. Runs
+	// never overlap, see lifecycle.Periodic.
+	pausedUntil time.Time
+}
+
+// New returns a syncer of the orders with source, granting the bonuses of
+// promotions, if not nil, to the orders it moves to PROCESSED.
+func New(orders storage.OrderRepository, source Source, promotions Promotions, cfg Config) *Syncer {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+
+	return &Syncer{orders: orders, source: source, promotions: promotions, cfg: cfg, now: time.Now}
+}
+
+// Run requests the state of every pending order and records the changes.
+// It fails only when the pending orders cannot be listed. It is meant for
+// lifecycle.Periodic.
+func (s *Syncer) Run(ctx context.Context) error {
+	if s.now().Before(s.pausedUntil) {
+		return nil
+	}
+
+	var after *domain.OrderCursor
+	for {
+		orders, err := s.orders.ListPending(ctx, after, s.cfg.BatchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, o := range orders {
+			err := s.sync(ctx, o)
+			var limited *accrual.RateLimitError
+			if errors.As(err, &limited) {
+				s.pause(ctx, limited.RetryAfter)
+				return nil
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				metricFailed.Add(1)
+				log.Error(ctx, "failed to sync order", err, "order", o.Number)
+			}
+		}
+
+		if len(orders) < s.cfg.BatchSize {
+			return nil
+		}
+		cursor := domain.CursorOf(orders[len(orders)-1])
+		after = &cursor
+	}
+}
+
+// sync records the state of the order in the accrual system.
+func (s *Syncer) sync(ctx context.Context, o domain.Order) error {
+	res, err := s.source.Order(ctx, o.Number)
+	if errors.Is(err, accrual.ErrNotRegistered) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	status := orderStatus(res.Status)
+	if status == "" {
+		log.Warning(ctx, "unknown accrual status", "order", o.Number, "status", string(res.Status))
+		return nil
+	}
+	if status == o.Status {
+		return nil
+	}
+
+	u := domain.StatusUpdate{Number: o.Number, Status: status, Accrual: res.Accrual}
+	if status == domain.OrderStatusProcessed && s.promotions != nil {
+		o.Accrual = res.Accrual
+		if u.Bonuses, err = s.promotions.OrderBonuses(o); err != nil {
+			return err
+		}
+	}
+	if err := s.orders.Update(ctx, u); err != nil {
+		return err
+	}
+	metricUpdated.Add(1)
+	log.Debug(ctx, "updated order status", "order", o.Number, "status", string(status))
+	return nil
+}
+
+func (s *Syncer) pause(ctx context.Context, retryAfter time.Duration) {
+	if retryAfter <= 0 {
+		retryAfter = defaultRetryAfter
+	}
+	s.pausedUntil = s.now().Add(retryAfter)
+	metricRateLimited.Add(1)
+	log.Warning(ctx, "accrual system rate limit, pausing", "retry_after", retryAfter.String())
+}
+
+// orderStatus returns the order status of an accrual status, empty if it
+// is unknown. Registered orders are being processed already.
+func orderStatus(s accrual.Status) domain.OrderStatus {
+	switch s {
+	case accrual.StatusRegistered, accrual.StatusProcessing:
+		return domain.OrderStatusProcessing
+	case accrual.StatusInvalid:
+		return domain.OrderStatusInvalid
+	case accrual.StatusProcessed:
+		return domain.OrderStatusProcessed
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,129 @@
+package accrualsync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/accrual"
+	"github.com/paramonies/ya-gophermart/internal/accrualmock"
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/storage/memory"
+)
+
+func TestSyncer(t *testing.T) {
+	ts, mock := accrualmock.NewTestServer(accrualmock.Config{RetryAfter: 30 * time.Second})
+	defer ts.Close()
+	mock.Script("12345678903",
+		accrualmock.Step{Status: accrualmock.StatusRegistered},
+		accrualmock.Step{Status: accrualmock.StatusProcessed, Accrual: money.MustParse("729.98")})
+	mock.Script("79927398713", accrualmock.Step{Status: accrualmock.StatusInvalid})
+
+	ctx := context.Background()
+	s := memory.NewStorage()
+	alice, err := s.Users.Create(ctx, "alice", "hash")
+	require.NoError(t, err)
+	for _, number := range []string{"12345678903", "79927398713"} {
+		_, err := s.Orders.Create(ctx, alice.ID, number)
+		require.NoError(t, err)
+	}
+
+	now := time.Now()
+	syncer := New(s.Orders, accrual.NewClient(ts.URL, time.Second), nil, Config{BatchSize: 1})
+	syncer.now = func() time.Time { return now }
+	status := func(number string) domain.OrderStatus {
+		o, err := s.Orders.Get(ctx, number)
+		require.NoError(t, err)
+		return o.Status
+	}
+
+	require.NoError(t, syncer.Run(ctx))
+	assert.Equal(t, domain.OrderStatusProcessing, status("12345678903"))
+	assert.Equal(t, domain.OrderStatusInvalid, status("79927398713"))
+
+	// A 429 pauses the runs for its Retry-After.
+	mock.Throttle(1)
+	require.NoError(t, syncer.Run(ctx))
+	require.NoError(t, syncer.Run(ctx))
+	assert.Equal(t, 2, mock.Queries("12345678903"))
+
+	now = now.Add(31 * time.Second)
+	require.NoError(t, syncer.Run(ctx))
+	assert.Equal(t, domain.OrderStatusProcessed, status("12345678903"))
+	b, err := s.Ledger.Balance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, money.MustParse("729.98"), b.Current)
+
+	pending, err := s.Orders.ListPending(ctx, nil, 10)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+
+	// A requeued order is synced again.
+	mock.Script("79927398713", accrualmock.Step{Status: accrualmock.StatusProcessed, Accrual: money.MustParse("10")})
+	require.NoError(t, s.Orders.Requeue(ctx, "79927398713"))
+	require.NoError(t, syncer.Run(ctx))
+	assert.Equal(t, domain.OrderStatusProcessed, status("79927398713"))
+}
+
+// failingSource fails for the orders in errs and reports the others
+// PROCESSED.
+type failingSource map[string]error
+
+func (f failingSource) Order(_ context.Context, number string) (accrual.Result, error) {
+	if err, ok := f[number]; ok {
+		return accrual.Result{}, err
+	}
+	return accrual.Result{Order: number, Status: accrual.StatusProcessed, Accrual: money.MustParse("1")}, nil
+}
+
+func TestSyncerSkipsFailedOrders(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+	alice, err := s.Users.Create(ctx, "alice", "hash")
+	require.NoError(t, err)
+	for _, number := range []string{"12345678903", "79927398713"} {
+		_, err := s.Orders.Create(ctx, alice.ID, number)
+		require.NoError(t, err)
+	}
+
+	source := failingSource{"12345678903": errors.New("unexpected status 500")}
+	syncer := New(s.Orders, source, nil, Config{})
+	require.NoError(t, syncer.Run(ctx))
+
+	o, err := s.Orders.Get(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, domain.OrderStatusNew, o.Status)
+	o, err = s.Orders.Get(ctx, "79927398713")
+	require.NoError(t, err)
+	assert.Equal(t, domain.OrderStatusProcessed, o.Status)
+}
+
+// bonusFunc adapts a function to Promotions.
+type bonusFunc func(o domain.Order) ([]domain.Bonus, error)
+
+func (f bonusFunc) OrderBonuses(o domain.Order) ([]domain.Bonus, error) {
+	return f(o)
+}
+
+func TestSyncerGrantsBonuses(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+	alice, err := s.Users.Create(ctx, "alice", "hash")
+	require.NoError(t, err)
+	_, err = s.Orders.Create(ctx, alice.ID, "12345678903")
+	require.NoError(t, err)
+
+	promotions := bonusFunc(func(o domain.Order) ([]domain.Bonus, error) {
+		return []domain.Bonus{{RuleID: "x2", Amount: o.Accrual}}, nil
+	})
+	require.NoError(t, New(s.Orders, failingSource{}, promotions, Config{}).Run(ctx))
+
+	b, err := s.Ledger.Balance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, money.FromUnits(2), b.Current)
+}
@@ -0,0 +1,176 @@
+// Package audit writes the tamper-evident audit trail of security and
+// money-affecting events and verifies it.
+//
+// Entries are appended to a storage.AuditRepository and chained by hash,
+// see domain.AuditEntry: Verify detects any change to past entries. As
+// each entry needs the hash of the one before, appends are serialized:
+// the PostgreSQL storage locks the head of the chain until the appending
+// transaction ends.
+package audit
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/pkg/log"
+)
+
+// Actions of audit entries.
+const (
+	ActionRegister     = "user.register"
+	ActionLogin        = "user.login"
+	ActionLoginFailed  = "user.login_failed"
+	ActionBlock        = "user.block"
+	ActionUnblock      = "user.unblock"
+	ActionSetRoles     = "user.set_roles"
+	ActionWithdraw     = "balance.withdraw"
+	ActionCorrection   = "balance.correction"
+	ActionRefund       = "balance.refund"
+	ActionOrderRecheck = "order.recheck"
+	ActionConfigChange = "config.change"
+)
+
+// Actors that are not users or operators.
+const (
+	// SystemActor is the service itself.
+	SystemActor = "system"
+	// AnonymousActor is an unauthenticated client.
+	AnonymousActor = "anonymous"
+)
+
+const (
+	// ConfigTarget is the target of config change entries.
+	ConfigTarget = "config"
+
+	// batchSize is how many entries are read at once.
+	batchSize = 1000
+)
+
+// Log records audit entries.
+type Log struct {
+	repo storage.AuditRepository
+
+	now func() time.Time
+}
+
+// New returns a log appending to repo.
+func New(repo storage.AuditRepository) *Log {
+	return &Log{repo: repo, now: time.Now}
+}
+
+// Entry returns an entry recording that actor did action to target now,
+// for storage to append along with the write it records.
+func (l *Log) Entry(actor, action, target string, metadata map[string]string) *domain.AuditEntry {
+	return &domain.AuditEntry{
+		CreatedAt: l.now(),
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		Metadata:  metadata,
+	}
+}
+
+// Record appends an entry: actor did action to target. A failure is
+// logged and does not fail the audited operation, which already happened.
+func (l *Log) Record(ctx context.Context, actor, action, target string, metadata map[string]string) {
+	_, err := l.repo.Append(ctx, *l.Entry(actor, action, target, metadata))
+	if err != nil {
+		log.Error(ctx, "failed to record audit entry", err, "actor", actor, "action", action, "target", target)
+	}
+}
+
+// RecordConfig records the settings of the service if they differ from
+// the ones last recorded. Settings must not hold secrets in clear.
+func (l *Log) RecordConfig(ctx context.Context, settings map[string]string) error {
+	last, err := l.lastConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	var changed []string
+	for key, v := range settings {
+		if old, ok := last[key]; !ok || old != v {
+			changed = append(changed, key)
+		}
+	}
+	for key := range last {
+		if _, ok := settings[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	sort.Strings(changed)
+	log.Info(ctx, "configuration changed", "keys", changed)
+	_, err = l.repo.Append(ctx, domain.AuditEntry{
+		CreatedAt: l.now(),
+		Actor:     SystemActor,
+		Action:    ActionConfigChange,
+		Target:    ConfigTarget,
+		Metadata:  settings,
+	})
+	return err
+}
+
+// lastConfig returns the settings of the last config change entry.
+func (l *Log) lastConfig(ctx context.Context) (map[string]string, error) {
+	var last map[string]string
+	q := domain.AuditQuery{Action: ActionConfigChange, Limit: batchSize}
+	for {
+		entries, err := l.repo.List(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			return last, nil
+		}
+		last = entries[len(entries)-1].Metadata
+		q.AfterID = entries[len(entries)-1].ID
+	}
+}
+
+// ChainError reports the first entry that breaks the hash chain.
+type ChainError struct {
+	ID     int64
+	Reason string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("audit entry %d: %s", e.ID, e.Reason)
+}
+
+// Verify walks the whole audit log and checks its hash chain. It returns
+// how many entries were checked and a *ChainError if the chain is broken.
+func Verify(ctx context.Context, repo storage.AuditRepository) (int, error) {
+	var checked int
+	var prevHash string
+	var prevID int64
+	q := domain.AuditQuery{Limit: batchSize}
+	for {
+		entries, err := repo.List(ctx, q)
+		if err != nil {
+			return checked, err
+		}
+		if len(entries) == 0 {
+			return checked, nil
+		}
+
+		for _, e := range entries {
+			switch {
+			case e.PrevHash != prevHash:
+				return checked, &ChainError{ID: e.ID, Reason: fmt.Sprintf("does not follow entry %d", prevID)}
+			case e.Hash != e.ComputeHash():
+				return checked, &ChainError{ID: e.ID, Reason: "hash mismatch, the entry was modified"}
+			}
+			prevHash, prevID = e.Hash, e.ID
+			checked++
+		}
+		q.AfterID = prevID
+	}
+}
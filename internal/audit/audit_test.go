@@ -0,0 +1,115 @@
+package audit
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/internal/storage/memory"
+)
+
+// tamperedRepository changes the entries it lists, as someone editing
+// the table behind the service's back would.
+type tamperedRepository struct {
+	storage.AuditRepository
+	tamper func([]domain.AuditEntry) []domain.AuditEntry
+}
+
+func (r tamperedRepository) List(ctx context.Context, q domain.AuditQuery) ([]domain.AuditEntry, error) {
+	entries, err := r.AuditRepository.List(ctx, q)
+	if err != nil || len(entries) == 0 {
+		return entries, err
+	}
+	return r.tamper(entries), nil
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	repo := memory.NewStorage().Audit
+	l := New(repo)
+
+	checked, err := Verify(ctx, repo)
+	require.NoError(t, err)
+	assert.Zero(t, checked)
+
+	l.Record(ctx, "alice", ActionLogin, "alice", map[string]string{"ip": "192.0.2.1"})
+	l.Record(ctx, "alice", ActionWithdraw, "2377225624", map[string]string{"sum": "100"})
+	l.Record(ctx, "bob", ActionCorrection, "alice", map[string]string{"amount": "-100", "reason": "fraud"})
+
+	checked, err = Verify(ctx, repo)
+	require.NoError(t, err)
+	assert.Equal(t, 3, checked)
+
+	tests := []struct {
+		name   string
+		tamper func([]domain.AuditEntry) []domain.AuditEntry
+		id     int64
+	}{
+		{
+			name: "Modified",
+			tamper: func(entries []domain.AuditEntry) []domain.AuditEntry {
+				entries[1].Metadata["sum"] = "1"
+				return entries
+			},
+			id: 2,
+		},
+		{
+			name: "Rehashed",
+			tamper: func(entries []domain.AuditEntry) []domain.AuditEntry {
+				entries[1].Actor = "mallory"
+				entries[1].Hash = entries[1].ComputeHash()
+				return entries
+			},
+			id: 3,
+		},
+		{
+			name: "Removed",
+			tamper: func(entries []domain.AuditEntry) []domain.AuditEntry {
+				return append(entries[:1], entries[2:]...)
+			},
+			id: 3,
+		},
+		{
+			name: "RemovedFirst",
+			tamper: func(entries []domain.AuditEntry) []domain.AuditEntry {
+				return entries[1:]
+			},
+			id: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Verify(ctx, tamperedRepository{AuditRepository: repo, tamper: tt.tamper})
+			var chainErr *ChainError
+			require.ErrorAs(t, err, &chainErr)
+			assert.Equal(t, tt.id, chainErr.ID)
+		})
+	}
+}
+
+func TestLog_RecordConfig(t *testing.T) {
+	ctx := context.Background()
+	repo := memory.NewStorage().Audit
+	l := New(repo)
+
+	settings := map[string]string{"auth.access_ttl": "15m0s", "admin.token": ""}
+	require.NoError(t, l.RecordConfig(ctx, settings))
+	require.NoError(t, l.RecordConfig(ctx, map[string]string{"auth.access_ttl": "15m0s", "admin.token": ""}))
+
+	entries, err := repo.List(ctx, domain.AuditQuery{Action: ActionConfigChange})
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "unchanged settings are not recorded again")
+	assert.Equal(t, SystemActor, entries[0].Actor)
+	assert.Equal(t, settings, entries[0].Metadata)
+
+	require.NoError(t, l.RecordConfig(ctx, map[string]string{"auth.access_ttl": "5m0s", "admin.token": ""}))
+	require.NoError(t, l.RecordConfig(ctx, map[string]string{"auth.access_ttl": "5m0s"}))
+	entries, err = repo.List(ctx, domain.AuditQuery{Action: ActionConfigChange})
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, map[string]string{"auth.access_ttl": "5m0s"}, entries[2].Metadata)
+}
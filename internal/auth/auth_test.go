@@ -0,0 +1,310 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/internal/storage/memory"
+)
+
+func newTestService(s *storage.Storage) *Service {
+	return NewService(s.Users, s.Sessions, Config{Secret: []byte("secret")})
+}
+
+func TestSigner(t *testing.T) {
+	s := signer{secret: []byte("secret")}
+	now := time.Now()
+	claims := Claims{
+		UserID:    "u",
+		SessionID: "s",
+		Roles:     []domain.Role{domain.RoleSupport},
+		IssuedAt:  now,
+		ExpiresAt: now.Add(time.Minute),
+	}
+
+	token, err := s.issue(claims)
+	require.NoError(t, err)
+
+	got, err := s.parse(token, now)
+	require.NoError(t, err)
+	assert.Equal(t, "u", got.UserID)
+	assert.Equal(t, "s", got.SessionID)
+	assert.Equal(t, []domain.Role{domain.RoleSupport}, got.Roles)
+
+	_, err = s.parse(token, now.Add(time.Minute))
+	assert.ErrorIs(t, err, ErrInvalidToken, "expired")
+	_, err = signer{secret: []byte("other")}.parse(token, now)
+	assert.ErrorIs(t, err, ErrInvalidToken, "signed with another secret")
+	parts := strings.Split(token, ".")
+	_, err = s.parse(parts[0]+"."+parts[1]+"x."+parts[2], now)
+	assert.ErrorIs(t, err, ErrInvalidToken, "tampered")
+	_, err = s.parse("garbage", now)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestHashParams(t *testing.T) {
+	weak := HashParams{BcryptCost: 4}
+	hash, err := weak.Hash("secret")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$2a$04$"))
+	assert.False(t, weak.NeedsRehash(hash))
+	assert.True(t, HashParams{BcryptCost: 5}.NeedsRehash(hash), "cost raised")
+	assert.False(t, HashParams{BcryptCost: 4, Argon2Time: 1}.NeedsRehash(hash))
+
+	argon := HashParams{Algorithm: AlgorithmArgon2id, Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 1}
+	assert.True(t, argon.NeedsRehash(hash), "algorithm changed")
+	argonHash, err := argon.Hash("secret")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(argonHash, "$argon2id$v=19$m=1024,t=1,p=1$"))
+	assert.False(t, argon.NeedsRehash(argonHash))
+	raised := argon
+	raised.Argon2Memory = 2048
+	assert.True(t, raised.NeedsRehash(argonHash))
+
+	for _, h := range []string{hash, argonHash} {
+		ok, err := CheckPassword(h, "secret")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		ok, err = CheckPassword(h, "wrong")
+		require.NoError(t, err)
+		assert.False(t, ok)
+	}
+
+	ok, err := CheckPassword(hash, strings.Repeat("x", 73))
+	require.NoError(t, err, "too long for bcrypt")
+	assert.False(t, ok)
+
+	_, err = CheckPassword("plain", "plain")
+	assert.Error(t, err)
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	p := PasswordPolicy{MinLength: 8, MinClasses: 3, RejectCommon: true}
+
+	assert.ErrorIs(t, p.Check("Ab1"), domain.ErrWeakPassword)
+	assert.ErrorIs(t, p.Check("abcdefgh1"), domain.ErrWeakPassword)
+	assert.ErrorIs(t, p.Check("Password123"), domain.ErrWeakPassword)
+	assert.NoError(t, p.Check("Correct-horse"))
+	assert.NoError(t, p.Check("пароль-Ок1"))
+	assert.NoError(t, PasswordPolicy{}.Check("1"))
+
+	assert.NoError(t, PasswordPolicy{}.Check(strings.Repeat("x", MaxPasswordBytes)))
+	assert.ErrorIs(t, PasswordPolicy{}.Check(strings.Repeat("x", MaxPasswordBytes+1)), domain.ErrWeakPassword)
+	assert.ErrorIs(t, PasswordPolicy{MaxBytes: 8}.Check("пароль"), domain.ErrWeakPassword, "counted in bytes")
+}
+
+func TestService_Login(t *testing.T) {
+	ctx := context.Background()
+	svc := newTestService(memory.NewStorage())
+
+	registered, err := svc.Register(ctx, domain.Registration{Login: "alice"}, "secret")
+	require.NoError(t, err)
+	_, err = svc.Register(ctx, domain.Registration{Login: "alice"}, "other")
+	assert.ErrorIs(t, err, domain.ErrLoginTaken)
+
+	_, err = svc.Login(ctx, "alice", "wrong")
+	assert.ErrorIs(t, err, domain.ErrInvalidCredentials)
+	_, err = svc.Login(ctx, "bob", "secret")
+	assert.ErrorIs(t, err, domain.ErrInvalidCredentials)
+	assert.NotEmpty(t, svc.dummyHash, "unknown logins are hashed too")
+	_, err = svc.Login(ctx, "alice", strings.Repeat("x", 100))
+	assert.ErrorIs(t, err, domain.ErrInvalidCredentials)
+
+	tokens, err := svc.Login(ctx, "alice", "secret")
+	require.NoError(t, err)
+
+	first, err := svc.Authenticate(ctx, registered.AccessToken)
+	require.NoError(t, err)
+	second, err := svc.Authenticate(ctx, tokens.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, first.UserID, second.UserID)
+	assert.NotEqual(t, first.SessionID, second.SessionID)
+
+	_, err = svc.Authenticate(ctx, "garbage")
+	assert.ErrorIs(t, err, domain.ErrUnauthorized)
+}
+
+func TestService_Refresh(t *testing.T) {
+	ctx := context.Background()
+	svc := newTestService(memory.NewStorage())
+
+	tokens, err := svc.Register(ctx, domain.Registration{Login: "alice"}, "secret")
+	require.NoError(t, err)
+
+	refreshed, err := svc.Refresh(ctx, tokens.RefreshToken)
+	require.NoError(t, err)
+	assert.NotEqual(t, tokens.RefreshToken, refreshed.RefreshToken)
+	_, err = svc.Authenticate(ctx, refreshed.AccessToken)
+	require.NoError(t, err)
+
+	_, err = svc.Refresh(ctx, "unknown")
+	assert.ErrorIs(t, err, domain.ErrInvalidRefreshToken)
+
+	// The old token leaked: the whole session is revoked.
+	_, err = svc.Refresh(ctx, tokens.RefreshToken)
+	assert.ErrorIs(t, err, domain.ErrRefreshTokenReused)
+	_, err = svc.Authenticate(ctx, refreshed.AccessToken)
+	assert.ErrorIs(t, err, domain.ErrUnauthorized)
+	_, err = svc.Refresh(ctx, refreshed.RefreshToken)
+	assert.ErrorIs(t, err, domain.ErrInvalidRefreshToken)
+}
+
+func TestService_Logout(t *testing.T) {
+	ctx := context.Background()
+	svc := newTestService(memory.NewStorage())
+
+	first, err := svc.Register(ctx, domain.Registration{Login: "alice"}, "secret")
+	require.NoError(t, err)
+	second, err := svc.Login(ctx, "alice", "secret")
+	require.NoError(t, err)
+	third, err := svc.Login(ctx, "alice", "secret")
+	require.NoError(t, err)
+
+	claims, err := svc.Authenticate(ctx, first.AccessToken)
+	require.NoError(t, err)
+	require.NoError(t, svc.Logout(ctx, claims.SessionID))
+	_, err = svc.Authenticate(ctx, first.AccessToken)
+	assert.ErrorIs(t, err, domain.ErrUnauthorized)
+	_, err = svc.Authenticate(ctx, second.AccessToken)
+	require.NoError(t, err)
+
+	require.NoError(t, svc.LogoutAll(ctx, claims.UserID))
+	_, err = svc.Authenticate(ctx, second.AccessToken)
+	assert.ErrorIs(t, err, domain.ErrUnauthorized)
+	_, err = svc.Refresh(ctx, third.RefreshToken)
+	assert.ErrorIs(t, err, domain.ErrInvalidRefreshToken)
+}
+
+func TestService_UpgradesHashOnLogin(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+
+	old := NewService(s.Users, s.Sessions, Config{Secret: []byte("secret"), Hash: HashParams{BcryptCost: 4}})
+	_, err := old.Register(ctx, domain.Registration{Login: "alice"}, "secret")
+	require.NoError(t, err)
+
+	params := HashParams{Algorithm: AlgorithmArgon2id, Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 1}
+	svc := NewService(s.Users, s.Sessions, Config{Secret: []byte("secret"), Hash: params})
+	_, err = svc.Login(ctx, "alice", "secret")
+	require.NoError(t, err)
+
+	u, err := s.Users.GetByLogin(ctx, "alice")
+	require.NoError(t, err)
+	assert.False(t, params.NeedsRehash(u.PasswordHash))
+	_, err = svc.Login(ctx, "alice", "secret")
+	require.NoError(t, err)
+}
+
+func TestService_ChangePassword(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+	svc := NewService(s.Users, s.Sessions, Config{
+		Secret: []byte("secret"),
+		Policy: PasswordPolicy{MinLength: 8},
+	})
+
+	_, err := svc.Register(ctx, domain.Registration{Login: "alice"}, "short")
+	assert.ErrorIs(t, err, domain.ErrWeakPassword)
+
+	current, err := svc.Register(ctx, domain.Registration{Login: "alice"}, "long enough")
+	require.NoError(t, err)
+	other, err := svc.Login(ctx, "alice", "long enough")
+	require.NoError(t, err)
+	claims, err := svc.Authenticate(ctx, current.AccessToken)
+	require.NoError(t, err)
+
+	err = svc.ChangePassword(ctx, claims.UserID, claims.SessionID, "wrong", "even longer")
+	assert.ErrorIs(t, err, domain.ErrWrongPassword)
+	err = svc.ChangePassword(ctx, claims.UserID, claims.SessionID, "long enough", "short")
+	assert.ErrorIs(t, err, domain.ErrWeakPassword)
+	require.NoError(t, svc.ChangePassword(ctx, claims.UserID, claims.SessionID, "long enough", "even longer"))
+
+	// Only the session that changed the password survives.
+	_, err = svc.Authenticate(ctx, current.AccessToken)
+	require.NoError(t, err)
+	_, err = svc.Authenticate(ctx, other.AccessToken)
+	assert.ErrorIs(t, err, domain.ErrUnauthorized)
+
+	_, err = svc.Login(ctx, "alice", "long enough")
+	assert.ErrorIs(t, err, domain.ErrInvalidCredentials)
+	_, err = svc.Login(ctx, "alice", "even longer")
+	require.NoError(t, err)
+}
+
+func TestService_Block(t *testing.T) {
+	ctx := context.Background()
+	svc := newTestService(memory.NewStorage())
+
+	tokens, err := svc.Register(ctx, domain.Registration{Login: "alice"}, "secret")
+	require.NoError(t, err)
+	claims, err := svc.Authenticate(ctx, tokens.AccessToken)
+	require.NoError(t, err)
+
+	require.NoError(t, svc.Block(ctx, claims.UserID))
+	_, err = svc.Authenticate(ctx, tokens.AccessToken)
+	assert.ErrorIs(t, err, domain.ErrUnauthorized)
+	_, err = svc.Refresh(ctx, tokens.RefreshToken)
+	assert.ErrorIs(t, err, domain.ErrInvalidRefreshToken)
+	_, err = svc.Login(ctx, "alice", "wrong")
+	assert.ErrorIs(t, err, domain.ErrInvalidCredentials)
+	_, err = svc.Login(ctx, "alice", "secret")
+	assert.ErrorIs(t, err, domain.ErrUserBlocked)
+
+	require.NoError(t, svc.Unblock(ctx, claims.UserID))
+	_, err = svc.Login(ctx, "alice", "secret")
+	require.NoError(t, err)
+}
+
+func TestService_SetRoles(t *testing.T) {
+	ctx := context.Background()
+	svc := newTestService(memory.NewStorage())
+
+	tokens, err := svc.Register(ctx, domain.Registration{Login: "alice"}, "secret")
+	require.NoError(t, err)
+	claims, err := svc.Authenticate(ctx, tokens.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, []domain.Role{domain.RoleUser}, claims.Roles)
+
+	roles := []domain.Role{domain.RoleUser, domain.RoleAdmin}
+	require.NoError(t, svc.SetRoles(ctx, claims.UserID, roles))
+	_, err = svc.Authenticate(ctx, tokens.AccessToken)
+	assert.ErrorIs(t, err, domain.ErrUnauthorized, "sessions with the former roles are revoked")
+
+	tokens, err = svc.Login(ctx, "alice", "secret")
+	require.NoError(t, err)
+	tokens, err = svc.Refresh(ctx, tokens.RefreshToken)
+	require.NoError(t, err)
+	claims, err = svc.Authenticate(ctx, tokens.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, roles, claims.Roles)
+}
+
+func TestService_PollRevocations(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+	// Two instances of the service share the storage.
+	a, b := newTestService(s), newTestService(s)
+
+	tokens, err := a.Register(ctx, domain.Registration{Login: "alice"}, "secret")
+	require.NoError(t, err)
+	claims, err := b.Authenticate(ctx, tokens.AccessToken)
+	require.NoError(t, err)
+
+	require.NoError(t, a.Logout(ctx, claims.SessionID))
+	_, err = a.Authenticate(ctx, tokens.AccessToken)
+	assert.ErrorIs(t, err, domain.ErrUnauthorized)
+
+	// b trusts its cache until it polls.
+	_, err = b.Authenticate(ctx, tokens.AccessToken)
+	require.NoError(t, err)
+	require.NoError(t, b.PollRevocations(ctx))
+	_, err = b.Authenticate(ctx, tokens.AccessToken)
+	assert.ErrorIs(t, err, domain.ErrUnauthorized)
+}
@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/storage"
+)
+
+// revocationOverlap is how far back each poll looks before the latest
+// revocation seen. A revocation committed late may carry an earlier
+// timestamp than one already seen.
+const revocationOverlap = 10 * time.Second
+
+// sessionCache tells whether sessions are active without reading the
+// storage on every request. A session found active is trusted until the
+// entry expires, a revoked one is remembered until no access token issued
+// for it can be valid anymore.
+//
+// Revocations made by this process are applied at once. Revocations made
+// by other instances are learned by polling the storage, so they take
+// effect within the poll interval.
+type sessionCache struct {
+	repo storage.SessionRepository
+	ttl  time.Duration
+
+	mu        sync.Mutex
+	active    map[string]time.Time // session ID to entry expiry
+	revoked   map[string]time.Time // session ID to revocation time
+	watermark time.Time
+}
+
+func newSessionCache(repo storage.SessionRepository, ttl time.Duration, now time.Time) *sessionCache {
+	return &sessionCache{
+		repo:      repo,
+		ttl:       ttl,
+		active:    make(map[string]time.Time),
+		revoked:   make(map[string]time.Time),
+		watermark: now,
+	}
+}
+
+// isActive reports whether the session is active at now, reading it from
+// the storage on a cache miss.
+func (c *sessionCache) isActive(ctx context.Context, id string, now time.Time) (bool, error) {
+	c.mu.Lock()
+	_, revoked := c.revoked[id]
+	expiry, cached := c.active[id]
+	c.mu.Unlock()
+
+	if revoked {
+		return false, nil
+	}
+	if cached && now.Before(expiry) {
+		return true, nil
+	}
+
+	s, err := c.repo.Get(ctx, id)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !s.RevokedAt.IsZero() {
+		c.revoked[id] = s.RevokedAt
+		return false, nil
+	}
+	if !s.Active(now) {
+		return false, nil
+	}
+	if _, revoked := c.revoked[id]; revoked {
+		// Invalidated while the session was being read.
+		return false, nil
+	}
+	c.active[id] = now.Add(c.ttl)
+	return true, nil
+}
+
+// invalidate marks the session revoked at now.
+func (c *sessionCache) invalidate(id string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.active, id)
+	if _, ok := c.revoked[id]; !ok {
+		c.revoked[id] = now
+	}
+}
+
+// poll applies the revocations made since the previous poll and forgets
+// the entries that are no longer needed.
+func (c *sessionCache) poll(ctx context.Context, now time.Time) error {
+	c.mu.Lock()
+	since := c.watermark.Add(-revocationOverlap)
+	c.mu.Unlock()
+
+	sessions, err := c.repo.RevokedSince(ctx, since)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, s := range sessions {
+		delete(c.active, s.ID)
+		c.revoked[s.ID] = s.RevokedAt
+		if s.RevokedAt.After(c.watermark) {
+			c.watermark = s.RevokedAt
+		}
+	}
+
+	for id, expiry := range c.active {
+		if !now.Before(expiry) {
+			delete(c.active, id)
+		}
+	}
+	// Access tokens of a session revoked longer than their lifetime ago
+	// have all expired.
+	for id, revokedAt := range c.revoked {
+		if now.Sub(revokedAt) > c.ttl+revocationOverlap {
+			delete(c.revoked, id)
+		}
+	}
+	return nil
+}
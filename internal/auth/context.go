@@ -0,0 +1,65 @@
+// Package auth identifies the user or operator behind a request.
+package auth
+
+import (
+	"context"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+)
+
+type userIDKey struct{}
+
+type sessionIDKey struct{}
+
+// NewContext returns a copy of ctx carrying the ID of the authenticated user.
+func NewContext(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, userIDKey{}, userID)
+}
+
+// UserIDFromContext returns the ID of the authenticated user, if any.
+func UserIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(userIDKey{}).(string)
+	return id, ok && id != ""
+}
+
+// NewSessionContext returns a copy of ctx carrying the ID of the session
+// the request was authenticated with.
+func NewSessionContext(ctx context.Context, sessionID string) context.Context {
+	return context.WithValue(ctx, sessionIDKey{}, sessionID)
+}
+
+// SessionIDFromContext returns the ID of the session of the request, if any.
+func SessionIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(sessionIDKey{}).(string)
+	return id, ok && id != ""
+}
+
+type operatorKey struct{}
+
+type rolesKey struct{}
+
+// NewOperatorContext returns a copy of ctx carrying the identity of the
+// operator behind an admin request.
+func NewOperatorContext(ctx context.Context, operator string) context.Context {
+	return context.WithValue(ctx, operatorKey{}, operator)
+}
+
+// OperatorFromContext returns the identity of the operator of an admin
+// request, if any.
+func OperatorFromContext(ctx context.Context) (string, bool) {
+	operator, ok := ctx.Value(operatorKey{}).(string)
+	return operator, ok && operator != ""
+}
+
+// NewRolesContext returns a copy of ctx carrying the roles the request
+// was authenticated with.
+func NewRolesContext(ctx context.Context, roles []domain.Role) context.Context {
+	return context.WithValue(ctx, rolesKey{}, roles)
+}
+
+// RolesFromContext returns the roles of the request, none if it is not
+// authenticated.
+func RolesFromContext(ctx context.Context) []domain.Role {
+	roles, _ := ctx.Value(rolesKey{}).([]domain.Role)
+	return roles
+}
@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hash algorithms.
+const (
+	AlgorithmBcrypt   = "bcrypt"
+	AlgorithmArgon2id = "argon2id"
+)
+
+// Defaults of HashParams.
+const (
+	DefaultBcryptCost    = bcrypt.DefaultCost
+	DefaultArgon2Time    = 3
+	DefaultArgon2Memory  = 64 * 1024
+	DefaultArgon2Threads = 2
+
+	argon2SaltSize = 16
+	argon2KeySize  = 32
+)
+
+var errUnknownHash = errors.New("unknown password hash format")
+
+// HashParams select how new password hashes are made. Hashes describe
+// their own algorithm and parameters, so hashes made with other params
+// are still verified and can be upgraded, see NeedsRehash.
+type HashParams struct {
+	// Algorithm is AlgorithmBcrypt, the default, or AlgorithmArgon2id.
+	Algorithm  string
+	BcryptCost int
+	// Argon2Memory is in KiB.
+	Argon2Time    uint32
+	Argon2Memory  uint32
+	Argon2Threads uint8
+}
+
+func (p HashParams) withDefaults() HashParams {
+	if p.Algorithm == "" {
+		p.Algorithm = AlgorithmBcrypt
+	}
+	if p.BcryptCost == 0 {
+		p.BcryptCost = DefaultBcryptCost
+	}
+	if p.Argon2Time == 0 {
+		p.Argon2Time = DefaultArgon2Time
+	}
+	if p.Argon2Memory == 0 {
+		p.Argon2Memory = DefaultArgon2Memory
+	}
+	if p.Argon2Threads == 0 {
+		p.Argon2Threads = DefaultArgon2Threads
+	}
+	return p
+}
+
+// Hash returns the hash of password in the modular crypt format:
+// $2a$<cost>$... for bcrypt and $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>.
+func (p HashParams) Hash(password string) (string, error) {
+	p = p.withDefaults()
+
+	switch p.Algorithm {
+	case AlgorithmBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), p.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	case AlgorithmArgon2id:
+		salt := make([]byte, argon2SaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		a := argon2Hash{
+			time:    p.Argon2Time,
+			memory:  p.Argon2Memory,
+			threads: p.Argon2Threads,
+			salt:    salt,
+		}
+		a.key = a.derive(password)
+		return a.String(), nil
+	default:
+		return "", fmt.Errorf("unknown password hash algorithm %q", p.Algorithm)
+	}
+}
+
+// NeedsRehash reports whether hash was made with another algorithm or
+// weaker parameters than p.
+func (p HashParams) NeedsRehash(hash string) bool {
+	p = p.withDefaults()
+
+	switch {
+	case isBcrypt(hash):
+		if p.Algorithm != AlgorithmBcrypt {
+			return true
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost < p.BcryptCost
+	case strings.HasPrefix(hash, "$"+AlgorithmArgon2id+"$"):
+		if p.Algorithm != AlgorithmArgon2id {
+			return true
+		}
+		a, err := parseArgon2Hash(hash)
+		return err != nil || a.time < p.Argon2Time || a.memory < p.Argon2Memory || a.threads < p.Argon2Threads
+	default:
+		return true
+	}
+}
+
+// CheckPassword reports whether password matches hash, whatever the
+// algorithm and parameters of hash. Passwords too long for bcrypt never
+// match bcrypt hashes.
+func CheckPassword(hash, password string) (bool, error) {
+	if isBcrypt(hash) {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) || errors.Is(err, bcrypt.ErrPasswordTooLong) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	a, err := parseArgon2Hash(hash)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(a.key, a.derive(password)) == 1, nil
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+type argon2Hash struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2Hash(hash string) (argon2Hash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != AlgorithmArgon2id {
+		return argon2Hash{}, errUnknownHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return argon2Hash{}, errUnknownHash
+	}
+
+	var a argon2Hash
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &a.memory, &a.time, &a.threads); err != nil {
+		return argon2Hash{}, errUnknownHash
+	}
+	var err error
+	if a.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return argon2Hash{}, errUnknownHash
+	}
+	if a.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(a.key) == 0 {
+		return argon2Hash{}, errUnknownHash
+	}
+	return a, nil
+}
+
+func (a argon2Hash) derive(password string) []byte {
+	keySize := uint32(len(a.key))
+	if keySize == 0 {
+		keySize = argon2KeySize
+	}
+	return argon2.IDKey([]byte(password), a.salt, a.time, a.memory, a.threads, keySize)
+}
+
+func (a argon2Hash) String() string {
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", AlgorithmArgon2id, argon2.Version,
+		a.memory, a.time, a.threads,
+		base64.RawStdEncoding.EncodeToString(a.salt), base64.RawStdEncoding.EncodeToString(a.key))
+}
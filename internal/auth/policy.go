@@ -0,0 +1,87 @@
+package auth
+
+import (
+	// Embeds the common password denylist.
+	_ "embed"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+)
+
+//go:embed common_passwords.txt
+var commonPasswordList string
+
+// commonPasswords are the passwords tried first by password guessing,
+// lowercase.
+var commonPasswords = func() map[string]bool {
+	m := make(map[string]bool)
+	for _, p := range strings.Fields(commonPasswordList) {
+		m[p] = true
+	}
+	return m
+}()
+
+// MaxPasswordBytes is the default maximum length of passwords in bytes,
+// the longest password bcrypt hashes.
+const MaxPasswordBytes = 72
+
+// PasswordPolicy is what new passwords must satisfy. The zero policy
+// accepts any non-empty password of at most MaxPasswordBytes bytes.
+type PasswordPolicy struct {
+	// MinLength is the minimum number of characters.
+	MinLength int
+	// MaxBytes is the maximum length in bytes, MaxPasswordBytes if zero.
+	MaxBytes int
+	// MinClasses is the minimum number of character classes used, out of
+	// lowercase letters, uppercase letters, digits and other characters.
+	MinClasses int
+	// RejectCommon refuses the passwords of the built-in denylist of
+	// common passwords, whatever their case.
+	RejectCommon bool
+}
+
+// Check returns domain.ErrWeakPassword telling which rule password breaks,
+// nil if it satisfies the policy.
+func (p PasswordPolicy) Check(password string) error {
+	if n := utf8.RuneCountInString(password); n < p.MinLength {
+		return domain.ErrWeakPassword.WithMessage(
+			fmt.Sprintf("password must be at least %d characters long", p.MinLength))
+	}
+	maxBytes := p.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = MaxPasswordBytes
+	}
+	if len(password) > maxBytes {
+		return domain.ErrWeakPassword.WithMessage(
+			fmt.Sprintf("password must be at most %d bytes long", maxBytes))
+	}
+	if n := characterClasses(password); n < p.MinClasses {
+		return domain.ErrWeakPassword.WithMessage(fmt.Sprintf(
+			"password must use at least %d of lowercase letters, uppercase letters, digits and other characters",
+			p.MinClasses))
+	}
+	if p.RejectCommon && commonPasswords[strings.ToLower(password)] {
+		return domain.ErrWeakPassword.WithMessage("password is too common")
+	}
+	return nil
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
@@ -0,0 +1,353 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/pkg/log"
+)
+
+const (
+	// DefaultAccessTTL is the lifetime of access tokens.
+	DefaultAccessTTL = 15 * time.Minute
+	// DefaultRefreshTTL is how long a session lasts without a refresh.
+	DefaultRefreshTTL = 30 * 24 * time.Hour
+
+	refreshTokenSize = 32
+)
+
+// Config configures a Service.
+type Config struct {
+	// Secret signs the access tokens.
+	Secret []byte
+	// AccessTTL is the lifetime of access tokens, DefaultAccessTTL if zero.
+	AccessTTL time.Duration
+	// RefreshTTL is how long a session lasts without a refresh,
+	// DefaultRefreshTTL if zero.
+	RefreshTTL time.Duration
+	// Hash selects how passwords are hashed. Hashes made with other
+	// params are upgraded on login.
+	Hash HashParams
+	// Policy is what new passwords must satisfy.
+	Policy PasswordPolicy
+}
+
+// Tokens are issued on login and on each refresh. The access token
+// authenticates requests until ExpiresAt, the refresh token can be
+// exchanged once for new tokens.
+type Tokens struct {
+	UserID       string
+	AccessToken  string
+	RefreshToken string
+	ExpiresAt    time.Time
+}
+
+// Service registers and logs in users and manages their sessions.
+type Service struct {
+	users    storage.UserRepository
+	sessions storage.SessionRepository
+	signer   signer
+	cfg      Config
+	cache    *sessionCache
+
+	// dummyHash is checked against on logins of unknown users, so that
+	// they take as long as wrong passwords.
+	dummyHash     string
+	dummyHashOnce sync.Once
+
+	now func() time.Time
+}
+
+// NewService returns a service over the repositories.
+func NewService(users storage.UserRepository, sessions storage.SessionRepository, cfg Config) *Service {
+	if cfg.AccessTTL <= 0 {
+		cfg.AccessTTL = DefaultAccessTTL
+	}
+	if cfg.RefreshTTL <= 0 {
+		cfg.RefreshTTL = DefaultRefreshTTL
+	}
+
+	return &Service{
+		users:    users,
+		sessions: sessions,
+		signer:   signer{secret: cfg.Secret},
+		cfg:      cfg,
+		cache:    newSessionCache(sessions, cfg.AccessTTL, time.Now()),
+		now:      time.Now,
+	}
+}
+
+// Register creates the user of r with the password and logs them in, see
+// storage.UserRepository.Register. It returns domain.ErrWeakPassword if
+// the password breaks the policy and domain.ErrLoginTaken if the login
+// exists.
+func (s *Service) Register(ctx context.Context, r domain.Registration, password string) (Tokens, error) {
+	if err := s.cfg.Policy.Check(password); err != nil {
+		return Tokens{}, err
+	}
+
+	hash, err := s.cfg.Hash.Hash(password)
+	if err != nil {
+		return Tokens{}, fmt.Errorf("failed to hash password: %w", err)
+	}
+	r.PasswordHash = hash
+
+	u, err := s.users.Register(ctx, r)
+	if err != nil {
+		return Tokens{}, err
+	}
+	return s.startSession(ctx, u)
+}
+
+// Login starts a session for the user. It returns
+// domain.ErrInvalidCredentials if the login and password do not match and
+// domain.ErrUserBlocked if the user is blocked.
+func (s *Service) Login(ctx context.Context, login, password string) (Tokens, error) {
+	u, err := s.users.GetByLogin(ctx, login)
+	if errors.Is(err, storage.ErrNotFound) {
+		// Hashing takes most of a login, skipping it would tell which
+		// logins exist.
+		if hash := s.getDummyHash(ctx); hash != "" {
+			_, _ = CheckPassword(hash, password)
+		}
+		return Tokens{}, domain.ErrInvalidCredentials
+	}
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	ok, err := CheckPassword(u.PasswordHash, password)
+	if err != nil {
+		return Tokens{}, fmt.Errorf("failed to check password: %w", err)
+	}
+	if !ok {
+		return Tokens{}, domain.ErrInvalidCredentials
+	}
+	// Checked after the password so that blocks are not disclosed to
+	// whoever guesses logins.
+	if u.Blocked() {
+		return Tokens{}, domain.ErrUserBlocked
+	}
+
+	// The password is only known now, it is the time to upgrade its hash.
+	if s.cfg.Hash.NeedsRehash(u.PasswordHash) {
+		if err := s.setPassword(ctx, u.ID, password); err != nil {
+			log.Error(ctx, "failed to upgrade password hash", err, "user_id", u.ID)
+		}
+	}
+	return s.startSession(ctx, u)
+}
+
+// ChangePassword replaces the password of the user and revokes their
+// sessions but sessionID, the one asking for the change. It returns
+// domain.ErrWrongPassword if current does not match and
+// domain.ErrWeakPassword if password breaks the policy.
+func (s *Service) ChangePassword(ctx context.Context, userID, sessionID, current, password string) error {
+	u, err := s.users.GetByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	ok, err := CheckPassword(u.PasswordHash, current)
+	if err != nil {
+		return fmt.Errorf("failed to check password: %w", err)
+	}
+	if !ok {
+		return domain.ErrWrongPassword
+	}
+	if err := s.cfg.Policy.Check(password); err != nil {
+		return err
+	}
+
+	if err := s.setPassword(ctx, userID, password); err != nil {
+		return err
+	}
+	return s.revokeAll(ctx, userID, sessionID, domain.RevokedByPasswordChange)
+}
+
+func (s *Service) getDummyHash(ctx context.Context) string {
+	s.dummyHashOnce.Do(func() {
+		hash, err := s.cfg.Hash.Hash("dummy password")
+		if err != nil {
+			log.Error(ctx, "failed to hash dummy password", err)
+			return
+		}
+		s.dummyHash = hash
+	})
+	return s.dummyHash
+}
+
+func (s *Service) startSession(ctx context.Context, u domain.User) (Tokens, error) {
+	refresh, refreshHash, err := newRefreshToken()
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	now := s.now()
+	session, err := s.sessions.Create(ctx, domain.Session{
+		UserID:    u.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.cfg.RefreshTTL),
+	}, refreshHash)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	return s.issue(session, u.Roles, refresh, now)
+}
+
+// Refresh exchanges a refresh token for new tokens of the same session.
+// A refresh token that is used twice revokes its session.
+func (s *Service) Refresh(ctx context.Context, refreshToken string) (Tokens, error) {
+	refresh, newHash, err := newRefreshToken()
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	now := s.now()
+	session, err := s.sessions.Rotate(ctx, hashRefreshToken(refreshToken), newHash, now, now.Add(s.cfg.RefreshTTL))
+	if errors.Is(err, domain.ErrRefreshTokenReused) {
+		s.cache.invalidate(session.ID, now)
+		log.Warning(ctx, "refresh token reused, session revoked", "session_id", session.ID, "user_id", session.UserID)
+		return Tokens{}, err
+	}
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	u, err := s.users.GetByID(ctx, session.UserID)
+	if err != nil {
+		return Tokens{}, err
+	}
+	return s.issue(session, u.Roles, refresh, now)
+}
+
+// Logout revokes the session.
+func (s *Service) Logout(ctx context.Context, sessionID string) error {
+	if err := s.sessions.Revoke(ctx, sessionID, domain.RevokedByLogout); err != nil {
+		return err
+	}
+	s.cache.invalidate(sessionID, s.now())
+	return nil
+}
+
+// LogoutAll revokes every session of the user.
+func (s *Service) LogoutAll(ctx context.Context, userID string) error {
+	return s.revokeAll(ctx, userID, "", domain.RevokedByLogoutAll)
+}
+
+// Block blocks the user and revokes all their sessions. Blocked users
+// cannot log in until unblocked.
+func (s *Service) Block(ctx context.Context, userID string) error {
+	if err := s.users.SetBlocked(ctx, userID, s.now()); err != nil {
+		return err
+	}
+	return s.revokeAll(ctx, userID, "", domain.RevokedByBlock)
+}
+
+// SetRoles replaces the roles of the user and revokes all their
+// sessions, so that no access token carries the former roles.
+func (s *Service) SetRoles(ctx context.Context, userID string, roles []domain.Role) error {
+	if err := s.users.SetRoles(ctx, userID, roles); err != nil {
+		return err
+	}
+	return s.revokeAll(ctx, userID, "", domain.RevokedByRoleChange)
+}
+
+// Unblock lets a blocked user log in again.
+func (s *Service) Unblock(ctx context.Context, userID string) error {
+	return s.users.SetBlocked(ctx, userID, time.Time{})
+}
+
+func (s *Service) revokeAll(ctx context.Context, userID, exceptID, reason string) error {
+	sessions, err := s.sessions.RevokeAll(ctx, userID, exceptID, reason)
+	if err != nil {
+		return err
+	}
+
+	now := s.now()
+	for _, session := range sessions {
+		s.cache.invalidate(session.ID, now)
+	}
+	return nil
+}
+
+// Authenticate returns the claims of a valid access token of an active
+// session. It returns domain.ErrUnauthorized otherwise.
+func (s *Service) Authenticate(ctx context.Context, accessToken string) (Claims, error) {
+	now := s.now()
+	claims, err := s.signer.parse(accessToken, now)
+	if err != nil {
+		return Claims{}, domain.ErrUnauthorized
+	}
+
+	active, err := s.cache.isActive(ctx, claims.SessionID, now)
+	if err != nil {
+		return Claims{}, err
+	}
+	if !active {
+		return Claims{}, domain.ErrUnauthorized
+	}
+	return claims, nil
+}
+
+// PollRevocations applies the sessions revoked by other instances to the
+// cache Authenticate relies on.
+func (s *Service) PollRevocations(ctx context.Context) error {
+	return s.cache.poll(ctx, s.now())
+}
+
+func (s *Service) setPassword(ctx context.Context, userID, password string) error {
+	hash, err := s.cfg.Hash.Hash(password)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	return s.users.UpdatePasswordHash(ctx, userID, hash)
+}
+
+func (s *Service) issue(session domain.Session, roles []domain.Role, refresh string, now time.Time) (Tokens, error) {
+	expiresAt := now.Add(s.cfg.AccessTTL)
+	access, err := s.signer.issue(Claims{
+		UserID:    session.UserID,
+		SessionID: session.ID,
+		Roles:     roles,
+		IssuedAt:  now,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return Tokens{}, fmt.Errorf("failed to issue access token: %w", err)
+	}
+
+	return Tokens{
+		UserID:       session.UserID,
+		AccessToken:  access,
+		RefreshToken: refresh,
+		ExpiresAt:    expiresAt,
+	}, nil
+}
+
+// newRefreshToken returns a random refresh token and the hash it is
+// stored under.
+func newRefreshToken() (string, string, error) {
+	b := make([]byte, refreshTokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashRefreshToken(token), nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
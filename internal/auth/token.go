@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+)
+
+// ErrInvalidToken is returned for access tokens that are malformed,
+// badly signed or expired.
+var ErrInvalidToken = errors.New("invalid access token")
+
+// tokenHeader is the JOSE header of every access token.
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Claims are carried by an access token.
+type Claims struct {
+	UserID    string
+	SessionID string
+	Roles     []domain.Role
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	SessionID string   `json:"sid"`
+	Roles     []string `json:"roles"`
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+// signer issues and verifies access tokens, JWTs signed with HS256.
+type signer struct {
+	secret []byte
+}
+
+func (s signer) issue(c Claims) (string, error) {
+	roles := make([]string, 0, len(c.Roles))
+	for _, role := range c.Roles {
+		roles = append(roles, string(role))
+	}
+	payload, err := json.Marshal(jwtClaims{
+		Subject:   c.UserID,
+		SessionID: c.SessionID,
+		Roles:     roles,
+		IssuedAt:  c.IssuedAt.Unix(),
+		ExpiresAt: c.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(s.sign(unsigned)), nil
+}
+
+// parse returns the claims of a token that is valid at now.
+func (s signer) parse(token string, now time.Time) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return Claims{}, ErrInvalidToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, s.sign(parts[0]+"."+parts[1])) {
+		return Claims{}, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	var c jwtClaims
+	if err := json.Unmarshal(payload, &c); err != nil || c.Subject == "" || c.SessionID == "" {
+		return Claims{}, ErrInvalidToken
+	}
+
+	claims := Claims{
+		UserID:    c.Subject,
+		SessionID: c.SessionID,
+		IssuedAt:  time.Unix(c.IssuedAt, 0),
+		ExpiresAt: time.Unix(c.ExpiresAt, 0),
+	}
+	// Tokens issued before roles existed belong to plain users.
+	if c.Roles == nil {
+		claims.Roles = []domain.Role{domain.RoleUser}
+	}
+	for _, role := range c.Roles {
+		claims.Roles = append(claims.Roles, domain.Role(role))
+	}
+	if !now.Before(claims.ExpiresAt) {
+		return Claims{}, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+func (s signer) sign(unsigned string) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(unsigned))
+	return mac.Sum(nil)
+}
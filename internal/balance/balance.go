@@ -0,0 +1,107 @@
+// Package balance reads user balances from snapshots instead of the whole
+// ledger.
+//
+// A snapshot holds the balance of a user up to a ledger entry and how
+// many entries it is made of; Compact moves it forward in the background,
+// and a read adds the entries after it. A read also counts the entries
+// the ledger holds up to the snapshot: a different count, or a balance
+// that cannot result from a ledger, reveals a broken snapshot. The
+// balance is then recomputed from the whole ledger and the snapshot
+// deleted, for Compact to rebuild it.
+package balance
+
+import (
+	"context"
+	"expvar"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/pkg/log"
+)
+
+// Defaults of Config.
+const (
+	DefaultLag       = time.Minute
+	DefaultBatchSize = 1000
+)
+
+// Metrics of the snapshots, published by expvar.
+var (
+	metricCompacted  = new(expvar.Int)
+	metricMismatches = new(expvar.Int)
+)
+
+func init() {
+	m := expvar.NewMap("balance_snapshots")
+	m.Set("compacted_total", metricCompacted)
+	m.Set("mismatches_total", metricMismatches)
+}
+
+// Config tunes the Service. Zero values select the defaults.
+type Config struct {
+	// Lag keeps the entries created within it out of the snapshots. It
+	// must be longer than any transaction writing to the ledger.
+	Lag time.Duration
+	// BatchSize is how many snapshots Compact moves at once.
+	BatchSize int
+}
+
+// Service reads balances and compacts the ledger into snapshots.
+type Service struct {
+	ledger storage.LedgerRepository
+	cfg    Config
+	now    func() time.Time
+}
+
+// New returns a service over the ledger.
+func New(ledger storage.LedgerRepository, cfg Config) *Service {
+	if cfg.Lag <= 0 {
+		cfg.Lag = DefaultLag
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+
+	return &Service{ledger: ledger, cfg: cfg, now: time.Now}
+}
+
+// Balance returns the balance of the user: its snapshot plus the entries
+// after it, or the whole ledger if the snapshot does not match the ledger.
+func (s *Service) Balance(ctx context.Context, userID string) (domain.Balance, error) {
+	snapshot, tail, err := s.ledger.SnapshotBalance(ctx, userID)
+	if err != nil {
+		return domain.Balance{}, err
+	}
+
+	if snapshot.Matches(tail) {
+		return snapshot.Balance.Add(tail.Balance), nil
+	}
+
+	metricMismatches.Add(1)
+	log.Warning(ctx, "balance snapshot does not match the ledger, recomputing", "user_id", userID,
+		"last_entry_id", snapshot.LastEntryID, "entry_count", snapshot.EntryCount, "covered", tail.Covered)
+	if err := s.ledger.DeleteSnapshot(ctx, userID); err != nil {
+		return domain.Balance{}, err
+	}
+	return s.ledger.Balance(ctx, userID)
+}
+
+// Compact moves the snapshots forward until all are up to date. It is
+// meant for lifecycle.Periodic.
+func (s *Service) Compact(ctx context.Context) error {
+	before := s.now().Add(-s.cfg.Lag)
+	for {
+		n, err := s.ledger.CompactBalances(ctx, before, s.cfg.BatchSize)
+		if err != nil {
+			return err
+		}
+		metricCompacted.Add(int64(n))
+		if n > 0 {
+			log.Debug(ctx, "compacted balances", "count", n)
+		}
+		if n < s.cfg.BatchSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package balance
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/internal/storage/memory"
+)
+
+// brokenLedger returns snapshots changed by corrupt.
+type brokenLedger struct {
+	storage.LedgerRepository
+	corrupt func(*domain.BalanceSnapshot)
+	deleted []string
+}
+
+func (l *brokenLedger) SnapshotBalance(ctx context.Context, userID string) (domain.BalanceSnapshot, domain.LedgerTail, error) {
+	snapshot, tail, err := l.LedgerRepository.SnapshotBalance(ctx, userID)
+	l.corrupt(&snapshot)
+	return snapshot, tail, err
+}
+
+func (l *brokenLedger) DeleteSnapshot(ctx context.Context, userID string) error {
+	l.deleted = append(l.deleted, userID)
+	return l.LedgerRepository.DeleteSnapshot(ctx, userID)
+}
+
+func setup(t *testing.T) (*storage.Storage, string) {
+	t.Helper()
+
+	ctx := context.Background()
+	s := memory.NewStorage()
+	alice, err := s.Users.Create(ctx, "alice", "hash")
+	require.NoError(t, err)
+	_, err = s.Orders.Create(ctx, alice.ID, "12345678903")
+	require.NoError(t, err)
+	require.NoError(t, s.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessed, money.FromUnits(500)))
+	require.NoError(t, s.Ledger.Withdraw(ctx, alice.ID, "2377225624", money.MustParse("100.5"), nil))
+	return s, alice.ID
+}
+
+func TestService_Compact(t *testing.T) {
+	ctx := context.Background()
+	s, userID := setup(t)
+	want := domain.Balance{Current: money.MustParse("399.5"), Withdrawn: money.MustParse("100.5")}
+
+	svc := New(s.Ledger, Config{BatchSize: 1})
+	svc.now = func() time.Time { return time.Now().Add(time.Hour) }
+	require.NoError(t, svc.Compact(ctx))
+
+	snapshot, tail, err := s.Ledger.SnapshotBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, want, snapshot.Balance)
+	assert.Equal(t, domain.Balance{}, tail.Balance)
+
+	require.NoError(t, s.Ledger.Withdraw(ctx, userID, "79927398713", money.FromUnits(99), nil))
+	b, err := svc.Balance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, domain.Balance{Current: money.MustParse("300.5"), Withdrawn: money.MustParse("199.5")}, b)
+}
+
+func TestService_BrokenSnapshot(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(*domain.BalanceSnapshot)
+	}{
+		{"Negative", func(s *domain.BalanceSnapshot) {
+			s.Balance.Current -= money.FromUnits(1000)
+		}},
+		{"MissingEntry", func(s *domain.BalanceSnapshot) {
+			// As if the withdrawal committed after the compaction.
+			s.Balance = domain.Balance{Current: money.FromUnits(500)}
+			s.EntryCount--
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, userID := setup(t)
+			ledger := &brokenLedger{LedgerRepository: s.Ledger, corrupt: tt.corrupt}
+
+			svc := New(ledger, Config{})
+			svc.now = func() time.Time { return time.Now().Add(time.Hour) }
+			require.NoError(t, svc.Compact(ctx))
+
+			b, err := svc.Balance(ctx, userID)
+			require.NoError(t, err)
+			assert.Equal(t, domain.Balance{Current: money.MustParse("399.5"), Withdrawn: money.MustParse("100.5")}, b)
+			assert.Equal(t, []string{userID}, ledger.deleted)
+		})
+	}
+}
@@ -0,0 +1,174 @@
+// Package bruteforce throttles password guessing and mass registration.
+//
+// Failed logins are counted per login and per client IP. Once a counter
+// reaches its threshold, every further failure blocks the login or IP for
+// twice as long as the previous one, up to a maximum. Registrations are
+// limited per client IP. Counters live in a storage.AttemptRepository, in
+// memory for a single instance or in PostgreSQL to share them in a cluster.
+package bruteforce
+
+import (
+	"context"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/pkg/log"
+)
+
+// Defaults of Config.
+const (
+	DefaultLoginThreshold = 5
+	DefaultIPThreshold    = 20
+	DefaultWindow         = time.Hour
+	DefaultBaseDelay      = 30 * time.Second
+	DefaultMaxDelay       = time.Hour
+	DefaultRegisterLimit  = 10
+	DefaultRegisterWindow = time.Hour
+)
+
+// Config configures a Guard. Zero fields take the defaults.
+type Config struct {
+	// LoginThreshold is how many failures of a login lock it.
+	LoginThreshold int
+	// IPThreshold is how many failures from an IP block it.
+	IPThreshold int
+	// Window is how long failures are counted from the first one.
+	Window time.Duration
+	// BaseDelay is the first lockout, MaxDelay the longest.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// RegisterLimit is how many registrations an IP may attempt in
+	// RegisterWindow.
+	RegisterLimit  int
+	RegisterWindow time.Duration
+}
+
+// Guard decides whether logins and registrations may be attempted.
+type Guard struct {
+	repo storage.AttemptRepository
+	cfg  Config
+
+	now func() time.Time
+}
+
+// NewGuard returns a guard keeping its counters in repo.
+func NewGuard(repo storage.AttemptRepository, cfg Config) *Guard {
+	if cfg.LoginThreshold <= 0 {
+		cfg.LoginThreshold = DefaultLoginThreshold
+	}
+	if cfg.IPThreshold <= 0 {
+		cfg.IPThreshold = DefaultIPThreshold
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = DefaultWindow
+	}
+	if cfg.BaseDelay <= 0 {
+		cfg.BaseDelay = DefaultBaseDelay
+	}
+	if cfg.MaxDelay < cfg.BaseDelay {
+		cfg.MaxDelay = DefaultMaxDelay
+	}
+	if cfg.RegisterLimit <= 0 {
+		cfg.RegisterLimit = DefaultRegisterLimit
+	}
+	if cfg.RegisterWindow <= 0 {
+		cfg.RegisterWindow = DefaultRegisterWindow
+	}
+
+	return &Guard{repo: repo, cfg: cfg, now: time.Now}
+}
+
+// CheckLogin returns how long to wait before the login may be attempted
+// from ip, zero if it may be attempted now.
+func (g *Guard) CheckLogin(ctx context.Context, login, ip string) (time.Duration, error) {
+	now := g.now()
+
+	var wait time.Duration
+	for _, key := range []string{loginKey(login), ipKey(ip)} {
+		c, err := g.repo.Get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		if c.Blocked(now) && c.BlockedUntil.Sub(now) > wait {
+			wait = c.BlockedUntil.Sub(now)
+		}
+	}
+	return wait, nil
+}
+
+// LoginFailed counts a failed login from ip and locks the login or blocks
+// the IP once they reached their threshold.
+func (g *Guard) LoginFailed(ctx context.Context, login, ip string) error {
+	if err := g.fail(ctx, loginKey(login), g.cfg.LoginThreshold, "login", login); err != nil {
+		return err
+	}
+	return g.fail(ctx, ipKey(ip), g.cfg.IPThreshold, "ip", ip)
+}
+
+// LoginSucceeded clears the failures of the login. The failures of the IP
+// are kept, one valid account must not unlock guessing others.
+func (g *Guard) LoginSucceeded(ctx context.Context, login string) error {
+	return g.repo.Reset(ctx, loginKey(login))
+}
+
+// Register counts a registration attempt from ip. It returns how long to
+// wait before registering from ip if the limit is exceeded, zero otherwise.
+func (g *Guard) Register(ctx context.Context, ip string) (time.Duration, error) {
+	now := g.now()
+	c, err := g.repo.Increment(ctx, registerKey(ip), now, now.Add(-g.cfg.RegisterWindow))
+	if err != nil {
+		return 0, err
+	}
+	if c.Count <= g.cfg.RegisterLimit {
+		return 0, nil
+	}
+
+	wait := c.WindowStart.Add(g.cfg.RegisterWindow).Sub(now)
+	if c.Count == g.cfg.RegisterLimit+1 {
+		log.Warning(ctx, "registration rate limit exceeded", "ip", ip, "retry_after", wait)
+	}
+	return wait, nil
+}
+
+// DeleteStale deletes the counters that no longer matter.
+func (g *Guard) DeleteStale(ctx context.Context) (int64, error) {
+	window := g.cfg.Window
+	if g.cfg.RegisterWindow > window {
+		window = g.cfg.RegisterWindow
+	}
+	return g.repo.DeleteStale(ctx, g.now().Add(-window))
+}
+
+func (g *Guard) fail(ctx context.Context, key string, threshold int, kind, value string) error {
+	now := g.now()
+	c, err := g.repo.Increment(ctx, key, now, now.Add(-g.cfg.Window))
+	if err != nil {
+		return err
+	}
+	if c.Count < threshold {
+		return nil
+	}
+
+	delay := g.delay(c.Count - threshold)
+	if err := g.repo.Block(ctx, key, now.Add(delay)); err != nil {
+		return err
+	}
+	log.Warning(ctx, "too many failed logins, locked out", kind, value, "failures", c.Count, "retry_after", delay)
+	return nil
+}
+
+// delay returns the lockout after n failures past the threshold.
+func (g *Guard) delay(n int) time.Duration {
+	d := g.cfg.BaseDelay
+	for i := 0; i < n && d < g.cfg.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > g.cfg.MaxDelay {
+		d = g.cfg.MaxDelay
+	}
+	return d
+}
+
+func loginKey(login string) string { return "login:" + login }
+func ipKey(ip string) string       { return "ip:" + ip }
+func registerKey(ip string) string { return "register:" + ip }
@@ -0,0 +1,107 @@
+package bruteforce
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/storage/memory"
+)
+
+func newTestGuard(cfg Config) (*Guard, *time.Time) {
+	g := NewGuard(memory.NewAttemptRepository(), cfg)
+	now := time.Now()
+	g.now = func() time.Time { return now }
+	return g, &now
+}
+
+func TestGuard_LoginLockout(t *testing.T) {
+	ctx := context.Background()
+	g, now := newTestGuard(Config{LoginThreshold: 3, IPThreshold: 100, BaseDelay: time.Minute, MaxDelay: 3 * time.Minute})
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, g.LoginFailed(ctx, "alice", "10.0.0.1"))
+	}
+	wait, err := g.CheckLogin(ctx, "alice", "10.0.0.1")
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+
+	// The third failure locks the login, from any IP.
+	require.NoError(t, g.LoginFailed(ctx, "alice", "10.0.0.1"))
+	wait, err = g.CheckLogin(ctx, "alice", "10.0.0.2")
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, wait)
+	wait, err = g.CheckLogin(ctx, "bob", "10.0.0.1")
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+
+	// Each further failure doubles the lockout, up to the maximum.
+	*now = now.Add(time.Minute)
+	require.NoError(t, g.LoginFailed(ctx, "alice", "10.0.0.1"))
+	wait, err = g.CheckLogin(ctx, "alice", "10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Minute, wait)
+
+	*now = now.Add(2 * time.Minute)
+	require.NoError(t, g.LoginFailed(ctx, "alice", "10.0.0.1"))
+	wait, err = g.CheckLogin(ctx, "alice", "10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, 3*time.Minute, wait)
+
+	*now = now.Add(3 * time.Minute)
+	require.NoError(t, g.LoginSucceeded(ctx, "alice"))
+	require.NoError(t, g.LoginFailed(ctx, "alice", "10.0.0.1"))
+	wait, err = g.CheckLogin(ctx, "alice", "10.0.0.1")
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+}
+
+func TestGuard_IPLockout(t *testing.T) {
+	ctx := context.Background()
+	g, _ := newTestGuard(Config{LoginThreshold: 100, IPThreshold: 3, BaseDelay: time.Minute})
+
+	for _, login := range []string{"alice", "bob", "carol"} {
+		require.NoError(t, g.LoginFailed(ctx, login, "10.0.0.1"))
+	}
+	wait, err := g.CheckLogin(ctx, "dave", "10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, wait)
+	wait, err = g.CheckLogin(ctx, "dave", "10.0.0.2")
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+}
+
+func TestGuard_Register(t *testing.T) {
+	ctx := context.Background()
+	g, now := newTestGuard(Config{RegisterLimit: 2, RegisterWindow: time.Hour})
+
+	for i := 0; i < 2; i++ {
+		wait, err := g.Register(ctx, "10.0.0.1")
+		require.NoError(t, err)
+		assert.Zero(t, wait)
+	}
+
+	*now = now.Add(10 * time.Minute)
+	wait, err := g.Register(ctx, "10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, 50*time.Minute, wait)
+	wait, err = g.Register(ctx, "10.0.0.2")
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+
+	*now = now.Add(50 * time.Minute)
+	wait, err = g.Register(ctx, "10.0.0.1")
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+
+	deleted, err := g.DeleteStale(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, deleted)
+	*now = now.Add(2 * time.Hour)
+	deleted, err = g.DeleteStale(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), deleted)
+}
@@ -0,0 +1,94 @@
+// Package certs builds the TLS configuration of the API listener: it loads
+// and hot-reloads the server certificate, generates a self-signed one for
+// local development and verifies client certificates on admin routes.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/config"
+)
+
+const (
+	defaultReloadInterval = 10 * time.Second
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewTLSConfig returns the tls.Config of the API listener built from cfg.
+// HTTP/2 is negotiated through ALPN alongside HTTP/1.1.
+func NewTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	minVersion, ok := tlsVersions[cfg.MinVersion]
+	if !ok {
+		minVersion = tls.VersionTLS12
+	}
+
+	tlsCfg := &tls.Config{
+		MinVersion: minVersion,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+
+	if cfg.SelfSigned {
+		cert, err := SelfSigned(time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate self-signed certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	} else {
+		reloader, err := NewReloader(cfg.CertFile, cfg.KeyFile, defaultReloadInterval)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.GetCertificate = reloader.GetCertificate
+	}
+
+	if cfg.ClientCAFile != "" {
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		// Client certificates are only mandatory on admin routes,
+		// see RequireClientCert.
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsCfg, nil
+}
+
+// RequireClientCert rejects requests that were not made over TLS with
+// a client certificate verified against the configured client CA.
+func RequireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in client CA file")
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,99 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeKeyPair(t *testing.T, cert tls.Certificate, certFile, keyFile string, mod time.Time) {
+	t.Helper()
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	require.NoError(t, os.WriteFile(certFile, certPEM, 0o600))
+
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	require.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+
+	require.NoError(t, os.Chtimes(certFile, mod, mod))
+	require.NoError(t, os.Chtimes(keyFile, mod, mod))
+}
+
+func TestReloader_ReloadsChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+
+	now := time.Now()
+	first, err := SelfSigned(now)
+	require.NoError(t, err)
+	writeKeyPair(t, first, certFile, keyFile, now.Add(-time.Hour))
+
+	r, err := NewReloader(certFile, keyFile, 0)
+	require.NoError(t, err)
+
+	got, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, first.Certificate[0], got.Certificate[0])
+
+	second, err := SelfSigned(now)
+	require.NoError(t, err)
+	writeKeyPair(t, second, certFile, keyFile, now)
+
+	got, err = r.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, second.Certificate[0], got.Certificate[0])
+}
+
+func TestReloader_KeepsCertificateOnBrokenFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+
+	now := time.Now()
+	cert, err := SelfSigned(now)
+	require.NoError(t, err)
+	writeKeyPair(t, cert, certFile, keyFile, now.Add(-time.Hour))
+
+	r, err := NewReloader(certFile, keyFile, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0o600))
+
+	got, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, cert.Certificate[0], got.Certificate[0])
+}
+
+func TestRequireClientCert(t *testing.T) {
+	h := RequireClientCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	t.Run("PlainHTTP", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin", nil))
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+
+	t.Run("VerifiedClient", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{}}}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+}
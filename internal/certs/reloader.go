@@ -0,0 +1,97 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/pkg/log"
+)
+
+// Reloader serves a certificate/key pair from disk and reloads it when
+// either file changes. Files are checked at most once per interval, during
+// a TLS handshake, so no background goroutine is needed.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	checkedAt time.Time
+}
+
+// NewReloader loads the certificate/key pair and returns a Reloader for it.
+func NewReloader(certFile, keyFile string, interval time.Duration) (*Reloader, error) {
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: interval,
+	}
+
+	if err := r.reload(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.checkedAt) >= r.interval {
+		if err := r.reload(now); err != nil {
+			// Keep serving the previous certificate: a half-written file
+			// must not take the listener down.
+			log.Error(context.Background(), "failed to reload TLS certificate", err,
+				"cert_file", r.certFile, "key_file", r.keyFile)
+		}
+	}
+
+	return r.cert, nil
+}
+
+func (r *Reloader) reload(now time.Time) error {
+	r.checkedAt = now
+
+	certMod, err := modTime(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyMod, err := modTime(r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	if r.cert != nil && certMod.Equal(r.certMod) && keyMod.Equal(r.keyMod) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS key pair: %w", err)
+	}
+
+	r.cert = &cert
+	r.certMod = certMod
+	r.keyMod = keyMod
+	log.Info(context.Background(), "loaded TLS certificate", "cert_file", r.certFile)
+
+	return nil
+}
+
+func modTime(path string) (time.Time, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	return fi.ModTime(), nil
+}
@@ -13,3 +13,14 @@ type ErrMissingOption struct {
 func (e ErrMissingOption) Error() string {
 	return fmt.Sprintf("Missing configuration option [%s]", e.Option)
 }
+
+// ErrInvalidOption is the error when configuration option is provided
+// but its value cannot be used.
+type ErrInvalidOption struct {
+	Option string
+	Reason string
+}
+
+func (e ErrInvalidOption) Error() string {
+	return fmt.Sprintf("Invalid configuration option [%s]: %s", e.Option, e.Reason)
+}
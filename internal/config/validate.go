@@ -1,5 +1,12 @@
 package config
 
+import (
+	"fmt"
+	"strings"
+
+	"github.com/paramonies/ya-gophermart/internal/money"
+)
+
 func (cfg *AppConfig) validate() error {
 	if cfg.RunAddress == "" {
 		return ErrMissingOption{
@@ -7,5 +14,389 @@ func (cfg *AppConfig) validate() error {
 		}
 	}
 
+	return cfg.TLS.validate()
+}
+
+func (cfg *DatabaseConfig) validate() error {
+	if cfg.BackgroundTimeout < 0 {
+		return ErrInvalidOption{
+			Option: "db.background_timeout",
+			Reason: "must not be negative",
+		}
+	}
+
+	return nil
+}
+
+func (cfg *TLSConfig) validate() error {
+	if !cfg.Enabled() {
+		return nil
+	}
+
+	if cfg.SelfSigned && (cfg.CertFile != "" || cfg.KeyFile != "") {
+		return ErrInvalidOption{
+			Option: "tls.self_signed",
+			Reason: "cannot be combined with cert_file and key_file",
+		}
+	}
+
+	if !cfg.SelfSigned {
+		if cfg.CertFile == "" {
+			return ErrMissingOption{
+				Option: "tls.cert_file",
+			}
+		}
+		if cfg.KeyFile == "" {
+			return ErrMissingOption{
+				Option: "tls.key_file",
+			}
+		}
+	}
+
+	switch cfg.MinVersion {
+	case "", "1.0", "1.1", "1.2", "1.3":
+	default:
+		return ErrInvalidOption{
+			Option: "tls.min_version",
+			Reason: "must be one of 1.0, 1.1, 1.2, 1.3",
+		}
+	}
+
+	return nil
+}
+
+func (cfg *OutboxConfig) validate() error {
+	switch cfg.Sink {
+	case "", "stdout":
+	case "webhook":
+		if cfg.WebhookURL == "" {
+			return ErrMissingOption{
+				Option: "outbox.webhook_url",
+			}
+		}
+	case "nats":
+		if cfg.NATSURL == "" {
+			return ErrMissingOption{
+				Option: "outbox.nats_url",
+			}
+		}
+	default:
+		return ErrInvalidOption{
+			Option: "outbox.sink",
+			Reason: "must be one of stdout, webhook, nats",
+		}
+	}
+	if cfg.MaxAttempts < 1 {
+		return ErrInvalidOption{
+			Option: "outbox.max_attempts",
+			Reason: "must be positive",
+		}
+	}
+
+	return nil
+}
+
+func (cfg *WebhooksConfig) validate() error {
+	if cfg.MaxAttempts < 1 {
+		return ErrInvalidOption{
+			Option: "webhooks.max_attempts",
+			Reason: "must be at least 1",
+		}
+	}
+
+	return nil
+}
+
+func (cfg *IdempotencyConfig) validate() error {
+	if cfg.TTL <= 0 {
+		return ErrInvalidOption{
+			Option: "idempotency.ttl",
+			Reason: "must be positive",
+		}
+	}
+	if cfg.CleanupInterval <= 0 {
+		return ErrInvalidOption{
+			Option: "idempotency.cleanup_interval",
+			Reason: "must be positive",
+		}
+	}
+	if cfg.Lease <= 0 {
+		return ErrInvalidOption{
+			Option: "idempotency.lease",
+			Reason: "must be positive",
+		}
+	}
+
+	return nil
+}
+
+func (cfg *AuthConfig) validate() error {
+	if cfg.AccessTTL <= 0 {
+		return ErrInvalidOption{
+			Option: "auth.access_ttl",
+			Reason: "must be positive",
+		}
+	}
+	if cfg.RefreshTTL <= cfg.AccessTTL {
+		return ErrInvalidOption{
+			Option: "auth.refresh_ttl",
+			Reason: "must be longer than access_ttl",
+		}
+	}
+	if cfg.RevocationPollInterval <= 0 {
+		return ErrInvalidOption{
+			Option: "auth.revocation_poll_interval",
+			Reason: "must be positive",
+		}
+	}
+
+	return cfg.Password.validate()
+}
+
+func (cfg *PasswordConfig) validate() error {
+	if cfg.MinLength < 1 {
+		return ErrInvalidOption{
+			Option: "auth.password.min_length",
+			Reason: "must be at least 1",
+		}
+	}
+	if cfg.MinClasses < 0 || cfg.MinClasses > 4 {
+		return ErrInvalidOption{
+			Option: "auth.password.min_classes",
+			Reason: "must be between 0 and 4",
+		}
+	}
+
+	switch cfg.HashAlgorithm {
+	case "bcrypt":
+		if cfg.BcryptCost < 4 || cfg.BcryptCost > 31 {
+			return ErrInvalidOption{
+				Option: "auth.password.bcrypt_cost",
+				Reason: "must be between 4 and 31",
+			}
+		}
+	case "argon2id":
+		if cfg.Argon2Time < 1 {
+			return ErrInvalidOption{
+				Option: "auth.password.argon2_time",
+				Reason: "must be at least 1",
+			}
+		}
+		if cfg.Argon2Memory < 8*cfg.Argon2Threads {
+			return ErrInvalidOption{
+				Option: "auth.password.argon2_memory",
+				Reason: "must be at least 8 KiB per thread",
+			}
+		}
+		if cfg.Argon2Threads < 1 || cfg.Argon2Threads > 255 {
+			return ErrInvalidOption{
+				Option: "auth.password.argon2_threads",
+				Reason: "must be between 1 and 255",
+			}
+		}
+	default:
+		return ErrInvalidOption{
+			Option: "auth.password.hash_algorithm",
+			Reason: "must be one of bcrypt, argon2id",
+		}
+	}
+
+	return nil
+}
+
+func (cfg *BruteForceConfig) validate() error {
+	switch cfg.Backend {
+	case "memory", "postgres":
+	default:
+		return ErrInvalidOption{
+			Option: "bruteforce.backend",
+			Reason: "must be one of memory, postgres",
+		}
+	}
+	if cfg.LoginThreshold < 1 {
+		return ErrInvalidOption{
+			Option: "bruteforce.login_threshold",
+			Reason: "must be at least 1",
+		}
+	}
+	if cfg.IPThreshold < 1 {
+		return ErrInvalidOption{
+			Option: "bruteforce.ip_threshold",
+			Reason: "must be at least 1",
+		}
+	}
+	if cfg.BaseDelay <= 0 {
+		return ErrInvalidOption{
+			Option: "bruteforce.base_delay",
+			Reason: "must be positive",
+		}
+	}
+	if cfg.MaxDelay < cfg.BaseDelay {
+		return ErrInvalidOption{
+			Option: "bruteforce.max_delay",
+			Reason: "must not be shorter than base_delay",
+		}
+	}
+	if cfg.RegisterLimit < 1 {
+		return ErrInvalidOption{
+			Option: "bruteforce.register_limit",
+			Reason: "must be at least 1",
+		}
+	}
+	if cfg.Window <= 0 {
+		return ErrInvalidOption{
+			Option: "bruteforce.window",
+			Reason: "must be positive",
+		}
+	}
+	if cfg.RegisterWindow <= 0 {
+		return ErrInvalidOption{
+			Option: "bruteforce.register_window",
+			Reason: "must be positive",
+		}
+	}
+	if cfg.CleanupInterval <= 0 {
+		return ErrInvalidOption{
+			Option: "bruteforce.cleanup_interval",
+			Reason: "must be positive",
+		}
+	}
+
+	return nil
+}
+
+func (cfg *AdminConfig) validate(tls TLSConfig) error {
+	if cfg.RequireClientCert && tls.ClientCAFile == "" {
+		return ErrInvalidOption{
+			Option: "admin.require_client_cert",
+			Reason: "needs app.tls.client_ca_file",
+		}
+	}
+
+	return nil
+}
+
+func (cfg *ReconciliationConfig) validate() error {
+	if cfg.Interval < 0 {
+		return ErrInvalidOption{
+			Option: "reconciliation.interval",
+			Reason: "must not be negative",
+		}
+	}
+	if cfg.Window <= 0 {
+		return ErrInvalidOption{
+			Option: "reconciliation.window",
+			Reason: "must be positive",
+		}
+	}
+
+	return nil
+}
+
+func (cfg *BalanceConfig) validate() error {
+	if cfg.SnapshotInterval < 0 {
+		return ErrInvalidOption{
+			Option: "balance.snapshot_interval",
+			Reason: "must not be negative",
+		}
+	}
+	if cfg.SnapshotLag <= 0 {
+		return ErrInvalidOption{
+			Option: "balance.snapshot_lag",
+			Reason: "must be positive",
+		}
+	}
+	if cfg.SnapshotBatchSize <= 0 {
+		return ErrInvalidOption{
+			Option: "balance.snapshot_batch_size",
+			Reason: "must be positive",
+		}
+	}
+
+	return nil
+}
+
+func (cfg *ExpirationConfig) validate() error {
+	if cfg.After < 0 {
+		return ErrInvalidOption{
+			Option: "expiration.after",
+			Reason: "must not be negative",
+		}
+	}
+	if cfg.After > 0 && cfg.Interval <= 0 {
+		return ErrInvalidOption{
+			Option: "expiration.interval",
+			Reason: "must be positive when points expire",
+		}
+	}
+	if cfg.Soon <= 0 {
+		return ErrInvalidOption{
+			Option: "expiration.soon",
+			Reason: "must be positive",
+		}
+	}
+
+	return nil
+}
+
+func (cfg *PromotionsConfig) validate() error {
+	ids := make(map[string]bool, len(cfg.Rules))
+	for i, rule := range cfg.Rules {
+		option := fmt.Sprintf("promotions.rules[%d].id", i)
+		if strings.TrimSpace(rule.ID) == "" {
+			return ErrInvalidOption{Option: option, Reason: "must not be empty"}
+		}
+		if ids[rule.ID] {
+			return ErrInvalidOption{Option: option, Reason: fmt.Sprintf("duplicate rule ID %q", rule.ID)}
+		}
+		ids[rule.ID] = true
+	}
+
+	return nil
+}
+
+func (cfg *ReferralsConfig) validate() error {
+	if cfg.Interval < 0 {
+		return ErrInvalidOption{
+			Option: "referrals.interval",
+			Reason: "must not be negative",
+		}
+	}
+	for option, bonus := range map[string]string{
+		"referrals.referrer_bonus": cfg.ReferrerBonus,
+		"referrals.referred_bonus": cfg.ReferredBonus,
+	} {
+		amount, err := money.Parse(bonus)
+		if err != nil {
+			return ErrInvalidOption{Option: option, Reason: err.Error()}
+		}
+		if amount < 0 {
+			return ErrInvalidOption{Option: option, Reason: "must not be negative"}
+		}
+	}
+	if cfg.Cap < 0 {
+		return ErrInvalidOption{
+			Option: "referrals.cap",
+			Reason: "must not be negative",
+		}
+	}
+
+	return nil
+}
+
+func (cfg *AccrualSyncConfig) validate() error {
+	if cfg.Interval < 0 {
+		return ErrInvalidOption{
+			Option: "accrual_sync.interval",
+			Reason: "must not be negative",
+		}
+	}
+	if cfg.BatchSize <= 0 {
+		return ErrInvalidOption{
+			Option: "accrual_sync.batch_size",
+			Reason: "must be positive",
+		}
+	}
+
 	return nil
 }
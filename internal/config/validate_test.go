@@ -2,6 +2,7 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -18,3 +19,425 @@ func TestValidate_AppConfig(t *testing.T) {
 		}
 	})
 }
+
+func TestValidate_DatabaseConfig(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		cfg := &DatabaseConfig{QueryTimeout: time.Second, BackgroundTimeout: time.Minute}
+		assert.NoError(t, cfg.validate())
+	})
+
+	t.Run("NegativeBackgroundTimeout", func(t *testing.T) {
+		cfg := &DatabaseConfig{QueryTimeout: time.Second, BackgroundTimeout: -time.Minute}
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrInvalidOption))
+			assert.Contains(t, err.Error(), "db.background_timeout")
+		}
+	})
+}
+
+func TestValidate_TLSConfig(t *testing.T) {
+	t.Run("Disabled", func(t *testing.T) {
+		cfg := &TLSConfig{}
+		assert.NoError(t, cfg.validate())
+	})
+
+	t.Run("MissingKeyFile", func(t *testing.T) {
+		cfg := &TLSConfig{
+			CertFile: "server.crt",
+		}
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrMissingOption))
+			assert.Contains(t, err.Error(), "tls.key_file")
+		}
+	})
+
+	t.Run("SelfSignedWithCertFile", func(t *testing.T) {
+		cfg := &TLSConfig{
+			CertFile:   "server.crt",
+			KeyFile:    "server.key",
+			SelfSigned: true,
+		}
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrInvalidOption))
+			assert.Contains(t, err.Error(), "tls.self_signed")
+		}
+	})
+
+	t.Run("UnknownMinVersion", func(t *testing.T) {
+		cfg := &TLSConfig{
+			SelfSigned: true,
+			MinVersion: "2.0",
+		}
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrInvalidOption))
+			assert.Contains(t, err.Error(), "tls.min_version")
+		}
+	})
+}
+
+func TestValidate_OutboxConfig(t *testing.T) {
+	t.Run("Disabled", func(t *testing.T) {
+		cfg := &OutboxConfig{MaxAttempts: 20}
+		assert.NoError(t, cfg.validate())
+	})
+
+	t.Run("WebhookWithoutURL", func(t *testing.T) {
+		cfg := &OutboxConfig{
+			Sink: "webhook",
+		}
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrMissingOption))
+			assert.Contains(t, err.Error(), "outbox.webhook_url")
+		}
+	})
+
+	t.Run("UnknownSink", func(t *testing.T) {
+		cfg := &OutboxConfig{
+			Sink: "kafka",
+		}
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrInvalidOption))
+			assert.Contains(t, err.Error(), "outbox.sink")
+		}
+	})
+
+	t.Run("NoAttempts", func(t *testing.T) {
+		cfg := &OutboxConfig{Sink: "stdout"}
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrInvalidOption))
+			assert.Contains(t, err.Error(), "outbox.max_attempts")
+		}
+	})
+}
+
+func TestValidate_WebhooksConfig(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		cfg := &WebhooksConfig{
+			MaxAttempts: 10,
+		}
+		assert.NoError(t, cfg.validate())
+	})
+
+	t.Run("NoAttempts", func(t *testing.T) {
+		cfg := &WebhooksConfig{}
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrInvalidOption))
+			assert.Contains(t, err.Error(), "webhooks.max_attempts")
+		}
+	})
+}
+
+func TestValidate_IdempotencyConfig(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		cfg := &IdempotencyConfig{
+			TTL:             time.Hour,
+			CleanupInterval: time.Minute,
+			Lease:           time.Minute,
+		}
+		assert.NoError(t, cfg.validate())
+	})
+
+	t.Run("NoTTL", func(t *testing.T) {
+		cfg := &IdempotencyConfig{
+			CleanupInterval: time.Minute,
+		}
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrInvalidOption))
+			assert.Contains(t, err.Error(), "idempotency.ttl")
+		}
+	})
+
+	t.Run("NoLease", func(t *testing.T) {
+		cfg := &IdempotencyConfig{
+			TTL:             time.Hour,
+			CleanupInterval: time.Minute,
+		}
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrInvalidOption))
+			assert.Contains(t, err.Error(), "idempotency.lease")
+		}
+	})
+}
+
+func TestValidate_AuthConfig(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		cfg := &AuthConfig{
+			AccessTTL:              15 * time.Minute,
+			RefreshTTL:             24 * time.Hour,
+			RevocationPollInterval: 5 * time.Second,
+			Password: PasswordConfig{
+				MinLength:     8,
+				HashAlgorithm: "bcrypt",
+				BcryptCost:    10,
+			},
+		}
+		assert.NoError(t, cfg.validate())
+	})
+
+	t.Run("RefreshShorterThanAccess", func(t *testing.T) {
+		cfg := &AuthConfig{
+			AccessTTL:              time.Hour,
+			RefreshTTL:             time.Minute,
+			RevocationPollInterval: 5 * time.Second,
+		}
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrInvalidOption))
+			assert.Contains(t, err.Error(), "auth.refresh_ttl")
+		}
+	})
+}
+
+func TestValidate_BruteForceConfig(t *testing.T) {
+	valid := func() *BruteForceConfig {
+		return &BruteForceConfig{
+			Backend:         "memory",
+			LoginThreshold:  5,
+			IPThreshold:     20,
+			Window:          time.Hour,
+			BaseDelay:       30 * time.Second,
+			MaxDelay:        time.Hour,
+			RegisterLimit:   10,
+			RegisterWindow:  time.Hour,
+			CleanupInterval: 10 * time.Minute,
+		}
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		assert.NoError(t, valid().validate())
+	})
+
+	t.Run("UnknownBackend", func(t *testing.T) {
+		cfg := valid()
+		cfg.Backend = "redis"
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrInvalidOption))
+			assert.Contains(t, err.Error(), "bruteforce.backend")
+		}
+	})
+
+	t.Run("MaxDelayShorterThanBase", func(t *testing.T) {
+		cfg := valid()
+		cfg.MaxDelay = time.Second
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrInvalidOption))
+			assert.Contains(t, err.Error(), "bruteforce.max_delay")
+		}
+	})
+}
+
+func TestValidate_PasswordConfig(t *testing.T) {
+	t.Run("Argon2id", func(t *testing.T) {
+		cfg := &PasswordConfig{
+			MinLength:     8,
+			MinClasses:    2,
+			HashAlgorithm: "argon2id",
+			Argon2Time:    3,
+			Argon2Memory:  64 * 1024,
+			Argon2Threads: 2,
+		}
+		assert.NoError(t, cfg.validate())
+	})
+
+	t.Run("UnknownAlgorithm", func(t *testing.T) {
+		cfg := &PasswordConfig{
+			MinLength:     8,
+			HashAlgorithm: "md5",
+		}
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrInvalidOption))
+			assert.Contains(t, err.Error(), "auth.password.hash_algorithm")
+		}
+	})
+
+	t.Run("BcryptCostTooLow", func(t *testing.T) {
+		cfg := &PasswordConfig{
+			MinLength:     8,
+			HashAlgorithm: "bcrypt",
+			BcryptCost:    2,
+		}
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrInvalidOption))
+			assert.Contains(t, err.Error(), "auth.password.bcrypt_cost")
+		}
+	})
+}
+
+func TestValidate_AdminConfig(t *testing.T) {
+	cfg := &AdminConfig{Token: "secret", RequireClientCert: true}
+	err := cfg.validate(TLSConfig{})
+	if assert.Error(t, err) {
+		assert.ErrorAs(t, err, new(ErrInvalidOption))
+		assert.Contains(t, err.Error(), "admin.require_client_cert")
+	}
+
+	assert.NoError(t, cfg.validate(TLSConfig{ClientCAFile: "ca.pem"}))
+}
+
+func TestValidate_ReconciliationConfig(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		cfg := &ReconciliationConfig{Window: time.Hour}
+		assert.NoError(t, cfg.validate())
+	})
+
+	t.Run("NegativeInterval", func(t *testing.T) {
+		cfg := &ReconciliationConfig{Interval: -time.Second, Window: time.Hour}
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrInvalidOption))
+			assert.Contains(t, err.Error(), "reconciliation.interval")
+		}
+	})
+
+	t.Run("NoWindow", func(t *testing.T) {
+		cfg := &ReconciliationConfig{Interval: time.Hour}
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrInvalidOption))
+			assert.Contains(t, err.Error(), "reconciliation.window")
+		}
+	})
+}
+
+func TestValidate_BalanceConfig(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		cfg := &BalanceConfig{SnapshotLag: time.Minute, SnapshotBatchSize: 100}
+		assert.NoError(t, cfg.validate())
+	})
+
+	t.Run("NoLag", func(t *testing.T) {
+		cfg := &BalanceConfig{SnapshotInterval: time.Minute, SnapshotBatchSize: 100}
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrInvalidOption))
+			assert.Contains(t, err.Error(), "balance.snapshot_lag")
+		}
+	})
+
+	t.Run("NoBatchSize", func(t *testing.T) {
+		cfg := &BalanceConfig{SnapshotInterval: time.Minute, SnapshotLag: time.Minute}
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrInvalidOption))
+			assert.Contains(t, err.Error(), "balance.snapshot_batch_size")
+		}
+	})
+}
+
+func TestValidate_ExpirationConfig(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		cfg := &ExpirationConfig{After: 365 * 24 * time.Hour, Interval: 24 * time.Hour, Soon: time.Hour}
+		assert.NoError(t, cfg.validate())
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		cfg := &ExpirationConfig{Soon: time.Hour}
+		assert.NoError(t, cfg.validate())
+	})
+
+	t.Run("NoInterval", func(t *testing.T) {
+		cfg := &ExpirationConfig{After: time.Hour, Soon: time.Hour}
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrInvalidOption))
+			assert.Contains(t, err.Error(), "expiration.interval")
+		}
+	})
+
+	t.Run("NegativeAfter", func(t *testing.T) {
+		cfg := &ExpirationConfig{After: -time.Hour, Interval: time.Hour, Soon: time.Hour}
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrInvalidOption))
+			assert.Contains(t, err.Error(), "expiration.after")
+		}
+	})
+}
+
+func TestValidate_PromotionsConfig(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		cfg := &PromotionsConfig{Rules: []PromotionRuleConfig{
+			{ID: "welcome", Trigger: "registration", Bonus: "100"},
+			{ID: "first-x2", Trigger: "order_processed", Multiplier: "2", FirstOrder: true},
+		}}
+		assert.NoError(t, cfg.validate())
+	})
+
+	t.Run("DuplicateRule", func(t *testing.T) {
+		cfg := &PromotionsConfig{Rules: []PromotionRuleConfig{
+			{ID: "welcome", Trigger: "registration", Bonus: "100"},
+			{ID: "welcome", Trigger: "registration", Bonus: "200"},
+		}}
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrInvalidOption))
+			assert.Contains(t, err.Error(), "promotions.rules[1].id")
+		}
+	})
+}
+
+func TestValidate_ReferralsConfig(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		cfg := &ReferralsConfig{Interval: time.Minute, ReferrerBonus: "100", ReferredBonus: "0", Cap: 10}
+		assert.NoError(t, cfg.validate())
+	})
+
+	t.Run("BadBonus", func(t *testing.T) {
+		for _, bonus := range []string{"", "ten", "-1"} {
+			cfg := &ReferralsConfig{Interval: time.Minute, ReferrerBonus: "100", ReferredBonus: bonus}
+			err := cfg.validate()
+			if assert.Error(t, err, bonus) {
+				assert.ErrorAs(t, err, new(ErrInvalidOption))
+				assert.Contains(t, err.Error(), "referrals.referred_bonus")
+			}
+		}
+	})
+
+	t.Run("NegativeCap", func(t *testing.T) {
+		cfg := &ReferralsConfig{ReferrerBonus: "100", ReferredBonus: "50", Cap: -1}
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrInvalidOption))
+			assert.Contains(t, err.Error(), "referrals.cap")
+		}
+	})
+}
+
+func TestValidate_AccrualSyncConfig(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		cfg := &AccrualSyncConfig{Interval: time.Second, BatchSize: 100}
+		assert.NoError(t, cfg.validate())
+	})
+
+	t.Run("NegativeInterval", func(t *testing.T) {
+		cfg := &AccrualSyncConfig{Interval: -time.Second, BatchSize: 100}
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrInvalidOption))
+			assert.Contains(t, err.Error(), "accrual_sync.interval")
+		}
+	})
+
+	t.Run("NoBatchSize", func(t *testing.T) {
+		cfg := &AccrualSyncConfig{Interval: time.Second}
+		err := cfg.validate()
+		if assert.Error(t, err) {
+			assert.ErrorAs(t, err, new(ErrInvalidOption))
+			assert.Contains(t, err.Error(), "accrual_sync.batch_size")
+		}
+	})
+}
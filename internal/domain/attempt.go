@@ -0,0 +1,18 @@
+package domain
+
+import "time"
+
+// AttemptCounter counts attempts under a key, e.g. the failed logins of
+// a user or the registrations from an IP address, in a fixed window that
+// starts with the first attempt.
+type AttemptCounter struct {
+	Key          string
+	Count        int
+	WindowStart  time.Time
+	BlockedUntil time.Time
+}
+
+// Blocked reports whether attempts are refused at now.
+func (c AttemptCounter) Blocked(now time.Time) bool {
+	return now.Before(c.BlockedUntil)
+}
@@ -0,0 +1,80 @@
+package domain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// AuditEntry is a record of the audit log. Entries are chained: each one
+// holds the hash of the previous one, so a change to a past entry breaks
+// the hashes of all entries that follow.
+type AuditEntry struct {
+	ID        int64
+	CreatedAt time.Time
+	// Actor did Action to Target: a user ID, an operator or "system".
+	Actor    string
+	Action   string
+	Target   string
+	Metadata map[string]string
+	// PrevHash is the Hash of the previous entry, empty for the first one.
+	PrevHash string
+	Hash     string
+}
+
+// WithMetadata returns a copy of the entry with metadata added to its
+// own.
+func (e AuditEntry) WithMetadata(metadata map[string]string) AuditEntry {
+	merged := make(map[string]string, len(e.Metadata)+len(metadata))
+	for k, v := range e.Metadata {
+		merged[k] = v
+	}
+	for k, v := range metadata {
+		merged[k] = v
+	}
+	e.Metadata = merged
+	return e
+}
+
+// ComputeHash returns the hash of the entry: the SHA-256 of its fields
+// and PrevHash. The ID is left out, the chain orders the entries.
+func (e AuditEntry) ComputeHash() string {
+	metadata := e.Metadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+
+	// Map keys are sorted by encoding/json, the encoding is canonical.
+	b, _ := json.Marshal(struct {
+		PrevHash  string            `json:"prev_hash"`
+		CreatedAt string            `json:"created_at"`
+		Actor     string            `json:"actor"`
+		Action    string            `json:"action"`
+		Target    string            `json:"target"`
+		Metadata  map[string]string `json:"metadata"`
+	}{
+		PrevHash:  e.PrevHash,
+		CreatedAt: e.CreatedAt.UTC().Format(time.RFC3339Nano),
+		Actor:     e.Actor,
+		Action:    e.Action,
+		Target:    e.Target,
+		Metadata:  metadata,
+	})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditQuery selects audit entries, in ID order. Zero fields do not
+// filter.
+type AuditQuery struct {
+	Actor  string
+	Action string
+	Target string
+	// From and To bound CreatedAt, To is exclusive.
+	From time.Time
+	To   time.Time
+	// AfterID selects the entries after the one with this ID.
+	AfterID int64
+	Limit   int
+}
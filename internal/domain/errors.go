@@ -0,0 +1,91 @@
+// Package domain holds the business entities of the loyalty system and
+// the errors its operations may fail with.
+package domain
+
+// Error is a domain error with a stable machine-readable code.
+// Handlers translate it to an HTTP status, see handlers.WriteError.
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is reports whether target is a domain error with the same code,
+// so errors made by WithMessage still match the base error.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// WithMessage returns a copy of the error with a more specific message.
+func (e *Error) WithMessage(msg string) *Error {
+	return &Error{Code: e.Code, Message: msg}
+}
+
+var (
+	// ErrBadRequest is returned when a request is malformed.
+	ErrBadRequest = &Error{Code: "bad_request", Message: "bad request"}
+	// ErrUnauthorized is returned when a request needs an authenticated user.
+	ErrUnauthorized = &Error{Code: "unauthorized", Message: "authentication required"}
+	// ErrForbidden is returned when the authenticated user lacks the
+	// role a route requires.
+	ErrForbidden = &Error{Code: "forbidden", Message: "access denied"}
+	// ErrNotFound is returned when the requested resource does not exist
+	// or belongs to another user.
+	ErrNotFound = &Error{Code: "not_found", Message: "not found"}
+	// ErrInvalidRefreshToken is returned when a refresh token is unknown,
+	// already used or belongs to an ended session.
+	ErrInvalidRefreshToken = &Error{Code: "invalid_refresh_token", Message: "invalid refresh token"}
+	// ErrRefreshTokenReused is returned when a refresh token is used
+	// after it has been rotated.
+	ErrRefreshTokenReused = &Error{Code: "refresh_token_reused", Message: "refresh token was already used, the session is revoked"}
+	// ErrLoginTaken is returned when a user registers with a login that
+	// already exists.
+	ErrLoginTaken = &Error{Code: "login_taken", Message: "login is already taken"}
+	// ErrInvalidCredentials is returned when the login/password pair does not match.
+	ErrInvalidCredentials = &Error{Code: "invalid_credentials", Message: "invalid login or password"}
+	// ErrWeakPassword is returned when a new password breaks the password policy.
+	ErrWeakPassword = &Error{Code: "weak_password", Message: "password is too weak"}
+	// ErrWrongPassword is returned when the current password given to
+	// change it does not match.
+	ErrWrongPassword = &Error{Code: "wrong_password", Message: "current password is wrong"}
+	// ErrTooManyAttempts is returned when attempts are refused for a while
+	// after too many failures or requests.
+	ErrTooManyAttempts = &Error{Code: "too_many_attempts", Message: "too many attempts, try again later"}
+	// ErrUserBlocked is returned when a blocked user logs in.
+	ErrUserBlocked = &Error{Code: "user_blocked", Message: "user is blocked"}
+	// ErrOrderAlreadyProcessed is returned when an order that was credited
+	// is queued for another accrual check.
+	ErrOrderAlreadyProcessed = &Error{Code: "order_already_processed", Message: "order has already been processed"}
+	// ErrInsufficientFunds is returned when a withdrawal exceeds the current balance.
+	ErrInsufficientFunds = &Error{Code: "insufficient_funds", Message: "insufficient funds"}
+	// ErrOrderOwnedByOther is returned when an order number has already been
+	// uploaded by another user.
+	ErrOrderOwnedByOther = &Error{Code: "order_owned_by_other", Message: "order number has already been uploaded by another user"}
+	// ErrInvalidOrderNumber is returned when an order number fails the Luhn check.
+	ErrInvalidOrderNumber = &Error{Code: "invalid_order_number", Message: "invalid order number"}
+	// ErrOrderAlreadyPaid is returned when points have already been withdrawn
+	// for the order number.
+	ErrOrderAlreadyPaid = &Error{Code: "order_already_paid", Message: "points have already been withdrawn for this order"}
+	// ErrAlreadyRefunded is returned when the withdrawal for an order
+	// number has already been refunded.
+	ErrAlreadyRefunded = &Error{Code: "already_refunded", Message: "the withdrawal for this order has already been refunded"}
+	// ErrRequestTooLarge is returned when a request body exceeds the
+	// size the service reads.
+	ErrRequestTooLarge = &Error{Code: "request_too_large", Message: "request body is too large"}
+	// ErrUnsupportedEncoding is returned for a request body in a
+	// Content-Encoding the service does not decode.
+	ErrUnsupportedEncoding = &Error{Code: "unsupported_encoding", Message: "unsupported content encoding"}
+	// ErrIdempotencyKeyReused is returned when an Idempotency-Key comes
+	// back with a different request.
+	ErrIdempotencyKeyReused = &Error{Code: "idempotency_key_reused", Message: "idempotency key was used with a different request"}
+	// ErrIdempotencyKeyInFlight is returned when a request with the same
+	// Idempotency-Key is still being handled.
+	ErrIdempotencyKeyInFlight = &Error{Code: "idempotency_key_in_flight", Message: "a request with this idempotency key is in progress"}
+	// ErrUnknownReferralCode is returned when no user has the referral
+	// code given at registration.
+	ErrUnknownReferralCode = &Error{Code: "unknown_referral_code", Message: "unknown referral code"}
+)
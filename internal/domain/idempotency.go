@@ -0,0 +1,24 @@
+package domain
+
+import "time"
+
+// IdempotencyRecord is the first response to a request carrying an
+// Idempotency-Key, replayed when the request is retried. StatusCode is
+// zero while the first request is still being handled. UserID is the
+// owner of the key: the ID of a user, or an operator prefixed with
+// "operator:".
+type IdempotencyRecord struct {
+	UserID      string
+	Key         string
+	RequestHash string
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+// Completed reports whether the response has been recorded.
+func (r IdempotencyRecord) Completed() bool {
+	return r.StatusCode != 0
+}
@@ -0,0 +1,190 @@
+package domain
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/money"
+)
+
+// EntryKind is the kind of a ledger entry.
+type EntryKind string
+
+const (
+	// EntryAccrual credits the accrual of a processed order.
+	EntryAccrual EntryKind = "accrual"
+	// EntryWithdrawal debits points spent on a new order.
+	EntryWithdrawal EntryKind = "withdrawal"
+	// EntryCorrection is a change made by support or by reconciliation,
+	// either way. Corrections of an accrual carry the order number.
+	EntryCorrection EntryKind = "correction"
+	// EntryExpiry debits the unspent points of a credit lot that expired.
+	// It carries the order number of the lot, if any.
+	EntryExpiry EntryKind = "expiry"
+	// EntryRefund credits back a withdrawal whose order was cancelled. It
+	// carries the order number of the withdrawal, and gives the points
+	// back to the credit lots they were spent from.
+	EntryRefund EntryKind = "refund"
+	// EntryBonus credits a promotion. It carries the ID of the rule that
+	// granted it, and the order number if an order earned it.
+	EntryBonus EntryKind = "bonus"
+)
+
+// LedgerEntry is an append-only change of a user's balance.
+// Credits have a positive Amount, debits a negative one.
+type LedgerEntry struct {
+	ID          int64
+	UserID      string
+	Kind        EntryKind
+	OrderNumber string
+	Amount      money.Amount
+	CreatedAt   time.Time
+	// Reason and Operator explain manual entries: why they were made and
+	// by whom.
+	Reason   string
+	Operator string
+	// RuleID is the promotion rule of a bonus.
+	RuleID string
+}
+
+// Correction is a balance change requested by support, or made by
+// reconciliation to fix the accrual of OrderNumber.
+type Correction struct {
+	UserID      string
+	OrderNumber string
+	Amount      money.Amount
+	Reason      string
+	Operator    string
+	// Audit, if not nil, is appended to the audit log along with the
+	// correction, its metadata holding the ID of the entry as entry_id.
+	Audit *AuditEntry
+}
+
+// Bonus is a promotion granted to a user by a rule, for an order or for
+// the user alone if OrderNumber is empty.
+type Bonus struct {
+	UserID      string
+	RuleID      string
+	OrderNumber string
+	Amount      money.Amount
+	Reason      string
+	// OncePerUser grants the bonus only if the rule granted none to the
+	// user yet, for whatever order.
+	OncePerUser bool
+	// FirstOrder grants the bonus of an order only if no other order of
+	// the user is PROCESSED.
+	FirstOrder bool
+}
+
+// Refund is the reversal of the withdrawal for OrderNumber, requested by
+// Operator.
+type Refund struct {
+	OrderNumber string
+	Reason      string
+	Operator    string
+	// Audit, if not nil, is appended to the audit log along with the
+	// refund, its metadata holding the user_id, amount and entry_id of
+	// the entry.
+	Audit *AuditEntry
+}
+
+// Balance is the state of a user's account. Withdrawn is the sum of all
+// the withdrawals, refunded or not, and Refunded what the refunds gave
+// back.
+type Balance struct {
+	Current   money.Amount
+	Withdrawn money.Amount
+	Refunded  money.Amount
+}
+
+// Valid reports whether the balance can result from a ledger: no amount
+// is negative and no more is refunded than withdrawn.
+func (b Balance) Valid() bool {
+	return b.Current >= 0 && b.Withdrawn >= 0 && b.Refunded >= 0 && b.Refunded <= b.Withdrawn
+}
+
+// Add returns the sum of the balances.
+func (b Balance) Add(other Balance) Balance {
+	return Balance{
+		Current:   b.Current + other.Current,
+		Withdrawn: b.Withdrawn + other.Withdrawn,
+		Refunded:  b.Refunded + other.Refunded,
+	}
+}
+
+// Apply adds the entry to the balance.
+func (b Balance) Apply(e LedgerEntry) Balance {
+	b.Current += e.Amount
+	switch e.Kind {
+	case EntryWithdrawal:
+		b.Withdrawn -= e.Amount
+	case EntryRefund:
+		b.Refunded += e.Amount
+	}
+	return b
+}
+
+// BalanceSnapshot is the balance of a user made of the ledger entries up
+// to LastEntryID. The entries after it, the tail, complete the balance.
+type BalanceSnapshot struct {
+	UserID      string
+	Balance     Balance
+	LastEntryID int64
+	// EntryCount is how many entries of the user make the snapshot.
+	EntryCount int64
+	UpdatedAt  time.Time
+}
+
+// LedgerTail is the ledger of a user next to its snapshot.
+type LedgerTail struct {
+	// Balance is made of the entries after the snapshot.
+	Balance Balance
+	// Covered is how many entries of the user the ledger holds up to the
+	// LastEntryID of the snapshot. It differs from EntryCount when the
+	// snapshot misses entries or counts entries it should not.
+	Covered int64
+}
+
+// Matches reports whether the snapshot is consistent with the tail: it
+// covers the entries it should and adds up to a valid balance.
+func (s BalanceSnapshot) Matches(tail LedgerTail) bool {
+	return s.EntryCount == tail.Covered && s.Balance.Valid() && s.Balance.Add(tail.Balance).Valid()
+}
+
+// CreditLot is the points of a credit entry not spent yet. Debits spend
+// the oldest lots first, and the unspent points of a lot expire at once.
+// A refund gives the points of its withdrawal back to the lots they were
+// spent from, so refunded points keep their expiry.
+type CreditLot struct {
+	EntryID     int64
+	UserID      string
+	OrderNumber string
+	Amount      money.Amount
+	Remaining   money.Amount
+	CreatedAt   time.Time
+}
+
+// NewExpiry returns the entry expiring the unspent points of the lot.
+func NewExpiry(lot CreditLot) LedgerEntry {
+	return LedgerEntry{
+		UserID:      lot.UserID,
+		Kind:        EntryExpiry,
+		OrderNumber: lot.OrderNumber,
+		Amount:      -lot.Remaining,
+		Reason:      fmt.Sprintf("points of entry %d expired", lot.EntryID),
+	}
+}
+
+// Withdrawal is points spent on a new order.
+type Withdrawal struct {
+	Order       string
+	Sum         money.Amount
+	ProcessedAt time.Time
+	// RefundedAt is when the withdrawal was refunded, zero if it was not.
+	RefundedAt time.Time
+}
+
+// Refunded reports whether the withdrawal was refunded.
+func (w Withdrawal) Refunded() bool {
+	return !w.RefundedAt.IsZero()
+}
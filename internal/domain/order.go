@@ -0,0 +1,133 @@
+package domain
+
+import (
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/money"
+)
+
+// OrderStatus is the processing status of an uploaded order.
+type OrderStatus string
+
+const (
+	OrderStatusNew        OrderStatus = "NEW"
+	OrderStatusProcessing OrderStatus = "PROCESSING"
+	OrderStatusInvalid    OrderStatus = "INVALID"
+	OrderStatusProcessed  OrderStatus = "PROCESSED"
+)
+
+// Valid reports whether s is one of the known statuses.
+func (s OrderStatus) Valid() bool {
+	switch s {
+	case OrderStatusNew, OrderStatusProcessing, OrderStatusInvalid, OrderStatusProcessed:
+		return true
+	}
+	return false
+}
+
+// Final reports whether the status can no longer change.
+func (s OrderStatus) Final() bool {
+	return s == OrderStatusInvalid || s == OrderStatusProcessed
+}
+
+// ValidOrderNumber reports whether number is a sequence of digits
+// passing the Luhn check.
+func ValidOrderNumber(number string) bool {
+	if number == "" {
+		return false
+	}
+
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			return false
+		}
+		d := int(c - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// Order is an order number uploaded by a user.
+type Order struct {
+	Number     string
+	UserID     string
+	Status     OrderStatus
+	Accrual    money.Amount
+	UploadedAt time.Time
+}
+
+// StatusUpdate moves an order to Status and grants what its processing
+// earns.
+type StatusUpdate struct {
+	Number  string
+	Status  OrderStatus
+	Accrual money.Amount
+	// Bonuses are granted to the user of the order along with the update
+	// if it moves the order to PROCESSED. Their UserID and OrderNumber
+	// are set then.
+	Bonuses []Bonus
+}
+
+// OrderCursor points at an order in the (UploadedAt, Number) ordering
+// used to list orders.
+type OrderCursor struct {
+	UploadedAt time.Time
+	Number     string
+}
+
+// CursorOf returns the cursor pointing at o.
+func CursorOf(o Order) OrderCursor {
+	return OrderCursor{UploadedAt: o.UploadedAt, Number: o.Number}
+}
+
+// OrderQuery selects orders, oldest first.
+// The zero value selects all of them, as SPECIFICATION.md requires.
+type OrderQuery struct {
+	// Limit is the page size, zero means no limit.
+	Limit int
+	// After skips the orders up to and including the cursor.
+	After *OrderCursor
+	// Statuses keeps only the orders in one of the statuses, if not empty.
+	Statuses []OrderStatus
+	// UploadedFrom and UploadedTo bound UploadedAt, inclusive and exclusive
+	// respectively. Zero values leave the range open.
+	UploadedFrom time.Time
+	UploadedTo   time.Time
+}
+
+// Match reports whether o satisfies the filters of q, ignoring Limit.
+func (q OrderQuery) Match(o Order) bool {
+	if q.After != nil {
+		if o.UploadedAt.Before(q.After.UploadedAt) {
+			return false
+		}
+		if o.UploadedAt.Equal(q.After.UploadedAt) && o.Number <= q.After.Number {
+			return false
+		}
+	}
+	if !q.UploadedFrom.IsZero() && o.UploadedAt.Before(q.UploadedFrom) {
+		return false
+	}
+	if !q.UploadedTo.IsZero() && !o.UploadedAt.Before(q.UploadedTo) {
+		return false
+	}
+	if len(q.Statuses) == 0 {
+		return true
+	}
+	for _, s := range q.Statuses {
+		if o.Status == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+package domain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderQuery_Match(t *testing.T) {
+	at := time.Date(2020, 12, 10, 15, 0, 0, 0, time.UTC)
+	o := Order{Number: "5", Status: OrderStatusProcessed, UploadedAt: at}
+
+	assert.True(t, OrderQuery{}.Match(o))
+	assert.False(t, OrderQuery{After: &OrderCursor{UploadedAt: at, Number: "5"}}.Match(o))
+	assert.True(t, OrderQuery{After: &OrderCursor{UploadedAt: at, Number: "4"}}.Match(o))
+	assert.False(t, OrderQuery{Statuses: []OrderStatus{OrderStatusNew}}.Match(o))
+	assert.False(t, OrderQuery{UploadedTo: at}.Match(o))
+	assert.True(t, OrderQuery{UploadedFrom: at}.Match(o))
+}
+
+func TestValidOrderNumber(t *testing.T) {
+	for _, n := range []string{"12345678903", "2377225624", "79927398713", "0"} {
+		assert.True(t, ValidOrderNumber(n), n)
+	}
+	for _, n := range []string{"", "12345678904", "1234a", " 12345678903", "-0"} {
+		assert.False(t, ValidOrderNumber(n), n)
+	}
+}
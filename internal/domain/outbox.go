@@ -0,0 +1,127 @@
+package domain
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/money"
+)
+
+// EventType is the type of an outbox event.
+type EventType string
+
+const (
+	// EventBalanceCredited is emitted when an accrual or a bonus is credited.
+	EventBalanceCredited EventType = "balance.credited"
+	// EventBalanceWithdrawn is emitted when points are withdrawn.
+	EventBalanceWithdrawn EventType = "balance.withdrawn"
+	// EventBalanceCorrected is emitted when support corrects a balance.
+	EventBalanceCorrected EventType = "balance.corrected"
+	// EventBalanceExpired is emitted when unspent points expire.
+	EventBalanceExpired EventType = "balance.expired"
+	// EventBalanceRefunded is emitted when a withdrawal is refunded.
+	EventBalanceRefunded EventType = "balance.refunded"
+	// EventOrderProcessing is emitted when the accrual system starts
+	// processing an order.
+	EventOrderProcessing EventType = "order.processing"
+	// EventOrderProcessed is emitted when an order reaches PROCESSED.
+	EventOrderProcessed EventType = "order.processed"
+	// EventOrderInvalid is emitted when an order reaches INVALID.
+	EventOrderInvalid EventType = "order.invalid"
+)
+
+// OutboxEvent is a state change recorded for other systems, in the same
+// transaction as the change itself. Events of a user are delivered in ID order.
+type OutboxEvent struct {
+	ID            int64
+	UserID        string
+	Type          EventType
+	Payload       json.RawMessage
+	CreatedAt     time.Time
+	Attempts      int
+	NextAttemptAt time.Time
+}
+
+// LedgerEventPayload is the payload of the balance events.
+type LedgerEventPayload struct {
+	EntryID int64        `json:"entry_id"`
+	Order   string       `json:"order,omitempty"`
+	Amount  money.Amount `json:"amount"`
+	Reason  string       `json:"reason,omitempty"`
+	Rule    string       `json:"rule,omitempty"`
+}
+
+// NewLedgerEvent returns the outbox event announcing the ledger entry.
+// The entry must already have its ID.
+func NewLedgerEvent(e LedgerEntry) OutboxEvent {
+	eventType := EventBalanceCredited
+	switch e.Kind {
+	case EntryWithdrawal:
+		eventType = EventBalanceWithdrawn
+	case EntryCorrection:
+		eventType = EventBalanceCorrected
+	case EntryExpiry:
+		eventType = EventBalanceExpired
+	case EntryRefund:
+		eventType = EventBalanceRefunded
+	}
+
+	payload, _ := json.Marshal(LedgerEventPayload{
+		EntryID: e.ID,
+		Order:   e.OrderNumber,
+		Amount:  e.Amount,
+		Reason:  e.Reason,
+		Rule:    e.RuleID,
+	})
+
+	return OutboxEvent{
+		UserID:    e.UserID,
+		Type:      eventType,
+		Payload:   payload,
+		CreatedAt: e.CreatedAt,
+	}
+}
+
+// OrderEventPayload is the payload of the order events.
+type OrderEventPayload struct {
+	Order   string       `json:"order"`
+	Status  OrderStatus  `json:"status"`
+	Accrual money.Amount `json:"accrual,omitempty"`
+}
+
+// OrderEvent returns the event type and payload announcing that the
+// order moved to status. It returns false for NEW, which is not a change.
+func OrderEvent(number string, status OrderStatus, accrual money.Amount) (EventType, json.RawMessage, bool) {
+	var event EventType
+	switch status {
+	case OrderStatusProcessing:
+		event = EventOrderProcessing
+		accrual = 0
+	case OrderStatusProcessed:
+		event = EventOrderProcessed
+	case OrderStatusInvalid:
+		event = EventOrderInvalid
+		accrual = 0
+	default:
+		return "", nil, false
+	}
+
+	payload, _ := json.Marshal(OrderEventPayload{Order: number, Status: status, Accrual: accrual})
+	return event, payload, true
+}
+
+// NewOrderEvent returns the outbox event announcing that the user's
+// order moved to status, see OrderEvent.
+func NewOrderEvent(userID, number string, status OrderStatus, accrual money.Amount) (OutboxEvent, bool) {
+	eventType, payload, ok := OrderEvent(number, status, accrual)
+	if !ok {
+		return OutboxEvent{}, false
+	}
+
+	return OutboxEvent{
+		UserID:    userID,
+		Type:      eventType,
+		Payload:   payload,
+		CreatedAt: time.Now(),
+	}, true
+}
@@ -0,0 +1,78 @@
+package domain
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/money"
+)
+
+// ReferralRuleID is the rule ID of the bonuses granted for referrals.
+const ReferralRuleID = "referral"
+
+// ReferralStatus is the state of a referral.
+type ReferralStatus string
+
+const (
+	// ReferralPending waits for the first PROCESSED order of the referred
+	// user.
+	ReferralPending ReferralStatus = "PENDING"
+	// ReferralRewarded granted the bonuses to both users.
+	ReferralRewarded ReferralStatus = "REWARDED"
+	// ReferralCapped reached its first order after the referrer had been
+	// rewarded for as many referrals as allowed, so no bonus was granted.
+	ReferralCapped ReferralStatus = "CAPPED"
+)
+
+// Referral is a user who registered with the referral code of another.
+// A user is referred once at most.
+type Referral struct {
+	ReferrerID    string
+	ReferredID    string
+	ReferredLogin string
+	Status        ReferralStatus
+	CreatedAt     time.Time
+	// OrderNumber is the first order of the referred user and RewardedAt
+	// when the referral left PENDING, both empty while it is pending.
+	OrderNumber string
+	RewardedAt  time.Time
+}
+
+// ReferralReward rewards the referral of ReferredID for their first
+// PROCESSED order.
+type ReferralReward struct {
+	ReferredID    string
+	OrderNumber   string
+	ReferrerBonus money.Amount
+	ReferredBonus money.Amount
+	// Cap is how many referrals of a referrer are rewarded at most,
+	// unlimited if zero.
+	Cap int
+}
+
+// Entries returns the bonus entries rewarding the referral of ref, leaving
+// out the zero bonuses.
+func (r ReferralReward) Entries(ref Referral) []LedgerEntry {
+	var entries []LedgerEntry
+	if r.ReferrerBonus > 0 {
+		entries = append(entries, LedgerEntry{
+			UserID:      ref.ReferrerID,
+			Kind:        EntryBonus,
+			OrderNumber: r.OrderNumber,
+			Amount:      r.ReferrerBonus,
+			Reason:      fmt.Sprintf("referral of user %s", ref.ReferredID),
+			RuleID:      ReferralRuleID,
+		})
+	}
+	if r.ReferredBonus > 0 {
+		entries = append(entries, LedgerEntry{
+			UserID:      ref.ReferredID,
+			Kind:        EntryBonus,
+			OrderNumber: r.OrderNumber,
+			Amount:      r.ReferredBonus,
+			Reason:      fmt.Sprintf("referred by user %s", ref.ReferrerID),
+			RuleID:      ReferralRuleID,
+		})
+	}
+	return entries
+}
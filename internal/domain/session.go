@@ -0,0 +1,29 @@
+package domain
+
+import "time"
+
+// Revocation reasons of sessions.
+const (
+	RevokedByLogout         = "logout"
+	RevokedByLogoutAll      = "logout_all"
+	RevokedByTokenReuse     = "refresh_token_reuse"
+	RevokedByPasswordChange = "password_change"
+	RevokedByBlock          = "user_blocked"
+	RevokedByRoleChange     = "role_change"
+)
+
+// Session is a login of a user. It lasts while its refresh tokens are
+// rotated before ExpiresAt and until it is revoked.
+type Session struct {
+	ID           string
+	UserID       string
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
+	RevokedAt    time.Time
+	RevokeReason string
+}
+
+// Active reports whether the session can be used at now.
+func (s Session) Active(now time.Time) bool {
+	return s.RevokedAt.IsZero() && now.Before(s.ExpiresAt)
+}
@@ -0,0 +1,66 @@
+package domain
+
+import (
+	"time"
+)
+
+// Role grants access to a group of routes.
+type Role string
+
+// Roles of users. New users are members of the loyalty program only.
+const (
+	// RoleUser is a member of the loyalty program.
+	RoleUser Role = "user"
+	// RoleSupport looks up users and handles their requests.
+	RoleSupport Role = "support"
+	// RoleAdmin also changes balances and roles.
+	RoleAdmin Role = "admin"
+	// RoleService is another system calling the internal routes.
+	RoleService Role = "service"
+)
+
+// Valid reports whether r is a known role.
+func (r Role) Valid() bool {
+	switch r {
+	case RoleUser, RoleSupport, RoleAdmin, RoleService:
+		return true
+	}
+	return false
+}
+
+// User is a registered user of the loyalty system.
+type User struct {
+	ID           string
+	Login        string
+	PasswordHash string
+	Roles        []Role
+	CreatedAt    time.Time
+	// BlockedAt is when support blocked the user, zero if they are not.
+	BlockedAt time.Time
+}
+
+// Registration is a new user and what the sign-up grants them.
+type Registration struct {
+	Login        string
+	PasswordHash string
+	// Bonuses are granted to the user along with its creation. Their
+	// UserID is set then.
+	Bonuses []Bonus
+	// ReferrerID is the user who referred the new one, empty if none.
+	ReferrerID string
+}
+
+// Blocked reports whether the user may not log in.
+func (u User) Blocked() bool {
+	return !u.BlockedAt.IsZero()
+}
+
+// HasRole reports whether the user has the role.
+func (u User) HasRole(r Role) bool {
+	for _, role := range u.Roles {
+		if role == r {
+			return true
+		}
+	}
+	return false
+}
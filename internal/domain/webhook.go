@@ -0,0 +1,43 @@
+package domain
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// DeliveryStatus is the state of a webhook delivery.
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	DeliveryFailed    DeliveryStatus = "failed"
+)
+
+// WebhookSubscription is a URL a user wants order status changes posted to.
+// Secret signs the deliveries.
+type WebhookSubscription struct {
+	ID        string
+	UserID    string
+	URL       string
+	Secret    string
+	CreatedAt time.Time
+}
+
+// WebhookDelivery is one notification sent, or to be sent, to a subscription.
+type WebhookDelivery struct {
+	ID             int64
+	SubscriptionID string
+	UserID         string
+	URL            string
+	Secret         string
+	Event          EventType
+	Payload        json.RawMessage
+	Status         DeliveryStatus
+	Attempts       int
+	NextAttemptAt  time.Time
+	LastStatusCode int
+	LastError      string
+	CreatedAt      time.Time
+	DeliveredAt    time.Time
+}
@@ -0,0 +1,97 @@
+// Package events wakes up the streams of users whose outbox gained
+// events. It carries no data: subscribers read the events from the
+// outbox after the last ID they sent, so a missed or repeated wake-up
+// costs a query and never an event.
+package events
+
+import "sync"
+
+// Subscription receives a value on C when the user may have new events.
+// C is closed when the hub closes.
+type Subscription struct {
+	C <-chan struct{}
+
+	hub    *Hub
+	userID string
+	ch     chan struct{}
+}
+
+// Cancel stops the subscription.
+func (s *Subscription) Cancel() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+
+	subs := s.hub.subs[s.userID]
+	if _, ok := subs[s]; !ok {
+		return
+	}
+	delete(subs, s)
+	if len(subs) == 0 {
+		delete(s.hub.subs, s.userID)
+	}
+}
+
+// Hub fans the notifications of storage.Notifier out to the
+// subscriptions of this process.
+type Hub struct {
+	mu     sync.Mutex
+	subs   map[string]map[*Subscription]struct{}
+	closed bool
+}
+
+// NewHub returns an empty hub.
+func NewHub() *Hub {
+	return &Hub{subs: make(map[string]map[*Subscription]struct{})}
+}
+
+// Subscribe returns a subscription to the notifications of the user.
+// After Close it returns a subscription whose channel is closed.
+func (h *Hub) Subscribe(userID string) *Subscription {
+	ch := make(chan struct{}, 1)
+	s := &Subscription{C: ch, hub: h, userID: userID, ch: ch}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		close(ch)
+		return s
+	}
+	if h.subs[userID] == nil {
+		h.subs[userID] = make(map[*Subscription]struct{})
+	}
+	h.subs[userID][s] = struct{}{}
+	return s
+}
+
+// Notify wakes up the subscriptions of the user. It never blocks:
+// pending wake-ups are coalesced.
+func (h *Hub) Notify(userID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for s := range h.subs[userID] {
+		select {
+		case s.ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close closes every subscription so that the streams end, e.g. when
+// the server shuts down.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return
+	}
+	h.closed = true
+	for _, subs := range h.subs {
+		for s := range subs {
+			close(s.ch)
+		}
+	}
+	h.subs = nil
+}
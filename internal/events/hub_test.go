@@ -0,0 +1,44 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func received(s *Subscription) bool {
+	select {
+	case _, ok := <-s.C:
+		return ok
+	default:
+		return false
+	}
+}
+
+func TestHub(t *testing.T) {
+	h := NewHub()
+	alice := h.Subscribe("alice")
+	alice2 := h.Subscribe("alice")
+	bob := h.Subscribe("bob")
+
+	h.Notify("alice")
+	h.Notify("alice")
+	assert.True(t, received(alice))
+	assert.False(t, received(alice), "wake-ups are coalesced")
+	assert.True(t, received(alice2))
+	assert.False(t, received(bob))
+
+	alice2.Cancel()
+	alice2.Cancel()
+	h.Notify("alice")
+	assert.True(t, received(alice))
+	assert.False(t, received(alice2))
+
+	h.Close()
+	_, ok := <-bob.C
+	assert.False(t, ok)
+	_, ok = <-h.Subscribe("carol").C
+	assert.False(t, ok)
+	bob.Cancel()
+	h.Notify("bob")
+}
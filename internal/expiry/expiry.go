@@ -0,0 +1,131 @@
+// Package expiry expires the points credited longer ago than a period.
+//
+// Each credit of the ledger opens a lot, debits spend the oldest lots
+// first, and Run writes an expiry entry for what is left of the lots
+// credited before the period. Users see the lots about to expire with
+// Expiring.
+package expiry
+
+import (
+	"context"
+	"expvar"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/pkg/log"
+)
+
+// Defaults of Config.
+const (
+	DefaultSoon      = 30 * 24 * time.Hour
+	DefaultBatchSize = 1000
+)
+
+// Metrics of the expiration, published by expvar.
+var (
+	metricExpiredLots = new(expvar.Int)
+	metricLastRun     = new(expvar.Int)
+)
+
+func init() {
+	m := expvar.NewMap("points_expiration")
+	m.Set("expired_lots_total", metricExpiredLots)
+	m.Set("last_run_timestamp_seconds", metricLastRun)
+}
+
+// Config tunes the Service. Zero values select the defaults, but for
+// After.
+type Config struct {
+	// After is how long credited points last, forever if zero.
+	After time.Duration
+	// Soon is how far ahead Expiring looks.
+	Soon time.Duration
+	// BatchSize is how many lots Run expires at once.
+	BatchSize int
+}
+
+// Points are unspent points expiring at once.
+type Points struct {
+	Sum       money.Amount
+	ExpiresAt time.Time
+}
+
+// Service expires points and tells which are about to.
+type Service struct {
+	ledger storage.LedgerRepository
+	cfg    Config
+	now    func() time.Time
+}
+
+// New returns a service over the ledger.
+func New(ledger storage.LedgerRepository, cfg Config) *Service {
+	if cfg.Soon <= 0 {
+		cfg.Soon = DefaultSoon
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+
+	return &Service{ledger: ledger, cfg: cfg, now: time.Now}
+}
+
+// Enabled reports whether points expire at all.
+func (s *Service) Enabled() bool {
+	return s.cfg.After > 0
+}
+
+// Run expires the unspent points of every lot past its period. It is
+// meant for lifecycle.Periodic.
+func (s *Service) Run(ctx context.Context) error {
+	if !s.Enabled() {
+		return nil
+	}
+
+	before := s.now().Add(-s.cfg.After)
+	var total int
+	defer func() {
+		metricExpiredLots.Add(int64(total))
+		metricLastRun.Set(s.now().Unix())
+		if total > 0 {
+			log.Info(ctx, "expired points", "lots", total)
+		}
+	}()
+
+	for {
+		n, err := s.ledger.ExpireLots(ctx, before, s.cfg.BatchSize)
+		if err != nil {
+			return err
+		}
+		total += n
+		if n < s.cfg.BatchSize {
+			return nil
+		}
+	}
+}
+
+// Expiring returns the unspent points of the user expiring within Soon,
+// soonest first. Points past their period are included until Run
+// expires them.
+func (s *Service) Expiring(ctx context.Context, userID string) ([]Points, error) {
+	if !s.Enabled() {
+		return nil, nil
+	}
+
+	lots, err := s.ledger.Lots(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	horizon := s.now().Add(s.cfg.Soon)
+	var points []Points
+	for _, lot := range lots {
+		expiresAt := lot.CreatedAt.Add(s.cfg.After)
+		if expiresAt.After(horizon) {
+			// Lots are oldest first, the next ones expire later.
+			break
+		}
+		points = append(points, Points{Sum: lot.Remaining, ExpiresAt: expiresAt})
+	}
+	return points, nil
+}
@@ -0,0 +1,76 @@
+package expiry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/storage/memory"
+)
+
+func TestService(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+	alice, err := s.Users.Create(ctx, "alice", "hash")
+	require.NoError(t, err)
+	// The withdrawal spends the oldest lot first, so the order matters.
+	for _, order := range []struct {
+		number  string
+		accrual money.Amount
+	}{
+		{"12345678903", money.FromUnits(500)},
+		{"79927398713", money.FromUnits(100)},
+	} {
+		_, err := s.Orders.Create(ctx, alice.ID, order.number)
+		require.NoError(t, err)
+		require.NoError(t, s.Orders.UpdateStatus(ctx, order.number, domain.OrderStatusProcessed, order.accrual))
+	}
+	require.NoError(t, s.Ledger.Withdraw(ctx, alice.ID, "2377225624", money.FromUnits(450), nil))
+
+	t.Run("Disabled", func(t *testing.T) {
+		svc := New(s.Ledger, Config{})
+		svc.now = func() time.Time { return time.Now().Add(24 * time.Hour) }
+		assert.False(t, svc.Enabled())
+		require.NoError(t, svc.Run(ctx))
+
+		points, err := svc.Expiring(ctx, alice.ID)
+		require.NoError(t, err)
+		assert.Empty(t, points)
+	})
+
+	const year = 365 * 24 * time.Hour
+	svc := New(s.Ledger, Config{After: year, BatchSize: 1})
+
+	t.Run("Expiring", func(t *testing.T) {
+		points, err := svc.Expiring(ctx, alice.ID)
+		require.NoError(t, err)
+		assert.Empty(t, points)
+
+		svc.now = func() time.Time { return time.Now().Add(year - 24*time.Hour) }
+		points, err = svc.Expiring(ctx, alice.ID)
+		require.NoError(t, err)
+		require.Len(t, points, 2)
+		assert.Equal(t, money.FromUnits(50), points[0].Sum)
+		assert.Equal(t, money.FromUnits(100), points[1].Sum)
+		assert.True(t, points[0].ExpiresAt.After(time.Now().Add(year-time.Minute)))
+	})
+
+	t.Run("Run", func(t *testing.T) {
+		svc.now = func() time.Time { return time.Now().Add(year - 24*time.Hour) }
+		require.NoError(t, svc.Run(ctx))
+		b, err := s.Ledger.Balance(ctx, alice.ID)
+		require.NoError(t, err)
+		assert.Equal(t, money.FromUnits(150), b.Current)
+
+		svc.now = func() time.Time { return time.Now().Add(year + time.Minute) }
+		require.NoError(t, svc.Run(ctx))
+		b, err = s.Ledger.Balance(ctx, alice.ID)
+		require.NoError(t, err)
+		assert.Equal(t, domain.Balance{Withdrawn: money.FromUnits(450)}, b)
+	})
+}
@@ -0,0 +1,423 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/paramonies/ya-gophermart/internal/audit"
+	"github.com/paramonies/ya-gophermart/internal/auth"
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+)
+
+const (
+	// AdminTokenHeader carries the token of admin requests.
+	AdminTokenHeader = "X-Admin-Token"
+	// OperatorHeader names the operator of an admin request made without
+	// a client certificate.
+	OperatorHeader = "X-Operator"
+
+	// unnamedOperator stands for an operator who used the admin token
+	// without naming themselves.
+	unnamedOperator = "admin-token"
+
+	// defaultRefundReason explains the refunds requested without a reason.
+	defaultRefundReason = "order cancelled"
+
+	defaultUsersPageSize = 50
+	maxUsersPageSize     = 1000
+)
+
+type adminUserResponse struct {
+	ID        string        `json:"id"`
+	Login     string        `json:"login"`
+	Roles     []domain.Role `json:"roles"`
+	CreatedAt time.Time     `json:"created_at"`
+	BlockedAt *time.Time    `json:"blocked_at,omitempty"`
+}
+
+type adminOrderResponse struct {
+	Number     string       `json:"number"`
+	Status     string       `json:"status"`
+	Accrual    money.Amount `json:"accrual,omitempty"`
+	UploadedAt time.Time    `json:"uploaded_at"`
+}
+
+type ledgerEntryResponse struct {
+	ID        int64        `json:"id"`
+	Kind      string       `json:"kind"`
+	Order     string       `json:"order,omitempty"`
+	Amount    money.Amount `json:"amount"`
+	CreatedAt time.Time    `json:"created_at"`
+	Reason    string       `json:"reason,omitempty"`
+	Operator  string       `json:"operator,omitempty"`
+	Rule      string       `json:"rule,omitempty"`
+}
+
+type rolesRequest struct {
+	Roles []domain.Role `json:"roles"`
+}
+
+type correctionRequest struct {
+	Amount money.Amount `json:"amount"`
+	Reason string       `json:"reason"`
+}
+
+type refundRequest struct {
+	Reason string `json:"reason"`
+}
+
+// AdminAuthenticate authenticates admin requests. A request with the
+// admin token is made by an operator with the admin role, named by the
+// X-Operator header. Other requests need a bearer access token and are
+// made by its user. The common name of a verified client certificate
+// overrides both names. Without token, only access tokens are accepted.
+func AdminAuthenticate(token string, svc *auth.Service) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var ctx context.Context
+			var operator string
+			if got, ok := r.Header[AdminTokenHeader]; ok {
+				if token == "" || len(got) != 1 || subtle.ConstantTimeCompare([]byte(got[0]), []byte(token)) != 1 {
+					WriteError(w, r, domain.ErrUnauthorized)
+					return
+				}
+				ctx = auth.NewRolesContext(r.Context(), []domain.Role{domain.RoleAdmin})
+				operator = strings.TrimSpace(r.Header.Get(OperatorHeader))
+			} else {
+				var err error
+				if ctx, err = authenticateBearer(r, svc); err != nil {
+					WriteError(w, r, err)
+					return
+				}
+				operator, _ = auth.UserIDFromContext(ctx)
+			}
+
+			if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+				operator = r.TLS.VerifiedChains[0][0].Subject.CommonName
+			}
+			if operator != "" {
+				ctx = auth.NewOperatorContext(ctx, operator)
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// SearchUsers lists the users whose login contains the login parameter.
+// The optional limit parameter caps the number of users.
+func SearchUsers(repo storage.UserRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultUsersPageSize
+		if v := r.URL.Query().Get(paramLimit); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxUsersPageSize {
+				WriteError(w, r, domain.ErrBadRequest.WithMessage(
+					fmt.Sprintf("limit must be an integer between 1 and %d", maxUsersPageSize)))
+				return
+			}
+			limit = n
+		}
+
+		users, err := repo.Search(r.Context(), r.URL.Query().Get("login"), limit)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		resp := make([]adminUserResponse, 0, len(users))
+		for _, u := range users {
+			resp = append(resp, newAdminUserResponse(u))
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// ListUserOrders lists the orders of a user. It takes the pagination and
+// filter parameters of the user's own order list.
+func ListUserOrders(users storage.UserRepository, orders storage.OrderRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseOrderQuery(r)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		userID, ok := findUser(w, r, users)
+		if !ok {
+			return
+		}
+
+		list, err := orders.ListByUser(r.Context(), userID, q)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if q.Limit > 0 && len(list) == q.Limit {
+			w.Header().Set("Link", nextOrdersLink(r, list[len(list)-1]))
+		}
+
+		resp := make([]adminOrderResponse, 0, len(list))
+		for _, o := range list {
+			resp = append(resp, adminOrderResponse{
+				Number:     o.Number,
+				Status:     string(o.Status),
+				Accrual:    o.Accrual,
+				UploadedAt: o.UploadedAt,
+			})
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// ListUserLedger lists the ledger entries of a user, oldest first.
+func ListUserLedger(users storage.UserRepository, ledger storage.LedgerRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := findUser(w, r, users)
+		if !ok {
+			return
+		}
+
+		entries, err := ledger.Entries(r.Context(), userID)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		resp := make([]ledgerEntryResponse, 0, len(entries))
+		for _, e := range entries {
+			resp = append(resp, newLedgerEntryResponse(e))
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// BlockUser blocks a user and ends their sessions.
+func BlockUser(svc *auth.Service, trail *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setBlocked(w, r, svc.Block, trail, audit.ActionBlock)
+	}
+}
+
+// UnblockUser lets a blocked user log in again.
+func UnblockUser(svc *auth.Service, trail *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setBlocked(w, r, svc.Unblock, trail, audit.ActionUnblock)
+	}
+}
+
+// SetUserRoles replaces the roles of a user, who has to log in again.
+func SetUserRoles(svc *auth.Service, trail *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req rolesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			WriteError(w, r, domain.ErrBadRequest.WithMessage("malformed JSON body"))
+			return
+		}
+		for _, role := range req.Roles {
+			if !role.Valid() {
+				WriteError(w, r, domain.ErrBadRequest.WithMessage(fmt.Sprintf("unknown role %q", role)))
+				return
+			}
+		}
+
+		userID := chi.URLParam(r, "id")
+		err := svc.SetRoles(r.Context(), userID, req.Roles)
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, r, domain.ErrNotFound.WithMessage("user not found"))
+			return
+		}
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		roles := make([]string, 0, len(req.Roles))
+		for _, role := range req.Roles {
+			roles = append(roles, string(role))
+		}
+		trail.Record(r.Context(), auditActor(r), audit.ActionSetRoles, userID,
+			map[string]string{"roles": strings.Join(roles, ",")})
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// CorrectBalance credits or debits a user by hand. The correction is a
+// ledger entry recording its reason and the operator who made it.
+func CorrectBalance(ledger storage.LedgerRepository, trail *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		operator, ok := auth.OperatorFromContext(r.Context())
+		if !ok {
+			WriteError(w, r, domain.ErrBadRequest.WithMessage(
+				"the operator must be identified by a client certificate or "+OperatorHeader))
+			return
+		}
+
+		var req correctionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			WriteError(w, r, domain.ErrBadRequest.WithMessage("malformed JSON body"))
+			return
+		}
+		req.Reason = strings.TrimSpace(req.Reason)
+		if req.Amount == 0 || req.Reason == "" {
+			WriteError(w, r, domain.ErrBadRequest.WithMessage("a non-zero amount and a reason are required"))
+			return
+		}
+
+		userID := chi.URLParam(r, "id")
+		entry, err := ledger.Correct(r.Context(), domain.Correction{
+			UserID:   userID,
+			Amount:   req.Amount,
+			Reason:   req.Reason,
+			Operator: operator,
+			Audit: trail.Entry(operator, audit.ActionCorrection, userID, map[string]string{
+				"amount": req.Amount.String(),
+				"reason": req.Reason,
+			}),
+		})
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, r, domain.ErrNotFound.WithMessage("user not found"))
+			return
+		}
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, newLedgerEntryResponse(entry))
+	}
+}
+
+// RefundWithdrawal reverses the withdrawal for the order of the request
+// path, whose order was cancelled, by a refund entry crediting its points
+// back. The body may give a reason. A withdrawal is refunded once, later
+// requests get 409.
+func RefundWithdrawal(ledger storage.LedgerRepository, trail *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req refundRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			WriteError(w, r, domain.ErrBadRequest.WithMessage("malformed JSON body"))
+			return
+		}
+		req.Reason = strings.TrimSpace(req.Reason)
+		if req.Reason == "" {
+			req.Reason = defaultRefundReason
+		}
+
+		number := chi.URLParam(r, "number")
+		operator := auditActor(r)
+		entry, err := ledger.Refund(r.Context(), domain.Refund{
+			OrderNumber: number,
+			Reason:      req.Reason,
+			Operator:    operator,
+			Audit: trail.Entry(operator, audit.ActionRefund, number, map[string]string{
+				"reason": req.Reason,
+			}),
+		})
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, r, domain.ErrNotFound.WithMessage("no withdrawal for this order"))
+			return
+		}
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, newLedgerEntryResponse(entry))
+	}
+}
+
+// RecheckOrder queues an order that was not credited for another accrual
+// request, the accrual sync job asks for it again on its next run.
+// PROCESSED orders are refused, their accrual is final.
+func RecheckOrder(repo storage.OrderRepository, trail *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		number := chi.URLParam(r, "number")
+		err := repo.Requeue(r.Context(), number)
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, r, domain.ErrNotFound.WithMessage("order not found"))
+			return
+		}
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		trail.Record(r.Context(), auditActor(r), audit.ActionOrderRecheck, number, nil)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// findUser returns the ID of the user of the request path. It responds
+// 404 if there is no such user.
+func findUser(w http.ResponseWriter, r *http.Request, repo storage.UserRepository) (string, bool) {
+	u, err := repo.GetByID(r.Context(), chi.URLParam(r, "id"))
+	if errors.Is(err, storage.ErrNotFound) {
+		WriteError(w, r, domain.ErrNotFound.WithMessage("user not found"))
+		return "", false
+	}
+	if err != nil {
+		WriteError(w, r, err)
+		return "", false
+	}
+	return u.ID, true
+}
+
+func setBlocked(w http.ResponseWriter, r *http.Request, set func(ctx context.Context, userID string) error,
+	trail *audit.Log, action string) {
+	userID := chi.URLParam(r, "id")
+	err := set(r.Context(), userID)
+	if errors.Is(err, storage.ErrNotFound) {
+		WriteError(w, r, domain.ErrNotFound.WithMessage("user not found"))
+		return
+	}
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	trail.Record(r.Context(), auditActor(r), action, userID, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// auditActor returns the operator of an admin request as recorded in the
+// audit log.
+func auditActor(r *http.Request) string {
+	if operator, ok := auth.OperatorFromContext(r.Context()); ok {
+		return operator
+	}
+	return unnamedOperator
+}
+
+func newAdminUserResponse(u domain.User) adminUserResponse {
+	resp := adminUserResponse{ID: u.ID, Login: u.Login, Roles: u.Roles, CreatedAt: u.CreatedAt}
+	if u.Blocked() {
+		resp.BlockedAt = &u.BlockedAt
+	}
+	return resp
+}
+
+func newLedgerEntryResponse(e domain.LedgerEntry) ledgerEntryResponse {
+	return ledgerEntryResponse{
+		ID:        e.ID,
+		Kind:      string(e.Kind),
+		Order:     e.OrderNumber,
+		Amount:    e.Amount,
+		CreatedAt: e.CreatedAt,
+		Reason:    e.Reason,
+		Operator:  e.Operator,
+		Rule:      e.RuleID,
+	}
+}
@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/audit"
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+)
+
+func TestAdmin(t *testing.T) {
+	api := newTestAPI(t)
+	s := api.store
+	ctx := context.Background()
+	alice := api.createUser("alice")
+	api.createUser("bob")
+
+	do := func(operator, method, target, body string) *httptest.ResponseRecorder {
+		r := newRequest(method, target, strings.NewReader(body))
+		r.Header.Set(AdminTokenHeader, testAdminToken)
+		if operator != "" {
+			r.Header.Set(OperatorHeader, operator)
+		}
+		return api.do("", r)
+	}
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		w := api.do("", newRequest(http.MethodGet, "/admin/users", nil))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		r := newRequest(http.MethodGet, "/admin/users", nil)
+		r.Header.Set(AdminTokenHeader, "wrong")
+		assert.Equal(t, http.StatusUnauthorized, api.do("", r).Code)
+
+		// Plain users are authenticated but not allowed in.
+		assert.Equal(t, http.StatusForbidden, api.do(alice.ID, newRequest(http.MethodGet, "/admin/users", nil)).Code)
+	})
+
+	t.Run("SearchUsers", func(t *testing.T) {
+		w := do("", http.MethodGet, "/admin/users?login=LI", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		var users []adminUserResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &users))
+		require.Len(t, users, 1)
+		assert.Equal(t, alice.ID, users[0].ID)
+		assert.Nil(t, users[0].BlockedAt)
+		assert.Equal(t, []domain.Role{domain.RoleUser}, users[0].Roles)
+
+		assert.Equal(t, http.StatusBadRequest, do("", http.MethodGet, "/admin/users?limit=0", "").Code)
+	})
+
+	t.Run("Orders", func(t *testing.T) {
+		_, err := s.Orders.Create(ctx, alice.ID, "12345678903")
+		require.NoError(t, err)
+		require.NoError(t, s.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusInvalid, 0))
+
+		w := do("", http.MethodGet, "/admin/users/"+alice.ID+"/orders", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		var orders []adminOrderResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &orders))
+		require.Len(t, orders, 1)
+		assert.Equal(t, "INVALID", orders[0].Status)
+		assert.Equal(t, http.StatusNotFound, do("", http.MethodGet, "/admin/users/unknown/orders", "").Code)
+
+		assert.Equal(t, http.StatusAccepted, do("", http.MethodPost, "/admin/orders/12345678903/recheck", "").Code)
+		o, err := s.Orders.Get(ctx, "12345678903")
+		require.NoError(t, err)
+		assert.Equal(t, domain.OrderStatusNew, o.Status)
+		assert.Equal(t, http.StatusNotFound, do("", http.MethodPost, "/admin/orders/79927398713/recheck", "").Code)
+
+		require.NoError(t, s.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessed, money.FromUnits(100)))
+		assert.Equal(t, http.StatusConflict, do("", http.MethodPost, "/admin/orders/12345678903/recheck", "").Code)
+	})
+
+	t.Run("Corrections", func(t *testing.T) {
+		target := "/admin/users/" + alice.ID + "/corrections"
+		assert.Equal(t, http.StatusBadRequest, do("", http.MethodPost, target, `{"amount":10,"reason":"goodwill"}`).Code)
+		assert.Equal(t, http.StatusBadRequest, do("carol", http.MethodPost, target, `{"amount":10}`).Code)
+		assert.Equal(t, http.StatusBadRequest, do("carol", http.MethodPost, target, `{"amount":0,"reason":"noop"}`).Code)
+		assert.Equal(t, http.StatusPaymentRequired, do("carol", http.MethodPost, target, `{"amount":-1000,"reason":"typo"}`).Code)
+		assert.Equal(t, http.StatusNotFound,
+			do("carol", http.MethodPost, "/admin/users/unknown/corrections", `{"amount":10,"reason":"goodwill"}`).Code)
+
+		w := do("carol", http.MethodPost, target, `{"amount":-40,"reason":"duplicate accrual"}`)
+		require.Equal(t, http.StatusCreated, w.Code)
+		var entry ledgerEntryResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &entry))
+		assert.Equal(t, "correction", entry.Kind)
+		assert.Equal(t, "carol", entry.Operator)
+
+		w = do("", http.MethodGet, "/admin/users/"+alice.ID+"/ledger", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		var ledger []ledgerEntryResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ledger))
+		require.Len(t, ledger, 2)
+		assert.Equal(t, "duplicate accrual", ledger[1].Reason)
+
+		b, err := s.Ledger.Balance(ctx, alice.ID)
+		require.NoError(t, err)
+		assert.Equal(t, money.FromUnits(60), b.Current)
+	})
+
+	t.Run("Block", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, api.do(alice.ID, newRequest(http.MethodGet, "/api/user/webhooks", nil)).Code)
+		assert.Equal(t, http.StatusNoContent, do("", http.MethodPost, "/admin/users/"+alice.ID+"/block", "").Code)
+		assert.Equal(t, http.StatusUnauthorized, api.do(alice.ID, newRequest(http.MethodGet, "/api/user/webhooks", nil)).Code)
+
+		w := do("", http.MethodGet, "/admin/users?login=alice", "")
+		assert.Contains(t, w.Body.String(), "blocked_at")
+
+		assert.Equal(t, http.StatusNoContent, do("", http.MethodPost, "/admin/users/"+alice.ID+"/unblock", "").Code)
+		assert.Equal(t, http.StatusNotFound, do("", http.MethodPost, "/admin/users/unknown/block", "").Code)
+	})
+}
+
+func TestAdmin_Roles(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+	alice := api.createUser("alice")
+	support := api.createUser("support")
+	admin := api.createUser("admin")
+	service := api.createUser("service")
+	require.NoError(t, api.store.Users.SetRoles(ctx, support.ID, []domain.Role{domain.RoleSupport}))
+	require.NoError(t, api.store.Users.SetRoles(ctx, admin.ID, []domain.Role{domain.RoleUser, domain.RoleAdmin}))
+	require.NoError(t, api.store.Users.SetRoles(ctx, service.ID, []domain.Role{domain.RoleService}))
+
+	do := func(userID, method, target, body string) int {
+		return api.do(userID, newRequest(method, target, strings.NewReader(body))).Code
+	}
+
+	assert.Equal(t, http.StatusOK, do(support.ID, http.MethodGet, "/admin/users", ""))
+	assert.Equal(t, http.StatusOK, do(admin.ID, http.MethodGet, "/admin/users", ""))
+	assert.Equal(t, http.StatusForbidden, do(service.ID, http.MethodGet, "/admin/users", ""))
+
+	// Staff accounts are not members of the loyalty program.
+	assert.Equal(t, http.StatusForbidden, do(support.ID, http.MethodGet, "/api/user/webhooks", ""))
+	assert.Equal(t, http.StatusNoContent, do(admin.ID, http.MethodGet, "/api/user/webhooks", ""))
+
+	corrections := "/admin/users/" + alice.ID + "/corrections"
+	assert.Equal(t, http.StatusForbidden, do(service.ID, http.MethodPost, corrections, `{"amount":10,"reason":"goodwill"}`))
+	assert.Equal(t, http.StatusCreated, do(admin.ID, http.MethodPost, corrections, `{"amount":10,"reason":"goodwill"}`))
+	entries, err := api.store.Ledger.Entries(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, admin.ID, entries[0].Operator)
+
+	_, err = api.store.Orders.Create(ctx, alice.ID, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, do(service.ID, http.MethodPost, "/admin/orders/12345678903/recheck", ""))
+
+	roles := "/admin/users/" + alice.ID + "/roles"
+	assert.Equal(t, http.StatusForbidden, do(support.ID, http.MethodPut, roles, `{"roles":["admin"]}`))
+	assert.Equal(t, http.StatusBadRequest, do(admin.ID, http.MethodPut, roles, `{"roles":["root"]}`))
+	assert.Equal(t, http.StatusNoContent, do(admin.ID, http.MethodPut, roles, `{"roles":["user","support"]}`))
+	u, err := api.store.Users.GetByID(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.True(t, u.HasRole(domain.RoleSupport))
+
+	// Routes of every authenticated user stay open to staff.
+	assert.Equal(t, http.StatusNoContent, do(support.ID, http.MethodPost, "/api/user/logout", ""))
+}
+
+func TestRefundWithdrawal(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+	alice := api.createUser("alice")
+	service := api.createUser("service")
+	require.NoError(t, api.store.Users.SetRoles(ctx, service.ID, []domain.Role{domain.RoleService}))
+	_, err := api.store.Orders.Create(ctx, alice.ID, "12345678903")
+	require.NoError(t, err)
+	require.NoError(t, api.store.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessed, money.FromUnits(500)))
+	require.NoError(t, api.store.Ledger.Withdraw(ctx, alice.ID, "2377225624", money.MustParse("100.5"), nil))
+
+	refund := func(userID, number, key, body string) *httptest.ResponseRecorder {
+		r := newRequest(http.MethodPost, "/admin/withdrawals/"+number+"/refund", strings.NewReader(body))
+		if key != "" {
+			r.Header.Set(IdempotencyKeyHeader, key)
+		}
+		return api.do(userID, r)
+	}
+
+	assert.Equal(t, http.StatusForbidden, refund(alice.ID, "2377225624", "", "").Code)
+	assert.Equal(t, http.StatusNotFound, refund(service.ID, "79927398713", "", "").Code)
+	assert.Equal(t, http.StatusBadRequest, refund(service.ID, "2377225624", "", "{").Code)
+
+	w := refund(service.ID, "2377225624", "refund-1", `{"reason":"order 2377225624 cancelled by the store"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var entry ledgerEntryResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &entry))
+	assert.Equal(t, string(domain.EntryRefund), entry.Kind)
+	assert.Equal(t, money.MustParse("100.5"), entry.Amount)
+	assert.Equal(t, service.ID, entry.Operator)
+
+	// Retries replay the refund, others are refused.
+	w = refund(service.ID, "2377225624", "refund-1", `{"reason":"order 2377225624 cancelled by the store"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "true", w.Header().Get(IdempotentReplayedHeader))
+	assert.Equal(t, http.StatusConflict, refund(service.ID, "2377225624", "refund-2", "").Code)
+	assert.Equal(t, http.StatusConflict, refund(service.ID, "2377225624", "", "").Code)
+
+	b, err := api.store.Ledger.Balance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, domain.Balance{
+		Current:   money.FromUnits(500),
+		Withdrawn: money.MustParse("100.5"),
+		Refunded:  money.MustParse("100.5"),
+	}, b)
+
+	entries, err := api.store.Audit.List(ctx, domain.AuditQuery{Action: audit.ActionRefund})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "2377225624", entries[0].Target)
+	assert.Equal(t, alice.ID, entries[0].Metadata["user_id"])
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+)
+
+const (
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+
+	paramActor  = "actor"
+	paramAction = "action"
+	paramTarget = "target"
+	paramFrom   = "from"
+	paramTo     = "to"
+)
+
+var auditQueryParams = []string{paramActor, paramAction, paramTarget, paramFrom, paramTo, paramLimit}
+
+type auditEntryResponse struct {
+	ID        int64             `json:"id"`
+	CreatedAt time.Time         `json:"created_at"`
+	Actor     string            `json:"actor"`
+	Action    string            `json:"action"`
+	Target    string            `json:"target"`
+	Metadata  map[string]string `json:"metadata"`
+	PrevHash  string            `json:"prev_hash"`
+	Hash      string            `json:"hash"`
+}
+
+// ListAudit returns the audit entries selected by the actor, action,
+// target, from and to parameters, oldest first. Pages hold limit entries;
+// the Link header points at the next one, which starts after the entry
+// ID in the after parameter.
+func ListAudit(repo storage.AuditRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseAuditQuery(r)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		entries, err := repo.List(r.Context(), q)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if len(entries) == q.Limit {
+			w.Header().Set("Link", nextAuditLink(r, entries[len(entries)-1].ID))
+		}
+
+		resp := make([]auditEntryResponse, 0, len(entries))
+		for _, e := range entries {
+			resp = append(resp, auditEntryResponse{
+				ID:        e.ID,
+				CreatedAt: e.CreatedAt,
+				Actor:     e.Actor,
+				Action:    e.Action,
+				Target:    e.Target,
+				Metadata:  e.Metadata,
+				PrevHash:  e.PrevHash,
+				Hash:      e.Hash,
+			})
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+func parseAuditQuery(r *http.Request) (domain.AuditQuery, error) {
+	values := r.URL.Query()
+	q := domain.AuditQuery{
+		Actor:  values.Get(paramActor),
+		Action: values.Get(paramAction),
+		Target: values.Get(paramTarget),
+		Limit:  defaultAuditPageSize,
+	}
+
+	if v := values.Get(paramLimit); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxAuditPageSize {
+			return q, domain.ErrBadRequest.WithMessage(
+				fmt.Sprintf("limit must be an integer between 1 and %d", maxAuditPageSize))
+		}
+		q.Limit = limit
+	}
+
+	if v := values.Get(paramAfter); v != "" {
+		after, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || after < 0 {
+			return q, domain.ErrBadRequest.WithMessage("after must be an entry ID")
+		}
+		q.AfterID = after
+	}
+
+	var err error
+	if q.From, err = parseTimeParam(values, paramFrom); err != nil {
+		return q, err
+	}
+	if q.To, err = parseTimeParam(values, paramTo); err != nil {
+		return q, err
+	}
+
+	return q, nil
+}
+
+// nextAuditLink returns the Link header pointing at the page after the
+// entry lastID, keeping the other parameters of the request.
+func nextAuditLink(r *http.Request, lastID int64) string {
+	values := url.Values{}
+	for _, name := range auditQueryParams {
+		if v, ok := r.URL.Query()[name]; ok {
+			values[name] = v
+		}
+	}
+	values.Set(paramAfter, strconv.FormatInt(lastID, 10))
+
+	next := url.URL{Path: r.URL.Path, RawQuery: values.Encode()}
+	return fmt.Sprintf(`<%s>; rel="next"`, next.String())
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/audit"
+)
+
+func TestAudit(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+
+	post := func(target, body string) *httptest.ResponseRecorder {
+		return api.do("", newRequest(http.MethodPost, target, strings.NewReader(body)))
+	}
+	list := func(query string) (*httptest.ResponseRecorder, []auditEntryResponse) {
+		r := newRequest(http.MethodGet, "/admin/audit"+query, nil)
+		r.Header.Set(AdminTokenHeader, testAdminToken)
+		w := api.do("", r)
+
+		var entries []auditEntryResponse
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+		}
+		return w, entries
+	}
+
+	require.Equal(t, http.StatusOK, post("/api/user/register", `{"login":"alice","password":"secret"}`).Code)
+	require.Equal(t, http.StatusUnauthorized, post("/api/user/login", `{"login":"alice","password":"wrong"}`).Code)
+	require.Equal(t, http.StatusOK, post("/api/user/login", `{"login":"alice","password":"secret"}`).Code)
+
+	alice, err := api.store.Users.GetByLogin(ctx, "alice")
+	require.NoError(t, err)
+	r := newRequest(http.MethodPost, "/admin/users/"+alice.ID+"/corrections", strings.NewReader(`{"amount":100,"reason":"welcome"}`))
+	r.Header.Set(AdminTokenHeader, testAdminToken)
+	r.Header.Set(OperatorHeader, "carol")
+	require.Equal(t, http.StatusCreated, api.do("", r).Code)
+	w := api.do(alice.ID, newRequest(http.MethodPost, "/api/user/balance/withdraw", strings.NewReader(`{"order":"2377225624","sum":40.5}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w, entries := list("")
+	require.Equal(t, http.StatusOK, w.Code)
+	actions := make([]string, 0, len(entries))
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+	}
+	assert.Equal(t, []string{
+		audit.ActionRegister,
+		audit.ActionLoginFailed,
+		audit.ActionLogin,
+		audit.ActionCorrection,
+		audit.ActionWithdraw,
+	}, actions)
+	assert.Equal(t, "alice", entries[1].Target)
+	assert.Equal(t, "invalid_credentials", entries[1].Metadata["reason"])
+	assert.Equal(t, "carol", entries[3].Actor)
+	assert.Equal(t, "40.5", entries[4].Metadata["sum"])
+
+	_, entries = list("?actor=carol")
+	require.Len(t, entries, 1)
+	assert.Equal(t, audit.ActionCorrection, entries[0].Action)
+
+	w, entries = list("?target=" + alice.ID + "&limit=1")
+	require.Len(t, entries, 1)
+	link := w.Header().Get("Link")
+	require.NotEmpty(t, link)
+	next := link[strings.Index(link, "<")+1 : strings.Index(link, ">")]
+	_, entries = list(strings.TrimPrefix(next, "/admin/audit"))
+	require.Len(t, entries, 1)
+	assert.Equal(t, audit.ActionLogin, entries[0].Action)
+
+	w, _ = list("?from=yesterday")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w, _ = list("?after=-1")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
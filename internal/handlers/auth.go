@@ -0,0 +1,328 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/audit"
+	"github.com/paramonies/ya-gophermart/internal/auth"
+	"github.com/paramonies/ya-gophermart/internal/bruteforce"
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/promo"
+	"github.com/paramonies/ya-gophermart/internal/referral"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/pkg/log"
+)
+
+const bearerPrefix = "Bearer "
+
+type credentialsRequest struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+	// ReferralCode is only read at registration.
+	ReferralCode string `json:"referral_code"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type tokensResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// Register creates a user and logs them in. Registrations are limited
+// per client IP by guard and recorded in trail. A user registering with
+// a referral code is referred by its owner.
+func Register(svc *auth.Service, guard *bruteforce.Guard, trail *audit.Log, promotions *promo.Engine,
+	referrals *referral.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		wait, err := guard.Register(r.Context(), ip)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if wait > 0 {
+			writeTooManyAttempts(w, r, wait)
+			return
+		}
+
+		req, ok := decodeCredentials(w, r)
+		if !ok {
+			return
+		}
+
+		var referrerID string
+		if req.ReferralCode != "" {
+			referrerID, err = referrals.Referrer(r.Context(), req.ReferralCode)
+			if err != nil {
+				WriteError(w, r, err)
+				return
+			}
+		}
+
+		reg := domain.Registration{Login: req.Login, ReferrerID: referrerID}
+		if promotions != nil {
+			reg.Bonuses = promotions.RegistrationBonuses()
+		}
+		tokens, err := svc.Register(r.Context(), reg, req.Password)
+		if errors.Is(err, storage.ErrNotFound) {
+			// The referrer was deleted since the code was looked up.
+			err = domain.ErrUnknownReferralCode
+		}
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		metadata := map[string]string{"login": req.Login, "ip": ip}
+		if referrerID != "" {
+			metadata["referrer_id"] = referrerID
+		}
+		trail.Record(r.Context(), tokens.UserID, audit.ActionRegister, tokens.UserID, metadata)
+		writeTokens(w, tokens)
+	}
+}
+
+// Login starts a session for the user. Logins and client IPs with too
+// many failures are locked out by guard. Successes and failures are
+// recorded in trail.
+func Login(svc *auth.Service, guard *bruteforce.Guard, trail *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, ok := decodeCredentials(w, r)
+		if !ok {
+			return
+		}
+
+		ip := clientIP(r)
+		wait, err := guard.CheckLogin(r.Context(), req.Login, ip)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if wait > 0 {
+			writeTooManyAttempts(w, r, wait)
+			return
+		}
+
+		tokens, err := svc.Login(r.Context(), req.Login, req.Password)
+		if errors.Is(err, domain.ErrInvalidCredentials) || errors.Is(err, domain.ErrUserBlocked) {
+			var reason *domain.Error
+			errors.As(err, &reason)
+			trail.Record(r.Context(), audit.AnonymousActor, audit.ActionLoginFailed, req.Login,
+				map[string]string{"ip": ip, "reason": reason.Code})
+		}
+		if errors.Is(err, domain.ErrInvalidCredentials) {
+			if err := guard.LoginFailed(r.Context(), req.Login, ip); err != nil {
+				WriteError(w, r, err)
+				return
+			}
+		}
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		if err := guard.LoginSucceeded(r.Context(), req.Login); err != nil {
+			log.Error(r.Context(), "failed to reset failed logins", err, "login", req.Login)
+		}
+		trail.Record(r.Context(), tokens.UserID, audit.ActionLogin, tokens.UserID, map[string]string{"ip": ip})
+		writeTokens(w, tokens)
+	}
+}
+
+// RefreshToken exchanges a refresh token for new tokens.
+func RefreshToken(svc *auth.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req refreshRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+			WriteError(w, r, domain.ErrBadRequest.WithMessage("refresh_token is required"))
+			return
+		}
+
+		tokens, err := svc.Refresh(r.Context(), req.RefreshToken)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		writeTokens(w, tokens)
+	}
+}
+
+// Logout ends the session of the request.
+func Logout(svc *auth.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionID, ok := auth.SessionIDFromContext(r.Context())
+		if !ok {
+			WriteError(w, r, domain.ErrUnauthorized)
+			return
+		}
+
+		if err := svc.Logout(r.Context(), sessionID); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// LogoutAll ends every session of the user, including the one of the request.
+func LogoutAll(svc *auth.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.UserIDFromContext(r.Context())
+		if !ok {
+			WriteError(w, r, domain.ErrUnauthorized)
+			return
+		}
+
+		if err := svc.LogoutAll(r.Context(), userID); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ChangePassword replaces the password of the user and logs out their
+// other sessions.
+func ChangePassword(svc *auth.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.UserIDFromContext(r.Context())
+		if !ok {
+			WriteError(w, r, domain.ErrUnauthorized)
+			return
+		}
+		sessionID, _ := auth.SessionIDFromContext(r.Context())
+
+		var req changePasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			WriteError(w, r, domain.ErrBadRequest.WithMessage("malformed JSON body"))
+			return
+		}
+		if req.CurrentPassword == "" || req.NewPassword == "" {
+			WriteError(w, r, domain.ErrBadRequest.WithMessage("current_password and new_password are required"))
+			return
+		}
+
+		if err := svc.ChangePassword(r.Context(), userID, sessionID, req.CurrentPassword, req.NewPassword); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Authenticate rejects requests without a valid bearer access token and
+// puts the user, session and roles of the token in the request context.
+func Authenticate(svc *auth.Service) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, err := authenticateBearer(r, svc)
+			if err != nil {
+				WriteError(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RequireRole rejects the requests of users with none of roles with 403
+// and logs them. It must run after the request is authenticated.
+func RequireRole(roles ...domain.Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			have := auth.RolesFromContext(r.Context())
+			for _, role := range have {
+				for _, allowed := range roles {
+					if role == allowed {
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
+
+			userID, _ := auth.UserIDFromContext(r.Context())
+			log.Warning(r.Context(), "access denied",
+				"user_id", userID,
+				"roles", have,
+				"required", roles,
+				"method", r.Method,
+				"path", r.URL.Path)
+			WriteError(w, r, domain.ErrForbidden)
+		})
+	}
+}
+
+func authenticateBearer(r *http.Request, svc *auth.Service) (context.Context, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, bearerPrefix) {
+		return nil, domain.ErrUnauthorized
+	}
+
+	claims, err := svc.Authenticate(r.Context(), strings.TrimPrefix(header, bearerPrefix))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := auth.NewContext(r.Context(), claims.UserID)
+	ctx = auth.NewSessionContext(ctx, claims.SessionID)
+	return auth.NewRolesContext(ctx, claims.Roles), nil
+}
+
+// writeTooManyAttempts responds with 429 and the seconds to wait in Retry-After.
+func writeTooManyAttempts(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	seconds := int64((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	WriteError(w, r, domain.ErrTooManyAttempts)
+}
+
+// clientIP returns the IP address of the client. Forwarding headers are
+// not trusted: behind a proxy, it must rewrite RemoteAddr.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func decodeCredentials(w http.ResponseWriter, r *http.Request) (credentialsRequest, bool) {
+	var req credentialsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, r, domain.ErrBadRequest.WithMessage("malformed JSON body"))
+		return req, false
+	}
+	if req.Login == "" || req.Password == "" {
+		WriteError(w, r, domain.ErrBadRequest.WithMessage("login and password are required"))
+		return req, false
+	}
+	return req, true
+}
+
+// writeTokens responds with the tokens. The access token is also sent in
+// the Authorization header, as SPECIFICATION.md clients expect.
+func writeTokens(w http.ResponseWriter, tokens auth.Tokens) {
+	w.Header().Set("Authorization", bearerPrefix+tokens.AccessToken)
+	writeJSON(w, http.StatusOK, tokensResponse{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(time.Until(tokens.ExpiresAt).Round(time.Second) / time.Second),
+	})
+}
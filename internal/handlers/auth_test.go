@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/auth"
+	"github.com/paramonies/ya-gophermart/internal/bruteforce"
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/promo"
+)
+
+func TestAuthFlow(t *testing.T) {
+	api := newTestAPI(t)
+
+	post := func(target, token, body string) (*http.Response, tokensResponse) {
+		r := newRequest(http.MethodPost, target, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := api.do("", r)
+
+		var tokens tokensResponse
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&tokens))
+		}
+		return w.Result(), tokens
+	}
+
+	resp, _ := post("/api/user/register", "", `{"login":"alice"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	long := strings.Repeat("x", auth.MaxPasswordBytes+1)
+	resp, _ = post("/api/user/register", "", `{"login":"alice","password":"`+long+`"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "too long for bcrypt")
+	resp, registered := post("/api/user/register", "", `{"login":"alice","password":"secret"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Bearer "+registered.AccessToken, resp.Header.Get("Authorization"))
+	assert.Equal(t, "Bearer", registered.TokenType)
+	assert.Positive(t, registered.ExpiresIn)
+	resp, _ = post("/api/user/register", "", `{"login":"alice","password":"other"}`)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp, _ = post("/api/user/login", "", `{"login":"alice","password":"wrong"}`)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp, _ = post("/api/user/login", "", `{"login":"alice","password":"`+long+`"}`)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp, loggedIn := post("/api/user/login", "", `{"login":"alice","password":"secret"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, refreshed := post("/api/user/token/refresh", "", `{"refresh_token":"`+registered.RefreshToken+`"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = post("/api/user/token/refresh", "", `{}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, _ = post("/api/user/logout", "", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp, _ = post("/api/user/logout", refreshed.AccessToken, "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = post("/api/user/logout", refreshed.AccessToken, "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// The other session is still alive until every session is ended.
+	resp, _ = post("/api/user/orders", loggedIn.AccessToken, "12345678903")
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	resp, _ = post("/api/user/logout/all", loggedIn.AccessToken, "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = post("/api/user/orders", loggedIn.AccessToken, "12345678903")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp, _ = post("/api/user/token/refresh", "", `{"refresh_token":"`+loggedIn.RefreshToken+`"}`)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestLogin_Lockout(t *testing.T) {
+	api := newTestAPI(t)
+	_, err := api.auth.Register(context.Background(), domain.Registration{Login: "alice"}, "secret")
+	require.NoError(t, err)
+
+	login := func(password string) *httptest.ResponseRecorder {
+		body := `{"login":"alice","password":"` + password + `"}`
+		return api.do("", newRequest(http.MethodPost, "/api/user/login", strings.NewReader(body)))
+	}
+
+	for i := 0; i < bruteforce.DefaultLoginThreshold; i++ {
+		assert.Equal(t, http.StatusUnauthorized, login("wrong").Code)
+	}
+	// Locked out even with the right password.
+	w := login("secret")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+}
+
+func TestChangePassword(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.createUser("alice")
+	require.NoError(t, api.store.Users.UpdatePasswordHash(context.Background(), alice.ID, mustHash(t, "old password")))
+
+	change := func(body string) int {
+		return api.do(alice.ID, newRequest(http.MethodPost, "/api/user/password", strings.NewReader(body))).Code
+	}
+
+	assert.Equal(t, http.StatusBadRequest, change(`{"current_password":"old password"}`))
+	assert.Equal(t, http.StatusForbidden, change(`{"current_password":"wrong","new_password":"new password"}`))
+	assert.Equal(t, http.StatusNoContent, change(`{"current_password":"old password","new_password":"new password"}`))
+	// The session asking for the change stays logged in.
+	assert.Equal(t, http.StatusNoContent, change(`{"current_password":"new password","new_password":"newer password"}`))
+}
+
+func TestRegister_Promotions(t *testing.T) {
+	api := newTestAPI(t, func(d *Deps) {
+		rules, err := promo.ParseRules([]promo.Spec{{ID: "welcome", Trigger: "registration", Bonus: "100"}})
+		require.NoError(t, err)
+		d.Promotions = promo.New(rules)
+	})
+
+	w := api.do("", newRequest(http.MethodPost, "/api/user/register",
+		strings.NewReader(`{"login":"alice","password":"secret"}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	alice, err := api.store.Users.GetByLogin(context.Background(), "alice")
+	require.NoError(t, err)
+	entries, err := api.store.Ledger.Entries(context.Background(), alice.ID)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, domain.EntryBonus, entries[0].Kind)
+	assert.Equal(t, "welcome", entries[0].RuleID)
+	assert.Equal(t, money.FromUnits(100), entries[0].Amount)
+}
+
+func mustHash(t *testing.T, password string) string {
+	t.Helper()
+
+	hash, err := auth.HashParams{}.Hash(password)
+	require.NoError(t, err)
+	return hash
+}
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/audit"
+	"github.com/paramonies/ya-gophermart/internal/auth"
+	"github.com/paramonies/ya-gophermart/internal/balance"
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/expiry"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+)
+
+const (
+	// paramExpiring adds the points expiring soon to GET /api/user/balance.
+	paramExpiring = "expiring"
+	// paramRefunds adds the refunds to GET /api/user/balance/withdrawals.
+	paramRefunds = "refunds"
+)
+
+type balanceResponse struct {
+	Current   money.Amount `json:"current"`
+	Withdrawn money.Amount `json:"withdrawn"`
+}
+
+type expiringResponse struct {
+	Sum       money.Amount `json:"sum"`
+	ExpiresAt time.Time    `json:"expires_at"`
+}
+
+type balanceExpiringResponse struct {
+	balanceResponse
+	ExpiringSoon []expiringResponse `json:"expiring_soon"`
+}
+
+// GetBalance returns the current balance of the user and the points
+// withdrawn so far. With ?expiring=true, it also lists the points
+// expiring soon, soonest first.
+func GetBalance(balances *balance.Service, expiration *expiry.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.UserIDFromContext(r.Context())
+		if !ok {
+			WriteError(w, r, domain.ErrUnauthorized)
+			return
+		}
+
+		expiring, err := parseBoolParam(r, paramExpiring)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		b, err := balances.Balance(r.Context(), userID)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		resp := balanceResponse{Current: b.Current, Withdrawn: b.Withdrawn}
+		if !expiring {
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+
+		points, err := expiration.Expiring(r.Context(), userID)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		soon := make([]expiringResponse, 0, len(points))
+		for _, p := range points {
+			soon = append(soon, expiringResponse{Sum: p.Sum, ExpiresAt: p.ExpiresAt})
+		}
+		writeJSON(w, http.StatusOK, balanceExpiringResponse{balanceResponse: resp, ExpiringSoon: soon})
+	}
+}
+
+type withdrawalResponse struct {
+	Order       string       `json:"order"`
+	Sum         money.Amount `json:"sum"`
+	ProcessedAt time.Time    `json:"processed_at"`
+}
+
+type withdrawalRefundResponse struct {
+	withdrawalResponse
+	Refunded   bool       `json:"refunded"`
+	RefundedAt *time.Time `json:"refunded_at,omitempty"`
+}
+
+// GetWithdrawals lists the withdrawals of the user, oldest first, or
+// responds 204 if there are none. With ?refunds=true, each withdrawal
+// tells whether it was refunded.
+func GetWithdrawals(repo storage.LedgerRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.UserIDFromContext(r.Context())
+		if !ok {
+			WriteError(w, r, domain.ErrUnauthorized)
+			return
+		}
+
+		refunds, err := parseBoolParam(r, paramRefunds)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		withdrawals, err := repo.Withdrawals(r.Context(), userID)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if len(withdrawals) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if !refunds {
+			resp := make([]withdrawalResponse, 0, len(withdrawals))
+			for _, wd := range withdrawals {
+				resp = append(resp, newWithdrawalResponse(wd))
+			}
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+
+		resp := make([]withdrawalRefundResponse, 0, len(withdrawals))
+		for _, wd := range withdrawals {
+			item := withdrawalRefundResponse{withdrawalResponse: newWithdrawalResponse(wd), Refunded: wd.Refunded()}
+			if wd.Refunded() {
+				refundedAt := wd.RefundedAt
+				item.RefundedAt = &refundedAt
+			}
+			resp = append(resp, item)
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+func newWithdrawalResponse(wd domain.Withdrawal) withdrawalResponse {
+	return withdrawalResponse{Order: wd.Order, Sum: wd.Sum, ProcessedAt: wd.ProcessedAt}
+}
+
+// parseBoolParam returns the boolean query parameter, false if absent.
+func parseBoolParam(r *http.Request, name string) (bool, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, domain.ErrBadRequest.WithMessage(name + " must be a boolean")
+	}
+	return b, nil
+}
+
+type withdrawRequest struct {
+	Order string       `json:"order"`
+	Sum   money.Amount `json:"sum"`
+}
+
+// Withdraw debits points of the user to pay for an order and records the
+// withdrawal in trail, in the same transaction.
+func Withdraw(repo storage.LedgerRepository, trail *audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.UserIDFromContext(r.Context())
+		if !ok {
+			WriteError(w, r, domain.ErrUnauthorized)
+			return
+		}
+
+		var req withdrawRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			WriteError(w, r, domain.ErrBadRequest.WithMessage("malformed JSON body"))
+			return
+		}
+		if req.Sum <= 0 {
+			WriteError(w, r, domain.ErrBadRequest.WithMessage("sum must be positive"))
+			return
+		}
+		if !domain.ValidOrderNumber(req.Order) {
+			WriteError(w, r, domain.ErrInvalidOrderNumber)
+			return
+		}
+
+		entry := trail.Entry(userID, audit.ActionWithdraw, req.Order,
+			map[string]string{"sum": req.Sum.String()})
+		if err := repo.Withdraw(r.Context(), userID, req.Order, req.Sum, entry); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/pkg/log"
+	"github.com/paramonies/ya-gophermart/pkg/log/requestid"
+)
+
+const (
+	codeInternalError = "internal_error"
+	msgInternalError  = "internal server error"
+)
+
+// statusCodes maps domain error codes to the status codes of SPECIFICATION.md.
+var statusCodes = map[string]int{
+	domain.ErrBadRequest.Code:             http.StatusBadRequest,
+	domain.ErrUnauthorized.Code:           http.StatusUnauthorized,
+	domain.ErrInvalidRefreshToken.Code:    http.StatusUnauthorized,
+	domain.ErrRefreshTokenReused.Code:     http.StatusUnauthorized,
+	domain.ErrForbidden.Code:              http.StatusForbidden,
+	domain.ErrNotFound.Code:               http.StatusNotFound,
+	domain.ErrLoginTaken.Code:             http.StatusConflict,
+	domain.ErrInvalidCredentials.Code:     http.StatusUnauthorized,
+	domain.ErrWeakPassword.Code:           http.StatusBadRequest,
+	domain.ErrWrongPassword.Code:          http.StatusForbidden,
+	domain.ErrTooManyAttempts.Code:        http.StatusTooManyRequests,
+	domain.ErrUserBlocked.Code:            http.StatusForbidden,
+	domain.ErrOrderAlreadyProcessed.Code:  http.StatusConflict,
+	domain.ErrInsufficientFunds.Code:      http.StatusPaymentRequired,
+	domain.ErrOrderOwnedByOther.Code:      http.StatusConflict,
+	domain.ErrInvalidOrderNumber.Code:     http.StatusUnprocessableEntity,
+	domain.ErrOrderAlreadyPaid.Code:       http.StatusUnprocessableEntity,
+	domain.ErrAlreadyRefunded.Code:        http.StatusConflict,
+	domain.ErrRequestTooLarge.Code:        http.StatusRequestEntityTooLarge,
+	domain.ErrUnsupportedEncoding.Code:    http.StatusUnsupportedMediaType,
+	domain.ErrIdempotencyKeyReused.Code:   http.StatusUnprocessableEntity,
+	domain.ErrIdempotencyKeyInFlight.Code: http.StatusConflict,
+	domain.ErrUnknownReferralCode.Code:    http.StatusUnprocessableEntity,
+}
+
+// errorResponse is the JSON error body.
+type errorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// WriteError responds with the status code of err. The body is the plain
+// error message unless the client asked for JSON through Accept.
+// Errors that are not domain errors are logged and hidden behind a 500.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	resp := errorResponse{
+		Code:      codeInternalError,
+		Message:   msgInternalError,
+		RequestID: requestid.FromContext(r.Context()),
+	}
+
+	var domainErr *domain.Error
+	if errors.As(err, &domainErr) {
+		if code, ok := statusCodes[domainErr.Code]; ok {
+			status = code
+		}
+		resp.Code = domainErr.Code
+		resp.Message = domainErr.Message
+	}
+
+	if status == http.StatusInternalServerError {
+		log.Error(r.Context(), "request failed", err, "method", r.Method, "path", r.URL.Path)
+	}
+
+	if acceptsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = io.WriteString(w, resp.Message)
+}
+
+// acceptsJSON reports whether application/json is listed in Accept.
+// Wildcards do not count: JSON errors are opt-in.
+func acceptsJSON(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(v, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil || mediaType != "application/json" {
+				continue
+			}
+			if q, ok := params["q"]; ok && strings.Trim(q, "0.") == "" {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/pkg/log/requestid"
+)
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		accept     string
+		wantStatus int
+		wantType   string
+		wantBody   string
+	}{
+		{
+			name:       "PlainByDefault",
+			err:        domain.ErrLoginTaken,
+			wantStatus: http.StatusConflict,
+			wantType:   "text/plain; charset=utf-8",
+			wantBody:   "login is already taken",
+		},
+		{
+			name:       "WildcardStaysPlain",
+			err:        domain.ErrInsufficientFunds,
+			accept:     "*/*",
+			wantStatus: http.StatusPaymentRequired,
+			wantType:   "text/plain; charset=utf-8",
+			wantBody:   "insufficient funds",
+		},
+		{
+			name:       "JSON",
+			err:        fmt.Errorf("upload order: %w", domain.ErrInvalidOrderNumber),
+			accept:     "text/html, application/json;q=0.9",
+			wantStatus: http.StatusUnprocessableEntity,
+			wantType:   "application/json",
+			wantBody:   `{"code":"invalid_order_number","message":"invalid order number","request_id":"req-1"}` + "\n",
+		},
+		{
+			name:       "JSONRefused",
+			err:        domain.ErrOrderOwnedByOther,
+			accept:     "application/json;q=0",
+			wantStatus: http.StatusConflict,
+			wantType:   "text/plain; charset=utf-8",
+			wantBody:   "order number has already been uploaded by another user",
+		},
+		{
+			name:       "UnsupportedEncoding",
+			err:        domain.ErrUnsupportedEncoding,
+			accept:     "application/json",
+			wantStatus: http.StatusUnsupportedMediaType,
+			wantType:   "application/json",
+			wantBody:   `{"code":"unsupported_encoding","message":"unsupported content encoding","request_id":"req-1"}` + "\n",
+		},
+		{
+			name:       "UnknownError",
+			err:        errors.New("connection refused"),
+			accept:     "application/json",
+			wantStatus: http.StatusInternalServerError,
+			wantType:   "application/json",
+			wantBody:   `{"code":"internal_error","message":"internal server error","request_id":"req-1"}` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r = r.WithContext(requestid.NewContext(r.Context(), "req-1"))
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+
+			WriteError(w, r, tt.err)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantType, w.Header().Get("Content-Type"))
+			assert.Equal(t, tt.wantBody, w.Body.String())
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/auth"
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/events"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+)
+
+const (
+	// DefaultHeartbeat is how often an idle event stream sends a comment
+	// so that proxies keep the connection open.
+	DefaultHeartbeat = 15 * time.Second
+
+	eventsBatchSize = 100
+	// eventsRetry is the reconnection delay suggested to EventSource, in
+	// milliseconds.
+	eventsRetry = 3000
+)
+
+// Events streams the outbox events of the user as Server-Sent Events:
+// order status changes and balance changes, in commit order. The event
+// ID is the outbox ID, so a client reconnecting with Last-Event-ID gets
+// what it missed. Without it the stream starts with the next event.
+// Every heartbeat the outbox is also read, which bounds the delay of a
+// lost notification.
+func Events(repo storage.OutboxRepository, hub *events.Hub, heartbeat time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		userID, ok := auth.UserIDFromContext(ctx)
+		if !ok {
+			WriteError(w, r, domain.ErrUnauthorized)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			WriteError(w, r, fmt.Errorf("response writer does not support flushing"))
+			return
+		}
+
+		// Subscribe before reading the outbox so that nothing committed
+		// in between is missed.
+		sub := hub.Subscribe(userID)
+		defer sub.Cancel()
+
+		var lastID int64
+		if v := r.Header.Get("Last-Event-ID"); v != "" {
+			id, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || id < 0 {
+				WriteError(w, r, domain.ErrBadRequest.WithMessage("malformed Last-Event-ID"))
+				return
+			}
+			lastID = id
+		} else {
+			id, err := repo.LastUserEventID(ctx, userID)
+			if err != nil {
+				WriteError(w, r, err)
+				return
+			}
+			lastID = id
+		}
+
+		h := w.Header()
+		h.Set("Content-Type", "text/event-stream")
+		h.Set("Cache-Control", "no-cache")
+		h.Set("Connection", "keep-alive")
+		// Disable response buffering in nginx.
+		h.Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "retry: %d\n\n", eventsRetry)
+		flusher.Flush()
+
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+
+		for {
+			for {
+				batch, err := repo.UserEvents(ctx, userID, lastID, eventsBatchSize)
+				if err != nil {
+					// The status line is gone, the client reconnects.
+					return
+				}
+				for _, e := range batch {
+					fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, e.Payload)
+					lastID = e.ID
+				}
+				if len(batch) < eventsBatchSize {
+					break
+				}
+			}
+			flusher.Flush()
+
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-sub.C:
+				if !ok {
+					return
+				}
+			case <-ticker.C:
+				fmt.Fprint(w, ": heartbeat\n\n")
+			}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/auth"
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/events"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/storage/memory"
+)
+
+// sseEvent is an event read from a stream, Comment is set for comments.
+type sseEvent struct {
+	ID      string
+	Event   string
+	Data    string
+	Comment string
+}
+
+// readEvent reads lines up to the next blank line, skipping retry fields.
+func readEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+
+	var e sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if e != (sseEvent{}) {
+				return e
+			}
+		case strings.HasPrefix(line, ":"):
+			e.Comment = strings.TrimSpace(line[1:])
+		case strings.HasPrefix(line, "id: "):
+			e.ID = line[len("id: "):]
+		case strings.HasPrefix(line, "event: "):
+			e.Event = line[len("event: "):]
+		case strings.HasPrefix(line, "data: "):
+			e.Data = line[len("data: "):]
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := memory.NewStorage()
+	hub := events.NewHub()
+	go func() { _ = s.Notifier.Listen(ctx, hub.Notify) }()
+
+	alice, err := s.Users.Create(ctx, "alice", "hash")
+	require.NoError(t, err)
+	_, err = s.Orders.Create(ctx, alice.ID, "12345678903")
+	require.NoError(t, err)
+	require.NoError(t, s.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessing, 0))
+
+	handler := Events(s.Outbox, hub, 50*time.Millisecond)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if userID := r.Header.Get("X-Test-User"); userID != "" {
+			r = r.WithContext(auth.NewContext(r.Context(), userID))
+		}
+		handler(w, r)
+	}))
+	defer srv.Close()
+
+	connect := func(lastEventID string) (*http.Response, *bufio.Reader) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Test-User", alice.ID)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp, bufio.NewReader(resp.Body)
+	}
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		resp, err := http.Get(srv.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("BadLastEventID", func(t *testing.T) {
+		resp, _ := connect("abc")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	var processedID string
+	t.Run("Live", func(t *testing.T) {
+		resp, r := connect("")
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+		// The PROCESSING event happened before the stream started.
+		assert.Equal(t, "heartbeat", readEvent(t, r).Comment)
+
+		require.NoError(t, s.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessed, money.FromUnits(500)))
+
+		e := readEvent(t, r)
+		for e.Comment != "" {
+			e = readEvent(t, r)
+		}
+		assert.Equal(t, "order.processed", e.Event)
+		assert.JSONEq(t, `{"order":"12345678903","status":"PROCESSED","accrual":500}`, e.Data)
+		processedID = e.ID
+
+		e = readEvent(t, r)
+		for e.Comment != "" {
+			e = readEvent(t, r)
+		}
+		assert.Equal(t, "balance.credited", e.Event)
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		resp, r := connect("0")
+		defer resp.Body.Close()
+
+		var types []string
+		for len(types) < 3 {
+			if e := readEvent(t, r); e.Comment == "" {
+				types = append(types, e.Event)
+			}
+		}
+		assert.Equal(t, []string{"order.processing", "order.processed", "balance.credited"}, types)
+
+		resp2, r2 := connect(processedID)
+		defer resp2.Body.Close()
+		e := readEvent(t, r2)
+		assert.Equal(t, "balance.credited", e.Event)
+	})
+
+	t.Run("HubClosed", func(t *testing.T) {
+		resp, r := connect("")
+		defer resp.Body.Close()
+		hub.Close()
+
+		for {
+			if _, err := r.ReadString('\n'); err != nil {
+				break
+			}
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/audit"
+	"github.com/paramonies/ya-gophermart/internal/auth"
+	"github.com/paramonies/ya-gophermart/internal/bruteforce"
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/events"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/internal/storage/memory"
+)
+
+// testAdminToken authenticates admin requests to testAPI.
+const testAdminToken = "admin-token"
+
+// testHashParams keep password hashing cheap in tests.
+var testHashParams = auth.HashParams{BcryptCost: 4}
+
+// testAPI is the router over an in-memory storage.
+type testAPI struct {
+	t      *testing.T
+	store  *storage.Storage
+	auth   *auth.Service
+	router *chi.Mux
+	// tokens holds an access token per user ID.
+	tokens map[string]string
+}
+
+// newTestAPI returns the test API, options may change its dependencies.
+func newTestAPI(t *testing.T, options ...func(*Deps)) *testAPI {
+	s := memory.NewStorage()
+	svc := auth.NewService(s.Users, s.Sessions, auth.Config{
+		Secret: []byte("secret"),
+		Hash:   testHashParams,
+	})
+	deps := Deps{
+		Storage: s,
+		Auth:    svc,
+		Guard:   bruteforce.NewGuard(s.Attempts, bruteforce.Config{}),
+		Audit:   audit.New(s.Audit),
+		Events:  events.NewHub(),
+
+		AdminToken: testAdminToken,
+	}
+	for _, option := range options {
+		option(&deps)
+	}
+
+	return &testAPI{
+		t:      t,
+		store:  s,
+		auth:   svc,
+		router: NewRouter(deps),
+		tokens: make(map[string]string),
+	}
+}
+
+func (a *testAPI) createUser(login string) domain.User {
+	u, err := a.store.Users.Create(context.Background(), login, "hash")
+	require.NoError(a.t, err)
+	return u
+}
+
+// do serves the request as userID, anonymously if empty. Each user
+// logs in on its first request.
+func (a *testAPI) do(userID string, r *http.Request) *httptest.ResponseRecorder {
+	if userID != "" {
+		token, ok := a.tokens[userID]
+		if !ok {
+			token = a.login(userID)
+			a.tokens[userID] = token
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	a.router.ServeHTTP(w, r)
+	return w
+}
+
+// login starts a session for the user with a temporary password and
+// returns its access token. The password hash of the user is kept.
+func (a *testAPI) login(userID string) string {
+	ctx := context.Background()
+	u, err := a.store.Users.GetByID(ctx, userID)
+	require.NoError(a.t, err)
+
+	const password = "test-password"
+	hash, err := testHashParams.Hash(password)
+	require.NoError(a.t, err)
+	require.NoError(a.t, a.store.Users.UpdatePasswordHash(ctx, userID, hash))
+	defer func() {
+		require.NoError(a.t, a.store.Users.UpdatePasswordHash(ctx, userID, u.PasswordHash))
+	}()
+
+	tokens, err := a.auth.Login(ctx, u.Login, password)
+	require.NoError(a.t, err)
+	return tokens.AccessToken
+}
+
+func newRequest(method, target string, body io.Reader) *http.Request {
+	return httptest.NewRequest(method, target, body)
+}
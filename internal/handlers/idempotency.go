@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/auth"
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/pkg/log"
+	"github.com/paramonies/ya-gophermart/pkg/log/requestid"
+)
+
+const (
+	// IdempotencyKeyHeader makes a request safe to retry.
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set on replayed responses.
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	// DefaultIdempotencyTTL is how long responses are replayed.
+	DefaultIdempotencyTTL = 24 * time.Hour
+	// DefaultIdempotencyLease is how long a key is held for a request
+	// still being handled.
+	DefaultIdempotencyLease = time.Minute
+
+	maxIdempotencyKeyLength = 255
+	// maxIdempotentBodySize bounds the bodies read to be hashed.
+	maxIdempotentBodySize = 1 << 20
+
+	// operatorOwnerPrefix sets the keys of operators apart from user IDs.
+	operatorOwnerPrefix = "operator:"
+)
+
+// Idempotent replays the first response to a request carrying an
+// Idempotency-Key for ttl. The key must come back with the same method,
+// path and body, otherwise the request fails with 422. A retry arriving
+// while the first request is still handled gets 409, for up to lease: the
+// key of a request that never completes, because its instance died, is
+// free again after that. Server errors and panics are not recorded, so
+// the request can be retried.
+//
+// Keys are per user. Admin requests made with the admin token have no
+// user, their keys are per operator, see auditActor. Requests without the
+// header, or unauthenticated, pass through.
+func Idempotent(repo storage.IdempotencyRepository, ttl, lease time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(IdempotencyKeyHeader)
+			owner, ok := idempotencyOwner(r)
+			if key == "" || !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				WriteError(w, r, domain.ErrBadRequest.WithMessage("Idempotency-Key is too long"))
+				return
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodySize))
+			if err != nil {
+				// MaxBytesReader fails once it has read up to the limit.
+				if len(body) == maxIdempotentBodySize {
+					WriteError(w, r, domain.ErrRequestTooLarge)
+					return
+				}
+				WriteError(w, r, domain.ErrBadRequest.WithMessage("failed to read the body"))
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			hash := requestHash(r, body)
+			now := time.Now()
+			stored, reserved, err := repo.Reserve(r.Context(), domain.IdempotencyRecord{
+				UserID:      owner,
+				Key:         key,
+				RequestHash: hash,
+				CreatedAt:   now,
+				ExpiresAt:   now.Add(lease),
+			})
+			if err != nil {
+				WriteError(w, r, err)
+				return
+			}
+
+			if !reserved {
+				switch {
+				case stored.RequestHash != hash:
+					WriteError(w, r, domain.ErrIdempotencyKeyReused)
+				case !stored.Completed():
+					WriteError(w, r, domain.ErrIdempotencyKeyInFlight)
+				default:
+					if stored.ContentType != "" {
+						w.Header().Set("Content-Type", stored.ContentType)
+					}
+					w.Header().Set(IdempotentReplayedHeader, "true")
+					w.WriteHeader(stored.StatusCode)
+					_, _ = w.Write(stored.Body)
+				}
+				return
+			}
+
+			// The client may be gone, the outcome must still be recorded.
+			ctx := requestid.NewContext(context.Background(), requestid.FromContext(r.Context()))
+			defer func() {
+				if p := recover(); p != nil {
+					if err := repo.Release(ctx, owner, key); err != nil {
+						log.Error(ctx, "failed to release idempotency key", err, "key", key)
+					}
+					panic(p)
+				}
+			}()
+
+			rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+
+			if rec.status >= http.StatusInternalServerError {
+				err = repo.Release(ctx, owner, key)
+			} else {
+				err = repo.Complete(ctx, owner, key, rec.status, rec.Header().Get("Content-Type"), rec.body.Bytes(),
+					time.Now().Add(ttl))
+			}
+			if err != nil {
+				log.Error(ctx, "failed to record idempotent response", err, "key", key)
+			}
+		})
+	}
+}
+
+// idempotencyOwner returns whom the idempotency keys of the request
+// belong to: its user, or the operator of an admin token request.
+func idempotencyOwner(r *http.Request) (string, bool) {
+	if userID, ok := auth.UserIDFromContext(r.Context()); ok {
+		return userID, true
+	}
+	if len(auth.RolesFromContext(r.Context())) > 0 {
+		return operatorOwnerPrefix + auditActor(r), true
+	}
+	return "", false
+}
+
+// requestHash identifies the request a key was first used with.
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	_, _ = io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder passes the response through and keeps a copy.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if !rr.wroteHeader {
+		rr.wroteHeader = true
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(p []byte) (int, error) {
+	rr.wroteHeader = true
+	rr.body.Write(p)
+	return rr.ResponseWriter.Write(p)
+}
@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/auth"
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/storage/memory"
+)
+
+func TestIdempotent_Withdraw(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+	alice := api.createUser("alice")
+	bob := api.createUser("bob")
+	_, err := api.store.Orders.Create(ctx, alice.ID, "12345678903")
+	require.NoError(t, err)
+	require.NoError(t, api.store.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessed, money.FromUnits(500)))
+
+	withdraw := func(userID, key, body string) *httptest.ResponseRecorder {
+		r := newRequest(http.MethodPost, "/api/user/balance/withdraw", strings.NewReader(body))
+		if key != "" {
+			r.Header.Set(IdempotencyKeyHeader, key)
+		}
+		return api.do(userID, r)
+	}
+
+	w := withdraw(alice.ID, "k1", `{"order":"2377225624","sum":100}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get(IdempotentReplayedHeader))
+
+	// The retry is replayed, not withdrawn again: without the key it
+	// would fail with 422 as the order is already paid.
+	w = withdraw(alice.ID, "k1", `{"order":"2377225624","sum":100}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get(IdempotentReplayedHeader))
+
+	w = withdraw(alice.ID, "k1", `{"order":"2377225624","sum":200}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, domain.ErrIdempotencyKeyReused.Message, w.Body.String())
+
+	// Errors are replayed as well.
+	w = withdraw(alice.ID, "k2", `{"order":"79927398713","sum":1000}`)
+	assert.Equal(t, http.StatusPaymentRequired, w.Code)
+	w = withdraw(alice.ID, "k2", `{"order":"79927398713","sum":1000}`)
+	assert.Equal(t, http.StatusPaymentRequired, w.Code)
+	assert.Equal(t, "true", w.Header().Get(IdempotentReplayedHeader))
+	assert.Equal(t, domain.ErrInsufficientFunds.Message, w.Body.String())
+
+	// Keys are per user.
+	w = withdraw(bob.ID, "k1", `{"order":"79927398713","sum":100}`)
+	assert.Equal(t, http.StatusPaymentRequired, w.Code)
+
+	assert.Equal(t, http.StatusBadRequest, withdraw(alice.ID, strings.Repeat("k", 256), `{}`).Code)
+
+	b, err := api.store.Ledger.Balance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, domain.Balance{Current: money.FromUnits(400), Withdrawn: money.FromUnits(100)}, b)
+}
+
+func TestIdempotent_UploadOrder(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.createUser("alice")
+
+	upload := func(body string) int {
+		r := newRequest(http.MethodPost, "/api/user/orders", strings.NewReader(body))
+		r.Header.Set(IdempotencyKeyHeader, "k1")
+		return api.do(alice.ID, r).Code
+	}
+
+	assert.Equal(t, http.StatusAccepted, upload("12345678903"))
+	// Replayed as 202, where a plain repeat would get 200.
+	assert.Equal(t, http.StatusAccepted, upload("12345678903"))
+	assert.Equal(t, http.StatusUnprocessableEntity, upload("79927398713"))
+}
+
+func TestIdempotent(t *testing.T) {
+	s := memory.NewStorage()
+	alice, err := s.Users.Create(context.Background(), "alice", "hash")
+	require.NoError(t, err)
+
+	var calls int
+	status := http.StatusInternalServerError
+	release := make(chan struct{})
+	entered := make(chan struct{}, 1)
+	h := Idempotent(s.Idempotency, 50*time.Millisecond, time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		select {
+		case entered <- struct{}{}:
+		default:
+		}
+		<-release
+		w.WriteHeader(status)
+	}))
+
+	serve := func() int {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+		r.Header.Set(IdempotencyKeyHeader, "k")
+		r = r.WithContext(auth.NewContext(r.Context(), alice.ID))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// A retry while the first request runs is rejected.
+	first := make(chan int)
+	go func() { first <- serve() }()
+	<-entered
+	assert.Equal(t, http.StatusConflict, serve())
+	close(release)
+	assert.Equal(t, http.StatusInternalServerError, <-first)
+
+	// Server errors are not kept.
+	status = http.StatusCreated
+	assert.Equal(t, http.StatusCreated, serve())
+	assert.Equal(t, http.StatusCreated, serve())
+	assert.Equal(t, 2, calls)
+
+	// After the TTL the key is new again.
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, http.StatusCreated, serve())
+	assert.Equal(t, 3, calls)
+}
+
+func TestIdempotent_Operator(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+	alice := api.createUser("alice")
+	_, err := api.store.Orders.Create(ctx, alice.ID, "12345678903")
+	require.NoError(t, err)
+	require.NoError(t, api.store.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessed, money.FromUnits(500)))
+	require.NoError(t, api.store.Ledger.Withdraw(ctx, alice.ID, "2377225624", money.FromUnits(100), nil))
+
+	refund := func(operator string) *httptest.ResponseRecorder {
+		r := newRequest(http.MethodPost, "/admin/withdrawals/2377225624/refund", nil)
+		r.Header.Set(AdminTokenHeader, testAdminToken)
+		r.Header.Set(OperatorHeader, operator)
+		r.Header.Set(IdempotencyKeyHeader, "refund-1")
+		return api.do("", r)
+	}
+
+	// Admin token requests have no user, their keys are per operator.
+	assert.Equal(t, http.StatusCreated, refund("ops-1").Code)
+	w := refund("ops-1")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "true", w.Header().Get(IdempotentReplayedHeader))
+	assert.Equal(t, http.StatusConflict, refund("ops-2").Code)
+}
+
+func TestIdempotent_Recovery(t *testing.T) {
+	s := memory.NewStorage()
+	alice, err := s.Users.Create(context.Background(), "alice", "hash")
+	require.NoError(t, err)
+
+	serve := func(h http.Handler, key, body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set(IdempotencyKeyHeader, key)
+		r = r.WithContext(auth.NewContext(r.Context(), alice.ID))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	t.Run("Panic", func(t *testing.T) {
+		var calls int
+		h := Idempotent(s.Idempotency, time.Hour, time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls == 1 {
+				panic("boom")
+			}
+			w.WriteHeader(http.StatusCreated)
+		}))
+
+		// The panic releases the key.
+		assert.Panics(t, func() { serve(h, "panic", "body") })
+		assert.Equal(t, http.StatusCreated, serve(h, "panic", "body"))
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("Lease", func(t *testing.T) {
+		var calls int32
+		release := make(chan struct{})
+		entered := make(chan struct{}, 2)
+		h := Idempotent(s.Idempotency, time.Hour, 50*time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			entered <- struct{}{}
+			<-release
+			w.WriteHeader(http.StatusCreated)
+		}))
+
+		first := make(chan int)
+		go func() { first <- serve(h, "lease", "body") }()
+		<-entered
+		assert.Equal(t, http.StatusConflict, serve(h, "lease", "body"))
+
+		// The first request outlives the lease, as if its instance died:
+		// the key is free again long before the TTL.
+		time.Sleep(60 * time.Millisecond)
+		second := make(chan int)
+		go func() { second <- serve(h, "lease", "body") }()
+		<-entered
+		close(release)
+		assert.Equal(t, http.StatusCreated, <-first)
+		assert.Equal(t, http.StatusCreated, <-second)
+		assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+	})
+
+	t.Run("BodyTooLarge", func(t *testing.T) {
+		h := Idempotent(s.Idempotency, time.Hour, time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("the handler must not be called")
+		}))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, serve(h, "large", strings.Repeat("x", maxIdempotentBodySize+1)))
+	})
+}
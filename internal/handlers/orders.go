@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/auth"
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+)
+
+// maxOrderNumberSize bounds the body of an order upload.
+const maxOrderNumberSize = 256
+
+// OrderLister lists the orders of a user selected by q, oldest first.
+type OrderLister interface {
+	ListByUser(ctx context.Context, userID string, q domain.OrderQuery) ([]domain.Order, error)
+}
+
+type orderResponse struct {
+	Number     string       `json:"number"`
+	Status     string       `json:"status"`
+	Accrual    money.Amount `json:"accrual,omitempty"`
+	UploadedAt time.Time    `json:"uploaded_at"`
+}
+
+// UploadOrder registers an order number of the user for accrual. It
+// responds 202 for a new number and 200 if the user already uploaded it.
+func UploadOrder(repo storage.OrderRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.UserIDFromContext(r.Context())
+		if !ok {
+			WriteError(w, r, domain.ErrUnauthorized)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxOrderNumberSize+1))
+		if err != nil || len(body) > maxOrderNumberSize {
+			WriteError(w, r, domain.ErrBadRequest.WithMessage("the body must be an order number"))
+			return
+		}
+		number := strings.TrimSpace(string(body))
+		if number == "" {
+			WriteError(w, r, domain.ErrBadRequest.WithMessage("the body must be an order number"))
+			return
+		}
+		if !domain.ValidOrderNumber(number) {
+			WriteError(w, r, domain.ErrInvalidOrderNumber)
+			return
+		}
+
+		created, err := repo.Create(r.Context(), userID, number)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		if created {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// ListOrders lists the orders of the user, oldest first, selected by the
+// parameters of parseOrderQuery. A full page carries a Link to the next
+// one; 204 means there is nothing to list.
+func ListOrders(repo OrderLister) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.UserIDFromContext(r.Context())
+		if !ok {
+			WriteError(w, r, domain.ErrUnauthorized)
+			return
+		}
+
+		q, err := parseOrderQuery(r)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		list, err := repo.ListByUser(r.Context(), userID, q)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if len(list) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if q.Limit > 0 && len(list) == q.Limit {
+			w.Header().Set("Link", nextOrdersLink(r, list[len(list)-1]))
+		}
+
+		resp := make([]orderResponse, 0, len(list))
+		for _, o := range list {
+			resp = append(resp, orderResponse{
+				Number:     o.Number,
+				Status:     string(o.Status),
+				Accrual:    o.Accrual,
+				UploadedAt: o.UploadedAt,
+			})
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
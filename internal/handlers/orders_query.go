@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+)
+
+const (
+	maxOrdersPageSize = 1000
+
+	paramLimit        = "limit"
+	paramAfter        = "after"
+	paramStatus       = "status"
+	paramUploadedFrom = "uploaded_from"
+	paramUploadedTo   = "uploaded_to"
+)
+
+var orderQueryParams = []string{paramLimit, paramAfter, paramStatus, paramUploadedFrom, paramUploadedTo}
+
+// parseOrderQuery reads the optional pagination and filter parameters of
+// GET /api/user/orders. Without any of them the query selects every order,
+// which keeps the response of SPECIFICATION.md the default.
+func parseOrderQuery(r *http.Request) (domain.OrderQuery, error) {
+	var q domain.OrderQuery
+	values := r.URL.Query()
+
+	if v := values.Get(paramLimit); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxOrdersPageSize {
+			return q, domain.ErrBadRequest.WithMessage(
+				fmt.Sprintf("limit must be an integer between 1 and %d", maxOrdersPageSize))
+		}
+		q.Limit = limit
+	}
+
+	if v := values.Get(paramAfter); v != "" {
+		cursor, err := decodeOrderCursor(v)
+		if err != nil {
+			return q, domain.ErrBadRequest.WithMessage("malformed after cursor")
+		}
+		q.After = &cursor
+	}
+
+	for _, v := range values[paramStatus] {
+		for _, s := range strings.Split(v, ",") {
+			status := domain.OrderStatus(strings.ToUpper(strings.TrimSpace(s)))
+			if !status.Valid() {
+				return q, domain.ErrBadRequest.WithMessage(fmt.Sprintf("unknown order status %q", s))
+			}
+			q.Statuses = append(q.Statuses, status)
+		}
+	}
+
+	var err error
+	if q.UploadedFrom, err = parseTimeParam(values, paramUploadedFrom); err != nil {
+		return q, err
+	}
+	if q.UploadedTo, err = parseTimeParam(values, paramUploadedTo); err != nil {
+		return q, err
+	}
+
+	return q, nil
+}
+
+func parseTimeParam(values url.Values, name string) (time.Time, error) {
+	v := values.Get(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, domain.ErrBadRequest.WithMessage(name + " must be an RFC3339 timestamp")
+	}
+	return t, nil
+}
+
+// nextOrdersLink returns the Link header pointing at the page after
+// last, keeping the other parameters of the request.
+func nextOrdersLink(r *http.Request, last domain.Order) string {
+	values := url.Values{}
+	for _, name := range orderQueryParams {
+		if v, ok := r.URL.Query()[name]; ok {
+			values[name] = v
+		}
+	}
+	values.Set(paramAfter, encodeOrderCursor(domain.CursorOf(last)))
+
+	next := url.URL{Path: r.URL.Path, RawQuery: values.Encode()}
+	return fmt.Sprintf(`<%s>; rel="next"`, next.String())
+}
+
+// Cursors are opaque to clients: base64 of "<uploaded_at>|<number>".
+func encodeOrderCursor(c domain.OrderCursor) string {
+	raw := c.UploadedAt.UTC().Format(time.RFC3339Nano) + "|" + c.Number
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeOrderCursor(s string) (domain.OrderCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return domain.OrderCursor{}, err
+	}
+
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return domain.OrderCursor{}, fmt.Errorf("malformed cursor")
+	}
+
+	uploadedAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return domain.OrderCursor{}, err
+	}
+
+	return domain.OrderCursor{UploadedAt: uploadedAt, Number: parts[1]}, nil
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+)
+
+func TestParseOrderQuery(t *testing.T) {
+	t.Run("DefaultSelectsEverything", func(t *testing.T) {
+		q, err := parseOrderQuery(httptest.NewRequest(http.MethodGet, "/api/user/orders", nil))
+		require.NoError(t, err)
+		assert.Equal(t, domain.OrderQuery{}, q)
+	})
+
+	t.Run("Filters", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet,
+			"/api/user/orders?limit=10&status=new,processing&status=INVALID"+
+				"&uploaded_from=2020-12-01T00:00:00%2B03:00&uploaded_to=2020-12-11T00:00:00Z", nil)
+
+		q, err := parseOrderQuery(r)
+		require.NoError(t, err)
+		assert.Equal(t, 10, q.Limit)
+		assert.Equal(t, []domain.OrderStatus{
+			domain.OrderStatusNew, domain.OrderStatusProcessing, domain.OrderStatusInvalid,
+		}, q.Statuses)
+		assert.True(t, q.UploadedFrom.Equal(time.Date(2020, 11, 30, 21, 0, 0, 0, time.UTC)))
+		assert.True(t, q.UploadedTo.Equal(time.Date(2020, 12, 11, 0, 0, 0, 0, time.UTC)))
+	})
+
+	for _, query := range []string{"limit=0", "limit=abc", "status=DONE", "after=!!", "uploaded_to=yesterday"} {
+		t.Run("Invalid "+query, func(t *testing.T) {
+			_, err := parseOrderQuery(httptest.NewRequest(http.MethodGet, "/api/user/orders?"+query, nil))
+			assert.ErrorIs(t, err, domain.ErrBadRequest)
+		})
+	}
+}
+
+func TestNextOrdersLink(t *testing.T) {
+	last := domain.Order{
+		Number:     "12345678903",
+		UploadedAt: time.Date(2020, 12, 10, 15, 12, 1, 0, time.UTC),
+	}
+	r := httptest.NewRequest(http.MethodGet, "/api/user/orders?limit=2&status=NEW&foo=bar", nil)
+
+	link := nextOrdersLink(r, last)
+	assert.Equal(t, `</api/user/orders?after=MjAyMC0xMi0xMFQxNToxMjowMVp8MTIzNDU2Nzg5MDM&limit=2&status=NEW>; rel="next"`, link)
+
+	r = httptest.NewRequest(http.MethodGet, "/api/user/orders?after=MjAyMC0xMi0xMFQxNToxMjowMVp8MTIzNDU2Nzg5MDM", nil)
+	q, err := parseOrderQuery(r)
+	require.NoError(t, err)
+	require.NotNil(t, q.After)
+	assert.Equal(t, last.Number, q.After.Number)
+	assert.True(t, q.After.UploadedAt.Equal(last.UploadedAt))
+}
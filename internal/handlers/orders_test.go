@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/auth"
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/expiry"
+	"github.com/paramonies/ya-gophermart/internal/money"
+)
+
+func TestUploadOrder(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.createUser("alice")
+	bob := api.createUser("bob")
+
+	upload := func(userID, body string) int {
+		return api.do(userID, newRequest(http.MethodPost, "/api/user/orders", strings.NewReader(body))).Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, upload("", "12345678903"))
+	assert.Equal(t, http.StatusBadRequest, upload(alice.ID, ""))
+	assert.Equal(t, http.StatusUnprocessableEntity, upload(alice.ID, "12345678904"))
+	assert.Equal(t, http.StatusAccepted, upload(alice.ID, "12345678903\n"))
+	assert.Equal(t, http.StatusOK, upload(alice.ID, "12345678903"))
+	assert.Equal(t, http.StatusConflict, upload(bob.ID, "12345678903"))
+}
+
+// orderList is an OrderLister over a fixed list of orders.
+type orderList []domain.Order
+
+func (l orderList) ListByUser(_ context.Context, userID string, q domain.OrderQuery) ([]domain.Order, error) {
+	var orders []domain.Order
+	for _, o := range l {
+		if o.UserID == userID && q.Match(o) && (q.Limit == 0 || len(orders) < q.Limit) {
+			orders = append(orders, o)
+		}
+	}
+	return orders, nil
+}
+
+func TestListOrders(t *testing.T) {
+	at := time.Date(2020, 12, 10, 15, 0, 0, 0, time.UTC)
+	handler := ListOrders(orderList{
+		{Number: "12345678903", UserID: "alice", Status: domain.OrderStatusProcessed, Accrual: money.MustParse("729.98"), UploadedAt: at},
+		{Number: "79927398713", UserID: "alice", Status: domain.OrderStatusInvalid, UploadedAt: at.Add(time.Minute)},
+		{Number: "2377225624", UserID: "alice", Status: domain.OrderStatusNew, UploadedAt: at.Add(2 * time.Minute)},
+	})
+
+	list := func(userID, target string) ([]orderResponse, *http.Response) {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		if userID != "" {
+			r = r.WithContext(auth.NewContext(r.Context(), userID))
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		var resp []orderResponse
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		}
+		return resp, w.Result()
+	}
+	numbers := func(resp []orderResponse) []string {
+		var numbers []string
+		for _, o := range resp {
+			numbers = append(numbers, o.Number)
+		}
+		return numbers
+	}
+
+	_, res := list("", "/api/user/orders")
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	_, res = list("bob", "/api/user/orders")
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	_, res = list("alice", "/api/user/orders?limit=0")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	resp, res := list("alice", "/api/user/orders")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, []string{"12345678903", "79927398713", "2377225624"}, numbers(resp))
+	assert.Equal(t, "PROCESSED", resp[0].Status)
+	assert.Equal(t, money.MustParse("729.98"), resp[0].Accrual)
+	assert.Empty(t, res.Header.Get("Link"))
+
+	resp, res = list("alice", "/api/user/orders?status=processed,invalid")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, []string{"12345678903", "79927398713"}, numbers(resp))
+
+	resp, res = list("alice", "/api/user/orders?limit=2")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, []string{"12345678903", "79927398713"}, numbers(resp))
+	link := res.Header.Get("Link")
+	require.True(t, strings.HasPrefix(link, "</api/user/orders?after="), link)
+
+	next := strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+	resp, res = list("alice", next)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, []string{"2377225624"}, numbers(resp))
+	assert.Empty(t, res.Header.Get("Link"))
+}
+
+func TestWithdraw(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+	alice := api.createUser("alice")
+	_, err := api.store.Orders.Create(ctx, alice.ID, "12345678903")
+	require.NoError(t, err)
+	require.NoError(t, api.store.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessed, money.FromUnits(500)))
+
+	withdraw := func(userID, body string) int {
+		return api.do(userID, newRequest(http.MethodPost, "/api/user/balance/withdraw", strings.NewReader(body))).Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, withdraw("", `{"order":"2377225624","sum":100}`))
+	assert.Equal(t, http.StatusBadRequest, withdraw(alice.ID, `{`))
+	assert.Equal(t, http.StatusBadRequest, withdraw(alice.ID, `{"order":"2377225624","sum":0}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, withdraw(alice.ID, `{"order":"2377225625","sum":100}`))
+	assert.Equal(t, http.StatusPaymentRequired, withdraw(alice.ID, `{"order":"2377225624","sum":1000}`))
+	assert.Equal(t, http.StatusOK, withdraw(alice.ID, `{"order":"2377225624","sum":100}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, withdraw(alice.ID, `{"order":"2377225624","sum":100}`))
+
+	b, err := api.store.Ledger.Balance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, domain.Balance{Current: money.FromUnits(400), Withdrawn: money.FromUnits(100)}, b)
+}
+
+func TestGetBalance(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+	alice := api.createUser("alice")
+	_, err := api.store.Orders.Create(ctx, alice.ID, "12345678903")
+	require.NoError(t, err)
+	require.NoError(t, api.store.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessed, money.MustParse("500.5")))
+	require.NoError(t, api.store.Ledger.Withdraw(ctx, alice.ID, "2377225624", money.FromUnits(100), nil))
+
+	w := api.do("", newRequest(http.MethodGet, "/api/user/balance", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = api.do(alice.ID, newRequest(http.MethodGet, "/api/user/balance", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"current":400.5,"withdrawn":100}`, w.Body.String())
+
+	w = api.do(alice.ID, newRequest(http.MethodGet, "/api/user/balance?expiring=yes", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Points never expire by default.
+	w = api.do(alice.ID, newRequest(http.MethodGet, "/api/user/balance?expiring=true", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"current":400.5,"withdrawn":100,"expiring_soon":[]}`, w.Body.String())
+
+	// Refunds keep counting as withdrawn, see GET /api/user/balance/withdrawals.
+	_, err = api.store.Ledger.Refund(ctx, domain.Refund{OrderNumber: "2377225624"})
+	require.NoError(t, err)
+	w = api.do(alice.ID, newRequest(http.MethodGet, "/api/user/balance", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"current":500.5,"withdrawn":100}`, w.Body.String())
+}
+
+func TestGetBalance_Expiring(t *testing.T) {
+	const year = 365 * 24 * time.Hour
+	api := newTestAPI(t, func(deps *Deps) {
+		deps.Expiration = expiry.New(deps.Storage.Ledger, expiry.Config{After: year, Soon: 2 * year})
+	})
+	ctx := context.Background()
+	alice := api.createUser("alice")
+	_, err := api.store.Orders.Create(ctx, alice.ID, "12345678903")
+	require.NoError(t, err)
+	require.NoError(t, api.store.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessed, money.MustParse("500.5")))
+	require.NoError(t, api.store.Ledger.Withdraw(ctx, alice.ID, "2377225624", money.FromUnits(100), nil))
+
+	w := api.do(alice.ID, newRequest(http.MethodGet, "/api/user/balance?expiring=true", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Current      money.Amount `json:"current"`
+		ExpiringSoon []struct {
+			Sum       money.Amount `json:"sum"`
+			ExpiresAt time.Time    `json:"expires_at"`
+		} `json:"expiring_soon"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, money.MustParse("400.5"), resp.Current)
+	require.Len(t, resp.ExpiringSoon, 1)
+	assert.Equal(t, money.MustParse("400.5"), resp.ExpiringSoon[0].Sum)
+	assert.WithinDuration(t, time.Now().Add(year), resp.ExpiringSoon[0].ExpiresAt, time.Minute)
+}
+
+func TestGetWithdrawals(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+	alice := api.createUser("alice")
+
+	w := api.do(alice.ID, newRequest(http.MethodGet, "/api/user/balance/withdrawals", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	_, err := api.store.Orders.Create(ctx, alice.ID, "12345678903")
+	require.NoError(t, err)
+	require.NoError(t, api.store.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessed, money.FromUnits(500)))
+	require.NoError(t, api.store.Ledger.Withdraw(ctx, alice.ID, "2377225624", money.MustParse("100.5"), nil))
+	require.NoError(t, api.store.Ledger.Withdraw(ctx, alice.ID, "79927398713", money.FromUnits(50), nil))
+	_, err = api.store.Ledger.Refund(ctx, domain.Refund{OrderNumber: "2377225624"})
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusUnauthorized, api.do("", newRequest(http.MethodGet, "/api/user/balance/withdrawals", nil)).Code)
+	assert.Equal(t, http.StatusBadRequest,
+		api.do(alice.ID, newRequest(http.MethodGet, "/api/user/balance/withdrawals?refunds=maybe", nil)).Code)
+
+	w = api.do(alice.ID, newRequest(http.MethodGet, "/api/user/balance/withdrawals", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var plain []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &plain))
+	require.Len(t, plain, 2)
+	assert.Equal(t, "2377225624", plain[0]["order"])
+	assert.Equal(t, 100.5, plain[0]["sum"])
+	assert.Len(t, plain[0], 3)
+
+	w = api.do(alice.ID, newRequest(http.MethodGet, "/api/user/balance/withdrawals?refunds=true", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var withRefunds []withdrawalRefundResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &withRefunds))
+	require.Len(t, withRefunds, 2)
+	assert.True(t, withRefunds[0].Refunded)
+	assert.NotNil(t, withRefunds[0].RefundedAt)
+	assert.False(t, withRefunds[1].Refunded)
+	assert.Nil(t, withRefunds[1].RefundedAt)
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"expvar"
+	"net/http"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/reconcile"
+)
+
+type mismatchResponse struct {
+	Order    string       `json:"order"`
+	UserID   string       `json:"user_id"`
+	Expected money.Amount `json:"expected"`
+	Credited money.Amount `json:"credited"`
+	Fixed    bool         `json:"fixed"`
+	Error    string       `json:"error,omitempty"`
+}
+
+type reconciliationResponse struct {
+	StartedAt        time.Time               `json:"started_at"`
+	FinishedAt       time.Time               `json:"finished_at"`
+	WindowStart      time.Time               `json:"window_start"`
+	Checked          int                     `json:"checked"`
+	Skipped          int                     `json:"skipped"`
+	Mismatches       []mismatchResponse      `json:"mismatches"`
+	NegativeBalances map[string]money.Amount `json:"negative_balances"`
+	Error            string                  `json:"error,omitempty"`
+}
+
+// ReconciliationReport returns the report of the last reconciliation run.
+func ReconciliationReport(rec *reconcile.Reconciler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, ok := rec.LastReport()
+		if !ok {
+			WriteError(w, r, domain.ErrNotFound.WithMessage("reconciliation has not run yet"))
+			return
+		}
+
+		resp := reconciliationResponse{
+			StartedAt:        report.StartedAt,
+			FinishedAt:       report.FinishedAt,
+			WindowStart:      report.WindowStart,
+			Checked:          report.Checked,
+			Skipped:          report.Skipped,
+			Mismatches:       make([]mismatchResponse, 0, len(report.Mismatches)),
+			NegativeBalances: report.NegativeBalances,
+			Error:            report.Error,
+		}
+		if resp.NegativeBalances == nil {
+			resp.NegativeBalances = map[string]money.Amount{}
+		}
+		for _, m := range report.Mismatches {
+			resp.Mismatches = append(resp.Mismatches, mismatchResponse{
+				Order:    m.Order,
+				UserID:   m.UserID,
+				Expected: m.Expected,
+				Credited: m.Credited,
+				Fixed:    m.Fixed,
+				Error:    m.Error,
+			})
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// Metrics serves the metrics of the service published by expvar.
+func Metrics() http.HandlerFunc {
+	return expvar.Handler().ServeHTTP
+}
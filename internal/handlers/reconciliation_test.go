@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/accrual"
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/reconcile"
+)
+
+type accrualFunc func(ctx context.Context, number string) (accrual.Result, error)
+
+func (f accrualFunc) Order(ctx context.Context, number string) (accrual.Result, error) {
+	return f(ctx, number)
+}
+
+func TestReconciliationReport(t *testing.T) {
+	var rec *reconcile.Reconciler
+	api := newTestAPI(t, func(deps *Deps) {
+		source := accrualFunc(func(context.Context, string) (accrual.Result, error) {
+			return accrual.Result{Status: accrual.StatusProcessed, Accrual: money.FromUnits(120)}, nil
+		})
+		rec = reconcile.New(deps.Storage.Orders, deps.Storage.Ledger, source, deps.Audit, reconcile.Config{})
+		deps.Reconciler = rec
+	})
+	ctx := context.Background()
+	alice := api.createUser("alice")
+	_, err := api.store.Orders.Create(ctx, alice.ID, "12345678903")
+	require.NoError(t, err)
+	require.NoError(t, api.store.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessed, money.FromUnits(100)))
+
+	get := func(target string) *http.Response {
+		r := newRequest(http.MethodGet, target, nil)
+		r.Header.Set(AdminTokenHeader, testAdminToken)
+		return api.do("", r).Result()
+	}
+
+	assert.Equal(t, http.StatusNotFound, get("/admin/reconciliation").StatusCode)
+	assert.Equal(t, http.StatusForbidden, api.do(alice.ID, newRequest(http.MethodGet, "/admin/reconciliation", nil)).Code)
+
+	require.NoError(t, rec.Run(ctx))
+	resp := get("/admin/reconciliation")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var report reconciliationResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	assert.Equal(t, 1, report.Checked)
+	assert.Equal(t, []mismatchResponse{
+		{Order: "12345678903", UserID: alice.ID, Expected: money.FromUnits(120), Credited: money.FromUnits(100)},
+	}, report.Mismatches)
+
+	resp = get("/admin/metrics")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var metrics struct {
+		Reconciliation map[string]int64 `json:"reconciliation"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&metrics))
+	assert.Equal(t, int64(1), metrics.Reconciliation["last_run_mismatches"])
+}
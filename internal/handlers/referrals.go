@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/auth"
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/referral"
+)
+
+type referralCodeResponse struct {
+	Code string `json:"code"`
+}
+
+type referralResponse struct {
+	Login        string                `json:"login"`
+	Status       domain.ReferralStatus `json:"status"`
+	RegisteredAt time.Time             `json:"registered_at"`
+	Order        string                `json:"order,omitempty"`
+	RewardedAt   *time.Time            `json:"rewarded_at,omitempty"`
+}
+
+// GetReferralCode responds with the referral code of the user, to be
+// given at registration by the users they refer.
+func GetReferralCode(referrals *referral.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.UserIDFromContext(r.Context())
+		if !ok {
+			WriteError(w, r, domain.ErrUnauthorized)
+			return
+		}
+
+		code, err := referrals.Code(r.Context(), userID)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, referralCodeResponse{Code: code})
+	}
+}
+
+// ListReferrals lists the users referred by the user and the state of
+// their referral, oldest first, or responds 204 if there are none.
+func ListReferrals(referrals *referral.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.UserIDFromContext(r.Context())
+		if !ok {
+			WriteError(w, r, domain.ErrUnauthorized)
+			return
+		}
+
+		list, err := referrals.List(r.Context(), userID)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if len(list) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		resp := make([]referralResponse, 0, len(list))
+		for _, ref := range list {
+			item := referralResponse{
+				Login:        ref.ReferredLogin,
+				Status:       ref.Status,
+				RegisteredAt: ref.CreatedAt,
+				Order:        ref.OrderNumber,
+			}
+			if !ref.RewardedAt.IsZero() {
+				rewardedAt := ref.RewardedAt
+				item.RewardedAt = &rewardedAt
+			}
+			resp = append(resp, item)
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/referral"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+)
+
+func TestReferrals(t *testing.T) {
+	var svc *referral.Service
+	api := newTestAPI(t, func(d *Deps) {
+		svc = referral.New(d.Storage.Referrals, d.Storage.Orders, referral.Config{
+			ReferrerBonus: money.FromUnits(100),
+			ReferredBonus: money.FromUnits(50),
+		})
+		d.Referrals = svc
+	})
+	s := api.store
+	ctx := context.Background()
+	alice := api.createUser("alice")
+
+	do := func(userID, method, target, body string) *httptest.ResponseRecorder {
+		return api.do(userID, newRequest(method, target, strings.NewReader(body)))
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do("", http.MethodGet, "/api/user/referrals", "").Code)
+	assert.Equal(t, http.StatusNoContent, do(alice.ID, http.MethodGet, "/api/user/referrals", "").Code)
+
+	w := do(alice.ID, http.MethodGet, "/api/user/referrals/code", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var code referralCodeResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &code))
+	assert.NotEmpty(t, code.Code)
+	w = do(alice.ID, http.MethodGet, "/api/user/referrals/code", "")
+	assert.JSONEq(t, `{"code":"`+code.Code+`"}`, w.Body.String())
+
+	// An unknown code fails the registration.
+	w = do("", http.MethodPost, "/api/user/register", `{"login":"bob","password":"secret","referral_code":"NOSUCHCD"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	_, err := s.Users.GetByLogin(ctx, "bob")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	w = do("", http.MethodPost, "/api/user/register",
+		`{"login":"bob","password":"secret","referral_code":"`+strings.ToLower(code.Code)+`"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	bob, err := s.Users.GetByLogin(ctx, "bob")
+	require.NoError(t, err)
+
+	list := func() []referralResponse {
+		w := do(alice.ID, http.MethodGet, "/api/user/referrals", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp []referralResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+	referrals := list()
+	require.Len(t, referrals, 1)
+	assert.Equal(t, "bob", referrals[0].Login)
+	assert.Equal(t, domain.ReferralPending, referrals[0].Status)
+	assert.Nil(t, referrals[0].RewardedAt)
+	assert.Equal(t, http.StatusNoContent, do(bob.ID, http.MethodGet, "/api/user/referrals", "").Code)
+
+	_, err = s.Orders.Create(ctx, bob.ID, "12345678903")
+	require.NoError(t, err)
+	require.NoError(t, s.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessed, money.FromUnits(500)))
+	require.NoError(t, svc.Run(ctx))
+
+	referrals = list()
+	require.Len(t, referrals, 1)
+	assert.Equal(t, domain.ReferralRewarded, referrals[0].Status)
+	assert.Equal(t, "12345678903", referrals[0].Order)
+	assert.NotNil(t, referrals[0].RewardedAt)
+
+	b, err := s.Ledger.Balance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, money.FromUnits(100), b.Current)
+}
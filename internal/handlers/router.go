@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/paramonies/ya-gophermart/internal/audit"
+	"github.com/paramonies/ya-gophermart/internal/auth"
+	"github.com/paramonies/ya-gophermart/internal/balance"
+	"github.com/paramonies/ya-gophermart/internal/bruteforce"
+	"github.com/paramonies/ya-gophermart/internal/certs"
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/events"
+	"github.com/paramonies/ya-gophermart/internal/expiry"
+	"github.com/paramonies/ya-gophermart/internal/middleware"
+	"github.com/paramonies/ya-gophermart/internal/promo"
+	"github.com/paramonies/ya-gophermart/internal/reconcile"
+	"github.com/paramonies/ya-gophermart/internal/referral"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+)
+
+// Deps are the services the handlers use.
+type Deps struct {
+	Storage *storage.Storage
+	// Auth logs users in and authenticates their requests.
+	Auth *auth.Service
+	// Guard throttles logins and registrations.
+	Guard *bruteforce.Guard
+	// Audit records security and money-affecting events.
+	Audit *audit.Log
+	// Balances serves balances from snapshots, a service without a
+	// compactor over Storage if nil.
+	Balances *balance.Service
+	// Expiration lists the points expiring soon, none if nil.
+	Expiration *expiry.Service
+	// Promotions grants the registration bonuses, none if nil.
+	Promotions *promo.Engine
+	// Referrals runs the referral program, a service without bonuses over
+	// Storage if nil.
+	Referrals *referral.Service
+	// Events wakes up the event streams, see Events.
+	Events *events.Hub
+	// IdempotencyTTL is how long responses to requests with an
+	// Idempotency-Key are replayed, DefaultIdempotencyTTL if zero.
+	IdempotencyTTL time.Duration
+	// IdempotencyLease is how long the key of a request still being
+	// handled is held, DefaultIdempotencyLease if zero.
+	IdempotencyLease time.Duration
+	// AdminToken authenticates requests to /admin with the admin role,
+	// see AdminAuthenticate. Only access tokens are accepted if empty.
+	AdminToken string
+	// AdminRequireClientCert also requires a verified client certificate
+	// on the admin routes.
+	AdminRequireClientCert bool
+	// WebhooksAllowPrivateNetworks accepts webhook URLs pointing at
+	// loopback and private addresses.
+	WebhooksAllowPrivateNetworks bool
+	// Reconciler serves its last report on the admin routes, if not nil.
+	Reconciler *reconcile.Reconciler
+}
+
+// NewRouter returns the API router of the service.
+func NewRouter(deps Deps) *chi.Mux {
+	store := deps.Storage
+	idempotencyTTL := deps.IdempotencyTTL
+	if idempotencyTTL <= 0 {
+		idempotencyTTL = DefaultIdempotencyTTL
+	}
+	idempotencyLease := deps.IdempotencyLease
+	if idempotencyLease <= 0 {
+		idempotencyLease = DefaultIdempotencyLease
+	}
+	idempotent := Idempotent(store.Idempotency, idempotencyTTL, idempotencyLease)
+	balances := deps.Balances
+	if balances == nil {
+		balances = balance.New(store.Ledger, balance.Config{})
+	}
+	expiration := deps.Expiration
+	if expiration == nil {
+		expiration = expiry.New(store.Ledger, expiry.Config{})
+	}
+	referrals := deps.Referrals
+	if referrals == nil {
+		referrals = referral.New(store.Referrals, store.Orders, referral.Config{})
+	}
+
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(middleware.Decompress(middleware.DefaultMaxDecompressedSize, WriteError))
+	r.Use(middleware.Compress(middleware.CompressConfig{
+		MinSize:      middleware.DefaultMinCompressSize,
+		ContentTypes: middleware.DefaultCompressibleTypes,
+	}))
+
+	r.Post("/api/user/register", Register(deps.Auth, deps.Guard, deps.Audit, deps.Promotions, referrals))
+	r.Post("/api/user/login", Login(deps.Auth, deps.Guard, deps.Audit))
+	r.Post("/api/user/token/refresh", RefreshToken(deps.Auth))
+
+	r.Group(func(r chi.Router) {
+		r.Use(Authenticate(deps.Auth))
+
+		r.Post("/api/user/logout", Logout(deps.Auth))
+		r.Post("/api/user/logout/all", LogoutAll(deps.Auth))
+		r.Post("/api/user/password", ChangePassword(deps.Auth))
+
+		r.Group(func(r chi.Router) {
+			r.Use(RequireRole(domain.RoleUser))
+
+			r.With(idempotent).Post("/api/user/orders", UploadOrder(store.Orders))
+			r.Get("/api/user/orders", ListOrders(store.Orders))
+			r.Get("/api/user/balance", GetBalance(balances, expiration))
+			r.With(idempotent).Post("/api/user/balance/withdraw", Withdraw(store.Ledger, deps.Audit))
+			r.Get("/api/user/balance/withdrawals", GetWithdrawals(store.Ledger))
+			r.Get("/api/user/referrals", ListReferrals(referrals))
+			r.Get("/api/user/referrals/code", GetReferralCode(referrals))
+			r.Get("/api/user/events", Events(store.Outbox, deps.Events, DefaultHeartbeat))
+			r.Route("/api/user/webhooks", func(r chi.Router) {
+				r.Post("/", CreateWebhook(store.Webhooks, deps.WebhooksAllowPrivateNetworks))
+				r.Get("/", ListWebhooks(store.Webhooks))
+				r.Delete("/{id}", DeleteWebhook(store.Webhooks))
+				r.Get("/{id}/deliveries", ListWebhookDeliveries(store.Webhooks))
+			})
+		})
+	})
+
+	r.Route("/admin", func(r chi.Router) {
+		if deps.AdminRequireClientCert {
+			r.Use(certs.RequireClientCert)
+		}
+		r.Use(AdminAuthenticate(deps.AdminToken, deps.Auth))
+
+		staff := RequireRole(domain.RoleSupport, domain.RoleAdmin)
+		admin := RequireRole(domain.RoleAdmin)
+		r.With(staff).Get("/users", SearchUsers(store.Users))
+		r.With(staff).Get("/users/{id}/orders", ListUserOrders(store.Users, store.Orders))
+		r.With(staff).Get("/users/{id}/ledger", ListUserLedger(store.Users, store.Ledger))
+		r.With(staff).Post("/users/{id}/block", BlockUser(deps.Auth, deps.Audit))
+		r.With(staff).Post("/users/{id}/unblock", UnblockUser(deps.Auth, deps.Audit))
+		r.With(admin).Put("/users/{id}/roles", SetUserRoles(deps.Auth, deps.Audit))
+		r.With(admin).Post("/users/{id}/corrections", CorrectBalance(store.Ledger, deps.Audit))
+		r.With(admin).Get("/audit", ListAudit(store.Audit))
+		r.With(RequireRole(domain.RoleSupport, domain.RoleAdmin, domain.RoleService)).
+			Post("/orders/{number}/recheck", RecheckOrder(store.Orders, deps.Audit))
+		r.With(RequireRole(domain.RoleAdmin, domain.RoleService), idempotent).
+			Post("/withdrawals/{number}/refund", RefundWithdrawal(store.Ledger, deps.Audit))
+		r.With(RequireRole(domain.RoleAdmin, domain.RoleService)).Get("/metrics", Metrics())
+		if deps.Reconciler != nil {
+			r.With(staff).Get("/reconciliation", ReconciliationReport(deps.Reconciler))
+		}
+	})
+	return r
+}
@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/paramonies/ya-gophermart/internal/auth"
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/internal/webhooks"
+)
+
+const (
+	webhookSecretSize = 32
+
+	defaultDeliveriesPageSize = 50
+	maxDeliveriesPageSize     = 1000
+)
+
+type createWebhookRequest struct {
+	URL string `json:"url"`
+}
+
+// webhookResponse describes a subscription. The secret is only sent
+// once, in the response of CreateWebhook.
+type webhookResponse struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type deliveryResponse struct {
+	ID             int64           `json:"id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at,omitempty"`
+	LastStatusCode int             `json:"last_status_code,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+}
+
+// CreateWebhook subscribes the user to the status changes of their orders.
+// URLs pointing at non-public addresses are refused unless allowPrivate
+// is set.
+func CreateWebhook(repo storage.WebhookRepository, allowPrivate bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.UserIDFromContext(r.Context())
+		if !ok {
+			WriteError(w, r, domain.ErrUnauthorized)
+			return
+		}
+
+		var req createWebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			WriteError(w, r, domain.ErrBadRequest.WithMessage("malformed JSON body"))
+			return
+		}
+		if err := validateWebhookURL(req.URL, allowPrivate); err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		secret, err := newWebhookSecret()
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		sub, err := repo.CreateSubscription(r.Context(), userID, req.URL, secret)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, webhookResponse{
+			ID:        sub.ID,
+			URL:       sub.URL,
+			Secret:    sub.Secret,
+			CreatedAt: sub.CreatedAt,
+		})
+	}
+}
+
+// ListWebhooks lists the subscriptions of the user, without their secrets.
+func ListWebhooks(repo storage.WebhookRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.UserIDFromContext(r.Context())
+		if !ok {
+			WriteError(w, r, domain.ErrUnauthorized)
+			return
+		}
+
+		subs, err := repo.ListSubscriptions(r.Context(), userID)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if len(subs) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		resp := make([]webhookResponse, 0, len(subs))
+		for _, sub := range subs {
+			resp = append(resp, webhookResponse{ID: sub.ID, URL: sub.URL, CreatedAt: sub.CreatedAt})
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// DeleteWebhook removes a subscription of the user along with its
+// delivery log.
+func DeleteWebhook(repo storage.WebhookRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.UserIDFromContext(r.Context())
+		if !ok {
+			WriteError(w, r, domain.ErrUnauthorized)
+			return
+		}
+
+		err := repo.DeleteSubscription(r.Context(), userID, chi.URLParam(r, "id"))
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, r, domain.ErrNotFound.WithMessage("webhook not found"))
+			return
+		}
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ListWebhookDeliveries returns the delivery log of a subscription,
+// newest first. The optional limit parameter caps the number of entries.
+func ListWebhookDeliveries(repo storage.WebhookRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.UserIDFromContext(r.Context())
+		if !ok {
+			WriteError(w, r, domain.ErrUnauthorized)
+			return
+		}
+
+		limit := defaultDeliveriesPageSize
+		if v := r.URL.Query().Get(paramLimit); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxDeliveriesPageSize {
+				WriteError(w, r, domain.ErrBadRequest.WithMessage(
+					fmt.Sprintf("limit must be an integer between 1 and %d", maxDeliveriesPageSize)))
+				return
+			}
+			limit = n
+		}
+
+		id := chi.URLParam(r, "id")
+		found, err := hasSubscription(r, repo, userID, id)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if !found {
+			WriteError(w, r, domain.ErrNotFound.WithMessage("webhook not found"))
+			return
+		}
+
+		deliveries, err := repo.ListDeliveries(r.Context(), userID, id, limit)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+		if len(deliveries) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		resp := make([]deliveryResponse, 0, len(deliveries))
+		for _, d := range deliveries {
+			resp = append(resp, newDeliveryResponse(d))
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+func hasSubscription(r *http.Request, repo storage.WebhookRepository, userID, id string) (bool, error) {
+	subs, err := repo.ListSubscriptions(r.Context(), userID)
+	if err != nil {
+		return false, err
+	}
+	for _, sub := range subs {
+		if sub.ID == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func newDeliveryResponse(d domain.WebhookDelivery) deliveryResponse {
+	resp := deliveryResponse{
+		ID:             d.ID,
+		Event:          string(d.Event),
+		Payload:        d.Payload,
+		Status:         string(d.Status),
+		Attempts:       d.Attempts,
+		LastStatusCode: d.LastStatusCode,
+		LastError:      d.LastError,
+		CreatedAt:      d.CreatedAt,
+	}
+	if d.Status == domain.DeliveryPending {
+		resp.NextAttemptAt = &d.NextAttemptAt
+	}
+	if !d.DeliveredAt.IsZero() {
+		resp.DeliveredAt = &d.DeliveredAt
+	}
+	return resp
+}
+
+// validateWebhookURL accepts absolute http and https URLs. Unless
+// allowPrivate is set, their host must not be a non-public address, see
+// webhooks.CheckHost.
+func validateWebhookURL(raw string, allowPrivate bool) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return domain.ErrBadRequest.WithMessage("url must be an absolute http or https URL")
+	}
+	if !allowPrivate && webhooks.CheckHost(u.Hostname()) != nil {
+		return domain.ErrBadRequest.WithMessage("url must point at a public address")
+	}
+	return nil
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, webhookSecretSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
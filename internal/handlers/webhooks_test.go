@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+)
+
+func TestWebhooks(t *testing.T) {
+	api := newTestAPI(t)
+	s := api.store
+	ctx := context.Background()
+	alice := api.createUser("alice")
+	bob := api.createUser("bob")
+
+	do := func(userID, method, target, body string) *httptest.ResponseRecorder {
+		return api.do(userID, newRequest(method, target, strings.NewReader(body)))
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do("", http.MethodGet, "/api/user/webhooks", "").Code)
+	assert.Equal(t, http.StatusNoContent, do(alice.ID, http.MethodGet, "/api/user/webhooks", "").Code)
+	assert.Equal(t, http.StatusBadRequest, do(alice.ID, http.MethodPost, "/api/user/webhooks", `{"url":"ftp://x"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do(alice.ID, http.MethodPost, "/api/user/webhooks", `{`).Code)
+	for _, url := range []string{"http://127.0.0.1:8080/hook", "http://localhost/hook", "http://[::1]/hook", "https://10.1.2.3/hook"} {
+		assert.Equal(t, http.StatusBadRequest, do(alice.ID, http.MethodPost, "/api/user/webhooks", `{"url":"`+url+`"}`).Code, url)
+	}
+
+	w := do(alice.ID, http.MethodPost, "/api/user/webhooks", `{"url":"https://example.com/hook"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var created webhookResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.NotEmpty(t, created.ID)
+	assert.Len(t, created.Secret, 2*webhookSecretSize)
+
+	w = do(alice.ID, http.MethodGet, "/api/user/webhooks", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), created.Secret)
+	assert.Contains(t, w.Body.String(), "https://example.com/hook")
+
+	deliveries := "/api/user/webhooks/" + created.ID + "/deliveries"
+	assert.Equal(t, http.StatusNoContent, do(alice.ID, http.MethodGet, deliveries, "").Code)
+	assert.Equal(t, http.StatusNotFound, do(bob.ID, http.MethodGet, deliveries, "").Code)
+	assert.Equal(t, http.StatusBadRequest, do(alice.ID, http.MethodGet, deliveries+"?limit=0", "").Code)
+
+	_, err := s.Orders.Create(ctx, alice.ID, "12345678903")
+	require.NoError(t, err)
+	require.NoError(t, s.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessed, money.FromUnits(500)))
+
+	w = do(alice.ID, http.MethodGet, deliveries, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var log []deliveryResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &log))
+	require.Len(t, log, 1)
+	assert.Equal(t, "order.processed", log[0].Event)
+	assert.Equal(t, "pending", log[0].Status)
+	assert.NotNil(t, log[0].NextAttemptAt)
+
+	assert.Equal(t, http.StatusNotFound, do(bob.ID, http.MethodDelete, "/api/user/webhooks/"+created.ID, "").Code)
+	assert.Equal(t, http.StatusNoContent, do(alice.ID, http.MethodDelete, "/api/user/webhooks/"+created.ID, "").Code)
+	assert.Equal(t, http.StatusNotFound, do(alice.ID, http.MethodGet, deliveries, "").Code)
+}
+
+func TestCreateWebhook_AllowPrivateNetworks(t *testing.T) {
+	api := newTestAPI(t, func(deps *Deps) { deps.WebhooksAllowPrivateNetworks = true })
+	alice := api.createUser("alice")
+
+	w := api.do(alice.ID, newRequest(http.MethodPost, "/api/user/webhooks", strings.NewReader(`{"url":"http://127.0.0.1:8080/hook"}`)))
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
@@ -0,0 +1,311 @@
+package middleware
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+)
+
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+
+	// DefaultMinCompressSize is the response size below which compression
+	// costs more than it saves.
+	DefaultMinCompressSize = 1024
+	// DefaultMaxDecompressedSize bounds decompressed request bodies.
+	DefaultMaxDecompressedSize = 1 << 20
+)
+
+// DefaultCompressibleTypes are the response content types that are compressed.
+var DefaultCompressibleTypes = []string{"application/json", "text/plain"}
+
+// ErrorWriter responds with err, see handlers.WriteError.
+type ErrorWriter func(w http.ResponseWriter, r *http.Request, err error)
+
+// Decompress transparently decompresses gzip and deflate request bodies
+// according to Content-Encoding. Reading more than maxSize decompressed
+// bytes fails, which protects handlers from decompression bombs.
+// Malformed bodies and unknown encodings are answered by writeError with
+// domain.ErrBadRequest and domain.ErrUnsupportedEncoding.
+func Decompress(maxSize int64, writeError ErrorWriter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+
+			var body io.ReadCloser
+			switch encoding {
+			case "", "identity":
+				next.ServeHTTP(w, r)
+				return
+			case encodingGzip, "x-gzip":
+				zr, err := gzip.NewReader(r.Body)
+				if err != nil {
+					writeError(w, r, domain.ErrBadRequest.WithMessage("malformed gzip body"))
+					return
+				}
+				body = zr
+			case encodingDeflate:
+				body = newDeflateReader(r.Body)
+			default:
+				writeError(w, r, domain.ErrUnsupportedEncoding)
+				return
+			}
+			defer body.Close()
+
+			r.Body = http.MaxBytesReader(w, body, maxSize)
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// newDeflateReader accepts both the zlib-wrapped stream required by
+// RFC 9110 and the raw deflate stream some clients send instead.
+func newDeflateReader(r io.Reader) io.ReadCloser {
+	br := bufio.NewReader(r)
+	if header, err := br.Peek(2); err == nil && isZlibHeader(header) {
+		if zr, err := zlib.NewReader(br); err == nil {
+			return zr
+		}
+	}
+	return flate.NewReader(br)
+}
+
+func isZlibHeader(h []byte) bool {
+	return h[0]&0x0f == 8 && (uint16(h[0])<<8|uint16(h[1]))%31 == 0
+}
+
+// CompressConfig configures response compression.
+type CompressConfig struct {
+	// MinSize is the smallest response body that gets compressed.
+	MinSize int
+	// ContentTypes lists the media types that get compressed.
+	ContentTypes []string
+	// Level is the gzip/deflate compression level.
+	Level int
+}
+
+// Compress compresses responses with gzip or deflate according to
+// Accept-Encoding. Only the configured content types are compressed and
+// bodies smaller than MinSize are sent as is.
+func Compress(cfg CompressConfig) func(http.Handler) http.Handler {
+	types := make(map[string]struct{}, len(cfg.ContentTypes))
+	for _, t := range cfg.ContentTypes {
+		types[t] = struct{}{}
+	}
+	if cfg.Level == 0 {
+		cfg.Level = gzip.DefaultCompression
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding := negotiateEncoding(r.Header.Values("Accept-Encoding"))
+			if encoding == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{
+				ResponseWriter: w,
+				encoding:       encoding,
+				level:          cfg.Level,
+				minSize:        cfg.MinSize,
+				types:          types,
+				status:         http.StatusOK,
+			}
+			defer cw.close()
+
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// negotiateEncoding picks gzip over deflate among the accepted encodings.
+// An encoding refused with q=0 stays refused whatever "*" says.
+func negotiateEncoding(values []string) string {
+	accepted := make(map[string]bool)
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			coding, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			ok := true
+			if q, found := params["q"]; found {
+				f, err := strconv.ParseFloat(q, 64)
+				ok = err == nil && f > 0
+			}
+			accepted[coding] = ok
+		}
+	}
+
+	acceptable := func(coding string) bool {
+		if ok, found := accepted[coding]; found {
+			return ok
+		}
+		return accepted["*"]
+	}
+	switch {
+	case acceptable(encodingGzip):
+		return encodingGzip
+	case acceptable(encodingDeflate):
+		return encodingDeflate
+	}
+	return ""
+}
+
+// compressWriter buffers the beginning of the response until it knows
+// whether the body is worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+
+	encoding string
+	level    int
+	minSize  int
+	types    map[string]struct{}
+
+	status      int
+	buf         []byte
+	decided     bool
+	wroteHeader bool
+	enc         io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.status = status
+	if !cw.compressible() {
+		cw.passthrough()
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.decided {
+		if cw.enc != nil {
+			return cw.enc.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+
+	if cw.Header().Get("Content-Type") == "" {
+		cw.Header().Set("Content-Type", http.DetectContentType(p))
+	}
+	if !cw.compressible() {
+		cw.passthrough()
+		return cw.ResponseWriter.Write(p)
+	}
+
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= cw.minSize {
+		if err := cw.startCompression(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends what has been buffered so far, compressed if possible.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if cw.compressible() && len(cw.buf) > 0 {
+			_ = cw.startCompression()
+		} else {
+			cw.passthrough()
+		}
+	}
+	if f, ok := cw.enc.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) compressible() bool {
+	if cw.status < http.StatusOK || cw.status == http.StatusNoContent || cw.status == http.StatusNotModified {
+		return false
+	}
+	if cw.Header().Get("Content-Encoding") != "" {
+		return false
+	}
+
+	ct := cw.Header().Get("Content-Type")
+	if ct == "" {
+		// Not known until the first write.
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	_, ok := cw.types[mediaType]
+	return ok
+}
+
+func (cw *compressWriter) passthrough() {
+	if cw.decided {
+		return
+	}
+	cw.decided = true
+	cw.writeHeader()
+	if len(cw.buf) > 0 {
+		_, _ = cw.ResponseWriter.Write(cw.buf)
+		cw.buf = nil
+	}
+}
+
+func (cw *compressWriter) startCompression() error {
+	cw.decided = true
+
+	var err error
+	switch cw.encoding {
+	case encodingGzip:
+		cw.enc, err = gzip.NewWriterLevel(cw.ResponseWriter, cw.level)
+	case encodingDeflate:
+		cw.enc, err = zlib.NewWriterLevel(cw.ResponseWriter, cw.level)
+	}
+	if err != nil {
+		return err
+	}
+
+	h := cw.Header()
+	h.Set("Content-Encoding", cw.encoding)
+	h.Add("Vary", "Accept-Encoding")
+	h.Del("Content-Length")
+	cw.writeHeader()
+
+	_, err = cw.enc.Write(cw.buf)
+	cw.buf = nil
+	return err
+}
+
+func (cw *compressWriter) writeHeader() {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		// The whole body is below MinSize.
+		cw.passthrough()
+	}
+	if cw.enc != nil {
+		_ = cw.enc.Close()
+	}
+}
@@ -0,0 +1,199 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+)
+
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
+
+func gzipBytes(t *testing.T, p []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(p)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestDecompress(t *testing.T) {
+	var written error
+	writeError := func(w http.ResponseWriter, _ *http.Request, err error) {
+		written = err
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	h := Decompress(64, writeError)(http.HandlerFunc(echoHandler))
+	payload := []byte(`{"login":"user","password":"secret"}`)
+
+	t.Run("Gzip", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(gzipBytes(t, payload)))
+		r.Header.Set("Content-Encoding", "gzip")
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, payload, w.Body.Bytes())
+	})
+
+	t.Run("Deflate", func(t *testing.T) {
+		var zlibBuf, rawBuf bytes.Buffer
+		zw := zlib.NewWriter(&zlibBuf)
+		_, _ = zw.Write(payload)
+		require.NoError(t, zw.Close())
+		fw, _ := flate.NewWriter(&rawBuf, flate.DefaultCompression)
+		_, _ = fw.Write(payload)
+		require.NoError(t, fw.Close())
+
+		for _, body := range [][]byte{zlibBuf.Bytes(), rawBuf.Bytes()} {
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+			r.Header.Set("Content-Encoding", "deflate")
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, payload, w.Body.Bytes())
+		}
+	})
+
+	t.Run("Bomb", func(t *testing.T) {
+		bomb := gzipBytes(t, bytes.Repeat([]byte{'0'}, 1<<20))
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(bomb))
+		r.Header.Set("Content-Encoding", "gzip")
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	})
+
+	t.Run("UnsupportedEncoding", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("x"))
+		r.Header.Set("Content-Encoding", "br")
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, r)
+
+		assert.ErrorIs(t, written, domain.ErrUnsupportedEncoding)
+	})
+
+	t.Run("MalformedGzip", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("not gzip"))
+		r.Header.Set("Content-Encoding", "gzip")
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, r)
+
+		assert.ErrorIs(t, written, domain.ErrBadRequest)
+	})
+}
+
+func TestCompress(t *testing.T) {
+	large := `[` + strings.Repeat(`{"number":"9278923470","status":"PROCESSED"},`, 50) + `{}]`
+	respond := func(contentType, body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.WriteHeader(http.StatusOK)
+			_, _ = io.WriteString(w, body)
+		})
+	}
+	compress := Compress(CompressConfig{
+		MinSize:      256,
+		ContentTypes: []string{"application/json"},
+	})
+
+	t.Run("LargeJSON", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", "deflate, gzip")
+		w := httptest.NewRecorder()
+
+		compress(respond("application/json", large)).ServeHTTP(w, r)
+
+		assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+		zr, err := gzip.NewReader(w.Body)
+		require.NoError(t, err)
+		got, err := io.ReadAll(zr)
+		require.NoError(t, err)
+		assert.Equal(t, large, string(got))
+	})
+
+	t.Run("Deflate", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip;q=0, deflate")
+		w := httptest.NewRecorder()
+
+		compress(respond("application/json", large)).ServeHTTP(w, r)
+
+		assert.Equal(t, "deflate", w.Header().Get("Content-Encoding"))
+		zr, err := zlib.NewReader(w.Body)
+		require.NoError(t, err)
+		got, err := io.ReadAll(zr)
+		require.NoError(t, err)
+		assert.Equal(t, large, string(got))
+	})
+
+	t.Run("RefusedDespiteWildcard", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip;q=0, *")
+		w := httptest.NewRecorder()
+
+		compress(respond("application/json", large)).ServeHTTP(w, r)
+
+		assert.Equal(t, "deflate", w.Header().Get("Content-Encoding"))
+	})
+
+	t.Run("BelowMinSize", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+
+		compress(respond("application/json", `{"current":500.5}`)).ServeHTTP(w, r)
+
+		assert.Empty(t, w.Header().Get("Content-Encoding"))
+		assert.Equal(t, `{"current":500.5}`, w.Body.String())
+	})
+
+	t.Run("NotAllowedType", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+
+		compress(respond("image/png", large)).ServeHTTP(w, r)
+
+		assert.Empty(t, w.Header().Get("Content-Encoding"))
+		assert.Equal(t, large, w.Body.String())
+	})
+
+	t.Run("NotAccepted", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+
+		compress(respond("application/json", large)).ServeHTTP(w, r)
+
+		assert.Empty(t, w.Header().Get("Content-Encoding"))
+		assert.Equal(t, large, w.Body.String())
+	})
+}
@@ -0,0 +1,179 @@
+// Package money is the exact decimal amount of points used for accruals,
+// withdrawals and balances.
+//
+// An Amount is a count of hundredths of a point, so sums are exact where
+// binary floats are not: 0.1 + 0.2 is 0.3. Values with more decimals are
+// rounded half away from zero to Scale decimals when parsed or
+// multiplied, the only places where rounding happens. Amounts are JSON
+// numbers and NUMERIC in PostgreSQL.
+package money
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgtype"
+)
+
+// Scale is the number of decimals of an amount.
+const Scale = 2
+
+// unit is the number of hundredths in a point.
+const unit = 100
+
+// Amount is an exact number of points with Scale decimals.
+type Amount int64
+
+// ErrOutOfRange is returned for numbers that do not fit in an Amount.
+var ErrOutOfRange = errors.New("amount out of range")
+
+// FromUnits returns an amount of n whole points.
+func FromUnits(n int64) Amount {
+	return Amount(n * unit)
+}
+
+// Parse parses a decimal number such as "500", "-0.5" or "1e3", rounding
+// it half away from zero to Scale decimals.
+func Parse(s string) (Amount, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	r.Mul(r, big.NewRat(unit, 1))
+
+	a, ok := round(r)
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrOutOfRange, s)
+	}
+	return a, nil
+}
+
+// round rounds a number of hundredths half away from zero: it truncates
+// |r| + 1/2. It returns false if the result does not fit in an Amount.
+func round(r *big.Rat) (Amount, bool) {
+	neg := r.Sign() < 0
+	r = new(big.Rat).Abs(r)
+	r.Add(r, big.NewRat(1, 2))
+	minor := new(big.Int).Quo(r.Num(), r.Denom())
+	if neg {
+		minor.Neg(minor)
+	}
+	if !minor.IsInt64() {
+		return 0, false
+	}
+	return Amount(minor.Int64()), true
+}
+
+// Mul returns the amount multiplied by f, rounded half away from zero to
+// Scale decimals. It returns ErrOutOfRange if the product does not fit.
+func (a Amount) Mul(f *big.Rat) (Amount, error) {
+	r := new(big.Rat).SetInt64(int64(a))
+	p, ok := round(r.Mul(r, f))
+	if !ok {
+		return 0, ErrOutOfRange
+	}
+	return p, nil
+}
+
+// MustParse is like Parse but panics on error. It is meant for constants.
+func MustParse(s string) Amount {
+	a, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// String returns the amount as a decimal number without trailing zeros,
+// e.g. "500", "500.5" or "-0.05".
+func (a Amount) String() string {
+	return string(a.appendDecimal(nil))
+}
+
+func (a Amount) appendDecimal(buf []byte) []byte {
+	if a == math.MinInt64 {
+		// -a overflows, the digits are those of the unsigned value.
+		return append(buf, "-92233720368547758.08"...)
+	}
+
+	n := int64(a)
+	if n < 0 {
+		buf = append(buf, '-')
+		n = -n
+	}
+	buf = strconv.AppendInt(buf, n/unit, 10)
+	if frac := n % unit; frac != 0 {
+		buf = append(buf, '.', byte('0'+frac/10))
+		if frac%10 != 0 {
+			buf = append(buf, byte('0'+frac%10))
+		}
+	}
+	return buf
+}
+
+// MarshalJSON encodes the amount as a JSON number.
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return a.appendDecimal(nil), nil
+}
+
+// UnmarshalJSON decodes a JSON number. Strings are rejected, null leaves
+// the amount unchanged.
+func (a *Amount) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if s == "null" {
+		return nil
+	}
+	if s == "" || s[0] == '"' {
+		return fmt.Errorf("amount must be a JSON number, got %s", s)
+	}
+
+	v, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+// Value implements driver.Valuer: the amount is a decimal string, which
+// PostgreSQL reads as NUMERIC without rounding.
+func (a Amount) Value() (driver.Value, error) {
+	return a.String(), nil
+}
+
+// EncodeText implements pgtype.TextEncoder, so pgx sends the amount as a
+// decimal and not as its count of hundredths.
+func (a Amount) EncodeText(_ *pgtype.ConnInfo, buf []byte) ([]byte, error) {
+	return a.appendDecimal(buf), nil
+}
+
+// Scan implements sql.Scanner for NUMERIC columns. SQL NULL is zero.
+func (a *Amount) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case nil:
+		*a = 0
+		return nil
+	case string:
+		v, err := Parse(src)
+		if err != nil {
+			return err
+		}
+		*a = v
+		return nil
+	case []byte:
+		return a.Scan(string(src))
+	case int64:
+		if src > math.MaxInt64/unit || src < math.MinInt64/unit {
+			return fmt.Errorf("%w: %d", ErrOutOfRange, src)
+		}
+		*a = FromUnits(src)
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into money.Amount", src)
+	}
+}
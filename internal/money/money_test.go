@@ -0,0 +1,113 @@
+package money
+
+import (
+	"encoding/json"
+	"math"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	for s, want := range map[string]Amount{
+		"0":        0,
+		"500":      50000,
+		"500.5":    50050,
+		"-0.05":    -5,
+		"1e3":      100000,
+		"0.005":    1,
+		"0.0049":   0,
+		"-0.005":   -1,
+		"2.675":    268,
+		"1.999999": 200,
+	} {
+		got, err := Parse(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, want, got, s)
+	}
+
+	for _, s := range []string{"", "abc", "1,5", "NaN", "1e30"} {
+		_, err := Parse(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestAmount_Exact(t *testing.T) {
+	sum := MustParse("0.1") + MustParse("0.2")
+	assert.Equal(t, MustParse("0.3"), sum)
+	assert.Equal(t, "0.3", sum.String())
+}
+
+func TestAmount_Mul(t *testing.T) {
+	for _, tc := range []struct {
+		a    string
+		f    *big.Rat
+		want string
+	}{
+		{"500.5", big.NewRat(1, 1), "500.5"},
+		{"500.5", big.NewRat(1, 2), "250.25"},
+		{"0.05", big.NewRat(1, 2), "0.03"},
+		{"-0.05", big.NewRat(1, 2), "-0.03"},
+		{"100", big.NewRat(3, 2), "150"},
+	} {
+		got, err := MustParse(tc.a).Mul(tc.f)
+		require.NoError(t, err)
+		assert.Equal(t, MustParse(tc.want), got, "%s * %s", tc.a, tc.f)
+	}
+
+	_, err := Amount(math.MaxInt64).Mul(big.NewRat(2, 1))
+	assert.ErrorIs(t, err, ErrOutOfRange)
+}
+
+func TestAmount_String(t *testing.T) {
+	for a, want := range map[Amount]string{
+		0:      "0",
+		50000:  "500",
+		50050:  "500.5",
+		50005:  "500.05",
+		-5:     "-0.05",
+		-12345: "-123.45",
+	} {
+		assert.Equal(t, want, a.String())
+	}
+}
+
+func TestAmount_JSON(t *testing.T) {
+	var v struct {
+		Sum     Amount  `json:"sum"`
+		Accrual *Amount `json:"accrual,omitempty"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(`{"sum":751.1,"accrual":null}`), &v))
+	assert.Equal(t, Amount(75110), v.Sum)
+	assert.Nil(t, v.Accrual)
+
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"sum":751.1}`, string(b))
+
+	assert.Error(t, json.Unmarshal([]byte(`{"sum":"751.1"}`), &v))
+	assert.Error(t, json.Unmarshal([]byte(`{"sum":true}`), &v))
+}
+
+func TestAmount_Scan(t *testing.T) {
+	var a Amount
+	require.NoError(t, a.Scan("500.50"))
+	assert.Equal(t, MustParse("500.5"), a)
+	require.NoError(t, a.Scan([]byte("-1.25")))
+	assert.Equal(t, Amount(-125), a)
+	require.NoError(t, a.Scan(int64(3)))
+	assert.Equal(t, FromUnits(3), a)
+	require.NoError(t, a.Scan(nil))
+	assert.Equal(t, Amount(0), a)
+	assert.Error(t, a.Scan(1.5))
+
+	v, err := MustParse("500.5").Value()
+	require.NoError(t, err)
+	assert.Equal(t, "500.5", v)
+
+	buf, err := MustParse("-0.05").EncodeText(nil, []byte("x"))
+	require.NoError(t, err)
+	assert.Equal(t, "x-0.05", string(buf))
+}
@@ -0,0 +1,217 @@
+// Package outbox delivers the events of the transactional outbox to
+// external sinks. Delivery is at least once and in order for each user:
+// an event is marked delivered only after the sink accepted it, and the
+// later events of a user wait while an earlier one is being retried. An
+// event that still fails after the maximum number of attempts is
+// dead-lettered, kept in the outbox but no longer published, so that the
+// later events of its user go out.
+//
+// Dispatchers of several instances may share the outbox: each event is
+// claimed by one of them for claimLease, so a dispatcher that dies with
+// claimed events holds them back for that long.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/pkg/log"
+)
+
+const (
+	defaultPollInterval = time.Second
+	defaultBatchSize    = 100
+	defaultMaxAttempts  = 20
+
+	claimLease = 5 * time.Minute
+
+	minRetryDelay = time.Second
+	maxRetryDelay = 5 * time.Minute
+)
+
+// Message is what sinks publish for an event.
+type Message struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	UserID    string          `json:"user_id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// NewMessage returns the message of the event.
+func NewMessage(e domain.OutboxEvent) Message {
+	return Message{
+		ID:        e.ID,
+		Type:      string(e.Type),
+		UserID:    e.UserID,
+		CreatedAt: e.CreatedAt,
+		Payload:   e.Payload,
+	}
+}
+
+// Sink publishes messages. Publish may be called again with a message it
+// already accepted, consumers deduplicate by Message.ID.
+type Sink interface {
+	Publish(ctx context.Context, m Message) error
+}
+
+// Dispatcher polls the outbox and publishes pending events to a sink.
+type Dispatcher struct {
+	repo         storage.OutboxRepository
+	sink         Sink
+	pollInterval time.Duration
+	batchSize    int
+	maxAttempts  int
+	now          func() time.Time
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewDispatcher returns a dispatcher polling every pollInterval for up to
+// batchSize events, each published at most maxAttempts times. Zero values
+// select the defaults.
+func NewDispatcher(repo storage.OutboxRepository, sink Sink, pollInterval time.Duration, batchSize, maxAttempts int) *Dispatcher {
+	if pollInterval <= 0 {
+		pollInterval = defaultPollInterval
+	}
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+
+	return &Dispatcher{
+		repo:         repo,
+		sink:         sink,
+		pollInterval: pollInterval,
+		batchSize:    batchSize,
+		maxAttempts:  maxAttempts,
+		now:          time.Now,
+		stop:         make(chan struct{}),
+	}
+}
+
+// Start starts polling in the background.
+func (d *Dispatcher) Start(context.Context) error {
+	d.wg.Add(1)
+	go d.run()
+	return nil
+}
+
+// Stop stops polling and waits for the current batch to finish. It may be
+// called more than once.
+func (d *Dispatcher) Stop(ctx context.Context) error {
+	d.stopOnce.Do(func() { close(d.stop) })
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *Dispatcher) run() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-d.stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		if _, err := d.DispatchOnce(ctx); err != nil {
+			log.Error(ctx, "failed to dispatch outbox events", err)
+		}
+		cancel()
+	}
+}
+
+// DispatchOnce publishes the due events until there are none left or
+// batchSize of them were attempted, and returns how many were delivered.
+// Each claim takes the oldest pending event of every user, so a user with
+// many events does not hold back the others.
+func (d *Dispatcher) DispatchOnce(ctx context.Context) (int, error) {
+	delivered, attempted := 0, 0
+	for attempted < d.batchSize {
+		now := d.now()
+		events, err := d.repo.Claim(ctx, now, claimLease, d.batchSize-attempted)
+		if err != nil {
+			return delivered, err
+		}
+		if len(events) == 0 {
+			break
+		}
+
+		for _, e := range events {
+			attempted++
+			if err := d.sink.Publish(ctx, NewMessage(e)); err != nil {
+				if err := d.fail(ctx, e, now, err); err != nil {
+					return delivered, err
+				}
+				continue
+			}
+
+			if err := d.repo.MarkDelivered(ctx, e.ID); err != nil {
+				return delivered, err
+			}
+			delivered++
+		}
+	}
+
+	return delivered, nil
+}
+
+// fail schedules the retry of an event the sink refused, or dead-letters
+// it after maxAttempts.
+func (d *Dispatcher) fail(ctx context.Context, e domain.OutboxEvent, now time.Time, reason error) error {
+	attempts := e.Attempts + 1
+	if attempts >= d.maxAttempts {
+		log.Error(ctx, "giving up on outbox event", reason, "event_id", e.ID, "user_id", e.UserID,
+			"attempts", attempts)
+		return d.repo.MarkDead(ctx, e.ID, reason.Error())
+	}
+
+	retryAt := now.Add(retryDelay(e.Attempts))
+	log.Warning(ctx, "failed to publish outbox event", "event_id", e.ID, "attempts", attempts,
+		"retry_at", retryAt, "error", reason.Error())
+	return d.repo.MarkFailed(ctx, e.ID, retryAt, reason.Error())
+}
+
+// retryDelay doubles with every failed attempt, up to maxRetryDelay.
+func retryDelay(attempts int) time.Duration {
+	delay := minRetryDelay
+	for i := 0; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
@@ -0,0 +1,186 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/internal/storage/memory"
+)
+
+// fakeSink records published messages and fails for the users in failFor.
+type fakeSink struct {
+	published []Message
+	failFor   map[string]bool
+}
+
+func (s *fakeSink) Publish(_ context.Context, m Message) error {
+	if s.failFor[m.UserID] {
+		return errors.New("sink is down")
+	}
+	s.published = append(s.published, m)
+	return nil
+}
+
+func newUserWithEvents(t *testing.T, s *storage.Storage, login, order string) domain.User {
+	t.Helper()
+	ctx := context.Background()
+
+	u, err := s.Users.Create(ctx, login, "hash")
+	require.NoError(t, err)
+	_, err = s.Orders.Create(ctx, u.ID, order)
+	require.NoError(t, err)
+	require.NoError(t, s.Orders.UpdateStatus(ctx, order, domain.OrderStatusProcessed, money.FromUnits(100)))
+	require.NoError(t, s.Ledger.Withdraw(ctx, u.ID, order+"-w", money.FromUnits(40), nil))
+
+	return u
+}
+
+func TestDispatcher_DeliversInOrder(t *testing.T) {
+	s := memory.NewStorage()
+	alice := newUserWithEvents(t, s, "alice", "1")
+	bob := newUserWithEvents(t, s, "bob", "2")
+
+	sink := &fakeSink{failFor: map[string]bool{alice.ID: true}}
+	d := NewDispatcher(s.Outbox, sink, time.Second, 10, 3)
+	now := time.Now()
+	d.now = func() time.Time { return now }
+
+	delivered, err := d.DispatchOnce(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 3, delivered)
+	require.Len(t, sink.published, 3)
+	assert.Equal(t, bob.ID, sink.published[0].UserID)
+	assert.Equal(t, "order.processed", sink.published[0].Type)
+	assert.Equal(t, "balance.credited", sink.published[1].Type)
+	assert.Equal(t, "balance.withdrawn", sink.published[2].Type)
+
+	// Alice's first event failed, so the later ones were not tried either.
+	pending, err := s.Outbox.UserEvents(context.Background(), alice.ID, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, pending, 3)
+	assert.Equal(t, 1, pending[0].Attempts)
+	assert.Equal(t, 0, pending[1].Attempts)
+	assert.Equal(t, 0, pending[2].Attempts)
+
+	// The sink recovers, but the retry is not due yet.
+	sink.failFor = nil
+	delivered, err = d.DispatchOnce(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, delivered)
+
+	now = now.Add(minRetryDelay)
+	delivered, err = d.DispatchOnce(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 3, delivered)
+	assert.Equal(t, "order.processed", sink.published[3].Type)
+	assert.Equal(t, "balance.credited", sink.published[4].Type)
+	assert.Equal(t, "balance.withdrawn", sink.published[5].Type)
+	assert.Less(t, sink.published[4].ID, sink.published[5].ID)
+}
+
+func TestDispatcher_DeadLetter(t *testing.T) {
+	s := memory.NewStorage()
+	alice := newUserWithEvents(t, s, "alice", "1")
+
+	sink := &fakeSink{failFor: map[string]bool{alice.ID: true}}
+	d := NewDispatcher(s.Outbox, sink, time.Second, 10, 2)
+	now := time.Now()
+	d.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		delivered, err := d.DispatchOnce(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 0, delivered)
+		now = now.Add(maxRetryDelay)
+	}
+
+	// The first event is given up on after two attempts, the later ones
+	// go out once the sink recovers.
+	sink.failFor = nil
+	delivered, err := d.DispatchOnce(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, delivered)
+	require.Len(t, sink.published, 2)
+	assert.Equal(t, "balance.credited", sink.published[0].Type)
+	assert.Equal(t, "balance.withdrawn", sink.published[1].Type)
+
+	events, err := s.Outbox.UserEvents(context.Background(), alice.ID, 0, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 2, events[0].Attempts)
+
+	delivered, err = d.DispatchOnce(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, delivered)
+}
+
+func TestDispatcher_ClaimsOncePerUser(t *testing.T) {
+	s := memory.NewStorage()
+	newUserWithEvents(t, s, "alice", "1")
+	newUserWithEvents(t, s, "bob", "2")
+
+	// A batch of two reaches both users instead of the first two events
+	// of the first one.
+	sink := &fakeSink{}
+	d := NewDispatcher(s.Outbox, sink, time.Second, 2, 0)
+	delivered, err := d.DispatchOnce(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, delivered)
+	require.Len(t, sink.published, 2)
+	assert.NotEqual(t, sink.published[0].UserID, sink.published[1].UserID)
+}
+
+func TestDispatcher_StartStop(t *testing.T) {
+	s := memory.NewStorage()
+	newUserWithEvents(t, s, "alice", "1")
+
+	sink := NewWriterSink(io.Discard)
+	d := NewDispatcher(s.Outbox, sink, 10*time.Millisecond, 10, 0)
+	require.NoError(t, d.Start(context.Background()))
+
+	assert.Eventually(t, func() bool {
+		pending, err := s.Outbox.Claim(context.Background(), time.Now(), time.Millisecond, 10)
+		return err == nil && len(pending) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, d.Stop(context.Background()))
+	require.NoError(t, d.Stop(context.Background()))
+}
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, time.Second, retryDelay(0))
+	assert.Equal(t, 8*time.Second, retryDelay(3))
+	assert.Equal(t, maxRetryDelay, retryDelay(100))
+}
+
+func TestWebhookSink(t *testing.T) {
+	var got Message
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "42", r.Header.Get(EventIDHeader))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	sink := NewWebhookSink(srv.URL)
+	m := Message{ID: 42, Type: "balance.credited", UserID: "u", Payload: json.RawMessage(`{"amount":1}`)}
+
+	require.NoError(t, sink.Publish(context.Background(), m))
+	assert.Equal(t, int64(42), got.ID)
+	assert.JSONEq(t, `{"amount":1}`, string(got.Payload))
+
+	status = http.StatusBadGateway
+	assert.Error(t, sink.Publish(context.Background(), m))
+}
@@ -0,0 +1,77 @@
+// Package promo grants promotional bonuses on top of the accrual.
+//
+// Promotions are declarative rules, see Rule. The engine only computes the
+// bonuses; the storage grants them in the transaction of their trigger, so
+// none is missed. The bonuses of registration rules, from
+// RegistrationBonuses, are granted along with the user, see
+// domain.Registration. The bonuses of order rules, from OrderBonuses, are
+// granted along with the update moving the order to PROCESSED, see
+// domain.StatusUpdate. Each bonus is a ledger entry carrying the ID of
+// its rule, granted once per user and order.
+package promo
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+)
+
+// Engine evaluates the rules.
+type Engine struct {
+	rules []Rule
+	now   func() time.Time
+}
+
+// New returns an engine evaluating rules.
+func New(rules []Rule) *Engine {
+	return &Engine{rules: rules, now: time.Now}
+}
+
+// RegistrationBonuses returns the bonuses of the registration rules for a
+// user signing up now, granted along with the user, see
+// domain.Registration.
+func (e *Engine) RegistrationBonuses() []domain.Bonus {
+	now := e.now()
+	var bonuses []domain.Bonus
+	for _, rule := range e.rules {
+		if rule.Trigger != TriggerRegistration || !rule.active(now) {
+			continue
+		}
+		bonuses = append(bonuses, domain.Bonus{
+			RuleID: rule.ID,
+			Amount: rule.Bonus,
+			Reason: fmt.Sprintf("promotion %s", rule.ID),
+		})
+	}
+	return bonuses
+}
+
+// OrderBonuses returns the bonuses of the order rules for o, with its
+// accrual, being processed now, granted along with the update moving it
+// to PROCESSED, see domain.StatusUpdate.
+func (e *Engine) OrderBonuses(o domain.Order) ([]domain.Bonus, error) {
+	now := e.now()
+	var bonuses []domain.Bonus
+	for _, rule := range e.rules {
+		if rule.Trigger != TriggerOrderProcessed || !rule.active(now) {
+			continue
+		}
+
+		amount, err := rule.bonus(o.Accrual)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute bonus of rule %s for order %s: %w", rule.ID, o.Number, err)
+		}
+		if amount <= 0 {
+			continue
+		}
+		bonuses = append(bonuses, domain.Bonus{
+			RuleID:      rule.ID,
+			Amount:      amount,
+			Reason:      fmt.Sprintf("promotion %s for order %s", rule.ID, o.Number),
+			OncePerUser: rule.FirstOrder,
+			FirstOrder:  rule.FirstOrder,
+		})
+	}
+	return bonuses, nil
+}
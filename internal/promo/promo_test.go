@@ -0,0 +1,135 @@
+package promo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/internal/storage/memory"
+)
+
+func TestParseRule(t *testing.T) {
+	rule, err := ParseRule(Spec{ID: "welcome", Trigger: "registration", Bonus: "100.5"})
+	require.NoError(t, err)
+	assert.Equal(t, Rule{ID: "welcome", Trigger: TriggerRegistration, Bonus: money.MustParse("100.5")}, rule)
+
+	rule, err = ParseRule(Spec{
+		ID:         "autumn",
+		Trigger:    "order_processed",
+		Multiplier: "1.5",
+		FirstOrder: true,
+		From:       "2026-10-01T00:00:00Z",
+		To:         "2026-11-01T00:00:00Z",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "3/2", rule.Multiplier.String())
+	assert.True(t, rule.FirstOrder)
+	assert.Equal(t, time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), rule.From)
+
+	for _, spec := range []Spec{
+		{Trigger: "registration", Bonus: "100"},
+		{ID: "r", Trigger: "login", Bonus: "100"},
+		{ID: "referral", Trigger: "registration", Bonus: "100"},
+		{ID: "r", Trigger: "registration"},
+		{ID: "r", Trigger: "registration", Bonus: "-1"},
+		{ID: "r", Trigger: "registration", Multiplier: "2"},
+		{ID: "r", Trigger: "registration", Bonus: "1", FirstOrder: true},
+		{ID: "r", Trigger: "order_processed", Bonus: "1", Multiplier: "2"},
+		{ID: "r", Trigger: "order_processed", Multiplier: "1"},
+		{ID: "r", Trigger: "order_processed", Bonus: "1", From: "yesterday"},
+		{ID: "r", Trigger: "order_processed", Bonus: "1", From: "2026-11-01T00:00:00Z", To: "2026-10-01T00:00:00Z"},
+	} {
+		_, err := ParseRule(spec)
+		assert.Error(t, err, "%+v", spec)
+	}
+
+	_, err = ParseRules([]Spec{
+		{ID: "r", Trigger: "registration", Bonus: "1"},
+		{ID: "r", Trigger: "order_processed", Bonus: "1"},
+	})
+	assert.Error(t, err)
+}
+
+// process moves the order to PROCESSED with the bonuses of e.
+func process(t *testing.T, s *storage.Storage, e *Engine, number string, accrual money.Amount) {
+	t.Helper()
+
+	ctx := context.Background()
+	o, err := s.Orders.Get(ctx, number)
+	require.NoError(t, err)
+	o.Accrual = accrual
+	b, err := e.OrderBonuses(o)
+	require.NoError(t, err)
+	require.NoError(t, s.Orders.Update(ctx, domain.StatusUpdate{
+		Number:  number,
+		Status:  domain.OrderStatusProcessed,
+		Accrual: accrual,
+		Bonuses: b,
+	}))
+}
+
+func bonuses(t *testing.T, s *storage.Storage, userID string) map[string]money.Amount {
+	t.Helper()
+
+	entries, err := s.Ledger.Entries(context.Background(), userID)
+	require.NoError(t, err)
+	got := make(map[string]money.Amount)
+	for _, e := range entries {
+		if e.Kind == domain.EntryBonus {
+			got[e.RuleID+" "+e.OrderNumber] += e.Amount
+		}
+	}
+	return got
+}
+
+func TestEngine(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+
+	rules, err := ParseRules([]Spec{
+		{ID: "welcome", Trigger: "registration", Bonus: "100"},
+		{ID: "ended", Trigger: "registration", Bonus: "100", To: "2020-01-01T00:00:00Z"},
+		{ID: "first-x2", Trigger: "order_processed", Multiplier: "2", FirstOrder: true},
+		{ID: "campaign", Trigger: "order_processed", Bonus: "10.5"},
+		{ID: "upcoming", Trigger: "order_processed", Bonus: "1000", From: "2100-01-01T00:00:00Z"},
+	})
+	require.NoError(t, err)
+	e := New(rules)
+
+	assert.Equal(t, []domain.Bonus{{RuleID: "welcome", Amount: money.FromUnits(100), Reason: "promotion welcome"}},
+		e.RegistrationBonuses())
+	alice, err := s.Users.Register(ctx, domain.Registration{Login: "alice", PasswordHash: "hash", Bonuses: e.RegistrationBonuses()})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]money.Amount{"welcome ": money.FromUnits(100)}, bonuses(t, s, alice.ID))
+
+	// The order uploaded first is processed last.
+	for _, number := range []string{"12345678903", "79927398713"} {
+		_, err = s.Orders.Create(ctx, alice.ID, number)
+		require.NoError(t, err)
+	}
+	process(t, s, e, "79927398713", money.MustParse("250.25"))
+	process(t, s, e, "12345678903", money.FromUnits(500))
+
+	assert.Equal(t, map[string]money.Amount{
+		"welcome ":             money.FromUnits(100),
+		"first-x2 79927398713": money.MustParse("250.25"),
+		"campaign 79927398713": money.MustParse("10.5"),
+		"campaign 12345678903": money.MustParse("10.5"),
+	}, bonuses(t, s, alice.ID))
+
+	// Rules apply to the time of processing, however old the order is.
+	e.now = func() time.Time { return time.Date(2100, 6, 1, 0, 0, 0, 0, time.UTC) }
+	b, err := e.OrderBonuses(domain.Order{Number: "2377225624", UploadedAt: time.Now()})
+	require.NoError(t, err)
+	ids := make([]string, 0, len(b))
+	for _, bonus := range b {
+		ids = append(ids, bonus.RuleID)
+	}
+	assert.Equal(t, []string{"campaign", "upcoming"}, ids)
+}
@@ -0,0 +1,162 @@
+package promo
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+)
+
+// Trigger is the event a rule is evaluated on.
+type Trigger string
+
+const (
+	// TriggerRegistration grants the bonus to new users.
+	TriggerRegistration Trigger = "registration"
+	// TriggerOrderProcessed grants the bonus for orders reaching PROCESSED.
+	TriggerOrderProcessed Trigger = "order_processed"
+)
+
+// Rule is a promotion: the bonus granted on its trigger when its
+// conditions hold.
+type Rule struct {
+	ID      string
+	Trigger Trigger
+	// Bonus is a fixed number of points.
+	Bonus money.Amount
+	// Multiplier, if not nil, multiplies the accrual of the order: the
+	// bonus is the accrual times Multiplier minus one, so 2 doubles it.
+	Multiplier *big.Rat
+	// FirstOrder restricts the rule to the first order of the user to
+	// reach PROCESSED.
+	FirstOrder bool
+	// From and To bound when the rule applies, inclusive and exclusive
+	// respectively, to the processing of orders and to registrations.
+	// Zero values leave the range open.
+	From time.Time
+	To   time.Time
+}
+
+// Spec is a rule as written in the configuration. Amounts and
+// multipliers are decimal numbers, times RFC3339.
+type Spec struct {
+	ID         string
+	Trigger    string
+	Bonus      string
+	Multiplier string
+	FirstOrder bool
+	From       string
+	To         string
+}
+
+// ParseRule parses the rule of spec. A rule grants either a fixed Bonus
+// or a Multiplier of the accrual, the latter only for orders.
+func ParseRule(spec Spec) (Rule, error) {
+	rule := Rule{
+		ID:         strings.TrimSpace(spec.ID),
+		Trigger:    Trigger(spec.Trigger),
+		FirstOrder: spec.FirstOrder,
+	}
+	if rule.ID == "" {
+		return Rule{}, fmt.Errorf("rule without an ID")
+	}
+	if rule.ID == domain.ReferralRuleID {
+		return Rule{}, fmt.Errorf("rule ID %q is reserved for referrals", rule.ID)
+	}
+	fail := func(format string, args ...interface{}) (Rule, error) {
+		return Rule{}, fmt.Errorf("rule %q: %s", rule.ID, fmt.Sprintf(format, args...))
+	}
+
+	switch rule.Trigger {
+	case TriggerRegistration:
+		if rule.FirstOrder {
+			return fail("first_order needs the %s trigger", TriggerOrderProcessed)
+		}
+	case TriggerOrderProcessed:
+	default:
+		return fail("unknown trigger %q", spec.Trigger)
+	}
+
+	switch {
+	case spec.Bonus != "" && spec.Multiplier != "":
+		return fail("bonus and multiplier are exclusive")
+	case spec.Bonus != "":
+		bonus, err := money.Parse(spec.Bonus)
+		if err != nil {
+			return fail("bad bonus: %s", err)
+		}
+		if bonus <= 0 {
+			return fail("bonus must be positive")
+		}
+		rule.Bonus = bonus
+	case spec.Multiplier != "":
+		if rule.Trigger != TriggerOrderProcessed {
+			return fail("multiplier needs the %s trigger", TriggerOrderProcessed)
+		}
+		m, ok := new(big.Rat).SetString(strings.TrimSpace(spec.Multiplier))
+		if !ok || m.Cmp(big.NewRat(1, 1)) <= 0 {
+			return fail("multiplier must be a number above 1")
+		}
+		rule.Multiplier = m
+	default:
+		return fail("bonus or multiplier is required")
+	}
+
+	var err error
+	if rule.From, err = parseTime(spec.From); err != nil {
+		return fail("bad from: %s", err)
+	}
+	if rule.To, err = parseTime(spec.To); err != nil {
+		return fail("bad to: %s", err)
+	}
+	if !rule.From.IsZero() && !rule.To.IsZero() && !rule.From.Before(rule.To) {
+		return fail("from must be before to")
+	}
+
+	return rule, nil
+}
+
+// ParseRules parses the rules of specs, whose IDs must be unique.
+func ParseRules(specs []Spec) ([]Rule, error) {
+	rules := make([]Rule, 0, len(specs))
+	ids := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		rule, err := ParseRule(spec)
+		if err != nil {
+			return nil, err
+		}
+		if ids[rule.ID] {
+			return nil, fmt.Errorf("rule %q: duplicate ID", rule.ID)
+		}
+		ids[rule.ID] = true
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// active reports whether the rule applies at t.
+func (r Rule) active(t time.Time) bool {
+	if !r.From.IsZero() && t.Before(r.From) {
+		return false
+	}
+	return r.To.IsZero() || t.Before(r.To)
+}
+
+// bonus returns the bonus of the rule for an accrual.
+func (r Rule) bonus(accrual money.Amount) (money.Amount, error) {
+	if r.Multiplier == nil {
+		return r.Bonus, nil
+	}
+	extra := new(big.Rat).Sub(r.Multiplier, big.NewRat(1, 1))
+	return accrual.Mul(extra)
+}
@@ -0,0 +1,281 @@
+// Package reconcile checks the ledger against the accrual system.
+//
+// A run reads the final accrual of the PROCESSED orders uploaded within
+// a window, compares it to what the ledger credited for each order, and
+// lists the users whose balance is negative. Differences are reported in
+// the last Report and in the expvar metrics under "reconciliation". With
+// AutoFix, each difference is settled by a correction entry carrying the
+// order number, which later runs count as credited.
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/accrual"
+	"github.com/paramonies/ya-gophermart/internal/audit"
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/pkg/log"
+)
+
+const (
+	defaultWindow    = 24 * time.Hour
+	defaultBatchSize = 100
+
+	// Operator is the operator of the corrections made by AutoFix.
+	Operator = "reconciliation"
+)
+
+// Metrics of the runs, published by expvar.
+var (
+	metricRuns             = new(expvar.Int)
+	metricFailedRuns       = new(expvar.Int)
+	metricCheckedOrders    = new(expvar.Int)
+	metricMismatches       = new(expvar.Int)
+	metricFixed            = new(expvar.Int)
+	metricLastMismatches   = new(expvar.Int)
+	metricNegativeBalances = new(expvar.Int)
+	metricLastRun          = new(expvar.Int)
+)
+
+func init() {
+	m := expvar.NewMap("reconciliation")
+	m.Set("runs_total", metricRuns)
+	m.Set("failed_runs_total", metricFailedRuns)
+	m.Set("checked_orders_total", metricCheckedOrders)
+	m.Set("mismatches_total", metricMismatches)
+	m.Set("fixed_total", metricFixed)
+	m.Set("last_run_mismatches", metricLastMismatches)
+	m.Set("last_run_negative_balances", metricNegativeBalances)
+	m.Set("last_run_timestamp_seconds", metricLastRun)
+}
+
+// AccrualSource returns the accrual of orders, see accrual.Client.
+type AccrualSource interface {
+	Order(ctx context.Context, number string) (accrual.Result, error)
+}
+
+// Config tunes the Reconciler. Zero values select the defaults.
+type Config struct {
+	// Window selects the orders uploaded within it before the run.
+	Window time.Duration
+	// AutoFix posts a correction for each mismatch.
+	AutoFix   bool
+	BatchSize int
+}
+
+// Mismatch is an order whose ledger credits differ from its accrual.
+type Mismatch struct {
+	Order    string
+	UserID   string
+	Expected money.Amount
+	Credited money.Amount
+	// Fixed reports whether a correction settled the difference, Error
+	// why it could not.
+	Fixed bool
+	Error string
+}
+
+// Report is the outcome of a run.
+type Report struct {
+	StartedAt  time.Time
+	FinishedAt time.Time
+	// WindowStart starts the window, the orders uploaded since are checked.
+	WindowStart time.Time
+	Checked     int
+	// Skipped counts the orders the accrual system has no final result for.
+	Skipped          int
+	Mismatches       []Mismatch
+	NegativeBalances map[string]money.Amount
+	// Error is why the run stopped early, the report is partial then.
+	Error string
+}
+
+// Reconciler runs the reconciliation and keeps the last report.
+type Reconciler struct {
+	orders  storage.OrderRepository
+	ledger  storage.LedgerRepository
+	accrual AccrualSource
+	trail   *audit.Log
+	cfg     Config
+	now     func() time.Time
+
+	mu   sync.Mutex
+	last *Report
+}
+
+// New returns a reconciler of the ledger against source. Corrections made
+// by AutoFix are recorded in trail.
+func New(orders storage.OrderRepository, ledger storage.LedgerRepository, source AccrualSource, trail *audit.Log, cfg Config) *Reconciler {
+	if cfg.Window <= 0 {
+		cfg.Window = defaultWindow
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+
+	return &Reconciler{
+		orders:  orders,
+		ledger:  ledger,
+		accrual: source,
+		trail:   trail,
+		cfg:     cfg,
+		now:     time.Now,
+	}
+}
+
+// LastReport returns the report of the last run, false if none ran yet.
+func (r *Reconciler) LastReport() (Report, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.last == nil {
+		return Report{}, false
+	}
+	return *r.last, true
+}
+
+// Run reconciles the window ending now, keeps the report and updates the
+// metrics. It is meant for lifecycle.Periodic.
+func (r *Reconciler) Run(ctx context.Context) error {
+	report, err := r.reconcile(ctx)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	report.FinishedAt = r.now()
+
+	r.mu.Lock()
+	r.last = &report
+	r.mu.Unlock()
+
+	metricRuns.Add(1)
+	if err != nil {
+		metricFailedRuns.Add(1)
+	}
+	metricCheckedOrders.Add(int64(report.Checked))
+	metricMismatches.Add(int64(len(report.Mismatches)))
+	metricLastMismatches.Set(int64(len(report.Mismatches)))
+	metricNegativeBalances.Set(int64(len(report.NegativeBalances)))
+	metricLastRun.Set(report.FinishedAt.Unix())
+
+	if len(report.Mismatches) > 0 || len(report.NegativeBalances) > 0 {
+		log.Warning(ctx, "ledger does not reconcile", "mismatches", len(report.Mismatches),
+			"negative_balances", len(report.NegativeBalances))
+	}
+	return err
+}
+
+func (r *Reconciler) reconcile(ctx context.Context) (Report, error) {
+	report := Report{StartedAt: r.now()}
+	report.WindowStart = report.StartedAt.Add(-r.cfg.Window)
+
+	q := domain.OrderQuery{
+		Limit:        r.cfg.BatchSize,
+		Statuses:     []domain.OrderStatus{domain.OrderStatusProcessed},
+		UploadedFrom: report.WindowStart,
+	}
+	for {
+		orders, err := r.orders.List(ctx, q)
+		if err != nil {
+			return report, err
+		}
+
+		for _, o := range orders {
+			m, ok, err := r.check(ctx, o)
+			switch {
+			case errors.Is(err, accrual.ErrNotRegistered):
+				report.Skipped++
+			case err != nil:
+				return report, err
+			case !ok:
+				report.Skipped++
+			default:
+				report.Checked++
+				if m != nil {
+					report.Mismatches = append(report.Mismatches, *m)
+				}
+			}
+		}
+
+		if len(orders) < q.Limit {
+			break
+		}
+		cursor := domain.CursorOf(orders[len(orders)-1])
+		q.After = &cursor
+	}
+
+	negative, err := r.ledger.NegativeBalances(ctx)
+	if err != nil {
+		return report, err
+	}
+	report.NegativeBalances = negative
+
+	return report, nil
+}
+
+// check compares the credits of the order with its accrual. It returns
+// false if the accrual system has no final result for the order, and a
+// nil mismatch if the credits are right.
+func (r *Reconciler) check(ctx context.Context, o domain.Order) (*Mismatch, bool, error) {
+	res, err := r.accrual.Order(ctx, o.Number)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get accrual of order %s: %w", o.Number, err)
+	}
+
+	var expected money.Amount
+	switch res.Status {
+	case accrual.StatusProcessed:
+		expected = res.Accrual
+	case accrual.StatusInvalid:
+	default:
+		return nil, false, nil
+	}
+
+	credited, err := r.ledger.OrderCredits(ctx, o.Number)
+	if err != nil {
+		return nil, false, err
+	}
+	if credited == expected {
+		return nil, true, nil
+	}
+
+	m := &Mismatch{Order: o.Number, UserID: o.UserID, Expected: expected, Credited: credited}
+	if r.cfg.AutoFix {
+		r.fix(ctx, m)
+	}
+	return m, true, nil
+}
+
+// fix settles the mismatch with a correction.
+func (r *Reconciler) fix(ctx context.Context, m *Mismatch) {
+	amount := m.Expected - m.Credited
+	reason := fmt.Sprintf("reconciliation: accrual of order %s is %s, credited %s", m.Order, m.Expected, m.Credited)
+	entry, err := r.ledger.Correct(ctx, domain.Correction{
+		UserID:      m.UserID,
+		OrderNumber: m.Order,
+		Amount:      amount,
+		Reason:      reason,
+		Operator:    Operator,
+	})
+	if err != nil {
+		m.Error = err.Error()
+		log.Error(ctx, "failed to fix accrual", err, "order", m.Order, "user_id", m.UserID)
+		return
+	}
+
+	m.Fixed = true
+	metricFixed.Add(1)
+	r.trail.Record(ctx, audit.SystemActor, audit.ActionCorrection, m.UserID, map[string]string{
+		"entry_id": strconv.FormatInt(entry.ID, 10),
+		"order":    m.Order,
+		"amount":   amount.String(),
+		"reason":   reason,
+	})
+}
@@ -0,0 +1,129 @@
+package reconcile
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/accrual"
+	"github.com/paramonies/ya-gophermart/internal/audit"
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/internal/storage/memory"
+)
+
+// fakeAccrual answers with the results by order number, ErrNotRegistered
+// for the others, and err if set.
+type fakeAccrual struct {
+	results map[string]accrual.Result
+	err     error
+}
+
+func (f *fakeAccrual) Order(_ context.Context, number string) (accrual.Result, error) {
+	if f.err != nil {
+		return accrual.Result{}, f.err
+	}
+	res, ok := f.results[number]
+	if !ok {
+		return accrual.Result{}, accrual.ErrNotRegistered
+	}
+	return res, nil
+}
+
+func processed(t *testing.T, s *storage.Storage, userID, number string, amount money.Amount) {
+	t.Helper()
+
+	ctx := context.Background()
+	_, err := s.Orders.Create(ctx, userID, number)
+	require.NoError(t, err)
+	require.NoError(t, s.Orders.UpdateStatus(ctx, number, domain.OrderStatusProcessed, amount))
+}
+
+func TestReconciler(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+	alice, err := s.Users.Create(ctx, "alice", "hash")
+	require.NoError(t, err)
+
+	processed(t, s, alice.ID, "12345678903", money.FromUnits(500))
+	processed(t, s, alice.ID, "2377225624", money.FromUnits(100))
+	processed(t, s, alice.ID, "79927398713", money.FromUnits(50))
+	processed(t, s, alice.ID, "4561261212345467", money.FromUnits(10))
+	source := &fakeAccrual{results: map[string]accrual.Result{
+		"12345678903": {Status: accrual.StatusProcessed, Accrual: money.FromUnits(500)},
+		"2377225624":  {Status: accrual.StatusProcessed, Accrual: money.MustParse("120.5")},
+		"79927398713": {Status: accrual.StatusInvalid},
+	}}
+
+	_, ok := New(s.Orders, s.Ledger, source, audit.New(s.Audit), Config{}).LastReport()
+	assert.False(t, ok)
+
+	t.Run("Report", func(t *testing.T) {
+		r := New(s.Orders, s.Ledger, source, audit.New(s.Audit), Config{BatchSize: 2})
+		require.NoError(t, r.Run(ctx))
+
+		report, ok := r.LastReport()
+		require.True(t, ok)
+		assert.Equal(t, 3, report.Checked)
+		assert.Equal(t, 1, report.Skipped)
+		assert.Equal(t, []Mismatch{
+			{Order: "2377225624", UserID: alice.ID, Expected: money.MustParse("120.5"), Credited: money.FromUnits(100)},
+			{Order: "79927398713", UserID: alice.ID, Credited: money.FromUnits(50)},
+		}, report.Mismatches)
+		assert.Empty(t, report.NegativeBalances)
+	})
+
+	t.Run("AutoFix", func(t *testing.T) {
+		// The points of the invalid order are spent already.
+		require.NoError(t, s.Ledger.Withdraw(ctx, alice.ID, "5062821234567892", money.FromUnits(640), nil))
+
+		trail := audit.New(s.Audit)
+		r := New(s.Orders, s.Ledger, source, trail, Config{AutoFix: true})
+		require.NoError(t, r.Run(ctx))
+
+		report, _ := r.LastReport()
+		require.Len(t, report.Mismatches, 2)
+		assert.True(t, report.Mismatches[0].Fixed)
+		assert.False(t, report.Mismatches[1].Fixed)
+		assert.Equal(t, domain.ErrInsufficientFunds.Error(), report.Mismatches[1].Error)
+
+		credited, err := s.Ledger.OrderCredits(ctx, "2377225624")
+		require.NoError(t, err)
+		assert.Equal(t, money.MustParse("120.5"), credited)
+
+		entries, err := s.Audit.List(ctx, domain.AuditQuery{Action: audit.ActionCorrection})
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, audit.SystemActor, entries[0].Actor)
+		assert.Equal(t, "20.5", entries[0].Metadata["amount"])
+
+		require.NoError(t, r.Run(ctx))
+		report, _ = r.LastReport()
+		require.Len(t, report.Mismatches, 1)
+		assert.Equal(t, "79927398713", report.Mismatches[0].Order)
+	})
+
+	t.Run("RateLimited", func(t *testing.T) {
+		failing := &fakeAccrual{err: &accrual.RateLimitError{RetryAfter: time.Minute}}
+		r := New(s.Orders, s.Ledger, failing, audit.New(s.Audit), Config{})
+		require.Error(t, r.Run(ctx))
+
+		report, ok := r.LastReport()
+		require.True(t, ok)
+		assert.Contains(t, report.Error, "rate limit")
+		assert.Zero(t, report.Checked)
+	})
+
+	t.Run("Window", func(t *testing.T) {
+		r := New(s.Orders, s.Ledger, source, audit.New(s.Audit), Config{Window: time.Hour})
+		r.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+		require.NoError(t, r.Run(ctx))
+
+		report, _ := r.LastReport()
+		assert.Zero(t, report.Checked+report.Skipped)
+	})
+}
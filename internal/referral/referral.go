@@ -0,0 +1,181 @@
+// Package referral runs the referral program.
+//
+// Each user gets a referral code on first request, and users registering
+// with a code are referred by its owner. The referral is stored with the
+// user it refers, so users can be referred only once and never by
+// themselves. The first PROCESSED order of a
+// referred user rewards the referral: Run grants a bonus to both users,
+// unless the referrer was rewarded for as many referrals as the cap
+// allows.
+package referral
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"expvar"
+	"fmt"
+	"strings"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/pkg/log"
+)
+
+const (
+	defaultBatchSize = 100
+
+	// codeAlphabet leaves out the characters mistaken for one another.
+	codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	codeLength   = 8
+	// codeAttempts bounds the retries of codes taken by other users.
+	codeAttempts = 5
+)
+
+// Metrics of the referral program, published by expvar.
+var (
+	metricRewarded = new(expvar.Int)
+	metricCapped   = new(expvar.Int)
+)
+
+func init() {
+	m := expvar.NewMap("referrals")
+	m.Set("rewarded_total", metricRewarded)
+	m.Set("capped_total", metricCapped)
+}
+
+// Config tunes the Service. Zero values select the defaults, but for the
+// bonuses and Cap.
+type Config struct {
+	// ReferrerBonus and ReferredBonus are granted to the referrer and to
+	// the referred user respectively.
+	ReferrerBonus money.Amount
+	ReferredBonus money.Amount
+	// Cap is how many referrals of a user are rewarded at most, unlimited
+	// if zero.
+	Cap int
+	// BatchSize is how many pending referrals Run reads at once.
+	BatchSize int
+}
+
+// Service hands out referral codes and rewards referrals.
+type Service struct {
+	referrals storage.ReferralRepository
+	orders    storage.OrderRepository
+	cfg       Config
+}
+
+// New returns a service over the referrals and orders.
+func New(referrals storage.ReferralRepository, orders storage.OrderRepository, cfg Config) *Service {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+
+	return &Service{referrals: referrals, orders: orders, cfg: cfg}
+}
+
+// Code returns the referral code of the user, generating it on first use.
+func (s *Service) Code(ctx context.Context, userID string) (string, error) {
+	code, err := s.referrals.Code(ctx, userID)
+	if !errors.Is(err, storage.ErrNotFound) {
+		return code, err
+	}
+
+	for i := 0; i < codeAttempts; i++ {
+		code, err := newCode()
+		if err != nil {
+			return "", err
+		}
+		stored, ok, err := s.referrals.CreateCode(ctx, userID, code)
+		if err != nil || ok {
+			return stored, err
+		}
+	}
+	return "", fmt.Errorf("failed to generate a free referral code in %d attempts", codeAttempts)
+}
+
+// Referrer returns the ID of the user with the referral code. Returns
+// domain.ErrUnknownReferralCode if there is none.
+func (s *Service) Referrer(ctx context.Context, code string) (string, error) {
+	userID, err := s.referrals.Referrer(ctx, strings.ToUpper(strings.TrimSpace(code)))
+	if errors.Is(err, storage.ErrNotFound) {
+		return "", domain.ErrUnknownReferralCode
+	}
+	return userID, err
+}
+
+// List returns the referrals of the user, oldest first.
+func (s *Service) List(ctx context.Context, userID string) ([]domain.Referral, error) {
+	return s.referrals.ListByReferrer(ctx, userID)
+}
+
+// Run rewards the pending referrals whose referred user has a PROCESSED
+// order. It is meant for lifecycle.Periodic.
+func (s *Service) Run(ctx context.Context) error {
+	var after string
+	for {
+		pending, err := s.referrals.Pending(ctx, after, s.cfg.BatchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, ref := range pending {
+			if err := s.reward(ctx, ref); err != nil {
+				return err
+			}
+		}
+
+		if len(pending) < s.cfg.BatchSize {
+			return nil
+		}
+		after = pending[len(pending)-1].ReferredID
+	}
+}
+
+func (s *Service) reward(ctx context.Context, ref domain.Referral) error {
+	orders, err := s.orders.ListByUser(ctx, ref.ReferredID, domain.OrderQuery{
+		Limit:    1,
+		Statuses: []domain.OrderStatus{domain.OrderStatusProcessed},
+	})
+	if err != nil {
+		return err
+	}
+	if len(orders) == 0 {
+		return nil
+	}
+
+	rewarded, err := s.referrals.Reward(ctx, domain.ReferralReward{
+		ReferredID:    ref.ReferredID,
+		OrderNumber:   orders[0].Number,
+		ReferrerBonus: s.cfg.ReferrerBonus,
+		ReferredBonus: s.cfg.ReferredBonus,
+		Cap:           s.cfg.Cap,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to reward referral of user %s: %w", ref.ReferredID, err)
+	}
+
+	switch rewarded.Status {
+	case domain.ReferralRewarded:
+		metricRewarded.Add(1)
+		log.Info(ctx, "rewarded referral", "referrer_id", rewarded.ReferrerID, "referred_id", rewarded.ReferredID,
+			"order", rewarded.OrderNumber)
+	case domain.ReferralCapped:
+		metricCapped.Add(1)
+		log.Info(ctx, "referral over the cap", "referrer_id", rewarded.ReferrerID, "referred_id", rewarded.ReferredID)
+	}
+	return nil
+}
+
+func newCode() (string, error) {
+	b := make([]byte, codeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate referral code: %w", err)
+	}
+	for i := range b {
+		// 256 is a multiple of the alphabet length, no letter is favoured.
+		b[i] = codeAlphabet[int(b[i])%len(codeAlphabet)]
+	}
+	return string(b), nil
+}
@@ -0,0 +1,85 @@
+package referral
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/storage/memory"
+)
+
+func TestService(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+	svc := New(s.Referrals, s.Orders, Config{
+		ReferrerBonus: money.FromUnits(100),
+		ReferredBonus: money.FromUnits(50),
+		Cap:           1,
+		BatchSize:     1,
+	})
+
+	alice, err := s.Users.Create(ctx, "alice", "hash")
+	require.NoError(t, err)
+	users := map[string]domain.User{"alice": alice}
+
+	code, err := svc.Code(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Len(t, code, codeLength)
+	again, err := svc.Code(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, code, again)
+
+	_, err = svc.Referrer(ctx, "NOSUCHCD")
+	assert.ErrorIs(t, err, domain.ErrUnknownReferralCode)
+	referrerID, err := svc.Referrer(ctx, " "+strings.ToLower(code))
+	require.NoError(t, err)
+	assert.Equal(t, alice.ID, referrerID)
+
+	for _, login := range []string{"bob", "carol", "dave"} {
+		u, err := s.Users.Register(ctx, domain.Registration{Login: login, PasswordHash: "hash", ReferrerID: referrerID})
+		require.NoError(t, err)
+		users[login] = u
+	}
+
+	// Only the referred users with a PROCESSED order are rewarded.
+	_, err = s.Orders.Create(ctx, users["bob"].ID, "12345678903")
+	require.NoError(t, err)
+	require.NoError(t, s.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessed, money.FromUnits(10)))
+	_, err = s.Orders.Create(ctx, users["carol"].ID, "79927398713")
+	require.NoError(t, err)
+	require.NoError(t, svc.Run(ctx))
+
+	referrals, err := svc.List(ctx, alice.ID)
+	require.NoError(t, err)
+	statuses := make(map[string]domain.ReferralStatus)
+	for _, ref := range referrals {
+		statuses[ref.ReferredLogin] = ref.Status
+	}
+	assert.Equal(t, map[string]domain.ReferralStatus{
+		"bob":   domain.ReferralRewarded,
+		"carol": domain.ReferralPending,
+		"dave":  domain.ReferralPending,
+	}, statuses)
+
+	// Past the cap, referrals are closed without bonuses.
+	require.NoError(t, s.Orders.UpdateStatus(ctx, "79927398713", domain.OrderStatusProcessed, money.FromUnits(10)))
+	require.NoError(t, svc.Run(ctx))
+	referrals, err = svc.List(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, domain.ReferralCapped, referrals[1].Status)
+
+	for login, want := range map[string]money.Amount{
+		"alice": money.FromUnits(100),
+		"bob":   money.FromUnits(60),
+		"carol": money.FromUnits(10),
+	} {
+		b, err := s.Ledger.Balance(ctx, users[login].ID)
+		require.NoError(t, err)
+		assert.Equal(t, want, b.Current, login)
+	}
+}
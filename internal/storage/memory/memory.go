@@ -0,0 +1,1469 @@
+// Package memory implements the storage in process memory. It keeps the
+// guarantees of the PostgreSQL storage (unique logins and order numbers,
+// no negative balance) and is meant for tests and demos: nothing
+// survives a restart.
+package memory
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+)
+
+// db is shared by the repositories, one mutex makes every operation atomic.
+type db struct {
+	mu sync.Mutex
+
+	users     map[string]domain.User
+	logins    map[string]string
+	orders    map[string]domain.Order
+	ledger    []domain.LedgerEntry
+	entryID   int64
+	snapshots map[string]domain.BalanceSnapshot
+	lots      []domain.CreditLot
+	spends    []lotSpend
+	outbox    []outboxRecord
+
+	referralCodes map[string]string
+	referrals     []domain.Referral
+
+	idempotency map[idempotencyKey]domain.IdempotencyRecord
+
+	sessions      map[string]domain.Session
+	refreshTokens map[string]refreshToken
+
+	attempts map[string]domain.AttemptCounter
+
+	audit []domain.AuditEntry
+
+	listeners  map[int]func(userID string)
+	listenerID int
+
+	subscriptions  []domain.WebhookSubscription
+	deliveries     []domain.WebhookDelivery
+	lastDeliveryID int64
+}
+
+// lotSpend is what a debit spent from a credit lot.
+type lotSpend struct {
+	debitID int64
+	lotID   int64
+	amount  money.Amount
+}
+
+type outboxRecord struct {
+	event        domain.OutboxEvent
+	delivered    bool
+	dead         bool
+	claimedUntil time.Time
+	lastError    string
+}
+
+// NewStorage returns an empty in-memory storage.
+func NewStorage() *storage.Storage {
+	d := &db{
+		users:  make(map[string]domain.User),
+		logins: make(map[string]string),
+		orders: make(map[string]domain.Order),
+
+		snapshots: make(map[string]domain.BalanceSnapshot),
+
+		referralCodes: make(map[string]string),
+
+		idempotency: make(map[idempotencyKey]domain.IdempotencyRecord),
+
+		sessions:      make(map[string]domain.Session),
+		refreshTokens: make(map[string]refreshToken),
+		attempts:      make(map[string]domain.AttemptCounter),
+		listeners:     make(map[int]func(string)),
+	}
+
+	return &storage.Storage{
+		Users:       &userRepository{d},
+		Orders:      &orderRepository{d},
+		Ledger:      &ledgerRepository{d},
+		Referrals:   &referralRepository{d},
+		Outbox:      &outboxRepository{d},
+		Webhooks:    &webhookRepository{d},
+		Idempotency: &idempotencyRepository{d},
+		Sessions:    &sessionRepository{d},
+		Attempts:    &attemptRepository{d},
+		Audit:       &auditRepository{d},
+		Notifier:    &notifier{d},
+	}
+}
+
+// appendEntry appends the entry and its outbox event and returns the entry.
+// It must be called with the mutex held.
+func (d *db) appendEntry(e domain.LedgerEntry) domain.LedgerEntry {
+	d.entryID++
+	e.ID = d.entryID
+	e.CreatedAt = time.Now()
+	d.ledger = append(d.ledger, e)
+
+	switch {
+	case e.Kind == domain.EntryRefund:
+		// Refund gives the points back to their lots.
+	case e.Amount > 0:
+		d.lots = append(d.lots, domain.CreditLot{
+			EntryID:     e.ID,
+			UserID:      e.UserID,
+			OrderNumber: e.OrderNumber,
+			Amount:      e.Amount,
+			Remaining:   e.Amount,
+			CreatedAt:   e.CreatedAt,
+		})
+	case e.Kind != domain.EntryExpiry:
+		d.spendLots(e, -e.Amount)
+	}
+
+	d.appendEvent(domain.NewLedgerEvent(e))
+	return e
+}
+
+// spendLots spends sum from the oldest lots of the user of the debit and
+// records what it spent from each. It must be called with the mutex held.
+func (d *db) spendLots(debit domain.LedgerEntry, sum money.Amount) {
+	for i := range d.lots {
+		if sum <= 0 {
+			return
+		}
+		lot := &d.lots[i]
+		if lot.UserID != debit.UserID || lot.Remaining == 0 {
+			continue
+		}
+		spent := lot.Remaining
+		if spent > sum {
+			spent = sum
+		}
+		lot.Remaining -= spent
+		sum -= spent
+		d.spends = append(d.spends, lotSpend{debitID: debit.ID, lotID: lot.EntryID, amount: spent})
+	}
+}
+
+// restoreLots gives back to the lots what the debit spent from them. It
+// must be called with the mutex held.
+func (d *db) restoreLots(debitID int64) {
+	for _, spend := range d.spends {
+		if spend.debitID != debitID {
+			continue
+		}
+		for i := range d.lots {
+			if d.lots[i].EntryID == spend.lotID {
+				d.lots[i].Remaining += spend.amount
+			}
+		}
+	}
+}
+
+// appendEvent appends the event to the outbox and notifies the listeners.
+// It must be called with the mutex held.
+func (d *db) appendEvent(event domain.OutboxEvent) {
+	event.ID = int64(len(d.outbox) + 1)
+	event.NextAttemptAt = event.CreatedAt
+	d.outbox = append(d.outbox, outboxRecord{event: event})
+
+	for _, fn := range d.listeners {
+		fn(event.UserID)
+	}
+}
+
+// balance must be called with the mutex held.
+func (d *db) balance(userID string) domain.Balance {
+	var b domain.Balance
+	for _, e := range d.ledger {
+		if e.UserID == userID {
+			b = b.Apply(e)
+		}
+	}
+	return b
+}
+
+type userRepository struct {
+	*db
+}
+
+func (r *userRepository) Create(ctx context.Context, login, passwordHash string) (domain.User, error) {
+	return r.Register(ctx, domain.Registration{Login: login, PasswordHash: passwordHash})
+}
+
+func (r *userRepository) Register(_ context.Context, reg domain.Registration) (domain.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.logins[reg.Login]; ok {
+		return domain.User{}, domain.ErrLoginTaken
+	}
+	if _, ok := r.users[reg.ReferrerID]; reg.ReferrerID != "" && !ok {
+		return domain.User{}, storage.ErrNotFound
+	}
+
+	u := domain.User{
+		ID:           newUUID(),
+		Login:        reg.Login,
+		PasswordHash: reg.PasswordHash,
+		Roles:        []domain.Role{domain.RoleUser},
+		CreatedAt:    time.Now(),
+	}
+	r.users[u.ID] = u
+	r.logins[reg.Login] = u.ID
+
+	for _, b := range reg.Bonuses {
+		r.appendEntry(domain.LedgerEntry{
+			UserID:      u.ID,
+			Kind:        domain.EntryBonus,
+			OrderNumber: b.OrderNumber,
+			Amount:      b.Amount,
+			Reason:      b.Reason,
+			RuleID:      b.RuleID,
+		})
+	}
+	if reg.ReferrerID != "" {
+		r.referrals = append(r.referrals, domain.Referral{
+			ReferrerID:    reg.ReferrerID,
+			ReferredID:    u.ID,
+			ReferredLogin: u.Login,
+			Status:        domain.ReferralPending,
+			CreatedAt:     u.CreatedAt,
+		})
+	}
+
+	return u, nil
+}
+
+func (r *userRepository) GetByID(_ context.Context, id string) (domain.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.users[id]
+	if !ok {
+		return domain.User{}, storage.ErrNotFound
+	}
+	return u, nil
+}
+
+func (r *userRepository) GetByLogin(_ context.Context, login string) (domain.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id, ok := r.logins[login]
+	if !ok {
+		return domain.User{}, storage.ErrNotFound
+	}
+	return r.users[id], nil
+}
+
+func (r *userRepository) UpdatePasswordHash(_ context.Context, id, passwordHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.users[id]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	u.PasswordHash = passwordHash
+	r.users[id] = u
+	return nil
+}
+
+func (r *userRepository) Search(_ context.Context, query string, limit int) ([]domain.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	query = strings.ToLower(query)
+	var users []domain.User
+	for _, u := range r.users {
+		if strings.Contains(strings.ToLower(u.Login), query) {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Login < users[j].Login })
+	if limit > 0 && len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+func (r *userRepository) SetBlocked(_ context.Context, id string, now time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.users[id]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	if now.IsZero() || !u.Blocked() {
+		u.BlockedAt = now
+	}
+	r.users[id] = u
+	return nil
+}
+
+func (r *userRepository) SetRoles(_ context.Context, id string, roles []domain.Role) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.users[id]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	u.Roles = append([]domain.Role(nil), roles...)
+	r.users[id] = u
+	return nil
+}
+
+type orderRepository struct {
+	*db
+}
+
+func (r *orderRepository) Create(_ context.Context, userID, number string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if o, ok := r.orders[number]; ok {
+		if o.UserID != userID {
+			return false, domain.ErrOrderOwnedByOther
+		}
+		return false, nil
+	}
+
+	r.orders[number] = domain.Order{
+		Number:     number,
+		UserID:     userID,
+		Status:     domain.OrderStatusNew,
+		UploadedAt: time.Now(),
+	}
+	return true, nil
+}
+
+func (r *orderRepository) Get(_ context.Context, number string) (domain.Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	o, ok := r.orders[number]
+	if !ok {
+		return domain.Order{}, storage.ErrNotFound
+	}
+	return o, nil
+}
+
+func (r *orderRepository) ListByUser(_ context.Context, userID string, q domain.OrderQuery) ([]domain.Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.list(func(o domain.Order) bool {
+		return o.UserID == userID && q.Match(o)
+	}, q.Limit), nil
+}
+
+func (r *orderRepository) List(_ context.Context, q domain.OrderQuery) ([]domain.Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.list(q.Match, q.Limit), nil
+}
+
+func (r *orderRepository) ListPending(_ context.Context, after *domain.OrderCursor, limit int) ([]domain.Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	q := domain.OrderQuery{After: after}
+	return r.list(func(o domain.Order) bool {
+		return !o.Status.Final() && q.Match(o)
+	}, limit), nil
+}
+
+// list must be called with the mutex held.
+func (r *orderRepository) list(match func(domain.Order) bool, limit int) []domain.Order {
+	var orders []domain.Order
+	for _, o := range r.orders {
+		if match(o) {
+			orders = append(orders, o)
+		}
+	}
+
+	sort.Slice(orders, func(i, j int) bool {
+		if !orders[i].UploadedAt.Equal(orders[j].UploadedAt) {
+			return orders[i].UploadedAt.Before(orders[j].UploadedAt)
+		}
+		return orders[i].Number < orders[j].Number
+	})
+
+	if limit > 0 && len(orders) > limit {
+		orders = orders[:limit]
+	}
+	return orders
+}
+
+func (r *orderRepository) UpdateStatus(ctx context.Context, number string, status domain.OrderStatus, accrual money.Amount) error {
+	return r.Update(ctx, domain.StatusUpdate{Number: number, Status: status, Accrual: accrual})
+}
+
+func (r *orderRepository) Update(_ context.Context, u domain.StatusUpdate) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	o, ok := r.orders[u.Number]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	if o.Status.Final() || o.Status == u.Status {
+		return nil
+	}
+
+	o.Status = u.Status
+	if event, ok := domain.NewOrderEvent(o.UserID, u.Number, u.Status, u.Accrual); ok {
+		r.appendEvent(event)
+		if u.Status.Final() {
+			r.enqueueDeliveries(o.UserID, event.Type, event.Payload)
+		}
+	}
+	if u.Status == domain.OrderStatusProcessed {
+		o.Accrual = u.Accrual
+		if u.Accrual > 0 {
+			r.appendEntry(domain.LedgerEntry{
+				UserID:      o.UserID,
+				Kind:        domain.EntryAccrual,
+				OrderNumber: u.Number,
+				Amount:      u.Accrual,
+			})
+		}
+		for _, b := range u.Bonuses {
+			b.UserID = o.UserID
+			b.OrderNumber = u.Number
+			r.grantBonus(b)
+		}
+	}
+	r.orders[u.Number] = o
+
+	return nil
+}
+
+// grantBonus appends the entry of the bonus unless it is not due, see
+// domain.Bonus.
+func (d *db) grantBonus(b domain.Bonus) {
+	for _, e := range d.ledger {
+		if e.Kind == domain.EntryBonus && e.RuleID == b.RuleID && e.UserID == b.UserID &&
+			(b.OncePerUser || e.OrderNumber == b.OrderNumber) {
+			return
+		}
+	}
+	if b.FirstOrder {
+		for _, o := range d.orders {
+			if o.UserID == b.UserID && o.Number != b.OrderNumber && o.Status == domain.OrderStatusProcessed {
+				return
+			}
+		}
+	}
+
+	d.appendEntry(domain.LedgerEntry{
+		UserID:      b.UserID,
+		Kind:        domain.EntryBonus,
+		OrderNumber: b.OrderNumber,
+		Amount:      b.Amount,
+		Reason:      b.Reason,
+		RuleID:      b.RuleID,
+	})
+}
+
+func (r *orderRepository) Requeue(_ context.Context, number string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	o, ok := r.orders[number]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	if o.Status == domain.OrderStatusProcessed {
+		return domain.ErrOrderAlreadyProcessed
+	}
+	o.Status = domain.OrderStatusNew
+	o.Accrual = 0
+	r.orders[number] = o
+	return nil
+}
+
+type ledgerRepository struct {
+	*db
+}
+
+func (r *ledgerRepository) Balance(_ context.Context, userID string) (domain.Balance, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.balance(userID), nil
+}
+
+func (r *ledgerRepository) SnapshotBalance(_ context.Context, userID string) (domain.BalanceSnapshot, domain.LedgerTail, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	snapshot, ok := r.snapshots[userID]
+	if !ok {
+		snapshot = domain.BalanceSnapshot{UserID: userID}
+	}
+
+	var tail domain.LedgerTail
+	for _, e := range r.ledger {
+		if e.UserID != userID {
+			continue
+		}
+		if e.ID > snapshot.LastEntryID {
+			tail.Balance = tail.Balance.Apply(e)
+		} else {
+			tail.Covered++
+		}
+	}
+	return snapshot, tail, nil
+}
+
+func (r *ledgerRepository) DeleteSnapshot(_ context.Context, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.snapshots, userID)
+	return nil
+}
+
+func (r *ledgerRepository) CompactBalances(_ context.Context, before time.Time, limit int) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	snapshots := make(map[string]domain.BalanceSnapshot)
+	var users []string
+	for _, e := range r.ledger {
+		if !e.CreatedAt.Before(before) {
+			continue
+		}
+		snapshot, ok := snapshots[e.UserID]
+		if !ok {
+			users = append(users, e.UserID)
+			snapshot.UserID = e.UserID
+		}
+		snapshot.Balance = snapshot.Balance.Apply(e)
+		snapshot.LastEntryID = e.ID
+		snapshot.EntryCount++
+		snapshots[e.UserID] = snapshot
+	}
+
+	var compacted int
+	for _, userID := range users {
+		if compacted == limit {
+			break
+		}
+		snapshot := snapshots[userID]
+		if snapshot.LastEntryID <= r.snapshots[userID].LastEntryID {
+			continue
+		}
+		snapshot.UpdatedAt = time.Now()
+		r.snapshots[userID] = snapshot
+		compacted++
+	}
+	return compacted, nil
+}
+
+func (r *ledgerRepository) Withdraw(_ context.Context, userID, orderNumber string, sum money.Amount, audit *domain.AuditEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, e := range r.ledger {
+		if e.Kind == domain.EntryWithdrawal && e.OrderNumber == orderNumber {
+			return domain.ErrOrderAlreadyPaid
+		}
+	}
+	if r.balance(userID).Current < sum {
+		return domain.ErrInsufficientFunds
+	}
+
+	e := r.appendEntry(domain.LedgerEntry{
+		UserID:      userID,
+		Kind:        domain.EntryWithdrawal,
+		OrderNumber: orderNumber,
+		Amount:      -sum,
+	})
+	r.appendEntryAudit(audit, map[string]string{"entry_id": strconv.FormatInt(e.ID, 10)})
+	return nil
+}
+
+func (r *ledgerRepository) Withdrawals(_ context.Context, userID string) ([]domain.Withdrawal, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var withdrawals []domain.Withdrawal
+	refunds := make(map[string]int)
+	for _, e := range r.ledger {
+		if e.UserID != userID {
+			continue
+		}
+		switch e.Kind {
+		case domain.EntryWithdrawal:
+			refunds[e.OrderNumber] = len(withdrawals)
+			withdrawals = append(withdrawals, domain.Withdrawal{
+				Order:       e.OrderNumber,
+				Sum:         -e.Amount,
+				ProcessedAt: e.CreatedAt,
+			})
+		case domain.EntryRefund:
+			withdrawals[refunds[e.OrderNumber]].RefundedAt = e.CreatedAt
+		}
+	}
+	return withdrawals, nil
+}
+
+func (r *ledgerRepository) Entries(_ context.Context, userID string) ([]domain.LedgerEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var entries []domain.LedgerEntry
+	for _, e := range r.ledger {
+		if e.UserID == userID {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (r *ledgerRepository) Correct(_ context.Context, c domain.Correction) (domain.LedgerEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[c.UserID]; !ok {
+		return domain.LedgerEntry{}, storage.ErrNotFound
+	}
+	if r.balance(c.UserID).Current+c.Amount < 0 {
+		return domain.LedgerEntry{}, domain.ErrInsufficientFunds
+	}
+
+	e := r.appendEntry(domain.LedgerEntry{
+		UserID:      c.UserID,
+		Kind:        domain.EntryCorrection,
+		OrderNumber: c.OrderNumber,
+		Amount:      c.Amount,
+		Reason:      c.Reason,
+		Operator:    c.Operator,
+	})
+	r.appendEntryAudit(c.Audit, map[string]string{"entry_id": strconv.FormatInt(e.ID, 10)})
+	return e, nil
+}
+
+func (r *ledgerRepository) Refund(_ context.Context, refund domain.Refund) (domain.LedgerEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var withdrawal *domain.LedgerEntry
+	for i, e := range r.ledger {
+		if e.OrderNumber != refund.OrderNumber {
+			continue
+		}
+		switch e.Kind {
+		case domain.EntryWithdrawal:
+			withdrawal = &r.ledger[i]
+		case domain.EntryRefund:
+			return domain.LedgerEntry{}, domain.ErrAlreadyRefunded
+		}
+	}
+	if withdrawal == nil {
+		return domain.LedgerEntry{}, storage.ErrNotFound
+	}
+
+	r.restoreLots(withdrawal.ID)
+	e := r.appendEntry(domain.LedgerEntry{
+		UserID:      withdrawal.UserID,
+		Kind:        domain.EntryRefund,
+		OrderNumber: refund.OrderNumber,
+		Amount:      -withdrawal.Amount,
+		Reason:      refund.Reason,
+		Operator:    refund.Operator,
+	})
+	r.appendEntryAudit(refund.Audit, map[string]string{
+		"user_id":  e.UserID,
+		"amount":   e.Amount.String(),
+		"entry_id": strconv.FormatInt(e.ID, 10),
+	})
+	return e, nil
+}
+
+func (r *ledgerRepository) OrderCredits(_ context.Context, orderNumber string) (money.Amount, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var sum money.Amount
+	for _, e := range r.ledger {
+		if e.OrderNumber == orderNumber && (e.Kind == domain.EntryAccrual || e.Kind == domain.EntryCorrection) {
+			sum += e.Amount
+		}
+	}
+	return sum, nil
+}
+
+func (r *ledgerRepository) NegativeBalances(_ context.Context) (map[string]money.Amount, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current := make(map[string]money.Amount)
+	for _, e := range r.ledger {
+		current[e.UserID] += e.Amount
+	}
+
+	negative := make(map[string]money.Amount)
+	for userID, amount := range current {
+		if amount < 0 {
+			negative[userID] = amount
+		}
+	}
+	return negative, nil
+}
+
+func (r *ledgerRepository) Lots(_ context.Context, userID string) ([]domain.CreditLot, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var lots []domain.CreditLot
+	for _, lot := range r.lots {
+		if lot.UserID == userID && lot.Remaining > 0 {
+			lots = append(lots, lot)
+		}
+	}
+	return lots, nil
+}
+
+func (r *ledgerRepository) ExpireLots(_ context.Context, creditedBefore time.Time, limit int) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var expired int
+	for i := range r.lots {
+		if expired == limit {
+			break
+		}
+		lot := r.lots[i]
+		if lot.Remaining == 0 || !lot.CreatedAt.Before(creditedBefore) {
+			continue
+		}
+		r.lots[i].Remaining = 0
+		r.appendEntry(domain.NewExpiry(lot))
+		expired++
+	}
+	return expired, nil
+}
+
+type referralRepository struct {
+	*db
+}
+
+func (r *referralRepository) Code(_ context.Context, userID string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	code, ok := r.referralCodes[userID]
+	if !ok {
+		return "", storage.ErrNotFound
+	}
+	return code, nil
+}
+
+func (r *referralRepository) CreateCode(_ context.Context, userID, code string) (string, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[userID]; !ok {
+		return "", false, storage.ErrNotFound
+	}
+	if stored, ok := r.referralCodes[userID]; ok {
+		return stored, true, nil
+	}
+	for _, c := range r.referralCodes {
+		if c == code {
+			return "", false, nil
+		}
+	}
+	r.referralCodes[userID] = code
+	return code, true, nil
+}
+
+func (r *referralRepository) Referrer(_ context.Context, code string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for userID, c := range r.referralCodes {
+		if c == code {
+			return userID, nil
+		}
+	}
+	return "", storage.ErrNotFound
+}
+
+func (r *referralRepository) ListByReferrer(_ context.Context, referrerID string) ([]domain.Referral, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var referrals []domain.Referral
+	for _, ref := range r.referrals {
+		if ref.ReferrerID == referrerID {
+			referrals = append(referrals, ref)
+		}
+	}
+	return referrals, nil
+}
+
+func (r *referralRepository) Pending(_ context.Context, afterID string, limit int) ([]domain.Referral, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var referrals []domain.Referral
+	for _, ref := range r.referrals {
+		if ref.Status == domain.ReferralPending && ref.ReferredID > afterID {
+			referrals = append(referrals, ref)
+		}
+	}
+	sort.Slice(referrals, func(i, j int) bool { return referrals[i].ReferredID < referrals[j].ReferredID })
+	if len(referrals) > limit {
+		referrals = referrals[:limit]
+	}
+	return referrals, nil
+}
+
+func (r *referralRepository) Reward(_ context.Context, rw domain.ReferralReward) (domain.Referral, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.referral(rw.ReferredID)
+	if i < 0 {
+		return domain.Referral{}, storage.ErrNotFound
+	}
+	ref := r.referrals[i]
+	if ref.Status != domain.ReferralPending {
+		return ref, nil
+	}
+
+	ref.Status = domain.ReferralRewarded
+	if rw.Cap > 0 {
+		var rewarded int
+		for _, other := range r.referrals {
+			if other.ReferrerID == ref.ReferrerID && other.Status == domain.ReferralRewarded {
+				rewarded++
+			}
+		}
+		if rewarded >= rw.Cap {
+			ref.Status = domain.ReferralCapped
+		}
+	}
+	if ref.Status == domain.ReferralRewarded {
+		for _, e := range rw.Entries(ref) {
+			r.appendEntry(e)
+		}
+	}
+
+	ref.OrderNumber = rw.OrderNumber
+	ref.RewardedAt = time.Now()
+	r.referrals[i] = ref
+	return ref, nil
+}
+
+// referral returns the index of the referral of the user, -1 if they were
+// not referred. It must be called with the mutex held.
+func (d *db) referral(referredID string) int {
+	for i, ref := range d.referrals {
+		if ref.ReferredID == referredID {
+			return i
+		}
+	}
+	return -1
+}
+
+type outboxRepository struct {
+	*db
+}
+
+func (r *outboxRepository) Claim(_ context.Context, now time.Time, lease time.Duration, limit int) ([]domain.OutboxEvent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var events []domain.OutboxEvent
+	heads := make(map[string]bool)
+	for i := range r.outbox {
+		rec := &r.outbox[i]
+		if rec.delivered || rec.dead || heads[rec.event.UserID] {
+			continue
+		}
+		heads[rec.event.UserID] = true
+		if rec.event.NextAttemptAt.After(now) || rec.claimedUntil.After(now) {
+			continue
+		}
+		if limit > 0 && len(events) == limit {
+			break
+		}
+		rec.claimedUntil = now.Add(lease)
+		events = append(events, rec.event)
+	}
+	return events, nil
+}
+
+func (r *outboxRepository) MarkDelivered(_ context.Context, id int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec, err := r.record(id)
+	if err != nil {
+		return err
+	}
+	rec.delivered = true
+	rec.claimedUntil = time.Time{}
+	return nil
+}
+
+func (r *outboxRepository) MarkFailed(_ context.Context, id int64, nextAttemptAt time.Time, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec, err := r.record(id)
+	if err != nil {
+		return err
+	}
+	rec.event.Attempts++
+	rec.event.NextAttemptAt = nextAttemptAt
+	rec.lastError = reason
+	rec.claimedUntil = time.Time{}
+	return nil
+}
+
+func (r *outboxRepository) MarkDead(_ context.Context, id int64, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec, err := r.record(id)
+	if err != nil {
+		return err
+	}
+	rec.event.Attempts++
+	rec.dead = true
+	rec.lastError = reason
+	rec.claimedUntil = time.Time{}
+	return nil
+}
+
+func (r *outboxRepository) UserEvents(_ context.Context, userID string, afterID int64, limit int) ([]domain.OutboxEvent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var events []domain.OutboxEvent
+	for _, rec := range r.outbox {
+		if rec.event.UserID != userID || rec.event.ID <= afterID {
+			continue
+		}
+		if limit > 0 && len(events) == limit {
+			break
+		}
+		events = append(events, rec.event)
+	}
+	return events, nil
+}
+
+func (r *outboxRepository) LastUserEventID(_ context.Context, userID string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := len(r.outbox) - 1; i >= 0; i-- {
+		if r.outbox[i].event.UserID == userID {
+			return r.outbox[i].event.ID, nil
+		}
+	}
+	return 0, nil
+}
+
+// record must be called with the mutex held. Event IDs are 1-based
+// positions in the outbox.
+func (r *outboxRepository) record(id int64) (*outboxRecord, error) {
+	if id < 1 || id > int64(len(r.outbox)) {
+		return nil, storage.ErrNotFound
+	}
+	return &r.outbox[id-1], nil
+}
+
+type idempotencyKey struct {
+	userID string
+	key    string
+}
+
+type idempotencyRepository struct {
+	*db
+}
+
+func (r *idempotencyRepository) Reserve(_ context.Context, rec domain.IdempotencyRecord) (domain.IdempotencyRecord, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := idempotencyKey{rec.UserID, rec.Key}
+	if stored, ok := r.idempotency[k]; ok && stored.ExpiresAt.After(rec.CreatedAt) {
+		return stored, false, nil
+	}
+
+	rec.StatusCode = 0
+	rec.ContentType = ""
+	rec.Body = nil
+	r.idempotency[k] = rec
+	return rec, true, nil
+}
+
+func (r *idempotencyRepository) Complete(_ context.Context, userID, key string, statusCode int, contentType string, body []byte,
+	expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := idempotencyKey{userID, key}
+	rec, ok := r.idempotency[k]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	rec.StatusCode = statusCode
+	rec.ContentType = contentType
+	rec.Body = append([]byte(nil), body...)
+	rec.ExpiresAt = expiresAt
+	r.idempotency[k] = rec
+	return nil
+}
+
+func (r *idempotencyRepository) Release(_ context.Context, userID, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.idempotency, idempotencyKey{userID, key})
+	return nil
+}
+
+func (r *idempotencyRepository) DeleteExpired(_ context.Context, now time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var n int64
+	for k, rec := range r.idempotency {
+		if !rec.ExpiresAt.After(now) {
+			delete(r.idempotency, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+type refreshToken struct {
+	sessionID string
+	used      bool
+}
+
+type sessionRepository struct {
+	*db
+}
+
+func (r *sessionRepository) Create(_ context.Context, s domain.Session, refreshHash string) (domain.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s.ID = newUUID()
+	r.sessions[s.ID] = s
+	r.refreshTokens[refreshHash] = refreshToken{sessionID: s.ID}
+	return s, nil
+}
+
+func (r *sessionRepository) Get(_ context.Context, id string) (domain.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sessions[id]
+	if !ok {
+		return domain.Session{}, storage.ErrNotFound
+	}
+	return s, nil
+}
+
+func (r *sessionRepository) Rotate(_ context.Context, oldHash, newHash string, now, expiresAt time.Time) (domain.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.refreshTokens[oldHash]
+	if !ok {
+		return domain.Session{}, domain.ErrInvalidRefreshToken
+	}
+	s := r.sessions[t.sessionID]
+	if t.used {
+		r.revoke(&s, domain.RevokedByTokenReuse, now)
+		return s, domain.ErrRefreshTokenReused
+	}
+	if !s.Active(now) {
+		return domain.Session{}, domain.ErrInvalidRefreshToken
+	}
+
+	t.used = true
+	r.refreshTokens[oldHash] = t
+	r.refreshTokens[newHash] = refreshToken{sessionID: s.ID}
+	s.ExpiresAt = expiresAt
+	r.sessions[s.ID] = s
+	return s, nil
+}
+
+func (r *sessionRepository) Revoke(_ context.Context, id, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.sessions[id]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	r.revoke(&s, reason, time.Now())
+	return nil
+}
+
+func (r *sessionRepository) RevokeAll(_ context.Context, userID, exceptID, reason string) ([]domain.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	var revoked []domain.Session
+	for _, s := range r.sessions {
+		if s.UserID != userID || s.ID == exceptID || !s.RevokedAt.IsZero() {
+			continue
+		}
+		r.revoke(&s, reason, now)
+		revoked = append(revoked, s)
+	}
+	return revoked, nil
+}
+
+func (r *sessionRepository) RevokedSince(_ context.Context, since time.Time) ([]domain.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var revoked []domain.Session
+	for _, s := range r.sessions {
+		if s.RevokedAt.After(since) {
+			revoked = append(revoked, s)
+		}
+	}
+	sort.Slice(revoked, func(i, j int) bool {
+		return revoked[i].RevokedAt.Before(revoked[j].RevokedAt)
+	})
+	return revoked, nil
+}
+
+// revoke must be called with the mutex held.
+func (r *sessionRepository) revoke(s *domain.Session, reason string, now time.Time) {
+	if !s.RevokedAt.IsZero() {
+		return
+	}
+	s.RevokedAt = now
+	s.RevokeReason = reason
+	r.sessions[s.ID] = *s
+}
+
+// NewAttemptRepository returns an in-memory attempt repository on its own,
+// so that a single instance can keep its brute-force counters in process
+// whatever the storage.
+func NewAttemptRepository() storage.AttemptRepository {
+	return &attemptRepository{&db{attempts: make(map[string]domain.AttemptCounter)}}
+}
+
+type attemptRepository struct {
+	*db
+}
+
+func (r *attemptRepository) Get(_ context.Context, key string) (domain.AttemptCounter, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.attempts[key]
+	if !ok {
+		return domain.AttemptCounter{Key: key}, nil
+	}
+	return c, nil
+}
+
+func (r *attemptRepository) Increment(_ context.Context, key string, now, cutoff time.Time) (domain.AttemptCounter, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.attempts[key]
+	if !ok || !c.WindowStart.After(cutoff) {
+		c.Key = key
+		c.Count = 0
+		c.WindowStart = now
+	}
+	c.Count++
+	r.attempts[key] = c
+	return c, nil
+}
+
+func (r *attemptRepository) Block(_ context.Context, key string, until time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.attempts[key]
+	if !ok {
+		c = domain.AttemptCounter{Key: key, WindowStart: until}
+	}
+	if until.After(c.BlockedUntil) {
+		c.BlockedUntil = until
+	}
+	r.attempts[key] = c
+	return nil
+}
+
+func (r *attemptRepository) Reset(_ context.Context, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.attempts, key)
+	return nil
+}
+
+func (r *attemptRepository) DeleteStale(_ context.Context, before time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var n int64
+	for key, c := range r.attempts {
+		if c.WindowStart.Before(before) && c.BlockedUntil.Before(before) {
+			delete(r.attempts, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+type auditRepository struct {
+	*db
+}
+
+func (r *auditRepository) Append(_ context.Context, e domain.AuditEntry) (domain.AuditEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e = r.appendAudit(e)
+	e.Metadata = copyMetadata(e.Metadata)
+	return e, nil
+}
+
+// appendAudit chains the entry to the audit log and returns it. The
+// caller must hold the lock.
+func (d *db) appendAudit(e domain.AuditEntry) domain.AuditEntry {
+	e.ID = int64(len(d.audit)) + 1
+	e.CreatedAt = e.CreatedAt.Truncate(time.Microsecond)
+	e.Metadata = copyMetadata(e.Metadata)
+	e.PrevHash = ""
+	if len(d.audit) > 0 {
+		e.PrevHash = d.audit[len(d.audit)-1].Hash
+	}
+	e.Hash = e.ComputeHash()
+	d.audit = append(d.audit, e)
+	return e
+}
+
+// appendEntryAudit appends the audit entry of a ledger write, with
+// metadata added, if audit is not nil. The caller must hold the lock.
+func (d *db) appendEntryAudit(audit *domain.AuditEntry, metadata map[string]string) {
+	if audit != nil {
+		d.appendAudit(audit.WithMetadata(metadata))
+	}
+}
+
+func (r *auditRepository) List(_ context.Context, q domain.AuditQuery) ([]domain.AuditEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var entries []domain.AuditEntry
+	for _, e := range r.audit {
+		if e.ID <= q.AfterID ||
+			q.Actor != "" && e.Actor != q.Actor ||
+			q.Action != "" && e.Action != q.Action ||
+			q.Target != "" && e.Target != q.Target ||
+			!q.From.IsZero() && e.CreatedAt.Before(q.From) ||
+			!q.To.IsZero() && !e.CreatedAt.Before(q.To) {
+			continue
+		}
+		e.Metadata = copyMetadata(e.Metadata)
+		entries = append(entries, e)
+		if q.Limit > 0 && len(entries) == q.Limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+func copyMetadata(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+type notifier struct {
+	*db
+}
+
+// Listen implements storage.Notifier. fn is called with the mutex held.
+func (n *notifier) Listen(ctx context.Context, fn func(userID string)) error {
+	n.mu.Lock()
+	n.listenerID++
+	id := n.listenerID
+	n.listeners[id] = fn
+	n.mu.Unlock()
+
+	<-ctx.Done()
+
+	n.mu.Lock()
+	delete(n.listeners, id)
+	n.mu.Unlock()
+	return nil
+}
+
+// enqueueDeliveries queues the event for every subscription of the user.
+// It must be called with the mutex held.
+func (d *db) enqueueDeliveries(userID string, event domain.EventType, payload []byte) {
+	now := time.Now()
+	for _, sub := range d.subscriptions {
+		if sub.UserID != userID {
+			continue
+		}
+		d.lastDeliveryID++
+		d.deliveries = append(d.deliveries, domain.WebhookDelivery{
+			ID:             d.lastDeliveryID,
+			SubscriptionID: sub.ID,
+			UserID:         userID,
+			URL:            sub.URL,
+			Secret:         sub.Secret,
+			Event:          event,
+			Payload:        payload,
+			Status:         domain.DeliveryPending,
+			NextAttemptAt:  now,
+			CreatedAt:      now,
+		})
+	}
+}
+
+type webhookRepository struct {
+	*db
+}
+
+func (r *webhookRepository) CreateSubscription(_ context.Context, userID, url, secret string) (domain.WebhookSubscription, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sub := domain.WebhookSubscription{
+		ID:        newUUID(),
+		UserID:    userID,
+		URL:       url,
+		Secret:    secret,
+		CreatedAt: time.Now(),
+	}
+	r.subscriptions = append(r.subscriptions, sub)
+	return sub, nil
+}
+
+func (r *webhookRepository) ListSubscriptions(_ context.Context, userID string) ([]domain.WebhookSubscription, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var subs []domain.WebhookSubscription
+	for _, sub := range r.subscriptions {
+		if sub.UserID == userID {
+			subs = append(subs, sub)
+		}
+	}
+	return subs, nil
+}
+
+func (r *webhookRepository) DeleteSubscription(_ context.Context, userID, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, sub := range r.subscriptions {
+		if sub.ID != id || sub.UserID != userID {
+			continue
+		}
+		r.subscriptions = append(r.subscriptions[:i], r.subscriptions[i+1:]...)
+		deliveries := r.deliveries[:0]
+		for _, d := range r.deliveries {
+			if d.SubscriptionID != id {
+				deliveries = append(deliveries, d)
+			}
+		}
+		r.deliveries = deliveries
+		return nil
+	}
+	return storage.ErrNotFound
+}
+
+func (r *webhookRepository) ListDeliveries(_ context.Context, userID, subscriptionID string, limit int) ([]domain.WebhookDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var deliveries []domain.WebhookDelivery
+	for i := len(r.deliveries) - 1; i >= 0; i-- {
+		d := r.deliveries[i]
+		if d.UserID != userID || d.SubscriptionID != subscriptionID {
+			continue
+		}
+		if limit > 0 && len(deliveries) == limit {
+			break
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+func (r *webhookRepository) ClaimDeliveries(_ context.Context, now time.Time, lease time.Duration, limit int) ([]domain.WebhookDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var deliveries []domain.WebhookDelivery
+	for i := range r.deliveries {
+		d := &r.deliveries[i]
+		if d.Status != domain.DeliveryPending || d.NextAttemptAt.After(now) {
+			continue
+		}
+		if limit > 0 && len(deliveries) == limit {
+			break
+		}
+		deliveries = append(deliveries, *d)
+		d.NextAttemptAt = now.Add(lease)
+	}
+	return deliveries, nil
+}
+
+func (r *webhookRepository) UpdateDelivery(_ context.Context, d domain.WebhookDelivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.deliveries {
+		stored := &r.deliveries[i]
+		if stored.ID != d.ID {
+			continue
+		}
+		stored.Status = d.Status
+		stored.Attempts = d.Attempts
+		stored.NextAttemptAt = d.NextAttemptAt
+		stored.LastStatusCode = d.LastStatusCode
+		stored.LastError = d.LastError
+		stored.DeliveredAt = d.DeliveredAt
+		return nil
+	}
+	return storage.ErrNotFound
+}
+
+// newUUID returns a random (version 4) UUID, like gen_random_uuid() does.
+func newUUID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,14 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/internal/storage/storagetest"
+)
+
+func TestStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) *storage.Storage {
+		return NewStorage()
+	})
+}
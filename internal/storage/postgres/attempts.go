@@ -0,0 +1,98 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+)
+
+type attemptRepository struct {
+	*db
+}
+
+func (r *attemptRepository) Get(ctx context.Context, key string) (domain.AttemptCounter, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	c, err := scanAttemptCounter(key, r.pool.QueryRow(ctx,
+		`select count, window_start, blocked_until from attempt_counters where key = $1`, key))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return domain.AttemptCounter{Key: key}, nil
+	}
+	if err != nil {
+		return domain.AttemptCounter{}, fmt.Errorf("failed to get attempt counter: %w", err)
+	}
+	return c, nil
+}
+
+func (r *attemptRepository) Increment(ctx context.Context, key string, now, cutoff time.Time) (domain.AttemptCounter, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	c, err := scanAttemptCounter(key, r.pool.QueryRow(ctx,
+		`insert into attempt_counters (key, count, window_start) values ($1, 1, $2)
+		on conflict (key) do update set
+			count = case when attempt_counters.window_start <= $3 then 1 else attempt_counters.count + 1 end,
+			window_start = case when attempt_counters.window_start <= $3 then $2 else attempt_counters.window_start end
+		returning count, window_start, blocked_until`,
+		key, now, cutoff))
+	if err != nil {
+		return domain.AttemptCounter{}, fmt.Errorf("failed to increment attempt counter: %w", err)
+	}
+	return c, nil
+}
+
+func (r *attemptRepository) Block(ctx context.Context, key string, until time.Time) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.pool.Exec(ctx,
+		`insert into attempt_counters (key, count, window_start, blocked_until) values ($1, 0, $2, $2)
+		on conflict (key) do update set
+			blocked_until = greatest(attempt_counters.blocked_until, excluded.blocked_until)`,
+		key, until)
+	if err != nil {
+		return fmt.Errorf("failed to block attempts: %w", err)
+	}
+	return nil
+}
+
+func (r *attemptRepository) Reset(ctx context.Context, key string) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := r.pool.Exec(ctx, `delete from attempt_counters where key = $1`, key); err != nil {
+		return fmt.Errorf("failed to reset attempt counter: %w", err)
+	}
+	return nil
+}
+
+func (r *attemptRepository) DeleteStale(ctx context.Context, before time.Time) (int64, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	tag, err := r.pool.Exec(ctx,
+		`delete from attempt_counters
+		where window_start < $1 and (blocked_until is null or blocked_until < $1)`,
+		before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete stale attempt counters: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+func scanAttemptCounter(key string, row pgx.Row) (domain.AttemptCounter, error) {
+	c := domain.AttemptCounter{Key: key}
+	var blockedUntil pgtype.Timestamptz
+	err := row.Scan(&c.Count, &c.WindowStart, &blockedUntil)
+	if blockedUntil.Status == pgtype.Present {
+		c.BlockedUntil = blockedUntil.Time
+	}
+	return c, err
+}
@@ -0,0 +1,133 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+)
+
+const auditColumns = `id, created_at, actor, action, target, metadata, prev_hash, hash`
+
+type auditRepository struct {
+	*db
+}
+
+// NewAuditRepository returns the audit log of the database of pool, for
+// tools that only read it: unlike NewStorage, it applies no migrations.
+// Every query is bounded by queryTimeout.
+func NewAuditRepository(pool *pgxpool.Pool, queryTimeout time.Duration) storage.AuditRepository {
+	return &auditRepository{&db{pool: pool, queryTimeout: queryTimeout}}
+}
+
+func (r *auditRepository) Append(ctx context.Context, e domain.AuditEntry) (domain.AuditEntry, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	err := r.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		var err error
+		e, err = appendAudit(ctx, tx, e)
+		return err
+	})
+	if err != nil {
+		return domain.AuditEntry{}, err
+	}
+	return e, nil
+}
+
+// appendAudit appends the entry to the audit log within tx and returns
+// it. It locks the head of the hash chain until tx ends: appends are
+// serialized, each entry chained to the one committed before.
+func appendAudit(ctx context.Context, tx pgx.Tx, e domain.AuditEntry) (domain.AuditEntry, error) {
+	err := tx.QueryRow(ctx, `select hash from audit_head for update`).Scan(&e.PrevHash)
+	if err != nil {
+		return domain.AuditEntry{}, fmt.Errorf("failed to lock audit log: %w", err)
+	}
+
+	e.CreatedAt = e.CreatedAt.Truncate(time.Microsecond)
+	if e.Metadata == nil {
+		e.Metadata = map[string]string{}
+	}
+	e.Hash = e.ComputeHash()
+	err = tx.QueryRow(ctx,
+		`insert into audit_log (created_at, actor, action, target, metadata, prev_hash, hash)
+		values ($1, $2, $3, $4, $5, $6, $7) returning id`,
+		e.CreatedAt, e.Actor, e.Action, e.Target, e.Metadata, e.PrevHash, e.Hash,
+	).Scan(&e.ID)
+	if err != nil {
+		return domain.AuditEntry{}, fmt.Errorf("failed to append audit entry: %w", err)
+	}
+	if _, err := tx.Exec(ctx, `update audit_head set hash = $1`, e.Hash); err != nil {
+		return domain.AuditEntry{}, fmt.Errorf("failed to move audit head: %w", err)
+	}
+
+	return e, nil
+}
+
+// appendEntryAudit appends the audit entry of a ledger write within tx,
+// with metadata added, if audit is not nil.
+func appendEntryAudit(ctx context.Context, tx pgx.Tx, audit *domain.AuditEntry, metadata map[string]string) error {
+	if audit == nil {
+		return nil
+	}
+	_, err := appendAudit(ctx, tx, audit.WithMetadata(metadata))
+	return err
+}
+
+func (r *auditRepository) List(ctx context.Context, q domain.AuditQuery) ([]domain.AuditEntry, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	where := []string{"id > " + arg(q.AfterID)}
+	if q.Actor != "" {
+		where = append(where, "actor = "+arg(q.Actor))
+	}
+	if q.Action != "" {
+		where = append(where, "action = "+arg(q.Action))
+	}
+	if q.Target != "" {
+		where = append(where, "target = "+arg(q.Target))
+	}
+	if !q.From.IsZero() {
+		where = append(where, "created_at >= "+arg(q.From))
+	}
+	if !q.To.IsZero() {
+		where = append(where, "created_at < "+arg(q.To))
+	}
+
+	query := `select ` + auditColumns + ` from audit_log where ` + strings.Join(where, " and ") + ` order by id`
+	if q.Limit > 0 {
+		query += " limit " + arg(q.Limit)
+	}
+
+	rows, err := r.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit entries: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []domain.AuditEntry
+	for rows.Next() {
+		var e domain.AuditEntry
+		err := rows.Scan(&e.ID, &e.CreatedAt, &e.Actor, &e.Action, &e.Target, &e.Metadata, &e.PrevHash, &e.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan audit entry: %w", err)
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
@@ -0,0 +1,97 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+)
+
+const idempotencyColumns = `user_id, key, request_hash, coalesce(status_code, 0), coalesce(content_type, ''),
+	body, created_at, expires_at`
+
+type idempotencyRepository struct {
+	*db
+}
+
+func (r *idempotencyRepository) Reserve(ctx context.Context, rec domain.IdempotencyRecord) (domain.IdempotencyRecord, bool, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	// An expired record is replaced as if it did not exist.
+	stored, err := scanIdempotencyRecord(r.pool.QueryRow(ctx,
+		`insert into idempotency_keys (user_id, key, request_hash, created_at, expires_at)
+		values ($1, $2, $3, $4, $5)
+		on conflict (user_id, key) do update set
+			request_hash = excluded.request_hash, status_code = null, content_type = null, body = null,
+			created_at = excluded.created_at, expires_at = excluded.expires_at
+		where idempotency_keys.expires_at <= excluded.created_at
+		returning `+idempotencyColumns,
+		rec.UserID, rec.Key, rec.RequestHash, rec.CreatedAt, rec.ExpiresAt))
+	if err == nil {
+		return stored, true, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return domain.IdempotencyRecord{}, false, fmt.Errorf("failed to reserve idempotency key: %w", err)
+	}
+
+	stored, err = scanIdempotencyRecord(r.pool.QueryRow(ctx,
+		`select `+idempotencyColumns+` from idempotency_keys where user_id = $1 and key = $2`,
+		rec.UserID, rec.Key))
+	if err != nil {
+		return domain.IdempotencyRecord{}, false, fmt.Errorf("failed to get idempotency key: %w", err)
+	}
+	return stored, false, nil
+}
+
+func (r *idempotencyRepository) Complete(ctx context.Context, userID, key string, statusCode int, contentType string, body []byte,
+	expiresAt time.Time) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	tag, err := r.pool.Exec(ctx,
+		`update idempotency_keys set status_code = $3, content_type = $4, body = $5, expires_at = $6
+		where user_id = $1 and key = $2`,
+		userID, key, statusCode, contentType, body, expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to complete idempotency key: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
+func (r *idempotencyRepository) Release(ctx context.Context, userID, key string) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	_, err := r.pool.Exec(ctx, `delete from idempotency_keys where user_id = $1 and key = $2`, userID, key)
+	if err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	return nil
+}
+
+func (r *idempotencyRepository) DeleteExpired(ctx context.Context, now time.Time) (int64, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	tag, err := r.pool.Exec(ctx, `delete from idempotency_keys where expires_at <= $1`, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired idempotency keys: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+func scanIdempotencyRecord(row pgx.Row) (domain.IdempotencyRecord, error) {
+	var rec domain.IdempotencyRecord
+	err := row.Scan(&rec.UserID, &rec.Key, &rec.RequestHash, &rec.StatusCode, &rec.ContentType,
+		&rec.Body, &rec.CreatedAt, &rec.ExpiresAt)
+	return rec, err
+}
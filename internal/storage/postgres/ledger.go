@@ -0,0 +1,595 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+)
+
+// Kinds of the entries summed up in the balance, see domain.Balance.
+var (
+	withdrawalKind = string(domain.EntryWithdrawal)
+	refundKind     = string(domain.EntryRefund)
+)
+
+type ledgerRepository struct {
+	*db
+}
+
+func (r *ledgerRepository) Balance(ctx context.Context, userID string) (domain.Balance, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var b domain.Balance
+	err := r.pool.QueryRow(ctx,
+		`select coalesce(sum(amount), 0), coalesce(-sum(amount) filter (where kind = $2), 0),
+			coalesce(sum(amount) filter (where kind = $3), 0)
+		from ledger where user_id = $1`,
+		userID, withdrawalKind, refundKind,
+	).Scan(&b.Current, &b.Withdrawn, &b.Refunded)
+	if err != nil {
+		return domain.Balance{}, fmt.Errorf("failed to get balance: %w", err)
+	}
+
+	return b, nil
+}
+
+func (r *ledgerRepository) SnapshotBalance(ctx context.Context, userID string) (domain.BalanceSnapshot, domain.LedgerTail, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	snapshot := domain.BalanceSnapshot{UserID: userID}
+	var tail domain.LedgerTail
+	var updatedAt pgtype.Timestamptz
+	// The covered entries are counted on the (user_id, id) index alone.
+	err := r.pool.QueryRow(ctx,
+		`select coalesce(s.current, 0), coalesce(s.withdrawn, 0), coalesce(s.refunded, 0),
+			coalesce(s.last_entry_id, 0), coalesce(s.entry_count, 0), s.updated_at,
+			coalesce(sum(l.amount), 0), coalesce(-sum(l.amount) filter (where l.kind = $2), 0),
+			coalesce(sum(l.amount) filter (where l.kind = $3), 0),
+			(select count(*) from ledger c where c.user_id = u.user_id and c.id <= coalesce(s.last_entry_id, 0))
+		from (select $1::uuid as user_id) u
+		left join balance_snapshots s on s.user_id = u.user_id
+		left join ledger l on l.user_id = u.user_id and l.id > coalesce(s.last_entry_id, 0)
+		group by u.user_id, s.current, s.withdrawn, s.refunded, s.last_entry_id, s.entry_count, s.updated_at`,
+		userID, withdrawalKind, refundKind,
+	).Scan(&snapshot.Balance.Current, &snapshot.Balance.Withdrawn, &snapshot.Balance.Refunded,
+		&snapshot.LastEntryID, &snapshot.EntryCount, &updatedAt,
+		&tail.Balance.Current, &tail.Balance.Withdrawn, &tail.Balance.Refunded, &tail.Covered)
+	if err != nil {
+		return domain.BalanceSnapshot{}, domain.LedgerTail{}, fmt.Errorf("failed to get balance snapshot: %w", err)
+	}
+	if updatedAt.Status == pgtype.Present {
+		snapshot.UpdatedAt = updatedAt.Time
+	}
+
+	return snapshot, tail, nil
+}
+
+func (r *ledgerRepository) DeleteSnapshot(ctx context.Context, userID string) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := r.pool.Exec(ctx, `delete from balance_snapshots where user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to delete balance snapshot: %w", err)
+	}
+	return nil
+}
+
+func (r *ledgerRepository) CompactBalances(ctx context.Context, before time.Time, limit int) (int, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	// Each snapshot is recomputed from the whole ledger of the user, so
+	// that an error in a snapshot does not carry over to the next one.
+	tag, err := r.pool.Exec(ctx,
+		`with stale as (
+			select l.user_id, max(l.id) as last_entry_id
+			from ledger l
+			left join balance_snapshots s on s.user_id = l.user_id
+			where l.created_at < $1 and l.id > coalesce(s.last_entry_id, 0)
+			group by l.user_id
+			limit $2
+		)
+		insert into balance_snapshots (user_id, current, withdrawn, refunded, last_entry_id, entry_count, updated_at)
+		select st.user_id, coalesce(sum(l.amount), 0), coalesce(-sum(l.amount) filter (where l.kind = $3), 0),
+			coalesce(sum(l.amount) filter (where l.kind = $4), 0), st.last_entry_id, count(l.id), now()
+		from stale st
+		join ledger l on l.user_id = st.user_id and l.id <= st.last_entry_id
+		group by st.user_id, st.last_entry_id
+		on conflict (user_id) do update set
+			current = excluded.current,
+			withdrawn = excluded.withdrawn,
+			refunded = excluded.refunded,
+			last_entry_id = excluded.last_entry_id,
+			entry_count = excluded.entry_count,
+			updated_at = excluded.updated_at
+		where balance_snapshots.last_entry_id < excluded.last_entry_id`,
+		before, limit, withdrawalKind, refundKind)
+	if err != nil {
+		return 0, fmt.Errorf("failed to compact balances: %w", err)
+	}
+
+	return int(tag.RowsAffected()), nil
+}
+
+func (r *ledgerRepository) Withdraw(ctx context.Context, userID, orderNumber string, sum money.Amount, audit *domain.AuditEntry) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	return r.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		// The user row serializes the withdrawals of a user, so two of them
+		// cannot both see the balance before the other one.
+		if _, err := tx.Exec(ctx, `select 1 from users where id = $1 for update`, userID); err != nil {
+			return fmt.Errorf("failed to lock user: %w", err)
+		}
+
+		var current money.Amount
+		err := tx.QueryRow(ctx, `select coalesce(sum(amount), 0) from ledger where user_id = $1`, userID).Scan(&current)
+		if err != nil {
+			return fmt.Errorf("failed to get balance: %w", err)
+		}
+		if current < sum {
+			return domain.ErrInsufficientFunds
+		}
+
+		e, err := insertEntry(ctx, tx, domain.LedgerEntry{
+			UserID:      userID,
+			Kind:        domain.EntryWithdrawal,
+			OrderNumber: orderNumber,
+			Amount:      -sum,
+		})
+		if hasCode(err, codeUniqueViolation) {
+			return domain.ErrOrderAlreadyPaid
+		}
+		if err != nil {
+			return fmt.Errorf("failed to withdraw: %w", err)
+		}
+
+		return appendEntryAudit(ctx, tx, audit, map[string]string{
+			"entry_id": strconv.FormatInt(e.ID, 10),
+		})
+	})
+}
+
+func (r *ledgerRepository) Correct(ctx context.Context, c domain.Correction) (domain.LedgerEntry, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var e domain.LedgerEntry
+	err := r.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		// Serializes with the withdrawals of the user, see Withdraw.
+		var locked int
+		err := tx.QueryRow(ctx, `select 1 from users where id = $1 for update`, c.UserID).Scan(&locked)
+		if errors.Is(err, pgx.ErrNoRows) || hasCode(err, codeInvalidTextRepresentation) {
+			return storage.ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to lock user: %w", err)
+		}
+
+		var current money.Amount
+		err = tx.QueryRow(ctx, `select coalesce(sum(amount), 0) from ledger where user_id = $1`, c.UserID).Scan(&current)
+		if err != nil {
+			return fmt.Errorf("failed to get balance: %w", err)
+		}
+		if current+c.Amount < 0 {
+			return domain.ErrInsufficientFunds
+		}
+
+		e, err = insertEntry(ctx, tx, domain.LedgerEntry{
+			UserID:      c.UserID,
+			Kind:        domain.EntryCorrection,
+			OrderNumber: c.OrderNumber,
+			Amount:      c.Amount,
+			Reason:      c.Reason,
+			Operator:    c.Operator,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to correct balance: %w", err)
+		}
+
+		return appendEntryAudit(ctx, tx, c.Audit, map[string]string{
+			"entry_id": strconv.FormatInt(e.ID, 10),
+		})
+	})
+	if err != nil {
+		return domain.LedgerEntry{}, err
+	}
+
+	return e, nil
+}
+
+func (r *ledgerRepository) Refund(ctx context.Context, refund domain.Refund) (domain.LedgerEntry, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var e domain.LedgerEntry
+	err := r.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		var withdrawalID int64
+		var userID string
+		var sum money.Amount
+		var withdrawnAt time.Time
+		err := tx.QueryRow(ctx,
+			`select id, user_id::text, -amount, created_at from ledger where kind = $1 and order_number = $2`,
+			string(domain.EntryWithdrawal), refund.OrderNumber,
+		).Scan(&withdrawalID, &userID, &sum, &withdrawnAt)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return storage.ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get withdrawal: %w", err)
+		}
+
+		// Serializes with the withdrawals of the user, see Withdraw.
+		if _, err := tx.Exec(ctx, `select 1 from users where id = $1 for update`, userID); err != nil {
+			return fmt.Errorf("failed to lock user: %w", err)
+		}
+
+		e, err = insertEntry(ctx, tx, domain.LedgerEntry{
+			UserID:      userID,
+			Kind:        domain.EntryRefund,
+			OrderNumber: refund.OrderNumber,
+			Amount:      sum,
+			Reason:      refund.Reason,
+			Operator:    refund.Operator,
+		})
+		if hasCode(err, codeUniqueViolation) {
+			return domain.ErrAlreadyRefunded
+		}
+		if err != nil {
+			return fmt.Errorf("failed to refund withdrawal: %w", err)
+		}
+
+		if err := restoreLots(ctx, tx, withdrawalID, withdrawnAt, e); err != nil {
+			return err
+		}
+
+		return appendEntryAudit(ctx, tx, refund.Audit, map[string]string{
+			"user_id":  e.UserID,
+			"amount":   e.Amount.String(),
+			"entry_id": strconv.FormatInt(e.ID, 10),
+		})
+	})
+	if err != nil {
+		return domain.LedgerEntry{}, err
+	}
+
+	return e, nil
+}
+
+func (r *ledgerRepository) OrderCredits(ctx context.Context, orderNumber string) (money.Amount, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var sum money.Amount
+	err := r.pool.QueryRow(ctx,
+		`select coalesce(sum(amount), 0) from ledger where order_number = $1 and kind = any($2)`,
+		orderNumber, []string{string(domain.EntryAccrual), string(domain.EntryCorrection)},
+	).Scan(&sum)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get order credits: %w", err)
+	}
+
+	return sum, nil
+}
+
+func (r *ledgerRepository) NegativeBalances(ctx context.Context) (map[string]money.Amount, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.pool.Query(ctx,
+		`select user_id::text, sum(amount) from ledger group by user_id having sum(amount) < 0`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list negative balances: %w", err)
+	}
+	defer rows.Close()
+
+	negative := make(map[string]money.Amount)
+	for rows.Next() {
+		var userID string
+		var current money.Amount
+		if err := rows.Scan(&userID, &current); err != nil {
+			return nil, fmt.Errorf("failed to scan balance: %w", err)
+		}
+		negative[userID] = current
+	}
+
+	return negative, rows.Err()
+}
+
+func (r *ledgerRepository) Lots(ctx context.Context, userID string) ([]domain.CreditLot, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.pool.Query(ctx,
+		`select entry_id, user_id::text, order_number, amount, remaining, created_at from credit_lots
+		where user_id = $1 and remaining > 0
+		order by entry_id`,
+		userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list credit lots: %w", err)
+	}
+	defer rows.Close()
+
+	var lots []domain.CreditLot
+	for rows.Next() {
+		var lot domain.CreditLot
+		if err := rows.Scan(&lot.EntryID, &lot.UserID, &lot.OrderNumber, &lot.Amount, &lot.Remaining, &lot.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan credit lot: %w", err)
+		}
+		lots = append(lots, lot)
+	}
+
+	return lots, rows.Err()
+}
+
+func (r *ledgerRepository) ExpireLots(ctx context.Context, creditedBefore time.Time, limit int) (int, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var expired int
+	err := r.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx,
+			`select entry_id, user_id::text from credit_lots
+			where created_at < $1 and remaining > 0
+			order by user_id, entry_id
+			limit $2`,
+			creditedBefore, limit)
+		if err != nil {
+			return fmt.Errorf("failed to list expired credit lots: %w", err)
+		}
+		type key struct {
+			entryID int64
+			userID  string
+		}
+		var keys []key
+		for rows.Next() {
+			var k key
+			if err := rows.Scan(&k.entryID, &k.userID); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan credit lot: %w", err)
+			}
+			keys = append(keys, k)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to list expired credit lots: %w", err)
+		}
+
+		var locked string
+		for _, k := range keys {
+			// Serializes with the debits of the user, see Withdraw.
+			if k.userID != locked {
+				if _, err := tx.Exec(ctx, `select 1 from users where id = $1 for update`, k.userID); err != nil {
+					return fmt.Errorf("failed to lock user: %w", err)
+				}
+				locked = k.userID
+			}
+
+			var lot domain.CreditLot
+			err := tx.QueryRow(ctx,
+				`update credit_lots l set remaining = 0
+				from (select entry_id, remaining from credit_lots where entry_id = $1 for update) old
+				where l.entry_id = old.entry_id and old.remaining > 0
+				returning l.entry_id, l.user_id::text, l.order_number, old.remaining`,
+				k.entryID,
+			).Scan(&lot.EntryID, &lot.UserID, &lot.OrderNumber, &lot.Remaining)
+			if errors.Is(err, pgx.ErrNoRows) {
+				// Spent since it was listed.
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to expire credit lot: %w", err)
+			}
+
+			if _, err := insertEntry(ctx, tx, domain.NewExpiry(lot)); err != nil {
+				return fmt.Errorf("failed to write expiry: %w", err)
+			}
+			expired++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return expired, nil
+}
+
+// restoreLots gives the refund back to the lots its withdrawal spent. The
+// withdrawals made before the spends were recorded get a lot as old as
+// they are for what is left.
+func restoreLots(ctx context.Context, tx pgx.Tx, withdrawalID int64, withdrawnAt time.Time, refund domain.LedgerEntry) error {
+	var restored money.Amount
+	err := tx.QueryRow(ctx,
+		`with restored as (
+			update credit_lots l set remaining = l.remaining + s.amount
+			from lot_spends s
+			where s.debit_entry_id = $1 and l.entry_id = s.lot_entry_id
+			returning s.amount
+		)
+		select coalesce(sum(amount), 0) from restored`,
+		withdrawalID,
+	).Scan(&restored)
+	if err != nil {
+		return fmt.Errorf("failed to restore credit lots: %w", err)
+	}
+	if restored >= refund.Amount {
+		return nil
+	}
+
+	_, err = tx.Exec(ctx,
+		`insert into credit_lots (entry_id, user_id, order_number, amount, remaining, created_at)
+		values ($1, $2, $3, $4, $4, $5)`,
+		refund.ID, refund.UserID, refund.OrderNumber, refund.Amount-restored, withdrawnAt)
+	if err != nil {
+		return fmt.Errorf("failed to open credit lot: %w", err)
+	}
+	return nil
+}
+
+// grantBonus appends the entry of the bonus within tx unless it is not
+// due, see domain.Bonus. Bonuses limited per user lock the user, so that
+// two of them cannot both see none granted.
+func grantBonus(ctx context.Context, tx pgx.Tx, b domain.Bonus) error {
+	if b.OncePerUser || b.FirstOrder {
+		if _, err := tx.Exec(ctx, `select 1 from users where id = $1 for update`, b.UserID); err != nil {
+			return fmt.Errorf("failed to lock user: %w", err)
+		}
+	}
+
+	var granted bool
+	err := tx.QueryRow(ctx,
+		`select exists (
+			select 1 from ledger
+			where kind = 'bonus' and rule_id = $1 and user_id = $2 and ($3 or order_number = $4)
+		) or ($5 and exists (
+			select 1 from orders
+			where user_id = $2 and number <> $4 and status = 'PROCESSED'
+		))`,
+		b.RuleID, b.UserID, b.OncePerUser, b.OrderNumber, b.FirstOrder,
+	).Scan(&granted)
+	if err != nil {
+		return fmt.Errorf("failed to check bonus of rule %s: %w", b.RuleID, err)
+	}
+	if granted {
+		return nil
+	}
+
+	_, err = insertEntry(ctx, tx, domain.LedgerEntry{
+		UserID:      b.UserID,
+		Kind:        domain.EntryBonus,
+		OrderNumber: b.OrderNumber,
+		Amount:      b.Amount,
+		Reason:      b.Reason,
+		RuleID:      b.RuleID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to grant bonus of rule %s: %w", b.RuleID, err)
+	}
+	return nil
+}
+
+// insertEntry appends the entry and its outbox event within tx, keeps
+// the credit lots of the user, and returns the entry. Debits other than
+// expiries must hold the lock of the user, see Withdraw.
+func insertEntry(ctx context.Context, tx pgx.Tx, e domain.LedgerEntry) (domain.LedgerEntry, error) {
+	err := tx.QueryRow(ctx,
+		`insert into ledger (user_id, kind, order_number, amount, reason, operator, rule_id)
+		values ($1, $2, $3, $4, nullif($5, ''), nullif($6, ''), nullif($7, ''))
+		returning id, created_at`,
+		e.UserID, string(e.Kind), e.OrderNumber, e.Amount, e.Reason, e.Operator, e.RuleID,
+	).Scan(&e.ID, &e.CreatedAt)
+	if err != nil {
+		return domain.LedgerEntry{}, err
+	}
+
+	switch {
+	case e.Kind == domain.EntryRefund:
+		// Refund gives the points back to their lots.
+	case e.Amount > 0:
+		_, err = tx.Exec(ctx,
+			`insert into credit_lots (entry_id, user_id, order_number, amount, remaining, created_at)
+			values ($1, $2, $3, $4, $4, $5)`,
+			e.ID, e.UserID, e.OrderNumber, e.Amount, e.CreatedAt)
+		if err != nil {
+			return domain.LedgerEntry{}, fmt.Errorf("failed to open credit lot: %w", err)
+		}
+	case e.Kind != domain.EntryExpiry:
+		// Spends the oldest lots first: each lot gives what the debit
+		// still needs after the lots before it.
+		_, err = tx.Exec(ctx,
+			`with lots as (
+				select entry_id, remaining from credit_lots
+				where user_id = $1 and remaining > 0
+				order by entry_id
+				for update
+			), spent as (
+				select entry_id, least(remaining, greatest(0, $2 - (sum(remaining) over (order by entry_id) - remaining))) as amount
+				from lots
+			), updated as (
+				update credit_lots l set remaining = l.remaining - spent.amount
+				from spent
+				where l.entry_id = spent.entry_id and spent.amount > 0
+				returning l.entry_id, spent.amount
+			)
+			insert into lot_spends (debit_entry_id, lot_entry_id, amount)
+			select $3, entry_id, amount from updated`,
+			e.UserID, -e.Amount, e.ID)
+		if err != nil {
+			return domain.LedgerEntry{}, fmt.Errorf("failed to spend credit lots: %w", err)
+		}
+	}
+
+	return e, insertEvent(ctx, tx, domain.NewLedgerEvent(e))
+}
+
+func (r *ledgerRepository) Withdrawals(ctx context.Context, userID string) ([]domain.Withdrawal, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.pool.Query(ctx,
+		`select w.order_number, -w.amount, w.created_at, rf.created_at from ledger w
+		left join ledger rf on rf.kind = $3 and rf.order_number = w.order_number
+		where w.user_id = $1 and w.kind = $2
+		order by w.id`,
+		userID, string(domain.EntryWithdrawal), string(domain.EntryRefund))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list withdrawals: %w", err)
+	}
+	defer rows.Close()
+
+	var withdrawals []domain.Withdrawal
+	for rows.Next() {
+		var w domain.Withdrawal
+		var refundedAt pgtype.Timestamptz
+		if err := rows.Scan(&w.Order, &w.Sum, &w.ProcessedAt, &refundedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan withdrawal: %w", err)
+		}
+		if refundedAt.Status == pgtype.Present {
+			w.RefundedAt = refundedAt.Time
+		}
+		withdrawals = append(withdrawals, w)
+	}
+
+	return withdrawals, rows.Err()
+}
+
+func (r *ledgerRepository) Entries(ctx context.Context, userID string) ([]domain.LedgerEntry, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.pool.Query(ctx,
+		`select id, user_id::text, kind, order_number, amount, created_at,
+			coalesce(reason, ''), coalesce(operator, ''), coalesce(rule_id, '') from ledger
+		where user_id = $1
+		order by id`,
+		userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ledger entries: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []domain.LedgerEntry
+	for rows.Next() {
+		var e domain.LedgerEntry
+		var k string
+		if err := rows.Scan(&e.ID, &e.UserID, &k, &e.OrderNumber, &e.Amount, &e.CreatedAt, &e.Reason, &e.Operator, &e.RuleID); err != nil {
+			return nil, fmt.Errorf("failed to scan ledger entry: %w", err)
+		}
+		e.Kind = domain.EntryKind(k)
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
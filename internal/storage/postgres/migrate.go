@@ -0,0 +1,39 @@
+// Package postgres is the PostgreSQL storage of the service.
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+
+	// Registers the "pgx" database/sql driver.
+	_ "github.com/jackc/pgx/v4/stdlib"
+	migrate "github.com/rubenv/sql-migrate"
+
+	"github.com/paramonies/ya-gophermart/migrations"
+)
+
+// migrationsTable matches the table configured in dbconfig.yml.
+const migrationsTable = "migrations"
+
+// Migrate applies the embedded migrations that are not applied yet and
+// returns how many were applied.
+func Migrate(databaseURI string) (int, error) {
+	db, err := sql.Open("pgx", databaseURI)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+
+	migrate.SetTable(migrationsTable)
+	src := migrate.EmbedFileSystemMigrationSource{
+		FileSystem: migrations.FS,
+		Root:       ".",
+	}
+
+	n, err := migrate.Exec(db, "postgres", src, migrate.Up)
+	if err != nil {
+		return n, fmt.Errorf("failed to apply migrations: %w", err)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,66 @@
+package postgres
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"github.com/paramonies/ya-gophermart/pkg/log"
+)
+
+const (
+	// outboxChannel is notified by a trigger with the user ID of every
+	// outbox row, once the inserting transaction commits.
+	outboxChannel = "outbox_events"
+
+	listenRetryDelay = time.Second
+)
+
+// notifier implements storage.Notifier with LISTEN/NOTIFY, so every
+// instance of the service hears about the events committed by the others.
+type notifier struct {
+	pool *pgxpool.Pool
+}
+
+// Listen holds a connection of the pool for as long as ctx is not done
+// and reconnects when it breaks.
+func (n *notifier) Listen(ctx context.Context, fn func(userID string)) error {
+	for {
+		err := n.listen(ctx, fn)
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Warning(ctx, "lost the outbox notification channel, reconnecting", "error", err.Error())
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(listenRetryDelay):
+		}
+	}
+}
+
+func (n *notifier) listen(ctx context.Context, fn func(userID string)) error {
+	conn, err := n.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "listen "+outboxChannel); err != nil {
+		return err
+	}
+	defer func() {
+		// The connection returns to the pool, stop listening on it.
+		_, _ = conn.Exec(context.Background(), "unlisten "+outboxChannel)
+	}()
+
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		fn(notification.Payload)
+	}
+}
@@ -0,0 +1,239 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+)
+
+const orderColumns = `number, user_id::text, status, coalesce(accrual, 0), uploaded_at`
+
+type orderRepository struct {
+	*db
+}
+
+func (r *orderRepository) Create(ctx context.Context, userID, number string) (bool, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	tag, err := r.pool.Exec(ctx,
+		`insert into orders (number, user_id) values ($1, $2) on conflict (number) do nothing`,
+		number, userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to create order: %w", err)
+	}
+	if tag.RowsAffected() == 1 {
+		return true, nil
+	}
+
+	var ownerID string
+	err = r.pool.QueryRow(ctx, `select user_id::text from orders where number = $1`, number).Scan(&ownerID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get order owner: %w", err)
+	}
+	if ownerID != userID {
+		return false, domain.ErrOrderOwnedByOther
+	}
+
+	return false, nil
+}
+
+func (r *orderRepository) Get(ctx context.Context, number string) (domain.Order, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	o, err := scanOrder(r.pool.QueryRow(ctx, `select `+orderColumns+` from orders where number = $1`, number))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return domain.Order{}, storage.ErrNotFound
+	}
+	if err != nil {
+		return domain.Order{}, fmt.Errorf("failed to get order: %w", err)
+	}
+
+	return o, nil
+}
+
+func (r *orderRepository) ListByUser(ctx context.Context, userID string, q domain.OrderQuery) ([]domain.Order, error) {
+	return r.listQuery(ctx, []string{"user_id = $1"}, []interface{}{userID}, q)
+}
+
+func (r *orderRepository) List(ctx context.Context, q domain.OrderQuery) ([]domain.Order, error) {
+	return r.listQuery(ctx, []string{"true"}, nil, q)
+}
+
+// listQuery lists the orders matching where and selected by q. The
+// conditions in where use the first parameters, args.
+func (r *orderRepository) listQuery(ctx context.Context, where []string, args []interface{}, q domain.OrderQuery) ([]domain.Order, error) {
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if q.After != nil {
+		where = append(where, fmt.Sprintf("(uploaded_at, number) > (%s, %s)", arg(q.After.UploadedAt), arg(q.After.Number)))
+	}
+	if len(q.Statuses) > 0 {
+		statuses := make([]string, len(q.Statuses))
+		for i, s := range q.Statuses {
+			statuses[i] = string(s)
+		}
+		where = append(where, "status = any("+arg(statuses)+")")
+	}
+	if !q.UploadedFrom.IsZero() {
+		where = append(where, "uploaded_at >= "+arg(q.UploadedFrom))
+	}
+	if !q.UploadedTo.IsZero() {
+		where = append(where, "uploaded_at < "+arg(q.UploadedTo))
+	}
+
+	query := `select ` + orderColumns + ` from orders where ` + strings.Join(where, " and ") +
+		` order by uploaded_at, number`
+	if q.Limit > 0 {
+		query += " limit " + arg(q.Limit)
+	}
+
+	return r.list(ctx, query, args...)
+}
+
+func (r *orderRepository) ListPending(ctx context.Context, after *domain.OrderCursor, limit int) ([]domain.Order, error) {
+	if after == nil {
+		return r.list(ctx,
+			`select `+orderColumns+` from orders where status in ('NEW', 'PROCESSING') order by uploaded_at, number limit $1`,
+			limit)
+	}
+	return r.list(ctx,
+		`select `+orderColumns+` from orders where status in ('NEW', 'PROCESSING') and (uploaded_at, number) > ($2, $3)
+		order by uploaded_at, number limit $1`,
+		limit, after.UploadedAt, after.Number)
+}
+
+func (r *orderRepository) list(ctx context.Context, query string, args ...interface{}) ([]domain.Order, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list orders: %w", err)
+	}
+	defer rows.Close()
+
+	var orders []domain.Order
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan order: %w", err)
+		}
+		orders = append(orders, o)
+	}
+
+	return orders, rows.Err()
+}
+
+func (r *orderRepository) UpdateStatus(ctx context.Context, number string, status domain.OrderStatus, accrual money.Amount) error {
+	return r.Update(ctx, domain.StatusUpdate{Number: number, Status: status, Accrual: accrual})
+}
+
+func (r *orderRepository) Update(ctx context.Context, u domain.StatusUpdate) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	return r.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		var userID string
+		err := tx.QueryRow(ctx,
+			`update orders set status = $2, accrual = case when $2 = 'PROCESSED' then $3::numeric end
+			where number = $1 and status in ('NEW', 'PROCESSING') and status <> $2
+			returning user_id::text`,
+			u.Number, string(u.Status), u.Accrual,
+		).Scan(&userID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			var exists bool
+			if err := tx.QueryRow(ctx, `select exists (select from orders where number = $1)`, u.Number).Scan(&exists); err != nil {
+				return fmt.Errorf("failed to check order: %w", err)
+			}
+			if !exists {
+				return storage.ErrNotFound
+			}
+			// Already final or in status.
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update order status: %w", err)
+		}
+
+		if event, ok := domain.NewOrderEvent(userID, u.Number, u.Status, u.Accrual); ok {
+			if err := insertEvent(ctx, tx, event); err != nil {
+				return fmt.Errorf("failed to write order event: %w", err)
+			}
+			if u.Status.Final() {
+				if err := enqueueDeliveries(ctx, tx, userID, event.Type, event.Payload); err != nil {
+					return err
+				}
+			}
+		}
+
+		if u.Status != domain.OrderStatusProcessed {
+			return nil
+		}
+
+		if u.Accrual > 0 {
+			_, err = insertEntry(ctx, tx, domain.LedgerEntry{
+				UserID:      userID,
+				Kind:        domain.EntryAccrual,
+				OrderNumber: u.Number,
+				Amount:      u.Accrual,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to credit accrual: %w", err)
+			}
+		}
+
+		for _, b := range u.Bonuses {
+			b.UserID = userID
+			b.OrderNumber = u.Number
+			if err := grantBonus(ctx, tx, b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *orderRepository) Requeue(ctx context.Context, number string) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var status string
+	err := r.pool.QueryRow(ctx,
+		`with requeued as (
+			update orders set status = 'NEW', accrual = null where number = $1 and status <> 'PROCESSED'
+		)
+		select status from orders where number = $1`,
+		number,
+	).Scan(&status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return storage.ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to requeue order: %w", err)
+	}
+	if domain.OrderStatus(status) == domain.OrderStatusProcessed {
+		return domain.ErrOrderAlreadyProcessed
+	}
+	return nil
+}
+
+func scanOrder(row pgx.Row) (domain.Order, error) {
+	var o domain.Order
+	var status string
+	err := row.Scan(&o.Number, &o.UserID, &status, &o.Accrual, &o.UploadedAt)
+	o.Status = domain.OrderStatus(status)
+	return o, err
+}
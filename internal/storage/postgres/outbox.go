@@ -0,0 +1,150 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+)
+
+type outboxRepository struct {
+	*db
+}
+
+// Claim locks the candidates with skip locked, so that concurrent claims
+// pass over each other's events, and leases them before committing: the
+// row locks end with the transaction, the lease covers the publishing.
+func (r *outboxRepository) Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]domain.OutboxEvent, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var events []domain.OutboxEvent
+	err := r.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx,
+			`select o.id, o.user_id::text, o.type, o.payload, o.created_at, o.attempts, o.next_attempt_at
+			from outbox o
+			where o.delivered_at is null and o.dead_at is null
+				and o.next_attempt_at <= $1
+				and (o.claimed_until is null or o.claimed_until <= $1)
+				and not exists (
+					select 1 from outbox p
+					where p.user_id = o.user_id and p.id < o.id
+						and p.delivered_at is null and p.dead_at is null)
+			order by o.id limit $2
+			for update skip locked`,
+			now, limit)
+		if err != nil {
+			return err
+		}
+		events, err = scanEvents(rows)
+		if err != nil || len(events) == 0 {
+			return err
+		}
+
+		ids := make([]int64, 0, len(events))
+		for _, e := range events {
+			ids = append(ids, e.ID)
+		}
+		_, err = tx.Exec(ctx, `update outbox set claimed_until = $2 where id = any($1)`, ids, now.Add(lease))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim outbox events: %w", err)
+	}
+	return events, nil
+}
+
+func (r *outboxRepository) list(ctx context.Context, query string, args ...interface{}) ([]domain.OutboxEvent, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list outbox events: %w", err)
+	}
+	return scanEvents(rows)
+}
+
+func scanEvents(rows pgx.Rows) ([]domain.OutboxEvent, error) {
+	defer rows.Close()
+
+	var events []domain.OutboxEvent
+	for rows.Next() {
+		var e domain.OutboxEvent
+		var eventType string
+		var payload []byte
+		err := rows.Scan(&e.ID, &e.UserID, &eventType, &payload, &e.CreatedAt, &e.Attempts, &e.NextAttemptAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan outbox event: %w", err)
+		}
+		e.Type = domain.EventType(eventType)
+		e.Payload = payload
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+func (r *outboxRepository) UserEvents(ctx context.Context, userID string, afterID int64, limit int) ([]domain.OutboxEvent, error) {
+	return r.list(ctx,
+		`select id, user_id::text, type, payload, created_at, attempts, next_attempt_at from outbox
+		where user_id = $1 and id > $2
+		order by id limit $3`,
+		userID, afterID, limit)
+}
+
+func (r *outboxRepository) LastUserEventID(ctx context.Context, userID string) (int64, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var id int64
+	err := r.pool.QueryRow(ctx, `select coalesce(max(id), 0) from outbox where user_id = $1`, userID).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get last outbox event: %w", err)
+	}
+	return id, nil
+}
+
+func (r *outboxRepository) MarkDelivered(ctx context.Context, id int64) error {
+	return r.update(ctx, `update outbox set delivered_at = now(), claimed_until = null where id = $1`, id)
+}
+
+func (r *outboxRepository) MarkFailed(ctx context.Context, id int64, nextAttemptAt time.Time, reason string) error {
+	return r.update(ctx,
+		`update outbox set attempts = attempts + 1, next_attempt_at = $2, last_error = $3, claimed_until = null
+		where id = $1`,
+		id, nextAttemptAt, reason)
+}
+
+func (r *outboxRepository) MarkDead(ctx context.Context, id int64, reason string) error {
+	return r.update(ctx,
+		`update outbox set attempts = attempts + 1, dead_at = now(), last_error = $2, claimed_until = null
+		where id = $1`,
+		id, reason)
+}
+
+func (r *outboxRepository) update(ctx context.Context, query string, args ...interface{}) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	tag, err := r.pool.Exec(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to update outbox event: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
+// insertEvent writes the event to the outbox within tx.
+func insertEvent(ctx context.Context, tx pgx.Tx, event domain.OutboxEvent) error {
+	_, err := tx.Exec(ctx,
+		`insert into outbox (user_id, type, payload, created_at) values ($1, $2, $3, $4)`,
+		event.UserID, string(event.Type), string(event.Payload), event.CreatedAt)
+	return err
+}
@@ -0,0 +1,72 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"github.com/paramonies/ya-gophermart/internal/storage"
+)
+
+const (
+	codeUniqueViolation           = "23505"
+	codeForeignKeyViolation       = "23503"
+	codeInvalidTextRepresentation = "22P02"
+)
+
+// NewStorage applies the migrations and connects to the database.
+// Every query is bounded by queryTimeout.
+func NewStorage(ctx context.Context, databaseURI string, queryTimeout time.Duration) (*storage.Storage, error) {
+	if _, err := Migrate(databaseURI); err != nil {
+		return nil, err
+	}
+
+	pool, err := pgxpool.Connect(ctx, databaseURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	d := &db{pool: pool, queryTimeout: queryTimeout}
+	return &storage.Storage{
+		Users:       &userRepository{d},
+		Orders:      &orderRepository{d},
+		Ledger:      &ledgerRepository{d},
+		Referrals:   &referralRepository{d},
+		Outbox:      &outboxRepository{d},
+		Webhooks:    &webhookRepository{d},
+		Idempotency: &idempotencyRepository{d},
+		Sessions:    &sessionRepository{d},
+		Attempts:    &attemptRepository{d},
+		Audit:       &auditRepository{d},
+		Notifier:    &notifier{pool},
+		CloseFunc:   pool.Close,
+	}, nil
+}
+
+// db is shared by the repositories.
+type db struct {
+	pool         *pgxpool.Pool
+	queryTimeout time.Duration
+}
+
+// withTimeout bounds the queries of ctx by the query timeout, or the one
+// of storage.WithQueryTimeout.
+func (d *db) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := d.queryTimeout
+	if t, ok := storage.QueryTimeout(ctx); ok {
+		timeout = t
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func hasCode(err error, code string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == code
+}
@@ -0,0 +1,213 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+)
+
+const referralColumns = `r.referrer_id::text, r.referred_id::text, u.user_name, r.status, r.created_at,
+	coalesce(r.order_number, ''), r.rewarded_at`
+
+type referralRepository struct {
+	*db
+}
+
+func (r *referralRepository) Code(ctx context.Context, userID string) (string, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var code string
+	err := r.pool.QueryRow(ctx, `select code from referral_codes where user_id = $1`, userID).Scan(&code)
+	if errors.Is(err, pgx.ErrNoRows) || hasCode(err, codeInvalidTextRepresentation) {
+		return "", storage.ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get referral code: %w", err)
+	}
+
+	return code, nil
+}
+
+func (r *referralRepository) CreateCode(ctx context.Context, userID, code string) (string, bool, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var stored string
+	err := r.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx,
+			`insert into referral_codes (user_id, code) values ($1, $2) on conflict (user_id) do nothing`,
+			userID, code)
+		if err != nil {
+			return err
+		}
+		return tx.QueryRow(ctx, `select code from referral_codes where user_id = $1`, userID).Scan(&stored)
+	})
+	switch {
+	case hasCode(err, codeUniqueViolation):
+		return "", false, nil
+	case hasCode(err, codeForeignKeyViolation), hasCode(err, codeInvalidTextRepresentation):
+		return "", false, storage.ErrNotFound
+	case err != nil:
+		return "", false, fmt.Errorf("failed to create referral code: %w", err)
+	}
+
+	return stored, true, nil
+}
+
+func (r *referralRepository) Referrer(ctx context.Context, code string) (string, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var userID string
+	err := r.pool.QueryRow(ctx, `select user_id::text from referral_codes where code = $1`, code).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", storage.ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get referrer: %w", err)
+	}
+
+	return userID, nil
+}
+
+func (r *referralRepository) ListByReferrer(ctx context.Context, referrerID string) ([]domain.Referral, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.pool.Query(ctx,
+		`select `+referralColumns+` from referrals r join users u on u.id = r.referred_id
+		where r.referrer_id = $1
+		order by r.created_at, r.referred_id`,
+		referrerID)
+	if hasCode(err, codeInvalidTextRepresentation) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list referrals: %w", err)
+	}
+	return scanReferrals(rows)
+}
+
+func (r *referralRepository) Pending(ctx context.Context, afterID string, limit int) ([]domain.Referral, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	// User IDs compare as text, so that the first page needs no ID.
+	rows, err := r.pool.Query(ctx,
+		`select `+referralColumns+` from referrals r join users u on u.id = r.referred_id
+		where r.status = $1 and r.referred_id::text > $2
+		order by r.referred_id::text
+		limit $3`,
+		string(domain.ReferralPending), afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pending referrals: %w", err)
+	}
+	return scanReferrals(rows)
+}
+
+func (r *referralRepository) Reward(ctx context.Context, rw domain.ReferralReward) (domain.Referral, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var ref domain.Referral
+	err := r.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		var err error
+		ref, err = scanReferral(tx.QueryRow(ctx,
+			`select `+referralColumns+` from referrals r join users u on u.id = r.referred_id
+			where r.referred_id = $1
+			for update of r`,
+			rw.ReferredID))
+		if errors.Is(err, pgx.ErrNoRows) || hasCode(err, codeInvalidTextRepresentation) {
+			return storage.ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get referral: %w", err)
+		}
+		if ref.Status != domain.ReferralPending {
+			return nil
+		}
+
+		// Serializes the rewards of the referrer, so that two of them
+		// cannot both stay under the cap.
+		if _, err := tx.Exec(ctx, `select 1 from users where id = $1 for update`, ref.ReferrerID); err != nil {
+			return fmt.Errorf("failed to lock user: %w", err)
+		}
+
+		ref.Status = domain.ReferralRewarded
+		if rw.Cap > 0 {
+			var rewarded int
+			err := tx.QueryRow(ctx,
+				`select count(*) from referrals where referrer_id = $1 and status = $2`,
+				ref.ReferrerID, string(domain.ReferralRewarded),
+			).Scan(&rewarded)
+			if err != nil {
+				return fmt.Errorf("failed to count rewarded referrals: %w", err)
+			}
+			if rewarded >= rw.Cap {
+				ref.Status = domain.ReferralCapped
+			}
+		}
+
+		if ref.Status == domain.ReferralRewarded {
+			for _, e := range rw.Entries(ref) {
+				if _, err := insertEntry(ctx, tx, e); err != nil {
+					return fmt.Errorf("failed to grant referral bonus: %w", err)
+				}
+			}
+		}
+
+		ref.OrderNumber = rw.OrderNumber
+		err = tx.QueryRow(ctx,
+			`update referrals set status = $2, order_number = $3, rewarded_at = now()
+			where referred_id = $1
+			returning rewarded_at`,
+			ref.ReferredID, string(ref.Status), ref.OrderNumber,
+		).Scan(&ref.RewardedAt)
+		if err != nil {
+			return fmt.Errorf("failed to update referral: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return domain.Referral{}, err
+	}
+
+	return ref, nil
+}
+
+func scanReferral(row pgx.Row) (domain.Referral, error) {
+	var ref domain.Referral
+	var status string
+	var rewardedAt pgtype.Timestamptz
+	err := row.Scan(&ref.ReferrerID, &ref.ReferredID, &ref.ReferredLogin, &status, &ref.CreatedAt,
+		&ref.OrderNumber, &rewardedAt)
+	if err != nil {
+		return domain.Referral{}, err
+	}
+	ref.Status = domain.ReferralStatus(status)
+	if rewardedAt.Status == pgtype.Present {
+		ref.RewardedAt = rewardedAt.Time
+	}
+	return ref, nil
+}
+
+func scanReferrals(rows pgx.Rows) ([]domain.Referral, error) {
+	defer rows.Close()
+
+	var referrals []domain.Referral
+	for rows.Next() {
+		ref, err := scanReferral(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan referral: %w", err)
+		}
+		referrals = append(referrals, ref)
+	}
+	return referrals, rows.Err()
+}
@@ -0,0 +1,201 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+)
+
+const sessionColumns = `id::text, user_id::text, created_at, expires_at, revoked_at, coalesce(revoke_reason, '')`
+
+type sessionRepository struct {
+	*db
+}
+
+func (r *sessionRepository) Create(ctx context.Context, s domain.Session, refreshHash string) (domain.Session, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	err := r.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx,
+			`insert into sessions (user_id, created_at, expires_at) values ($1, $2, $3) returning id::text`,
+			s.UserID, s.CreatedAt, s.ExpiresAt,
+		).Scan(&s.ID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx,
+			`insert into refresh_tokens (token_hash, session_id, created_at) values ($1, $2, $3)`,
+			refreshHash, s.ID, s.CreatedAt)
+		return err
+	})
+	if err != nil {
+		return domain.Session{}, fmt.Errorf("failed to create session: %w", err)
+	}
+
+	return s, nil
+}
+
+func (r *sessionRepository) Get(ctx context.Context, id string) (domain.Session, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	s, err := scanSession(r.pool.QueryRow(ctx, `select `+sessionColumns+` from sessions where id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) || hasCode(err, codeInvalidTextRepresentation) {
+		return domain.Session{}, storage.ErrNotFound
+	}
+	if err != nil {
+		return domain.Session{}, fmt.Errorf("failed to get session: %w", err)
+	}
+	return s, nil
+}
+
+func (r *sessionRepository) Rotate(ctx context.Context, oldHash, newHash string, now, expiresAt time.Time) (domain.Session, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var s domain.Session
+	// The revocation on reuse must be committed although Rotate fails.
+	var result error
+	err := r.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		var sessionID string
+		var used bool
+		err := tx.QueryRow(ctx,
+			`select session_id::text, used_at is not null from refresh_tokens where token_hash = $1 for update`,
+			oldHash,
+		).Scan(&sessionID, &used)
+		if errors.Is(err, pgx.ErrNoRows) {
+			result = domain.ErrInvalidRefreshToken
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if used {
+			_, err := tx.Exec(ctx,
+				`update sessions set revoked_at = $2, revoke_reason = $3 where id = $1 and revoked_at is null`,
+				sessionID, now, domain.RevokedByTokenReuse)
+			if err != nil {
+				return err
+			}
+			s, err = scanSession(tx.QueryRow(ctx, `select `+sessionColumns+` from sessions where id = $1`, sessionID))
+			result = domain.ErrRefreshTokenReused
+			return err
+		}
+
+		s, err = scanSession(tx.QueryRow(ctx,
+			`select `+sessionColumns+` from sessions where id = $1 for update`, sessionID))
+		if err != nil {
+			return err
+		}
+		if !s.Active(now) {
+			result = domain.ErrInvalidRefreshToken
+			return nil
+		}
+
+		if _, err := tx.Exec(ctx, `update refresh_tokens set used_at = $2 where token_hash = $1`, oldHash, now); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx,
+			`insert into refresh_tokens (token_hash, session_id, created_at) values ($1, $2, $3)`,
+			newHash, sessionID, now)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `update sessions set expires_at = $2 where id = $1`, sessionID, expiresAt); err != nil {
+			return err
+		}
+		s.ExpiresAt = expiresAt
+		return nil
+	})
+	if err != nil {
+		return domain.Session{}, fmt.Errorf("failed to rotate refresh token: %w", err)
+	}
+	if errors.Is(result, domain.ErrRefreshTokenReused) {
+		return s, result
+	}
+	if result != nil {
+		return domain.Session{}, result
+	}
+
+	return s, nil
+}
+
+func (r *sessionRepository) Revoke(ctx context.Context, id, reason string) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var exists bool
+	err := r.pool.QueryRow(ctx,
+		`with revoked as (
+			update sessions set revoked_at = now(), revoke_reason = $2 where id = $1 and revoked_at is null
+		)
+		select exists (select from sessions where id = $1)`,
+		id, reason,
+	).Scan(&exists)
+	if hasCode(err, codeInvalidTextRepresentation) {
+		return storage.ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+	if !exists {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
+func (r *sessionRepository) RevokeAll(ctx context.Context, userID, exceptID, reason string) ([]domain.Session, error) {
+	return r.list(ctx,
+		`update sessions set revoked_at = now(), revoke_reason = $3
+		where user_id = $1 and id::text <> $2 and revoked_at is null
+		returning `+sessionColumns,
+		userID, exceptID, reason)
+}
+
+func (r *sessionRepository) RevokedSince(ctx context.Context, since time.Time) ([]domain.Session, error) {
+	return r.list(ctx,
+		`select `+sessionColumns+` from sessions where revoked_at > $1 order by revoked_at`,
+		since)
+}
+
+func (r *sessionRepository) list(ctx context.Context, query string, args ...interface{}) ([]domain.Session, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []domain.Session
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+func scanSession(row pgx.Row) (domain.Session, error) {
+	var s domain.Session
+	var revokedAt pgtype.Timestamptz
+	err := row.Scan(&s.ID, &s.UserID, &s.CreatedAt, &s.ExpiresAt, &revokedAt, &s.RevokeReason)
+	if revokedAt.Status == pgtype.Present {
+		s.RevokedAt = revokedAt.Time
+	}
+	return s, err
+}
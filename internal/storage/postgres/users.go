@@ -0,0 +1,205 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+)
+
+const userColumns = `id::text, user_name, password_hash, roles, created_at, blocked_at`
+
+type userRepository struct {
+	*db
+}
+
+func (r *userRepository) Create(ctx context.Context, login, passwordHash string) (domain.User, error) {
+	return r.Register(ctx, domain.Registration{Login: login, PasswordHash: passwordHash})
+}
+
+func (r *userRepository) Register(ctx context.Context, reg domain.Registration) (domain.User, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	u := domain.User{Login: reg.Login, PasswordHash: reg.PasswordHash, Roles: []domain.Role{domain.RoleUser}}
+	err := r.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx,
+			`insert into users (user_name, password_hash, roles) values ($1, $2, $3) returning id::text, created_at`,
+			reg.Login, reg.PasswordHash, roleNames(u.Roles),
+		).Scan(&u.ID, &u.CreatedAt)
+		if hasCode(err, codeUniqueViolation) {
+			return domain.ErrLoginTaken
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create user: %w", err)
+		}
+
+		for _, b := range reg.Bonuses {
+			_, err := insertEntry(ctx, tx, domain.LedgerEntry{
+				UserID:      u.ID,
+				Kind:        domain.EntryBonus,
+				OrderNumber: b.OrderNumber,
+				Amount:      b.Amount,
+				Reason:      b.Reason,
+				RuleID:      b.RuleID,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to grant bonus of rule %s: %w", b.RuleID, err)
+			}
+		}
+
+		if reg.ReferrerID == "" {
+			return nil
+		}
+		_, err = tx.Exec(ctx, `insert into referrals (referrer_id, referred_id) values ($1, $2)`, reg.ReferrerID, u.ID)
+		if hasCode(err, codeForeignKeyViolation) || hasCode(err, codeInvalidTextRepresentation) {
+			return storage.ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create referral: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return domain.User{}, err
+	}
+
+	return u, nil
+}
+
+func (r *userRepository) GetByID(ctx context.Context, id string) (domain.User, error) {
+	return r.get(ctx, "id", id)
+}
+
+func (r *userRepository) GetByLogin(ctx context.Context, login string) (domain.User, error) {
+	return r.get(ctx, "user_name", login)
+}
+
+func (r *userRepository) UpdatePasswordHash(ctx context.Context, id, passwordHash string) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	tag, err := r.pool.Exec(ctx, `update users set password_hash = $2 where id = $1`, id, passwordHash)
+	if hasCode(err, codeInvalidTextRepresentation) {
+		return storage.ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update password hash: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
+func (r *userRepository) Search(ctx context.Context, query string, limit int) ([]domain.User, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.pool.Query(ctx,
+		`select `+userColumns+` from users
+		where strpos(lower(user_name), lower($1)) > 0
+		order by user_name
+		limit $2`,
+		query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []domain.User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, u)
+	}
+
+	return users, rows.Err()
+}
+
+func (r *userRepository) SetBlocked(ctx context.Context, id string, now time.Time) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var blockedAt *time.Time
+	if !now.IsZero() {
+		blockedAt = &now
+	}
+	tag, err := r.pool.Exec(ctx,
+		`update users set blocked_at = case when $2::timestamptz is null then null else coalesce(blocked_at, $2) end
+		where id = $1`,
+		id, blockedAt)
+	if hasCode(err, codeInvalidTextRepresentation) {
+		return storage.ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to block user: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
+func (r *userRepository) SetRoles(ctx context.Context, id string, roles []domain.Role) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	tag, err := r.pool.Exec(ctx, `update users set roles = $2 where id = $1`, id, roleNames(roles))
+	if hasCode(err, codeInvalidTextRepresentation) {
+		return storage.ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set roles: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
+func (r *userRepository) get(ctx context.Context, column, value string) (domain.User, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	u, err := scanUser(r.pool.QueryRow(ctx, `select `+userColumns+` from users where `+column+` = $1`, value))
+	if errors.Is(err, pgx.ErrNoRows) || hasCode(err, codeInvalidTextRepresentation) {
+		return domain.User{}, storage.ErrNotFound
+	}
+	if err != nil {
+		return domain.User{}, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	return u, nil
+}
+
+func scanUser(row pgx.Row) (domain.User, error) {
+	var u domain.User
+	var roles []string
+	var blockedAt pgtype.Timestamptz
+	err := row.Scan(&u.ID, &u.Login, &u.PasswordHash, &roles, &u.CreatedAt, &blockedAt)
+	for _, role := range roles {
+		u.Roles = append(u.Roles, domain.Role(role))
+	}
+	if blockedAt.Status == pgtype.Present {
+		u.BlockedAt = blockedAt.Time
+	}
+	return u, err
+}
+
+// roleNames converts roles to the text[] of the roles column.
+func roleNames(roles []domain.Role) []string {
+	names := make([]string, 0, len(roles))
+	for _, role := range roles {
+		names = append(names, string(role))
+	}
+	return names
+}
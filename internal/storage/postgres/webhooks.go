@@ -0,0 +1,202 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+)
+
+const deliveryColumns = `d.id, d.subscription_id::text, d.user_id::text, s.url, s.secret, d.event, d.payload,
+	d.status, d.attempts, d.next_attempt_at, coalesce(d.last_status_code, 0), coalesce(d.last_error, ''),
+	d.created_at, d.delivered_at`
+
+type webhookRepository struct {
+	*db
+}
+
+func (r *webhookRepository) CreateSubscription(ctx context.Context, userID, url, secret string) (domain.WebhookSubscription, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	sub := domain.WebhookSubscription{UserID: userID, URL: url, Secret: secret}
+	err := r.pool.QueryRow(ctx,
+		`insert into webhook_subscriptions (user_id, url, secret) values ($1, $2, $3) returning id::text, created_at`,
+		userID, url, secret,
+	).Scan(&sub.ID, &sub.CreatedAt)
+	if err != nil {
+		return domain.WebhookSubscription{}, fmt.Errorf("failed to create webhook subscription: %w", err)
+	}
+
+	return sub, nil
+}
+
+func (r *webhookRepository) ListSubscriptions(ctx context.Context, userID string) ([]domain.WebhookSubscription, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.pool.Query(ctx,
+		`select id::text, user_id::text, url, secret, created_at from webhook_subscriptions
+		where user_id = $1 order by created_at, id`,
+		userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	var subs []domain.WebhookSubscription
+	for rows.Next() {
+		var sub domain.WebhookSubscription
+		if err := rows.Scan(&sub.ID, &sub.UserID, &sub.URL, &sub.Secret, &sub.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook subscription: %w", err)
+		}
+		subs = append(subs, sub)
+	}
+
+	return subs, rows.Err()
+}
+
+func (r *webhookRepository) DeleteSubscription(ctx context.Context, userID, id string) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	tag, err := r.pool.Exec(ctx,
+		`delete from webhook_subscriptions where id::text = $1 and user_id = $2`,
+		id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook subscription: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
+func (r *webhookRepository) ListDeliveries(ctx context.Context, userID, subscriptionID string, limit int) ([]domain.WebhookDelivery, error) {
+	return r.list(ctx,
+		`select `+deliveryColumns+` from webhook_deliveries d
+		join webhook_subscriptions s on s.id = d.subscription_id
+		where d.user_id = $1 and d.subscription_id::text = $2
+		order by d.id desc limit $3`,
+		userID, subscriptionID, limit)
+}
+
+// ClaimDeliveries locks the due deliveries with skip locked, so that
+// concurrent deliverers pass over each other's rows, and pushes their
+// next attempt past the lease before committing.
+func (r *webhookRepository) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]domain.WebhookDelivery, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var deliveries []domain.WebhookDelivery
+	err := r.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx,
+			`select `+deliveryColumns+` from webhook_deliveries d
+			join webhook_subscriptions s on s.id = d.subscription_id
+			where d.status = 'pending' and d.next_attempt_at <= $1
+			order by d.id limit $2
+			for update of d skip locked`,
+			now, limit)
+		if err != nil {
+			return err
+		}
+		deliveries, err = scanDeliveries(rows)
+		if err != nil || len(deliveries) == 0 {
+			return err
+		}
+
+		ids := make([]int64, 0, len(deliveries))
+		for _, d := range deliveries {
+			ids = append(ids, d.ID)
+		}
+		_, err = tx.Exec(ctx, `update webhook_deliveries set next_attempt_at = $2 where id = any($1)`,
+			ids, now.Add(lease))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim webhook deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+func (r *webhookRepository) list(ctx context.Context, query string, args ...interface{}) ([]domain.WebhookDelivery, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := r.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook deliveries: %w", err)
+	}
+	return scanDeliveries(rows)
+}
+
+func scanDeliveries(rows pgx.Rows) ([]domain.WebhookDelivery, error) {
+	defer rows.Close()
+
+	var deliveries []domain.WebhookDelivery
+	for rows.Next() {
+		var d domain.WebhookDelivery
+		var event, status string
+		var payload []byte
+		var deliveredAt pgtype.Timestamptz
+		err := rows.Scan(&d.ID, &d.SubscriptionID, &d.UserID, &d.URL, &d.Secret, &event, &payload,
+			&status, &d.Attempts, &d.NextAttemptAt, &d.LastStatusCode, &d.LastError,
+			&d.CreatedAt, &deliveredAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery: %w", err)
+		}
+		d.Event = domain.EventType(event)
+		d.Payload = payload
+		d.Status = domain.DeliveryStatus(status)
+		if deliveredAt.Status == pgtype.Present {
+			d.DeliveredAt = deliveredAt.Time
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+func (r *webhookRepository) UpdateDelivery(ctx context.Context, d domain.WebhookDelivery) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	var deliveredAt *time.Time
+	if !d.DeliveredAt.IsZero() {
+		deliveredAt = &d.DeliveredAt
+	}
+
+	var id int64
+	err := r.pool.QueryRow(ctx,
+		`update webhook_deliveries set status = $2, attempts = $3, next_attempt_at = $4,
+			last_status_code = nullif($5, 0), last_error = nullif($6, ''), delivered_at = $7
+		where id = $1 returning id`,
+		d.ID, string(d.Status), d.Attempts, d.NextAttemptAt, d.LastStatusCode, d.LastError, deliveredAt,
+	).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return storage.ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// enqueueDeliveries queues the event for every subscription of the user
+// within tx.
+func enqueueDeliveries(ctx context.Context, tx pgx.Tx, userID string, event domain.EventType, payload []byte) error {
+	_, err := tx.Exec(ctx,
+		`insert into webhook_deliveries (subscription_id, user_id, event, payload)
+		select id, user_id, $2, $3 from webhook_subscriptions where user_id = $1`,
+		userID, string(event), string(payload))
+	if err != nil {
+		return fmt.Errorf("failed to enqueue webhook deliveries: %w", err)
+	}
+	return nil
+}
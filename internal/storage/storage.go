@@ -0,0 +1,327 @@
+// Package storage defines the repositories of the service. The postgres
+// package is the production implementation, the memory package keeps
+// everything in process for tests and demos. Both must pass the
+// storagetest conformance suite.
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+)
+
+// MemoryURI selects the in-memory storage instead of PostgreSQL.
+const MemoryURI = "memory://"
+
+// ErrNotFound is returned when the requested entity does not exist.
+var ErrNotFound = errors.New("not found")
+
+type queryTimeoutKey struct{}
+
+// WithQueryTimeout returns a context whose queries time out after timeout
+// instead of the default of the storage, for background jobs going
+// through many rows at once. Zero disables the timeout.
+func WithQueryTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, queryTimeoutKey{}, timeout)
+}
+
+// QueryTimeout returns the timeout set by WithQueryTimeout, if any.
+func QueryTimeout(ctx context.Context) (time.Duration, bool) {
+	timeout, ok := ctx.Value(queryTimeoutKey{}).(time.Duration)
+	return timeout, ok
+}
+
+// UserRepository stores users. Logins are unique.
+type UserRepository interface {
+	// Create stores a new user with the domain.RoleUser role and returns
+	// it with its generated ID. Returns domain.ErrLoginTaken if the login
+	// exists.
+	Create(ctx context.Context, login, passwordHash string) (domain.User, error)
+	// Register creates the user like Create, grants the bonuses of the
+	// registration and records its referral by r.ReferrerID if set, all or
+	// nothing. Returns ErrNotFound if the referrer does not exist.
+	Register(ctx context.Context, r domain.Registration) (domain.User, error)
+	// GetByID returns ErrNotFound if there is no such user.
+	GetByID(ctx context.Context, id string) (domain.User, error)
+	// GetByLogin returns ErrNotFound if there is no such user.
+	GetByLogin(ctx context.Context, login string) (domain.User, error)
+	// UpdatePasswordHash replaces the password hash of the user. Returns
+	// ErrNotFound if there is no such user.
+	UpdatePasswordHash(ctx context.Context, id, passwordHash string) error
+	// Search returns up to limit users whose login contains query, case
+	// insensitively, ordered by login.
+	Search(ctx context.Context, query string, limit int) ([]domain.User, error)
+	// SetBlocked blocks the user at now, or unblocks them if now is zero.
+	// Blocking a blocked user keeps the first time. Returns ErrNotFound if
+	// there is no such user.
+	SetBlocked(ctx context.Context, id string, now time.Time) error
+	// SetRoles replaces the roles of the user. Returns ErrNotFound if
+	// there is no such user.
+	SetRoles(ctx context.Context, id string, roles []domain.Role) error
+}
+
+// OrderRepository stores uploaded orders. Order numbers are unique across users.
+type OrderRepository interface {
+	// Create stores a NEW order. It returns false if the user has already
+	// uploaded the number and domain.ErrOrderOwnedByOther if another user has.
+	Create(ctx context.Context, userID, number string) (bool, error)
+	// Get returns ErrNotFound if there is no such order.
+	Get(ctx context.Context, number string) (domain.Order, error)
+	// ListByUser returns the orders of the user selected by q, oldest first.
+	ListByUser(ctx context.Context, userID string, q domain.OrderQuery) ([]domain.Order, error)
+	// List returns the orders of all users selected by q, oldest first.
+	List(ctx context.Context, q domain.OrderQuery) ([]domain.Order, error)
+	// ListPending returns up to limit orders that are not final yet,
+	// oldest first, after the cursor unless it is nil.
+	ListPending(ctx context.Context, after *domain.OrderCursor, limit int) ([]domain.Order, error)
+	// UpdateStatus is Update without bonuses.
+	UpdateStatus(ctx context.Context, number string, status domain.OrderStatus, accrual money.Amount) error
+	// Update moves a pending order to u.Status and writes the outbox
+	// event of the change atomically. Moving it to PROCESSED also credits
+	// the accrual and grants u.Bonuses, skipping those the rule granted
+	// already, see domain.Bonus. Moving it to a final status queues a
+	// delivery for each webhook subscription of the user in the same
+	// transaction. Final orders and orders already in status are left
+	// untouched, so repeating an update is harmless.
+	Update(ctx context.Context, u domain.StatusUpdate) error
+	// Requeue moves an order that was not credited back to NEW, so that
+	// its accrual is requested again. Returns ErrNotFound if there is no
+	// such order and domain.ErrOrderAlreadyProcessed if it is PROCESSED.
+	Requeue(ctx context.Context, number string) error
+}
+
+// LedgerRepository stores balance changes. A balance never goes negative.
+type LedgerRepository interface {
+	// Balance returns the current balance of the user computed from the
+	// whole ledger.
+	Balance(ctx context.Context, userID string) (domain.Balance, error)
+	// SnapshotBalance returns the balance snapshot of the user, a zero one
+	// if there is none, and the ledger tail to check and complete it.
+	SnapshotBalance(ctx context.Context, userID string) (domain.BalanceSnapshot, domain.LedgerTail, error)
+	// DeleteSnapshot deletes the balance snapshot of the user, if any.
+	DeleteSnapshot(ctx context.Context, userID string) error
+	// CompactBalances moves the balance snapshots of up to limit users
+	// to their last entry created before the given time, and returns how
+	// many were moved. The time must be older than the start of any open
+	// transaction, or its entries could be left out of the snapshots.
+	CompactBalances(ctx context.Context, before time.Time, limit int) (int, error)
+	// Withdraw debits sum for the order and writes the outbox event
+	// atomically, and appends audit to the audit log if not nil, its
+	// metadata holding the ID of the entry as entry_id. Returns
+	// domain.ErrInsufficientFunds if the balance is lower than sum and
+	// domain.ErrOrderAlreadyPaid if points have already been withdrawn for
+	// the order.
+	Withdraw(ctx context.Context, userID, orderNumber string, sum money.Amount, audit *domain.AuditEntry) error
+	// Withdrawals returns the withdrawals of the user, oldest first, and
+	// when they were refunded.
+	Withdrawals(ctx context.Context, userID string) ([]domain.Withdrawal, error)
+	// Entries returns the ledger of the user, oldest first.
+	Entries(ctx context.Context, userID string) ([]domain.LedgerEntry, error)
+	// Correct appends a correction entry, its outbox event and its audit
+	// entry atomically and returns the entry. Returns ErrNotFound if there
+	// is no such user and domain.ErrInsufficientFunds if a negative
+	// correction exceeds the balance.
+	Correct(ctx context.Context, c domain.Correction) (domain.LedgerEntry, error)
+	// Refund appends a refund entry crediting back the withdrawal for the
+	// order, its outbox event and its audit entry atomically, and returns
+	// the entry. Returns ErrNotFound if no points were withdrawn for the
+	// order and domain.ErrAlreadyRefunded if the withdrawal was refunded
+	// already.
+	Refund(ctx context.Context, r domain.Refund) (domain.LedgerEntry, error)
+	// OrderCredits returns the sum of the accrual and corrections of the
+	// order, zero if there are none.
+	OrderCredits(ctx context.Context, orderNumber string) (money.Amount, error)
+	// NegativeBalances returns the current balance of the users whose
+	// balance is negative, by user ID.
+	NegativeBalances(ctx context.Context) (map[string]money.Amount, error)
+	// Lots returns the credit lots of the user with unspent points,
+	// oldest first. Every credit entry opens a lot, every debit but an
+	// expiry spends the oldest lots.
+	Lots(ctx context.Context, userID string) ([]domain.CreditLot, error)
+	// ExpireLots appends an expiry entry for each of up to limit lots
+	// credited before the given time with unspent points, and returns
+	// how many were expired.
+	ExpireLots(ctx context.Context, creditedBefore time.Time, limit int) (int, error)
+}
+
+// ReferralRepository stores the referral codes of users and their
+// referrals, see domain.Referral.
+type ReferralRepository interface {
+	// Code returns the referral code of the user, ErrNotFound if they have
+	// none yet.
+	Code(ctx context.Context, userID string) (string, error)
+	// CreateCode gives code to the user unless they have a code already,
+	// and returns the code of the user. It returns false if another user
+	// has code, and ErrNotFound if there is no such user.
+	CreateCode(ctx context.Context, userID, code string) (string, bool, error)
+	// Referrer returns the ID of the user with the referral code. Returns
+	// ErrNotFound if there is no such code.
+	Referrer(ctx context.Context, code string) (string, error)
+	// ListByReferrer returns the referrals of the user, oldest first.
+	ListByReferrer(ctx context.Context, referrerID string) ([]domain.Referral, error)
+	// Pending returns up to limit PENDING referrals whose referred user ID
+	// is above afterID, ordered by referred user ID.
+	Pending(ctx context.Context, afterID string, limit int) ([]domain.Referral, error)
+	// Reward moves the PENDING referral of r.ReferredID to REWARDED, along
+	// with the bonus entries of both users and their outbox events, or to
+	// CAPPED without bonuses if r.Cap referrals of the referrer were
+	// rewarded already. The referrals of a referrer are rewarded one at a
+	// time. It returns the referral, unchanged if it was not PENDING.
+	// Returns ErrNotFound if the user was not referred.
+	Reward(ctx context.Context, r domain.ReferralReward) (domain.Referral, error)
+}
+
+// OutboxRepository stores the events written along with ledger entries,
+// see domain.OutboxEvent.
+type OutboxRepository interface {
+	// Claim returns up to limit events due at now in ID order, only the
+	// oldest undelivered event of each user, so that the events of a user
+	// go out one after the other and no user holds back the others. The
+	// events are leased until now+lease: concurrent claims skip them, and
+	// the later events of their users, until they are marked or the
+	// lease runs out.
+	Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]domain.OutboxEvent, error)
+	// MarkDelivered marks the event as delivered.
+	MarkDelivered(ctx context.Context, id int64) error
+	// MarkFailed records a failed delivery attempt and when to retry.
+	MarkFailed(ctx context.Context, id int64, nextAttemptAt time.Time, reason string) error
+	// MarkDead records the last failed delivery attempt and gives up on
+	// the event: it is never claimed again and no longer holds back the
+	// later events of its user.
+	MarkDead(ctx context.Context, id int64, reason string) error
+	// UserEvents returns up to limit events of the user with an ID above
+	// afterID in ID order, whether delivered or not.
+	UserEvents(ctx context.Context, userID string, afterID int64, limit int) ([]domain.OutboxEvent, error)
+	// LastUserEventID returns the ID of the latest event of the user,
+	// zero if there is none.
+	LastUserEventID(ctx context.Context, userID string) (int64, error)
+}
+
+// IdempotencyRepository stores the responses replayed for retried
+// requests, see domain.IdempotencyRecord. Records are keyed by owner and key.
+type IdempotencyRepository interface {
+	// Reserve stores rec, without a response, unless an unexpired record
+	// of the same owner and key exists at rec.CreatedAt. It returns the
+	// stored record and whether it is rec.
+	Reserve(ctx context.Context, rec domain.IdempotencyRecord) (domain.IdempotencyRecord, bool, error)
+	// Complete records the response of a reserved record and moves its
+	// expiry to expiresAt.
+	Complete(ctx context.Context, userID, key string, statusCode int, contentType string, body []byte,
+		expiresAt time.Time) error
+	// Release deletes a record so that the key can be used again.
+	Release(ctx context.Context, userID, key string) error
+	// DeleteExpired deletes the records expired at now and returns how
+	// many there were.
+	DeleteExpired(ctx context.Context, now time.Time) (int64, error)
+}
+
+// SessionRepository stores sessions and the hashes of their refresh
+// tokens. Each use of a refresh token replaces it with a new one.
+type SessionRepository interface {
+	// Create stores the session with its first refresh token.
+	Create(ctx context.Context, s domain.Session, refreshHash string) (domain.Session, error)
+	// Get returns ErrNotFound if there is no such session.
+	Get(ctx context.Context, id string) (domain.Session, error)
+	// Rotate replaces the refresh token oldHash of an active session with
+	// newHash and moves the session expiry to expiresAt. It returns
+	// domain.ErrInvalidRefreshToken if the token is unknown or the
+	// session is not active at now. A token that was already rotated has
+	// leaked: its session is revoked with domain.RevokedByTokenReuse and
+	// returned along with domain.ErrRefreshTokenReused.
+	Rotate(ctx context.Context, oldHash, newHash string, now, expiresAt time.Time) (domain.Session, error)
+	// Revoke ends the session. Revoking an ended session is a no-op.
+	Revoke(ctx context.Context, id, reason string) error
+	// RevokeAll ends every active session of the user but exceptID, which
+	// may be empty, and returns them.
+	RevokeAll(ctx context.Context, userID, exceptID, reason string) ([]domain.Session, error)
+	// RevokedSince returns the sessions revoked after since, oldest first.
+	RevokedSince(ctx context.Context, since time.Time) ([]domain.Session, error)
+}
+
+// AttemptRepository stores attempt counters, see domain.AttemptCounter.
+// It backs the brute-force protection of logins and registrations.
+type AttemptRepository interface {
+	// Get returns the counter of key, a zero counter if there is none.
+	Get(ctx context.Context, key string) (domain.AttemptCounter, error)
+	// Increment counts an attempt at now and returns the counter. A window
+	// that started at cutoff or earlier is over: the count restarts at one
+	// in a window starting at now.
+	Increment(ctx context.Context, key string, now, cutoff time.Time) (domain.AttemptCounter, error)
+	// Block refuses attempts under key until the given time. A longer
+	// block in place is kept.
+	Block(ctx context.Context, key string, until time.Time) error
+	// Reset deletes the counter of key.
+	Reset(ctx context.Context, key string) error
+	// DeleteStale deletes the counters whose window started and whose
+	// block ended before the given time and returns how many there were.
+	DeleteStale(ctx context.Context, before time.Time) (int64, error)
+}
+
+// AuditRepository stores the audit log, see domain.AuditEntry. Entries
+// are never updated or deleted.
+type AuditRepository interface {
+	// Append chains e to the last entry and stores it. CreatedAt is
+	// truncated to microseconds. It returns the entry with its ID,
+	// PrevHash and Hash.
+	Append(ctx context.Context, e domain.AuditEntry) (domain.AuditEntry, error)
+	// List returns the entries selected by q in ID order.
+	List(ctx context.Context, q domain.AuditQuery) ([]domain.AuditEntry, error)
+}
+
+// Notifier announces outbox events once they are committed.
+type Notifier interface {
+	// Listen calls fn with the user ID of every committed outbox event
+	// until ctx is done. Notifications may be coalesced or repeated, and
+	// fn must not block.
+	Listen(ctx context.Context, fn func(userID string)) error
+}
+
+// WebhookRepository stores webhook subscriptions and their delivery log.
+type WebhookRepository interface {
+	// CreateSubscription stores a subscription and returns it with its ID.
+	CreateSubscription(ctx context.Context, userID, url, secret string) (domain.WebhookSubscription, error)
+	// ListSubscriptions returns the subscriptions of the user, oldest first.
+	ListSubscriptions(ctx context.Context, userID string) ([]domain.WebhookSubscription, error)
+	// DeleteSubscription returns ErrNotFound if the user has no such
+	// subscription. Its deliveries are deleted with it.
+	DeleteSubscription(ctx context.Context, userID, id string) error
+	// ListDeliveries returns up to limit deliveries of the user's
+	// subscription, newest first.
+	ListDeliveries(ctx context.Context, userID, subscriptionID string, limit int) ([]domain.WebhookDelivery, error)
+	// ClaimDeliveries returns up to limit pending deliveries due at now,
+	// oldest first, and leases them: they are not due again until
+	// now+lease, unless UpdateDelivery reschedules them.
+	ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]domain.WebhookDelivery, error)
+	// UpdateDelivery records the outcome of a delivery attempt: its Status,
+	// Attempts, NextAttemptAt, LastStatusCode, LastError and DeliveredAt.
+	UpdateDelivery(ctx context.Context, d domain.WebhookDelivery) error
+}
+
+// Storage groups the repositories of one backend.
+type Storage struct {
+	Users       UserRepository
+	Orders      OrderRepository
+	Ledger      LedgerRepository
+	Referrals   ReferralRepository
+	Outbox      OutboxRepository
+	Webhooks    WebhookRepository
+	Idempotency IdempotencyRepository
+	Sessions    SessionRepository
+	Attempts    AttemptRepository
+	Audit       AuditRepository
+	Notifier    Notifier
+
+	// CloseFunc releases the backend, it may be nil.
+	CloseFunc func()
+}
+
+// Close releases the backend.
+func (s *Storage) Close(context.Context) error {
+	if s.CloseFunc != nil {
+		s.CloseFunc()
+	}
+	return nil
+}
@@ -0,0 +1,1469 @@
+// Package storagetest is the conformance suite every storage
+// implementation must pass.
+package storagetest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+)
+
+// Run runs the suite. newStorage must return an empty storage.
+func Run(t *testing.T, newStorage func(t *testing.T) *storage.Storage) {
+	t.Run("Users", func(t *testing.T) { testUsers(t, newStorage(t)) })
+	t.Run("Registration", func(t *testing.T) { testRegistration(t, newStorage(t)) })
+	t.Run("Orders", func(t *testing.T) { testOrders(t, newStorage(t)) })
+	t.Run("OrderQuery", func(t *testing.T) { testOrderQuery(t, newStorage(t)) })
+	t.Run("OrderStatus", func(t *testing.T) { testOrderStatus(t, newStorage(t)) })
+	t.Run("Withdraw", func(t *testing.T) { testWithdraw(t, newStorage(t)) })
+	t.Run("Refund", func(t *testing.T) { testRefund(t, newStorage(t)) })
+	t.Run("Corrections", func(t *testing.T) { testCorrections(t, newStorage(t)) })
+	t.Run("Bonuses", func(t *testing.T) { testBonuses(t, newStorage(t)) })
+	t.Run("Referrals", func(t *testing.T) { testReferrals(t, newStorage(t)) })
+	t.Run("OrderCredits", func(t *testing.T) { testOrderCredits(t, newStorage(t)) })
+	t.Run("Snapshots", func(t *testing.T) { testSnapshots(t, newStorage(t)) })
+	t.Run("Lots", func(t *testing.T) { testLots(t, newStorage(t)) })
+	t.Run("RefundLots", func(t *testing.T) { testRefundLots(t, newStorage(t)) })
+	t.Run("Requeue", func(t *testing.T) { testRequeue(t, newStorage(t)) })
+	t.Run("UserAdmin", func(t *testing.T) { testUserAdmin(t, newStorage(t)) })
+	t.Run("Roles", func(t *testing.T) { testRoles(t, newStorage(t)) })
+	t.Run("ConcurrentWithdraw", func(t *testing.T) { testConcurrentWithdraw(t, newStorage(t)) })
+	t.Run("Outbox", func(t *testing.T) { testOutbox(t, newStorage(t)) })
+	t.Run("UserEvents", func(t *testing.T) { testUserEvents(t, newStorage(t)) })
+	t.Run("Notifier", func(t *testing.T) { testNotifier(t, newStorage(t)) })
+	t.Run("Webhooks", func(t *testing.T) { testWebhooks(t, newStorage(t)) })
+	t.Run("Idempotency", func(t *testing.T) { testIdempotency(t, newStorage(t)) })
+	t.Run("Sessions", func(t *testing.T) { testSessions(t, newStorage(t)) })
+	t.Run("Attempts", func(t *testing.T) { testAttempts(t, newStorage(t)) })
+	t.Run("Audit", func(t *testing.T) { testAudit(t, newStorage(t)) })
+	t.Run("LedgerAudit", func(t *testing.T) { testLedgerAudit(t, newStorage(t)) })
+}
+
+func createUser(t *testing.T, s *storage.Storage, login string) domain.User {
+	t.Helper()
+
+	u, err := s.Users.Create(context.Background(), login, "hash-"+login)
+	require.NoError(t, err)
+	return u
+}
+
+// referUser registers a user referred by referrerID.
+func referUser(t *testing.T, s *storage.Storage, login, referrerID string) domain.User {
+	t.Helper()
+
+	u, err := s.Users.Register(context.Background(), domain.Registration{
+		Login:        login,
+		PasswordHash: "hash-" + login,
+		ReferrerID:   referrerID,
+	})
+	require.NoError(t, err)
+	return u
+}
+
+// credit gives the user points through a processed order.
+func credit(t *testing.T, s *storage.Storage, userID, number string, accrual money.Amount) {
+	t.Helper()
+	ctx := context.Background()
+
+	_, err := s.Orders.Create(ctx, userID, number)
+	require.NoError(t, err)
+	require.NoError(t, s.Orders.UpdateStatus(ctx, number, domain.OrderStatusProcessed, accrual))
+}
+
+func testUsers(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+
+	u := createUser(t, s, "alice")
+	assert.NotEmpty(t, u.ID)
+	assert.Equal(t, "alice", u.Login)
+
+	_, err := s.Users.Create(ctx, "alice", "other")
+	assert.ErrorIs(t, err, domain.ErrLoginTaken)
+
+	got, err := s.Users.GetByLogin(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, u.ID, got.ID)
+	assert.Equal(t, "hash-alice", got.PasswordHash)
+
+	got, err = s.Users.GetByID(ctx, u.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", got.Login)
+
+	require.NoError(t, s.Users.UpdatePasswordHash(ctx, u.ID, "new-hash"))
+	got, err = s.Users.GetByLogin(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, "new-hash", got.PasswordHash)
+	assert.ErrorIs(t, s.Users.UpdatePasswordHash(ctx, "00000000-0000-0000-0000-000000000000", "hash"), storage.ErrNotFound)
+
+	_, err = s.Users.GetByLogin(ctx, "bob")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	_, err = s.Users.GetByID(ctx, "not-an-id")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func testRegistration(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+
+	reg := domain.Registration{
+		Login:        "alice",
+		PasswordHash: "hash-alice",
+		Bonuses: []domain.Bonus{
+			{RuleID: "welcome", Amount: money.FromUnits(100), Reason: "promotion welcome"},
+			{RuleID: "launch", Amount: money.MustParse("50.5"), Reason: "promotion launch"},
+		},
+	}
+	u, err := s.Users.Register(ctx, reg)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", u.Login)
+	assert.True(t, u.HasRole(domain.RoleUser))
+
+	_, err = s.Users.Register(ctx, reg)
+	assert.ErrorIs(t, err, domain.ErrLoginTaken)
+
+	entries, err := s.Ledger.Entries(ctx, u.ID)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, domain.EntryBonus, entries[0].Kind)
+	assert.Equal(t, "welcome", entries[0].RuleID)
+	assert.Equal(t, "promotion welcome", entries[0].Reason)
+	assert.Equal(t, "launch", entries[1].RuleID)
+
+	b, err := s.Ledger.Balance(ctx, u.ID)
+	require.NoError(t, err)
+	assert.Equal(t, money.MustParse("150.5"), b.Current)
+
+	bob, err := s.Users.Register(ctx, domain.Registration{Login: "bob", PasswordHash: "hash-bob", ReferrerID: u.ID})
+	require.NoError(t, err)
+	referrals, err := s.Referrals.ListByReferrer(ctx, u.ID)
+	require.NoError(t, err)
+	require.Len(t, referrals, 1)
+	assert.Equal(t, bob.ID, referrals[0].ReferredID)
+	assert.Equal(t, "bob", referrals[0].ReferredLogin)
+	assert.Equal(t, domain.ReferralPending, referrals[0].Status)
+
+	// An unknown referrer leaves no user behind.
+	_, err = s.Users.Register(ctx, domain.Registration{
+		Login:        "carol",
+		PasswordHash: "hash-carol",
+		ReferrerID:   "00000000-0000-0000-0000-000000000000",
+	})
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	_, err = s.Users.GetByLogin(ctx, "carol")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func testOrders(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	bob := createUser(t, s, "bob")
+
+	created, err := s.Orders.Create(ctx, alice.ID, "12345678903")
+	require.NoError(t, err)
+	assert.True(t, created)
+
+	created, err = s.Orders.Create(ctx, alice.ID, "12345678903")
+	require.NoError(t, err)
+	assert.False(t, created)
+
+	_, err = s.Orders.Create(ctx, bob.ID, "12345678903")
+	assert.ErrorIs(t, err, domain.ErrOrderOwnedByOther)
+
+	o, err := s.Orders.Get(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, alice.ID, o.UserID)
+	assert.Equal(t, domain.OrderStatusNew, o.Status)
+	assert.False(t, o.UploadedAt.IsZero())
+
+	_, err = s.Orders.Get(ctx, "79927398713")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func testOrderQuery(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	bob := createUser(t, s, "bob")
+
+	numbers := []string{"1", "2", "3", "4", "5"}
+	for _, n := range numbers {
+		_, err := s.Orders.Create(ctx, alice.ID, n)
+		require.NoError(t, err)
+	}
+	_, err := s.Orders.Create(ctx, bob.ID, "6")
+	require.NoError(t, err)
+	require.NoError(t, s.Orders.UpdateStatus(ctx, "2", domain.OrderStatusInvalid, 0))
+	require.NoError(t, s.Orders.UpdateStatus(ctx, "4", domain.OrderStatusProcessing, 0))
+
+	all, err := s.Orders.ListByUser(ctx, alice.ID, domain.OrderQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, numbers, orderNumbers(all))
+
+	var paged []string
+	q := domain.OrderQuery{Limit: 2}
+	for {
+		page, err := s.Orders.ListByUser(ctx, alice.ID, q)
+		require.NoError(t, err)
+		paged = append(paged, orderNumbers(page)...)
+		if len(page) < q.Limit {
+			break
+		}
+		cursor := domain.CursorOf(page[len(page)-1])
+		q.After = &cursor
+	}
+	assert.Equal(t, numbers, paged)
+
+	filtered, err := s.Orders.ListByUser(ctx, alice.ID, domain.OrderQuery{
+		Statuses: []domain.OrderStatus{domain.OrderStatusNew, domain.OrderStatusProcessing},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1", "3", "4", "5"}, orderNumbers(filtered))
+
+	ranged, err := s.Orders.ListByUser(ctx, alice.ID, domain.OrderQuery{
+		UploadedFrom: all[1].UploadedAt,
+		UploadedTo:   all[3].UploadedAt,
+	})
+	require.NoError(t, err)
+	for _, o := range ranged {
+		assert.False(t, o.UploadedAt.Before(all[1].UploadedAt))
+		assert.True(t, o.UploadedAt.Before(all[3].UploadedAt))
+	}
+
+	pending, err := s.Orders.ListPending(ctx, nil, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1", "3", "4", "5", "6"}, orderNumbers(pending))
+	cursor := domain.CursorOf(pending[1])
+	pending, err = s.Orders.ListPending(ctx, &cursor, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"4", "5"}, orderNumbers(pending))
+}
+
+func testOrderStatus(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+
+	_, err := s.Orders.Create(ctx, alice.ID, "12345678903")
+	require.NoError(t, err)
+
+	require.NoError(t, s.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessing, 0))
+	require.NoError(t, s.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessed, money.MustParse("500.5")))
+	// Final orders are not updated nor credited twice.
+	require.NoError(t, s.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessed, money.MustParse("500.5")))
+	require.NoError(t, s.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusInvalid, 0))
+
+	o, err := s.Orders.Get(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, domain.OrderStatusProcessed, o.Status)
+	assert.Equal(t, money.MustParse("500.5"), o.Accrual)
+
+	b, err := s.Ledger.Balance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, domain.Balance{Current: money.MustParse("500.5")}, b)
+
+	entries, err := s.Ledger.Entries(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, domain.EntryAccrual, entries[0].Kind)
+	assert.Equal(t, "12345678903", entries[0].OrderNumber)
+
+	err = s.Orders.UpdateStatus(ctx, "79927398713", domain.OrderStatusProcessed, money.FromUnits(1))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func testWithdraw(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	credit(t, s, alice.ID, "12345678903", money.FromUnits(500))
+
+	err := s.Ledger.Withdraw(ctx, alice.ID, "2377225624", money.FromUnits(501), nil)
+	assert.ErrorIs(t, err, domain.ErrInsufficientFunds)
+
+	require.NoError(t, s.Ledger.Withdraw(ctx, alice.ID, "2377225624", money.FromUnits(200), nil))
+	err = s.Ledger.Withdraw(ctx, alice.ID, "2377225624", money.FromUnits(10), nil)
+	assert.ErrorIs(t, err, domain.ErrOrderAlreadyPaid)
+	require.NoError(t, s.Ledger.Withdraw(ctx, alice.ID, "79927398713", money.FromUnits(300), nil))
+
+	b, err := s.Ledger.Balance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, domain.Balance{Current: 0, Withdrawn: money.FromUnits(500)}, b)
+
+	withdrawals, err := s.Ledger.Withdrawals(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, withdrawals, 2)
+	assert.Equal(t, "2377225624", withdrawals[0].Order)
+	assert.Equal(t, money.FromUnits(200), withdrawals[0].Sum)
+	assert.Equal(t, "79927398713", withdrawals[1].Order)
+	assert.False(t, withdrawals[1].ProcessedAt.Before(withdrawals[0].ProcessedAt))
+}
+
+func testRefund(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	credit(t, s, alice.ID, "12345678903", money.FromUnits(500))
+	require.NoError(t, s.Ledger.Withdraw(ctx, alice.ID, "2377225624", money.MustParse("200.5"), nil))
+	require.NoError(t, s.Ledger.Withdraw(ctx, alice.ID, "79927398713", money.FromUnits(100), nil))
+
+	_, err := s.Ledger.Refund(ctx, domain.Refund{OrderNumber: "4561261212345467"})
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	e, err := s.Ledger.Refund(ctx, domain.Refund{OrderNumber: "2377225624", Reason: "order cancelled", Operator: "store"})
+	require.NoError(t, err)
+	assert.NotZero(t, e.ID)
+	assert.Equal(t, alice.ID, e.UserID)
+	assert.Equal(t, domain.EntryRefund, e.Kind)
+	assert.Equal(t, money.MustParse("200.5"), e.Amount)
+	assert.Equal(t, "order cancelled", e.Reason)
+	assert.Equal(t, "store", e.Operator)
+
+	_, err = s.Ledger.Refund(ctx, domain.Refund{OrderNumber: "2377225624"})
+	assert.ErrorIs(t, err, domain.ErrAlreadyRefunded)
+
+	b, err := s.Ledger.Balance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, domain.Balance{
+		Current:   money.FromUnits(400),
+		Withdrawn: money.MustParse("300.5"),
+		Refunded:  money.MustParse("200.5"),
+	}, b)
+
+	withdrawals, err := s.Ledger.Withdrawals(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, withdrawals, 2)
+	assert.True(t, withdrawals[0].Refunded())
+	assert.False(t, withdrawals[0].RefundedAt.Before(withdrawals[0].ProcessedAt))
+	assert.False(t, withdrawals[1].Refunded())
+
+	events, err := s.Outbox.UserEvents(ctx, alice.ID, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, domain.EventBalanceRefunded, events[len(events)-1].Type)
+
+	// The refund is spendable again.
+	require.NoError(t, s.Ledger.Withdraw(ctx, alice.ID, "4561261212345467", money.FromUnits(400), nil))
+}
+
+func testBonuses(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	bob := createUser(t, s, "bob")
+	bonuses := []domain.Bonus{
+		{RuleID: "campaign", Amount: money.MustParse("10.5"), Reason: "promotion campaign"},
+		{RuleID: "first-order", Amount: money.FromUnits(50), OncePerUser: true, FirstOrder: true},
+	}
+	for _, number := range []string{"12345678903", "79927398713"} {
+		_, err := s.Orders.Create(ctx, alice.ID, number)
+		require.NoError(t, err)
+	}
+
+	// Bonuses are granted only when the order reaches PROCESSED.
+	require.NoError(t, s.Orders.Update(ctx, domain.StatusUpdate{
+		Number:  "79927398713",
+		Status:  domain.OrderStatusProcessing,
+		Bonuses: bonuses,
+	}))
+	for i := 0; i < 2; i++ {
+		require.NoError(t, s.Orders.Update(ctx, domain.StatusUpdate{
+			Number:  "12345678903",
+			Status:  domain.OrderStatusProcessed,
+			Accrual: money.FromUnits(100),
+			Bonuses: bonuses,
+		}))
+	}
+	require.NoError(t, s.Orders.Update(ctx, domain.StatusUpdate{
+		Number:  "79927398713",
+		Status:  domain.OrderStatusProcessed,
+		Bonuses: bonuses,
+	}))
+
+	b, err := s.Ledger.Balance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, domain.Balance{Current: money.FromUnits(171)}, b)
+
+	// The first order of bob was processed before the rule.
+	credit(t, s, bob.ID, "2377225624", money.FromUnits(10))
+	_, err = s.Orders.Create(ctx, bob.ID, "4561261212345467")
+	require.NoError(t, err)
+	require.NoError(t, s.Orders.Update(ctx, domain.StatusUpdate{
+		Number:  "4561261212345467",
+		Status:  domain.OrderStatusProcessed,
+		Bonuses: []domain.Bonus{{RuleID: "launch", Amount: money.FromUnits(50), FirstOrder: true}},
+	}))
+	b, err = s.Ledger.Balance(ctx, bob.ID)
+	require.NoError(t, err)
+	assert.Equal(t, money.FromUnits(10), b.Current)
+
+	entries, err := s.Ledger.Entries(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+	assert.Equal(t, domain.EntryBonus, entries[1].Kind)
+	assert.Equal(t, "campaign", entries[1].RuleID)
+	assert.Equal(t, "12345678903", entries[1].OrderNumber)
+	assert.Equal(t, "promotion campaign", entries[1].Reason)
+	assert.Equal(t, "first-order", entries[2].RuleID)
+	assert.Equal(t, "79927398713", entries[3].OrderNumber)
+
+	events, err := s.Outbox.UserEvents(ctx, alice.ID, 0, 100)
+	require.NoError(t, err)
+	var payload domain.LedgerEventPayload
+	require.NoError(t, json.Unmarshal(events[len(events)-1].Payload, &payload))
+	assert.Equal(t, "campaign", payload.Rule)
+}
+
+func testReferrals(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	bob := referUser(t, s, "bob", alice.ID)
+	carol := referUser(t, s, "carol", alice.ID)
+	dave := referUser(t, s, "dave", alice.ID)
+	const unknown = "00000000-0000-0000-0000-000000000000"
+
+	_, err := s.Referrals.Code(ctx, alice.ID)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	code, ok, err := s.Referrals.CreateCode(ctx, alice.ID, "ALICE001")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "ALICE001", code)
+	// The first code stays.
+	code, ok, err = s.Referrals.CreateCode(ctx, alice.ID, "ALICE002")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "ALICE001", code)
+	_, ok, err = s.Referrals.CreateCode(ctx, bob.ID, "ALICE001")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	_, _, err = s.Referrals.CreateCode(ctx, unknown, "NOBODY01")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	code, err = s.Referrals.Code(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "ALICE001", code)
+	referrerID, err := s.Referrals.Referrer(ctx, "ALICE001")
+	require.NoError(t, err)
+	assert.Equal(t, alice.ID, referrerID)
+	_, err = s.Referrals.Referrer(ctx, "ALICE002")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	referrals, err := s.Referrals.ListByReferrer(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, referrals, 3)
+	for i, u := range []domain.User{bob, carol, dave} {
+		assert.Equal(t, domain.Referral{
+			ReferrerID:    alice.ID,
+			ReferredID:    u.ID,
+			ReferredLogin: u.Login,
+			Status:        domain.ReferralPending,
+			CreatedAt:     referrals[i].CreatedAt,
+		}, referrals[i])
+	}
+
+	pending, err := s.Referrals.Pending(ctx, "", 2)
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	assert.Less(t, pending[0].ReferredID, pending[1].ReferredID)
+	rest, err := s.Referrals.Pending(ctx, pending[1].ReferredID, 2)
+	require.NoError(t, err)
+	assert.Len(t, rest, 1)
+
+	_, err = s.Referrals.Reward(ctx, domain.ReferralReward{ReferredID: alice.ID})
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	reward := domain.ReferralReward{
+		ReferrerBonus: money.FromUnits(100),
+		ReferredBonus: money.FromUnits(50),
+		Cap:           2,
+	}
+	for i, u := range []domain.User{bob, carol, dave} {
+		reward.ReferredID = u.ID
+		reward.OrderNumber = []string{"12345678903", "79927398713", "2377225624"}[i]
+		ref, err := s.Referrals.Reward(ctx, reward)
+		require.NoError(t, err)
+		assert.Equal(t, reward.OrderNumber, ref.OrderNumber)
+		assert.False(t, ref.RewardedAt.IsZero())
+		if i < 2 {
+			assert.Equal(t, domain.ReferralRewarded, ref.Status, u.Login)
+		} else {
+			assert.Equal(t, domain.ReferralCapped, ref.Status, u.Login)
+		}
+	}
+	// Rewarding again changes nothing.
+	reward.ReferredID = bob.ID
+	ref, err := s.Referrals.Reward(ctx, reward)
+	require.NoError(t, err)
+	assert.Equal(t, "12345678903", ref.OrderNumber)
+
+	for _, tt := range []struct {
+		user domain.User
+		want money.Amount
+	}{
+		{alice, money.FromUnits(200)},
+		{bob, money.FromUnits(50)},
+		{dave, 0},
+	} {
+		b, err := s.Ledger.Balance(ctx, tt.user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, b.Current, tt.user.Login)
+	}
+	entries, err := s.Ledger.Entries(ctx, bob.ID)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, domain.EntryBonus, entries[0].Kind)
+	assert.Equal(t, domain.ReferralRuleID, entries[0].RuleID)
+
+	referrals, err = s.Referrals.ListByReferrer(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, referrals, 3)
+	assert.Equal(t, "bob", referrals[0].ReferredLogin)
+	assert.Equal(t, domain.ReferralCapped, referrals[2].Status)
+	pending, err = s.Referrals.Pending(ctx, "", 10)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func testCorrections(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	credit(t, s, alice.ID, "12345678903", money.FromUnits(100))
+
+	_, err := s.Ledger.Correct(ctx, domain.Correction{UserID: alice.ID, Amount: money.FromUnits(-101), Reason: "too much", Operator: "bob"})
+	assert.ErrorIs(t, err, domain.ErrInsufficientFunds)
+	_, err = s.Ledger.Correct(ctx, domain.Correction{UserID: "00000000-0000-0000-0000-000000000000", Amount: money.FromUnits(1)})
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	e, err := s.Ledger.Correct(ctx, domain.Correction{UserID: alice.ID, Amount: money.MustParse("25.5"), Reason: "goodwill", Operator: "bob"})
+	require.NoError(t, err)
+	assert.NotZero(t, e.ID)
+	assert.Equal(t, domain.EntryCorrection, e.Kind)
+	// Corrections are not tied to orders, there may be several.
+	_, err = s.Ledger.Correct(ctx, domain.Correction{UserID: alice.ID, Amount: money.MustParse("-5.5"), Reason: "typo", Operator: "carol"})
+	require.NoError(t, err)
+
+	b, err := s.Ledger.Balance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, domain.Balance{Current: money.FromUnits(120)}, b)
+
+	entries, err := s.Ledger.Entries(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, "goodwill", entries[1].Reason)
+	assert.Equal(t, "bob", entries[1].Operator)
+	assert.Equal(t, money.MustParse("-5.5"), entries[2].Amount)
+
+	events, err := s.Outbox.UserEvents(ctx, alice.ID, 0, 10)
+	require.NoError(t, err)
+	assert.Equal(t, domain.EventBalanceCorrected, events[len(events)-1].Type)
+}
+
+func testOrderCredits(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	bob := createUser(t, s, "bob")
+	credit(t, s, alice.ID, "12345678903", money.FromUnits(100))
+	credit(t, s, bob.ID, "2377225624", money.FromUnits(50))
+	require.NoError(t, s.Ledger.Withdraw(ctx, alice.ID, "79927398713", money.FromUnits(30), nil))
+
+	// Reconciliation may correct an order several times.
+	for _, amount := range []money.Amount{money.MustParse("20.5"), money.MustParse("-0.5")} {
+		_, err := s.Ledger.Correct(ctx, domain.Correction{
+			UserID: alice.ID, OrderNumber: "12345678903", Amount: amount, Reason: "accrual changed", Operator: "reconciliation",
+		})
+		require.NoError(t, err)
+	}
+	_, err := s.Ledger.Correct(ctx, domain.Correction{UserID: alice.ID, Amount: money.FromUnits(5), Reason: "goodwill"})
+	require.NoError(t, err)
+
+	credits, err := s.Ledger.OrderCredits(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, money.FromUnits(120), credits)
+	credits, err = s.Ledger.OrderCredits(ctx, "79927398713")
+	require.NoError(t, err)
+	assert.Zero(t, credits)
+
+	negative, err := s.Ledger.NegativeBalances(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, negative)
+
+	orders, err := s.Orders.List(ctx, domain.OrderQuery{Statuses: []domain.OrderStatus{domain.OrderStatusProcessed}})
+	require.NoError(t, err)
+	require.Len(t, orders, 2)
+	assert.Equal(t, alice.ID, orders[0].UserID)
+	assert.Equal(t, bob.ID, orders[1].UserID)
+
+	orders, err = s.Orders.List(ctx, domain.OrderQuery{Limit: 1, After: &domain.OrderCursor{UploadedAt: orders[0].UploadedAt, Number: orders[0].Number}})
+	require.NoError(t, err)
+	require.Len(t, orders, 1)
+	assert.Equal(t, "2377225624", orders[0].Number)
+}
+
+func testSnapshots(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	bob := createUser(t, s, "bob")
+
+	snapshot, tail, err := s.Ledger.SnapshotBalance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Zero(t, snapshot.LastEntryID)
+	assert.Equal(t, domain.LedgerTail{}, tail)
+
+	credit(t, s, alice.ID, "12345678903", money.FromUnits(500))
+	require.NoError(t, s.Ledger.Withdraw(ctx, alice.ID, "2377225624", money.MustParse("100.5"), nil))
+	credit(t, s, bob.ID, "79927398713", money.FromUnits(10))
+
+	// Entries created from now on stay in the tail.
+	before := time.Now()
+	n, err := s.Ledger.CompactBalances(ctx, before, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = s.Ledger.CompactBalances(ctx, before, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = s.Ledger.CompactBalances(ctx, before, 10)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	_, err = s.Ledger.Correct(ctx, domain.Correction{UserID: alice.ID, Amount: money.FromUnits(1), Reason: "goodwill"})
+	require.NoError(t, err)
+
+	snapshot, tail, err = s.Ledger.SnapshotBalance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.NotZero(t, snapshot.LastEntryID)
+	assert.False(t, snapshot.UpdatedAt.IsZero())
+	assert.Equal(t, domain.Balance{Current: money.MustParse("399.5"), Withdrawn: money.MustParse("100.5")}, snapshot.Balance)
+	assert.Equal(t, int64(2), snapshot.EntryCount)
+	assert.Equal(t, domain.LedgerTail{Balance: domain.Balance{Current: money.FromUnits(1)}, Covered: 2}, tail)
+	assert.True(t, snapshot.Matches(tail))
+
+	full, err := s.Ledger.Balance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, full, snapshot.Balance.Add(tail.Balance))
+
+	n, err = s.Ledger.CompactBalances(ctx, time.Now().Add(time.Minute), 10)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	snapshot, tail, err = s.Ledger.SnapshotBalance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, full, snapshot.Balance)
+	assert.Equal(t, int64(3), snapshot.EntryCount)
+	assert.Equal(t, domain.LedgerTail{Covered: 3}, tail)
+
+	require.NoError(t, s.Ledger.DeleteSnapshot(ctx, alice.ID))
+	snapshot, tail, err = s.Ledger.SnapshotBalance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Zero(t, snapshot.LastEntryID)
+	assert.Equal(t, domain.LedgerTail{Balance: full}, tail)
+}
+
+func testLots(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	bob := createUser(t, s, "bob")
+
+	credit(t, s, alice.ID, "12345678903", money.FromUnits(500))
+	credit(t, s, alice.ID, "79927398713", money.FromUnits(100))
+	credit(t, s, bob.ID, "4561261212345467", money.FromUnits(10))
+	require.NoError(t, s.Ledger.Withdraw(ctx, alice.ID, "2377225624", money.FromUnits(550), nil))
+	_, err := s.Ledger.Correct(ctx, domain.Correction{UserID: alice.ID, Amount: -money.MustParse("10.5"), Reason: "fraud"})
+	require.NoError(t, err)
+
+	lots, err := s.Ledger.Lots(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, lots, 1)
+	assert.Equal(t, alice.ID, lots[0].UserID)
+	assert.Equal(t, "79927398713", lots[0].OrderNumber)
+	assert.Equal(t, money.FromUnits(100), lots[0].Amount)
+	assert.Equal(t, money.MustParse("39.5"), lots[0].Remaining)
+	assert.False(t, lots[0].CreatedAt.IsZero())
+
+	n, err := s.Ledger.ExpireLots(ctx, time.Now().Add(-time.Minute), 10)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	n, err = s.Ledger.ExpireLots(ctx, time.Now().Add(time.Minute), 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = s.Ledger.ExpireLots(ctx, time.Now().Add(time.Minute), 10)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = s.Ledger.ExpireLots(ctx, time.Now().Add(time.Minute), 10)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	lots, err = s.Ledger.Lots(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Empty(t, lots)
+
+	b, err := s.Ledger.Balance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, domain.Balance{Withdrawn: money.FromUnits(550)}, b)
+
+	entries, err := s.Ledger.Entries(ctx, alice.ID)
+	require.NoError(t, err)
+	last := entries[len(entries)-1]
+	assert.Equal(t, domain.EntryExpiry, last.Kind)
+	assert.Equal(t, "79927398713", last.OrderNumber)
+	assert.Equal(t, -money.MustParse("39.5"), last.Amount)
+
+	events, err := s.Outbox.UserEvents(ctx, alice.ID, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, domain.EventBalanceExpired, events[len(events)-1].Type)
+
+	// Credits after the expiry open new lots.
+	_, err = s.Ledger.Correct(ctx, domain.Correction{UserID: alice.ID, Amount: money.FromUnits(5), Reason: "goodwill"})
+	require.NoError(t, err)
+	lots, err = s.Ledger.Lots(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, lots, 1)
+	assert.Equal(t, money.FromUnits(5), lots[0].Remaining)
+}
+
+func testRefundLots(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+
+	credit(t, s, alice.ID, "12345678903", money.FromUnits(500))
+	credit(t, s, alice.ID, "79927398713", money.FromUnits(100))
+	require.NoError(t, s.Ledger.Withdraw(ctx, alice.ID, "2377225624", money.FromUnits(550), nil))
+	n, err := s.Ledger.ExpireLots(ctx, time.Now().Add(time.Minute), 10)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// The refunded points go back to their lots, expired or not.
+	_, err = s.Ledger.Refund(ctx, domain.Refund{OrderNumber: "2377225624"})
+	require.NoError(t, err)
+	lots, err := s.Ledger.Lots(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, lots, 2)
+	assert.Equal(t, "12345678903", lots[0].OrderNumber)
+	assert.Equal(t, money.FromUnits(500), lots[0].Remaining)
+	assert.Equal(t, "79927398713", lots[1].OrderNumber)
+	assert.Equal(t, money.FromUnits(50), lots[1].Remaining)
+
+	b, err := s.Ledger.Balance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, domain.Balance{
+		Current:   money.FromUnits(550),
+		Withdrawn: money.FromUnits(550),
+		Refunded:  money.FromUnits(550),
+	}, b)
+
+	// And expire when the lots do.
+	n, err = s.Ledger.ExpireLots(ctx, time.Now().Add(time.Minute), 10)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	b, err = s.Ledger.Balance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Zero(t, b.Current)
+}
+func testRequeue(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	credit(t, s, alice.ID, "12345678903", money.FromUnits(100))
+	_, err := s.Orders.Create(ctx, alice.ID, "2377225624")
+	require.NoError(t, err)
+	require.NoError(t, s.Orders.UpdateStatus(ctx, "2377225624", domain.OrderStatusInvalid, 0))
+
+	assert.ErrorIs(t, s.Orders.Requeue(ctx, "12345678903"), domain.ErrOrderAlreadyProcessed)
+	assert.ErrorIs(t, s.Orders.Requeue(ctx, "79927398713"), storage.ErrNotFound)
+
+	require.NoError(t, s.Orders.Requeue(ctx, "2377225624"))
+	o, err := s.Orders.Get(ctx, "2377225624")
+	require.NoError(t, err)
+	assert.Equal(t, domain.OrderStatusNew, o.Status)
+
+	pending, err := s.Orders.ListPending(ctx, nil, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2377225624"}, orderNumbers(pending))
+
+	// The order is processed again as if it was new.
+	require.NoError(t, s.Orders.UpdateStatus(ctx, "2377225624", domain.OrderStatusProcessed, money.FromUnits(50)))
+	b, err := s.Ledger.Balance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, money.FromUnits(150), b.Current)
+}
+
+func testUserAdmin(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	alice := createUser(t, s, "Alice")
+	createUser(t, s, "malice")
+	createUser(t, s, "bob")
+
+	users, err := s.Users.Search(ctx, "ALI", 10)
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	assert.Equal(t, "Alice", users[0].Login)
+	assert.Equal(t, "malice", users[1].Login)
+	users, err = s.Users.Search(ctx, "", 1)
+	require.NoError(t, err)
+	assert.Len(t, users, 1)
+	users, err = s.Users.Search(ctx, "%", 10)
+	require.NoError(t, err)
+	assert.Empty(t, users)
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	require.NoError(t, s.Users.SetBlocked(ctx, alice.ID, now))
+	require.NoError(t, s.Users.SetBlocked(ctx, alice.ID, now.Add(time.Hour)))
+	got, err := s.Users.GetByID(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.True(t, got.Blocked())
+	assert.True(t, got.BlockedAt.Equal(now))
+
+	require.NoError(t, s.Users.SetBlocked(ctx, alice.ID, time.Time{}))
+	got, err = s.Users.GetByLogin(ctx, "Alice")
+	require.NoError(t, err)
+	assert.False(t, got.Blocked())
+
+	assert.ErrorIs(t, s.Users.SetBlocked(ctx, "00000000-0000-0000-0000-000000000000", now), storage.ErrNotFound)
+}
+
+func testRoles(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	assert.Equal(t, []domain.Role{domain.RoleUser}, alice.Roles)
+
+	roles := []domain.Role{domain.RoleUser, domain.RoleSupport}
+	require.NoError(t, s.Users.SetRoles(ctx, alice.ID, roles))
+	got, err := s.Users.GetByID(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, roles, got.Roles)
+	assert.True(t, got.HasRole(domain.RoleSupport))
+	assert.False(t, got.HasRole(domain.RoleAdmin))
+
+	require.NoError(t, s.Users.SetRoles(ctx, alice.ID, []domain.Role{domain.RoleService}))
+	got, err = s.Users.GetByLogin(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, []domain.Role{domain.RoleService}, got.Roles)
+
+	err = s.Users.SetRoles(ctx, "00000000-0000-0000-0000-000000000000", roles)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func testConcurrentWithdraw(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	credit(t, s, alice.ID, "12345678903", money.FromUnits(100))
+
+	var wg sync.WaitGroup
+	results := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results <- s.Ledger.Withdraw(ctx, alice.ID, "order-"+string(rune('a'+i)), money.FromUnits(30), nil)
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+
+	succeeded := 0
+	for err := range results {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		assert.ErrorIs(t, err, domain.ErrInsufficientFunds)
+	}
+	assert.Equal(t, 3, succeeded)
+
+	b, err := s.Ledger.Balance(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, domain.Balance{Current: money.FromUnits(10), Withdrawn: money.FromUnits(90)}, b)
+}
+
+func testOutbox(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	credit(t, s, alice.ID, "12345678903", money.FromUnits(500))
+	require.NoError(t, s.Ledger.Withdraw(ctx, alice.ID, "2377225624", money.FromUnits(200), nil))
+	// Failed withdrawals leave no event.
+	assert.Error(t, s.Ledger.Withdraw(ctx, alice.ID, "79927398713", money.FromUnits(1000), nil))
+
+	events, err := s.Outbox.UserEvents(ctx, alice.ID, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+
+	assert.Equal(t, domain.EventOrderProcessed, events[0].Type)
+	assert.Equal(t, alice.ID, events[0].UserID)
+	assert.JSONEq(t, `{"order":"12345678903","status":"PROCESSED","accrual":500}`, string(events[0].Payload))
+	assert.Equal(t, domain.EventBalanceCredited, events[1].Type)
+	assert.JSONEq(t, fmt.Sprintf(`{"entry_id":%d,"order":"12345678903","amount":500}`, entryID(t, s, alice.ID, 0)),
+		string(events[1].Payload))
+	assert.Equal(t, domain.EventBalanceWithdrawn, events[2].Type)
+	assert.Less(t, events[0].ID, events[1].ID)
+	assert.Less(t, events[1].ID, events[2].ID)
+
+	bob := createUser(t, s, "bob")
+	credit(t, s, bob.ID, "4561261212345467", money.FromUnits(100))
+	bobEvents, err := s.Outbox.UserEvents(ctx, bob.ID, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, bobEvents, 2)
+
+	claimIDs := func(now time.Time, limit int) []int64 {
+		t.Helper()
+		claimed, err := s.Outbox.Claim(ctx, now, time.Minute, limit)
+		require.NoError(t, err)
+		ids := []int64{}
+		for _, e := range claimed {
+			ids = append(ids, e.ID)
+		}
+		return ids
+	}
+
+	// Only the oldest pending event of each user is claimed.
+	now := time.Now()
+	assert.Equal(t, []int64{events[0].ID}, claimIDs(now, 1))
+	assert.Equal(t, []int64{bobEvents[0].ID}, claimIDs(now, 10))
+	// Claimed events hold back the later events of their users until
+	// they are marked or the lease runs out.
+	assert.Empty(t, claimIDs(now, 10))
+	assert.Equal(t, []int64{events[0].ID, bobEvents[0].ID}, claimIDs(now.Add(2*time.Minute), 10))
+
+	retryAt := now.Add(time.Hour)
+	require.NoError(t, s.Outbox.MarkFailed(ctx, events[0].ID, retryAt, "connection refused"))
+	require.NoError(t, s.Outbox.MarkDelivered(ctx, bobEvents[0].ID))
+	// A failed event holds back the later events of its user until its retry.
+	assert.Equal(t, []int64{bobEvents[1].ID}, claimIDs(now.Add(2*time.Minute), 10))
+	require.NoError(t, s.Outbox.MarkDelivered(ctx, bobEvents[1].ID))
+
+	claimed, err := s.Outbox.Claim(ctx, retryAt, time.Minute, 10)
+	require.NoError(t, err)
+	require.Len(t, claimed, 1)
+	assert.Equal(t, events[0].ID, claimed[0].ID)
+	assert.Equal(t, 1, claimed[0].Attempts)
+	assert.WithinDuration(t, retryAt, claimed[0].NextAttemptAt, time.Millisecond)
+	require.NoError(t, s.Outbox.MarkDelivered(ctx, events[0].ID))
+
+	// A dead event no longer holds back the later ones and is never claimed again.
+	assert.Equal(t, []int64{events[1].ID}, claimIDs(retryAt, 10))
+	require.NoError(t, s.Outbox.MarkDead(ctx, events[1].ID, "rejected"))
+	assert.Equal(t, []int64{events[2].ID}, claimIDs(retryAt, 10))
+	require.NoError(t, s.Outbox.MarkDelivered(ctx, events[2].ID))
+	assert.Empty(t, claimIDs(retryAt.Add(24*time.Hour), 10))
+
+	assert.ErrorIs(t, s.Outbox.MarkDelivered(ctx, events[2].ID+100), storage.ErrNotFound)
+	assert.ErrorIs(t, s.Outbox.MarkDead(ctx, events[2].ID+100, "rejected"), storage.ErrNotFound)
+}
+
+func testUserEvents(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	bob := createUser(t, s, "bob")
+
+	last, err := s.Outbox.LastUserEventID(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Zero(t, last)
+
+	_, err = s.Orders.Create(ctx, alice.ID, "12345678903")
+	require.NoError(t, err)
+	require.NoError(t, s.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessing, 0))
+	// Not a change, no event.
+	require.NoError(t, s.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessing, 0))
+	credit(t, s, bob.ID, "2377225624", money.FromUnits(100))
+	require.NoError(t, s.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessed, money.FromUnits(500)))
+
+	events, err := s.Outbox.UserEvents(ctx, alice.ID, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	assert.Equal(t, domain.EventOrderProcessing, events[0].Type)
+	assert.JSONEq(t, `{"order":"12345678903","status":"PROCESSING"}`, string(events[0].Payload))
+	assert.Equal(t, domain.EventOrderProcessed, events[1].Type)
+	assert.Equal(t, domain.EventBalanceCredited, events[2].Type)
+
+	// Delivered events are still listed.
+	require.NoError(t, s.Outbox.MarkDelivered(ctx, events[0].ID))
+	after, err := s.Outbox.UserEvents(ctx, alice.ID, events[0].ID, 1)
+	require.NoError(t, err)
+	require.Len(t, after, 1)
+	assert.Equal(t, events[1].ID, after[0].ID)
+
+	last, err = s.Outbox.LastUserEventID(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, events[2].ID, last)
+
+	after, err = s.Outbox.UserEvents(ctx, alice.ID, last, 10)
+	require.NoError(t, err)
+	assert.Empty(t, after)
+}
+
+func testNotifier(t *testing.T, s *storage.Storage) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	alice := createUser(t, s, "alice")
+
+	notified := make(chan string, 10)
+	done := make(chan error)
+	go func() {
+		done <- s.Notifier.Listen(ctx, func(userID string) {
+			select {
+			case notified <- userID:
+			default:
+			}
+		})
+	}()
+
+	// Listen may take a moment to start, keep committing until heard.
+	deadline := time.After(5 * time.Second)
+	for i := 0; ; i++ {
+		credit(t, s, alice.ID, fmt.Sprintf("order-%d", i), money.FromUnits(10))
+		select {
+		case userID := <-notified:
+			assert.Equal(t, alice.ID, userID)
+		case <-time.After(100 * time.Millisecond):
+			continue
+		case <-deadline:
+			t.Fatal("no notification")
+		}
+		break
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Listen did not return")
+	}
+}
+
+func testWebhooks(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	bob := createUser(t, s, "bob")
+
+	sub, err := s.Webhooks.CreateSubscription(ctx, alice.ID, "https://example.com/hook", "secret")
+	require.NoError(t, err)
+	assert.NotEmpty(t, sub.ID)
+	other, err := s.Webhooks.CreateSubscription(ctx, alice.ID, "https://example.com/other", "secret2")
+	require.NoError(t, err)
+
+	subs, err := s.Webhooks.ListSubscriptions(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	assert.Equal(t, sub.ID, subs[0].ID)
+	assert.Equal(t, "https://example.com/hook", subs[0].URL)
+
+	subs, err = s.Webhooks.ListSubscriptions(ctx, bob.ID)
+	require.NoError(t, err)
+	assert.Empty(t, subs)
+
+	// Only final statuses of alice's orders are delivered.
+	_, err = s.Orders.Create(ctx, alice.ID, "12345678903")
+	require.NoError(t, err)
+	require.NoError(t, s.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessing, 0))
+	require.NoError(t, s.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessed, money.FromUnits(500)))
+	credit(t, s, bob.ID, "2377225624", money.FromUnits(100))
+	_, err = s.Orders.Create(ctx, alice.ID, "79927398713")
+	require.NoError(t, err)
+	require.NoError(t, s.Orders.UpdateStatus(ctx, "79927398713", domain.OrderStatusInvalid, 0))
+
+	now := time.Now()
+	pending, err := s.Webhooks.ClaimDeliveries(ctx, now, time.Minute, 10)
+	require.NoError(t, err)
+	require.Len(t, pending, 4)
+	d := pending[0]
+	assert.Equal(t, alice.ID, d.UserID)
+	assert.Equal(t, sub.ID, d.SubscriptionID)
+	assert.Equal(t, "https://example.com/hook", d.URL)
+	assert.Equal(t, "secret", d.Secret)
+	assert.Equal(t, domain.EventOrderProcessed, d.Event)
+	assert.Equal(t, domain.DeliveryPending, d.Status)
+	assert.JSONEq(t, `{"order":"12345678903","status":"PROCESSED","accrual":500}`, string(d.Payload))
+
+	d.Attempts = 1
+	d.LastStatusCode = 500
+	d.LastError = "unexpected status 500"
+	d.NextAttemptAt = now.Add(2 * time.Minute)
+	require.NoError(t, s.Webhooks.UpdateDelivery(ctx, d))
+
+	// Claimed deliveries are leased.
+	pending, err = s.Webhooks.ClaimDeliveries(ctx, now, time.Minute, 10)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+	pending, err = s.Webhooks.ClaimDeliveries(ctx, now.Add(time.Minute), time.Minute, 10)
+	require.NoError(t, err)
+	assert.Len(t, pending, 3)
+	pending, err = s.Webhooks.ClaimDeliveries(ctx, now.Add(3*time.Minute), time.Minute, 1)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, d.ID, pending[0].ID)
+
+	d.Status = domain.DeliveryDelivered
+	d.Attempts = 2
+	d.LastStatusCode = 204
+	d.LastError = ""
+	d.DeliveredAt = now
+	require.NoError(t, s.Webhooks.UpdateDelivery(ctx, d))
+
+	log, err := s.Webhooks.ListDeliveries(ctx, alice.ID, sub.ID, 10)
+	require.NoError(t, err)
+	require.Len(t, log, 2)
+	assert.Equal(t, domain.EventOrderInvalid, log[0].Event)
+	assert.JSONEq(t, `{"order":"79927398713","status":"INVALID"}`, string(log[0].Payload))
+	assert.Equal(t, d.ID, log[1].ID)
+	assert.Equal(t, domain.DeliveryDelivered, log[1].Status)
+	assert.Equal(t, 2, log[1].Attempts)
+	assert.Equal(t, 204, log[1].LastStatusCode)
+	assert.Empty(t, log[1].LastError)
+	assert.WithinDuration(t, now, log[1].DeliveredAt, time.Millisecond)
+
+	log, err = s.Webhooks.ListDeliveries(ctx, bob.ID, sub.ID, 10)
+	require.NoError(t, err)
+	assert.Empty(t, log)
+
+	d.ID += 100
+	assert.ErrorIs(t, s.Webhooks.UpdateDelivery(ctx, d), storage.ErrNotFound)
+
+	assert.ErrorIs(t, s.Webhooks.DeleteSubscription(ctx, bob.ID, sub.ID), storage.ErrNotFound)
+	require.NoError(t, s.Webhooks.DeleteSubscription(ctx, alice.ID, sub.ID))
+	assert.ErrorIs(t, s.Webhooks.DeleteSubscription(ctx, alice.ID, sub.ID), storage.ErrNotFound)
+
+	pending, err = s.Webhooks.ClaimDeliveries(ctx, now.Add(time.Hour), time.Minute, 10)
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	for _, p := range pending {
+		assert.Equal(t, other.ID, p.SubscriptionID)
+	}
+}
+
+func testIdempotency(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	bob := createUser(t, s, "bob")
+	now := time.Now().Truncate(time.Microsecond)
+
+	rec := domain.IdempotencyRecord{
+		UserID:      alice.ID,
+		Key:         "key-1",
+		RequestHash: "hash-1",
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(2 * time.Minute),
+	}
+	stored, reserved, err := s.Idempotency.Reserve(ctx, rec)
+	require.NoError(t, err)
+	assert.True(t, reserved)
+	assert.False(t, stored.Completed())
+
+	// The same key of another user is independent.
+	other := rec
+	other.UserID = bob.ID
+	_, reserved, err = s.Idempotency.Reserve(ctx, other)
+	require.NoError(t, err)
+	assert.True(t, reserved)
+
+	retry := rec
+	retry.RequestHash = "hash-2"
+	retry.CreatedAt = now.Add(time.Minute)
+	stored, reserved, err = s.Idempotency.Reserve(ctx, retry)
+	require.NoError(t, err)
+	assert.False(t, reserved)
+	assert.Equal(t, "hash-1", stored.RequestHash)
+	assert.False(t, stored.Completed())
+
+	// Completing moves the expiry from the lease of the reservation to
+	// the TTL of the response.
+	require.NoError(t, s.Idempotency.Complete(ctx, alice.ID, "key-1", 200, "application/json", []byte(`{"ok":true}`),
+		now.Add(time.Hour)))
+	stored, reserved, err = s.Idempotency.Reserve(ctx, retry)
+	require.NoError(t, err)
+	assert.False(t, reserved)
+	assert.True(t, stored.Completed())
+	assert.Equal(t, 200, stored.StatusCode)
+	assert.Equal(t, "application/json", stored.ContentType)
+	assert.Equal(t, `{"ok":true}`, string(stored.Body))
+	assert.WithinDuration(t, now.Add(time.Hour), stored.ExpiresAt, time.Millisecond)
+
+	assert.ErrorIs(t, s.Idempotency.Complete(ctx, alice.ID, "missing", 200, "", nil, now.Add(time.Hour)), storage.ErrNotFound)
+
+	// Once expired, the key is free again.
+	late := retry
+	late.CreatedAt = now.Add(2 * time.Hour)
+	late.ExpiresAt = now.Add(3 * time.Hour)
+	stored, reserved, err = s.Idempotency.Reserve(ctx, late)
+	require.NoError(t, err)
+	assert.True(t, reserved)
+	assert.Equal(t, "hash-2", stored.RequestHash)
+	assert.False(t, stored.Completed())
+
+	require.NoError(t, s.Idempotency.Release(ctx, alice.ID, "key-1"))
+	_, reserved, err = s.Idempotency.Reserve(ctx, rec)
+	require.NoError(t, err)
+	assert.True(t, reserved)
+
+	deleted, err := s.Idempotency.DeleteExpired(ctx, now.Add(90*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), deleted)
+	deleted, err = s.Idempotency.DeleteExpired(ctx, now.Add(90*time.Minute))
+	require.NoError(t, err)
+	assert.Zero(t, deleted)
+
+	// Operators own keys too.
+	operator := rec
+	operator.UserID = "operator:alice-ops"
+	stored, reserved, err = s.Idempotency.Reserve(ctx, operator)
+	require.NoError(t, err)
+	assert.True(t, reserved)
+	assert.Equal(t, "operator:alice-ops", stored.UserID)
+}
+
+func testSessions(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	first, err := s.Sessions.Create(ctx, domain.Session{
+		UserID:    alice.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+	}, "refresh-1")
+	require.NoError(t, err)
+	assert.NotEmpty(t, first.ID)
+	assert.True(t, first.Active(now))
+
+	got, err := s.Sessions.Get(ctx, first.ID)
+	require.NoError(t, err)
+	assert.Equal(t, alice.ID, got.UserID)
+	assert.True(t, got.ExpiresAt.Equal(now.Add(time.Hour)))
+	_, err = s.Sessions.Get(ctx, "not-an-id")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	rotated, err := s.Sessions.Rotate(ctx, "refresh-1", "refresh-2", now, now.Add(2*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, first.ID, rotated.ID)
+	assert.True(t, rotated.ExpiresAt.Equal(now.Add(2*time.Hour)))
+
+	_, err = s.Sessions.Rotate(ctx, "unknown", "refresh-3", now, now.Add(time.Hour))
+	assert.ErrorIs(t, err, domain.ErrInvalidRefreshToken)
+	// The session expires unless the token is rotated in time.
+	_, err = s.Sessions.Rotate(ctx, "refresh-2", "refresh-3", now.Add(3*time.Hour), now.Add(4*time.Hour))
+	assert.ErrorIs(t, err, domain.ErrInvalidRefreshToken)
+
+	// Presenting a rotated token again revokes the session.
+	reused, err := s.Sessions.Rotate(ctx, "refresh-1", "refresh-3", now, now.Add(time.Hour))
+	assert.ErrorIs(t, err, domain.ErrRefreshTokenReused)
+	assert.Equal(t, first.ID, reused.ID)
+	got, err = s.Sessions.Get(ctx, first.ID)
+	require.NoError(t, err)
+	assert.False(t, got.Active(now))
+	assert.Equal(t, domain.RevokedByTokenReuse, got.RevokeReason)
+	_, err = s.Sessions.Rotate(ctx, "refresh-2", "refresh-3", now, now.Add(time.Hour))
+	assert.ErrorIs(t, err, domain.ErrInvalidRefreshToken)
+
+	second, err := s.Sessions.Create(ctx, domain.Session{
+		UserID:    alice.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+	}, "refresh-4")
+	require.NoError(t, err)
+	third, err := s.Sessions.Create(ctx, domain.Session{
+		UserID:    alice.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+	}, "refresh-5")
+	require.NoError(t, err)
+
+	require.NoError(t, s.Sessions.Revoke(ctx, second.ID, domain.RevokedByLogout))
+	// Revoking again keeps the first reason.
+	require.NoError(t, s.Sessions.Revoke(ctx, second.ID, domain.RevokedByLogoutAll))
+	got, err = s.Sessions.Get(ctx, second.ID)
+	require.NoError(t, err)
+	assert.Equal(t, domain.RevokedByLogout, got.RevokeReason)
+	assert.ErrorIs(t, s.Sessions.Revoke(ctx, "00000000-0000-0000-0000-000000000000", domain.RevokedByLogout), storage.ErrNotFound)
+
+	fourth, err := s.Sessions.Create(ctx, domain.Session{
+		UserID:    alice.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+	}, "refresh-6")
+	require.NoError(t, err)
+
+	revoked, err := s.Sessions.RevokeAll(ctx, alice.ID, fourth.ID, domain.RevokedByPasswordChange)
+	require.NoError(t, err)
+	require.Len(t, revoked, 1)
+	assert.Equal(t, third.ID, revoked[0].ID)
+	assert.Equal(t, domain.RevokedByPasswordChange, revoked[0].RevokeReason)
+
+	revoked, err = s.Sessions.RevokeAll(ctx, alice.ID, "", domain.RevokedByLogoutAll)
+	require.NoError(t, err)
+	require.Len(t, revoked, 1)
+	assert.Equal(t, fourth.ID, revoked[0].ID)
+
+	since, err := s.Sessions.RevokedSince(ctx, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, since, 4)
+	assert.Equal(t, first.ID, since[0].ID)
+	for i := 1; i < len(since); i++ {
+		assert.False(t, since[i].RevokedAt.Before(since[i-1].RevokedAt))
+	}
+	since, err = s.Sessions.RevokedSince(ctx, since[3].RevokedAt)
+	require.NoError(t, err)
+	assert.Empty(t, since)
+}
+
+func testAttempts(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	c, err := s.Attempts.Get(ctx, "login:alice")
+	require.NoError(t, err)
+	assert.Zero(t, c.Count)
+	assert.False(t, c.Blocked(now))
+
+	for i := 1; i <= 3; i++ {
+		c, err = s.Attempts.Increment(ctx, "login:alice", now.Add(time.Duration(i)*time.Minute), now.Add(-time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, i, c.Count)
+		assert.True(t, c.WindowStart.Equal(now.Add(time.Minute)))
+	}
+
+	require.NoError(t, s.Attempts.Block(ctx, "login:alice", now.Add(time.Hour)))
+	// A shorter block does not shorten the one in place.
+	require.NoError(t, s.Attempts.Block(ctx, "login:alice", now.Add(time.Minute)))
+	c, err = s.Attempts.Get(ctx, "login:alice")
+	require.NoError(t, err)
+	assert.Equal(t, 3, c.Count)
+	assert.True(t, c.Blocked(now.Add(59*time.Minute)))
+	assert.False(t, c.Blocked(now.Add(time.Hour)))
+
+	// Once the window is over, counting starts again.
+	later := now.Add(2 * time.Hour)
+	c, err = s.Attempts.Increment(ctx, "login:alice", later, now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 1, c.Count)
+	assert.True(t, c.WindowStart.Equal(later))
+
+	_, err = s.Attempts.Increment(ctx, "ip:10.0.0.1", now, now.Add(-time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, s.Attempts.Reset(ctx, "login:alice"))
+	c, err = s.Attempts.Get(ctx, "login:alice")
+	require.NoError(t, err)
+	assert.Zero(t, c.Count)
+
+	require.NoError(t, s.Attempts.Block(ctx, "ip:10.0.0.2", now.Add(time.Hour)))
+	deleted, err := s.Attempts.DeleteStale(ctx, now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+	c, err = s.Attempts.Get(ctx, "ip:10.0.0.2")
+	require.NoError(t, err)
+	assert.True(t, c.Blocked(now))
+}
+
+func entryID(t *testing.T, s *storage.Storage, userID string, i int) int64 {
+	t.Helper()
+
+	entries, err := s.Ledger.Entries(context.Background(), userID)
+	require.NoError(t, err)
+	require.Greater(t, len(entries), i)
+	return entries[i].ID
+}
+
+func orderNumbers(orders []domain.Order) []string {
+	numbers := make([]string, 0, len(orders))
+	for _, o := range orders {
+		numbers = append(numbers, o.Number)
+	}
+	return numbers
+}
+
+func testAudit(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+
+	first, err := s.Audit.Append(ctx, domain.AuditEntry{
+		CreatedAt: start,
+		Actor:     "alice",
+		Action:    "user.login",
+		Target:    "alice",
+		Metadata:  map[string]string{"ip": "192.0.2.1"},
+	})
+	require.NoError(t, err)
+	assert.NotZero(t, first.ID)
+	assert.Empty(t, first.PrevHash)
+	assert.Equal(t, first.ComputeHash(), first.Hash)
+
+	second, err := s.Audit.Append(ctx, domain.AuditEntry{CreatedAt: start.Add(time.Second), Actor: "bob", Action: "user.login", Target: "bob"})
+	require.NoError(t, err)
+	third, err := s.Audit.Append(ctx, domain.AuditEntry{CreatedAt: start.Add(2 * time.Second), Actor: "alice", Action: "balance.withdraw", Target: "2377225624"})
+	require.NoError(t, err)
+	assert.Equal(t, first.Hash, second.PrevHash)
+	assert.Equal(t, second.Hash, third.PrevHash)
+
+	all, err := s.Audit.List(ctx, domain.AuditQuery{})
+	require.NoError(t, err)
+	require.Len(t, all, 3)
+	assert.Equal(t, map[string]string{"ip": "192.0.2.1"}, all[0].Metadata)
+	for i, e := range all {
+		assert.Equal(t, e.ComputeHash(), e.Hash, "entry %d survives the round trip", i)
+	}
+
+	entries, err := s.Audit.List(ctx, domain.AuditQuery{Actor: "alice"})
+	require.NoError(t, err)
+	assert.Equal(t, []int64{first.ID, third.ID}, auditIDs(entries))
+	entries, err = s.Audit.List(ctx, domain.AuditQuery{Action: "user.login", Target: "bob"})
+	require.NoError(t, err)
+	assert.Equal(t, []int64{second.ID}, auditIDs(entries))
+	entries, err = s.Audit.List(ctx, domain.AuditQuery{From: start.Add(time.Second), To: start.Add(2 * time.Second)})
+	require.NoError(t, err)
+	assert.Equal(t, []int64{second.ID}, auditIDs(entries))
+	entries, err = s.Audit.List(ctx, domain.AuditQuery{AfterID: first.ID, Limit: 1})
+	require.NoError(t, err)
+	assert.Equal(t, []int64{second.ID}, auditIDs(entries))
+}
+
+func testLedgerAudit(t *testing.T, s *storage.Storage) {
+	ctx := context.Background()
+	alice := createUser(t, s, "alice")
+	credit(t, s, alice.ID, "12345678903", money.FromUnits(100))
+	now := time.Now()
+
+	// Failed writes append no entry.
+	err := s.Ledger.Withdraw(ctx, alice.ID, "2377225624", money.FromUnits(101),
+		&domain.AuditEntry{CreatedAt: now, Actor: alice.ID, Action: "balance.withdraw", Target: "2377225624"})
+	assert.ErrorIs(t, err, domain.ErrInsufficientFunds)
+
+	require.NoError(t, s.Ledger.Withdraw(ctx, alice.ID, "2377225624", money.FromUnits(30),
+		&domain.AuditEntry{CreatedAt: now, Actor: alice.ID, Action: "balance.withdraw", Target: "2377225624",
+			Metadata: map[string]string{"sum": "30"}}))
+	correction, err := s.Ledger.Correct(ctx, domain.Correction{
+		UserID:   alice.ID,
+		Amount:   money.FromUnits(5),
+		Reason:   "goodwill",
+		Operator: "bob",
+		Audit:    &domain.AuditEntry{CreatedAt: now, Actor: "bob", Action: "balance.correction", Target: alice.ID},
+	})
+	require.NoError(t, err)
+	refund, err := s.Ledger.Refund(ctx, domain.Refund{
+		OrderNumber: "2377225624",
+		Operator:    "bob",
+		Audit:       &domain.AuditEntry{CreatedAt: now, Actor: "bob", Action: "balance.refund", Target: "2377225624"},
+	})
+	require.NoError(t, err)
+
+	ledger, err := s.Ledger.Entries(ctx, alice.ID)
+	require.NoError(t, err)
+	require.Len(t, ledger, 4)
+	entries, err := s.Audit.List(ctx, domain.AuditQuery{})
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, map[string]string{"sum": "30", "entry_id": strconv.FormatInt(ledger[1].ID, 10)}, entries[0].Metadata)
+	assert.Equal(t, map[string]string{"entry_id": strconv.FormatInt(correction.ID, 10)}, entries[1].Metadata)
+	assert.Equal(t, map[string]string{
+		"user_id":  alice.ID,
+		"amount":   "30",
+		"entry_id": strconv.FormatInt(refund.ID, 10),
+	}, entries[2].Metadata)
+	assert.Equal(t, entries[1].Hash, entries[2].PrevHash)
+}
+
+func auditIDs(entries []domain.AuditEntry) []int64 {
+	ids := make([]int64, 0, len(entries))
+	for _, e := range entries {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
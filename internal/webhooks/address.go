@@ -0,0 +1,55 @@
+package webhooks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// ErrForbiddenAddress is returned for webhook targets inside the network
+// of the service: loopback, private, link-local and similar addresses.
+// Posting to them would let users probe and call internal services.
+var ErrForbiddenAddress = errors.New("webhook address is not public")
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598, which
+// net.IP.IsPrivate does not cover.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// PublicIP reports whether ip may be the target of a webhook.
+func PublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || sharedAddressSpace.Contains(ip))
+}
+
+// CheckHost returns ErrForbiddenAddress if host, the host of a webhook
+// URL without the port, is a non-public IP address or a localhost name.
+// Other names are checked when the Deliverer dials the addresses they
+// resolve to.
+func CheckHost(host string) error {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrForbiddenAddress
+	}
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil && !PublicIP(ip) {
+		return ErrForbiddenAddress
+	}
+	return nil
+}
+
+// dialControl refuses connections to non-public addresses. It runs on the
+// resolved address of every connection, so names pointing inside, or
+// rebound to point inside after the subscription was checked, and
+// redirects are refused as well.
+func dialControl(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !PublicIP(ip) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+	}
+	return nil
+}
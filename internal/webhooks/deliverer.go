@@ -0,0 +1,275 @@
+// Package webhooks posts order status notifications to the URLs users
+// subscribed. Deliveries are queued by the storage together with the
+// status change, the Deliverer sends them signed with the subscription
+// secret and retries failures with exponential backoff until MaxAttempts
+// is reached. Every attempt is recorded in the delivery log. Deliveries
+// to non-public addresses are refused unless AllowPrivateNetworks is set.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/pkg/log"
+)
+
+const (
+	defaultPollInterval = time.Second
+	defaultBatchSize    = 100
+	defaultMaxAttempts  = 10
+	defaultTimeout      = 5 * time.Second
+
+	minRetryDelay = 5 * time.Second
+	maxRetryDelay = time.Hour
+
+	maxErrorLength = 500
+)
+
+// Config tunes the Deliverer. Zero values select the defaults.
+type Config struct {
+	PollInterval time.Duration
+	BatchSize    int
+	MaxAttempts  int
+	Timeout      time.Duration
+	// AllowPrivateNetworks lets deliveries reach loopback and private
+	// addresses, for development only.
+	AllowPrivateNetworks bool
+}
+
+// Payload is the JSON body of a delivery.
+type Payload struct {
+	ID        int64           `json:"id"`
+	Event     string          `json:"event"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Deliverer polls the pending deliveries and posts them. Each batch is
+// claimed for as long as sending it may take, so that deliverers of other
+// instances pass over it.
+type Deliverer struct {
+	repo   storage.WebhookRepository
+	cfg    Config
+	client *http.Client
+	now    func() time.Time
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewDeliverer returns a deliverer of the deliveries queued in repo.
+func NewDeliverer(repo storage.WebhookRepository, cfg Config) *Deliverer {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultPollInterval
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultMaxAttempts
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+
+	return &Deliverer{
+		repo:   repo,
+		cfg:    cfg,
+		client: newClient(cfg),
+		now:    time.Now,
+		stop:   make(chan struct{}),
+	}
+}
+
+// Start starts polling in the background.
+func (d *Deliverer) Start(context.Context) error {
+	d.wg.Add(1)
+	go d.run()
+	return nil
+}
+
+// Stop stops polling and waits for the current batch to finish. It may be
+// called more than once.
+func (d *Deliverer) Stop(ctx context.Context) error {
+	d.stopOnce.Do(func() { close(d.stop) })
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *Deliverer) run() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-d.stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		if _, err := d.DeliverOnce(ctx); err != nil {
+			log.Error(ctx, "failed to deliver webhooks", err)
+		}
+		cancel()
+	}
+}
+
+// DeliverOnce sends one batch of due deliveries and returns how many
+// succeeded.
+func (d *Deliverer) DeliverOnce(ctx context.Context) (int, error) {
+	now := d.now()
+	lease := time.Duration(d.cfg.BatchSize) * d.cfg.Timeout
+	deliveries, err := d.repo.ClaimDeliveries(ctx, now, lease, d.cfg.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, dl := range deliveries {
+		if ctx.Err() != nil {
+			return delivered, ctx.Err()
+		}
+
+		statusCode, err := d.send(ctx, dl)
+		dl.Attempts++
+		dl.LastStatusCode = statusCode
+		switch {
+		case err == nil:
+			dl.Status = domain.DeliveryDelivered
+			dl.LastError = ""
+			dl.DeliveredAt = d.now()
+		case dl.Attempts >= d.cfg.MaxAttempts:
+			dl.Status = domain.DeliveryFailed
+			dl.LastError = truncate(err.Error())
+			log.Warning(ctx, "giving up on webhook delivery", "delivery_id", dl.ID, "attempts", dl.Attempts,
+				"error", err.Error())
+		default:
+			dl.NextAttemptAt = now.Add(retryDelay(dl.Attempts - 1))
+			dl.LastError = truncate(err.Error())
+			log.Debug(ctx, "webhook delivery failed", "delivery_id", dl.ID, "attempts", dl.Attempts,
+				"retry_at", dl.NextAttemptAt, "error", err.Error())
+		}
+
+		// The subscription may have been deleted, along with its
+		// deliveries, while this one was sent.
+		err = d.repo.UpdateDelivery(ctx, dl)
+		if errors.Is(err, storage.ErrNotFound) {
+			log.Debug(ctx, "webhook delivery deleted", "delivery_id", dl.ID)
+			continue
+		}
+		if err != nil {
+			return delivered, err
+		}
+		if dl.Status == domain.DeliveryDelivered {
+			delivered++
+		}
+	}
+
+	return delivered, nil
+}
+
+// send posts the delivery and returns the response status code, zero if
+// there was no response. Any status other than 2xx is a failure.
+func (d *Deliverer) send(ctx context.Context, dl domain.WebhookDelivery) (int, error) {
+	body, err := json.Marshal(Payload{
+		ID:        dl.ID,
+		Event:     string(dl.Event),
+		CreatedAt: dl.CreatedAt,
+		Data:      dl.Payload,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dl.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, string(dl.Event))
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(dl.ID, 10))
+	req.Header.Set(SignatureHeader, Sign(dl.Secret, d.now(), body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// newClient returns the HTTP client of the deliveries. Unless private
+// networks are allowed it dials public addresses only, and directly:
+// a proxy would dial the target out of reach of the check.
+func newClient(cfg Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if !cfg.AllowPrivateNetworks {
+		dialer := &net.Dialer{
+			Timeout:   cfg.Timeout,
+			KeepAlive: 30 * time.Second,
+			Control:   dialControl,
+		}
+		transport.Proxy = nil
+		transport.DialContext = dialer.DialContext
+	}
+
+	return &http.Client{Timeout: cfg.Timeout, Transport: transport}
+}
+
+// retryDelay doubles with every failed attempt, up to maxRetryDelay.
+func retryDelay(attempts int) time.Duration {
+	delay := minRetryDelay
+	for i := 0; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+func truncate(s string) string {
+	if len(s) > maxErrorLength {
+		return s[:maxErrorLength]
+	}
+	return s
+}
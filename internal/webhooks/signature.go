@@ -0,0 +1,82 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SignatureHeader carries the signature of a delivery,
+	// "t=<unix seconds>,v1=<hex HMAC-SHA256>".
+	SignatureHeader = "X-Gophermart-Signature"
+	// EventHeader carries the event type of a delivery.
+	EventHeader = "X-Gophermart-Event"
+	// DeliveryHeader carries the delivery ID, receivers deduplicate
+	// retries by it.
+	DeliveryHeader = "X-Gophermart-Delivery"
+)
+
+var (
+	ErrBadSignature     = errors.New("bad webhook signature")
+	ErrExpiredSignature = errors.New("webhook signature timestamp out of tolerance")
+)
+
+// Sign returns the SignatureHeader value for body sent at t. The HMAC
+// covers "<unix seconds>.<body>" so that a captured request cannot be
+// replayed later with another timestamp.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac(secret, ts, body))
+}
+
+// Verify checks a SignatureHeader value against body. The timestamp must
+// be within tolerance of now; zero tolerance skips the check.
+func Verify(secret, header string, body []byte, tolerance time.Duration, now time.Time) error {
+	var ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			ts = kv[1]
+		case "v1":
+			sig = kv[1]
+		}
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, mac(secret, ts, body)) {
+		return ErrBadSignature
+	}
+
+	if tolerance > 0 {
+		skew := now.Sub(time.Unix(unix, 0))
+		if skew < 0 {
+			skew = -skew
+		}
+		if skew > tolerance {
+			return ErrExpiredSignature
+		}
+	}
+
+	return nil
+}
+
+func mac(secret, ts string, body []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(ts))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
@@ -0,0 +1,244 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/domain"
+	"github.com/paramonies/ya-gophermart/internal/money"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/internal/storage/memory"
+)
+
+func TestSignature(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"id":1}`)
+	header := Sign("secret", now, body)
+	assert.Regexp(t, `^t=1700000000,v1=[0-9a-f]{64}$`, header)
+
+	assert.NoError(t, Verify("secret", header, body, time.Minute, now.Add(30*time.Second)))
+	assert.ErrorIs(t, Verify("other", header, body, time.Minute, now), ErrBadSignature)
+	assert.ErrorIs(t, Verify("secret", header, []byte(`{"id":2}`), time.Minute, now), ErrBadSignature)
+	assert.ErrorIs(t, Verify("secret", "v1=abc", body, time.Minute, now), ErrBadSignature)
+	assert.ErrorIs(t, Verify("secret", header, body, time.Minute, now.Add(2*time.Minute)), ErrExpiredSignature)
+	assert.NoError(t, Verify("secret", header, body, 0, now.Add(time.Hour)))
+}
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, 5*time.Second, retryDelay(0))
+	assert.Equal(t, 10*time.Second, retryDelay(1))
+	assert.Equal(t, 40*time.Second, retryDelay(3))
+	assert.Equal(t, time.Hour, retryDelay(20))
+}
+
+// receiver records the requests it gets and answers with status.
+type receiver struct {
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests = append(rc.requests, r)
+	rc.bodies = append(rc.bodies, body)
+	w.WriteHeader(rc.status)
+}
+
+func processOrder(t *testing.T, s *storage.Storage, url string) domain.User {
+	t.Helper()
+	ctx := context.Background()
+
+	u, err := s.Users.Create(ctx, "alice", "hash")
+	require.NoError(t, err)
+	_, err = s.Webhooks.CreateSubscription(ctx, u.ID, url, "secret")
+	require.NoError(t, err)
+	_, err = s.Orders.Create(ctx, u.ID, "12345678903")
+	require.NoError(t, err)
+	require.NoError(t, s.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessed, money.FromUnits(500)))
+
+	return u
+}
+
+func TestDeliverer_Delivers(t *testing.T) {
+	rc := &receiver{status: http.StatusNoContent}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	s := memory.NewStorage()
+	u := processOrder(t, s, srv.URL)
+
+	d := NewDeliverer(s.Webhooks, Config{AllowPrivateNetworks: true})
+	delivered, err := d.DeliverOnce(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, delivered)
+
+	require.Len(t, rc.requests, 1)
+	r := rc.requests[0]
+	assert.Equal(t, http.MethodPost, r.Method)
+	assert.Equal(t, "order.processed", r.Header.Get(EventHeader))
+	assert.NotEmpty(t, r.Header.Get(DeliveryHeader))
+	assert.NoError(t, Verify("secret", r.Header.Get(SignatureHeader), rc.bodies[0], time.Minute, time.Now()))
+
+	var p Payload
+	require.NoError(t, json.Unmarshal(rc.bodies[0], &p))
+	assert.Equal(t, "order.processed", p.Event)
+	assert.JSONEq(t, `{"order":"12345678903","status":"PROCESSED","accrual":500}`, string(p.Data))
+
+	subs, err := s.Webhooks.ListSubscriptions(context.Background(), u.ID)
+	require.NoError(t, err)
+	log, err := s.Webhooks.ListDeliveries(context.Background(), u.ID, subs[0].ID, 10)
+	require.NoError(t, err)
+	require.Len(t, log, 1)
+	assert.Equal(t, domain.DeliveryDelivered, log[0].Status)
+	assert.Equal(t, 1, log[0].Attempts)
+	assert.Equal(t, http.StatusNoContent, log[0].LastStatusCode)
+
+	// Nothing left to send.
+	delivered, err = d.DeliverOnce(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, delivered)
+	assert.Len(t, rc.requests, 1)
+}
+
+func TestDeliverer_RefusesPrivateAddresses(t *testing.T) {
+	rc := &receiver{status: http.StatusNoContent}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	// The subscription was accepted, e.g. for a name that resolved to a
+	// public address then, but the connection goes to loopback.
+	s := memory.NewStorage()
+	u := processOrder(t, s, srv.URL)
+
+	d := NewDeliverer(s.Webhooks, Config{})
+	delivered, err := d.DeliverOnce(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, delivered)
+	assert.Empty(t, rc.requests)
+
+	subs, err := s.Webhooks.ListSubscriptions(context.Background(), u.ID)
+	require.NoError(t, err)
+	log, err := s.Webhooks.ListDeliveries(context.Background(), u.ID, subs[0].ID, 10)
+	require.NoError(t, err)
+	require.Len(t, log, 1)
+	assert.Contains(t, log[0].LastError, ErrForbiddenAddress.Error())
+}
+
+func TestCheckHost(t *testing.T) {
+	for _, host := range []string{"example.com", "93.184.216.34", "2606:2800:220:1:248:1893:25c8:1946"} {
+		assert.NoError(t, CheckHost(host), host)
+	}
+	for _, host := range []string{
+		"localhost", "api.localhost", "LOCALHOST.", "127.0.0.1", "::1", "[::1]", "0.0.0.0",
+		"10.0.0.1", "172.16.5.4", "192.168.1.1", "169.254.169.254", "100.64.0.1", "fd00::1", "fe80::1",
+		"::ffff:127.0.0.1",
+	} {
+		assert.ErrorIs(t, CheckHost(host), ErrForbiddenAddress, host)
+	}
+}
+
+func TestDeliverer_RetriesAndGivesUp(t *testing.T) {
+	rc := &receiver{status: http.StatusInternalServerError}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	s := memory.NewStorage()
+	u := processOrder(t, s, srv.URL)
+
+	d := NewDeliverer(s.Webhooks, Config{MaxAttempts: 3, AllowPrivateNetworks: true})
+	now := time.Now()
+	d.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	delivered, err := d.DeliverOnce(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, delivered)
+
+	subs, err := s.Webhooks.ListSubscriptions(ctx, u.ID)
+	require.NoError(t, err)
+	log, err := s.Webhooks.ListDeliveries(ctx, u.ID, subs[0].ID, 10)
+	require.NoError(t, err)
+	require.Len(t, log, 1)
+	assert.Equal(t, domain.DeliveryPending, log[0].Status)
+	assert.Equal(t, 1, log[0].Attempts)
+	assert.Equal(t, http.StatusInternalServerError, log[0].LastStatusCode)
+	assert.Contains(t, log[0].LastError, "500")
+	assert.Equal(t, now.Add(5*time.Second), log[0].NextAttemptAt)
+
+	// Not due yet.
+	_, err = d.DeliverOnce(ctx)
+	require.NoError(t, err)
+	assert.Len(t, rc.requests, 1)
+
+	now = now.Add(5 * time.Second)
+	_, err = d.DeliverOnce(ctx)
+	require.NoError(t, err)
+	now = now.Add(10 * time.Second)
+	_, err = d.DeliverOnce(ctx)
+	require.NoError(t, err)
+	assert.Len(t, rc.requests, 3)
+
+	log, err = s.Webhooks.ListDeliveries(ctx, u.ID, subs[0].ID, 10)
+	require.NoError(t, err)
+	assert.Equal(t, domain.DeliveryFailed, log[0].Status)
+	assert.Equal(t, 3, log[0].Attempts)
+
+	now = now.Add(time.Hour)
+	_, err = d.DeliverOnce(ctx)
+	require.NoError(t, err)
+	assert.Len(t, rc.requests, 3)
+}
+
+func TestDeliverer_SkipsDeletedSubscriptions(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewStorage()
+
+	// The first subscription is deleted while its delivery is sent.
+	var first domain.WebhookSubscription
+	var userID string
+	deleting := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = s.Webhooks.DeleteSubscription(ctx, userID, first.ID)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	srv := httptest.NewServer(deleting)
+	defer srv.Close()
+	rc := &receiver{status: http.StatusNoContent}
+	other := httptest.NewServer(rc)
+	defer other.Close()
+
+	u, err := s.Users.Create(ctx, "alice", "hash")
+	require.NoError(t, err)
+	userID = u.ID
+	first, err = s.Webhooks.CreateSubscription(ctx, u.ID, srv.URL, "secret")
+	require.NoError(t, err)
+	second, err := s.Webhooks.CreateSubscription(ctx, u.ID, other.URL, "secret")
+	require.NoError(t, err)
+	_, err = s.Orders.Create(ctx, u.ID, "12345678903")
+	require.NoError(t, err)
+	require.NoError(t, s.Orders.UpdateStatus(ctx, "12345678903", domain.OrderStatusProcessed, money.FromUnits(500)))
+
+	d := NewDeliverer(s.Webhooks, Config{AllowPrivateNetworks: true})
+	delivered, err := d.DeliverOnce(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, delivered)
+	assert.Len(t, rc.requests, 1)
+
+	log, err := s.Webhooks.ListDeliveries(ctx, u.ID, second.ID, 10)
+	require.NoError(t, err)
+	require.Len(t, log, 1)
+	assert.Equal(t, domain.DeliveryDelivered, log[0].Status)
+}
@@ -0,0 +1,37 @@
+-- +migrate Up
+alter table users add column if not exists password_hash text not null default '';
+
+create table if not exists orders
+(
+    number          text not null,
+    user_id         uuid not null,
+    status          text not null default 'NEW',
+    accrual         numeric,
+    uploaded_at     timestamptz not null default now(),
+
+    constraint orders_pk primary key (number),
+    constraint orders_user_fk foreign key (user_id) references users (id)
+);
+
+create index if not exists orders_user_uploaded_at_idx on orders (user_id, uploaded_at, number);
+create index if not exists orders_pending_idx on orders (uploaded_at) where status in ('NEW', 'PROCESSING');
+
+create table if not exists ledger
+(
+    id              bigserial,
+    user_id         uuid not null,
+    kind            text not null,
+    order_number    text not null,
+    amount          numeric not null,
+    created_at      timestamptz not null default now(),
+
+    constraint ledger_pk primary key (id),
+    constraint ledger_user_fk foreign key (user_id) references users (id)
+);
+
+create index if not exists ledger_user_idx on ledger (user_id, id);
+create unique index if not exists ledger_kind_order_uq on ledger (kind, order_number);
+-- +migrate Down
+drop table ledger;
+drop table orders;
+alter table users drop column password_hash;
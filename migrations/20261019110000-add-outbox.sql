@@ -0,0 +1,19 @@
+-- +migrate Up
+create table if not exists outbox
+(
+    id              bigserial,
+    user_id         uuid not null,
+    type            text not null,
+    payload         jsonb not null,
+    created_at      timestamptz not null default now(),
+    attempts        integer not null default 0,
+    next_attempt_at timestamptz not null default now(),
+    last_error      text,
+    delivered_at    timestamptz,
+
+    constraint outbox_pk primary key (id)
+);
+
+create index if not exists outbox_pending_idx on outbox (id) where delivered_at is null;
+-- +migrate Down
+drop table outbox;
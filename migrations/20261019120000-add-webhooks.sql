@@ -0,0 +1,37 @@
+-- +migrate Up
+create table if not exists webhook_subscriptions
+(
+    id              uuid default gen_random_uuid(),
+    user_id         uuid not null references users (id),
+    url             text not null,
+    secret          text not null,
+    created_at      timestamptz not null default now(),
+
+    constraint webhook_subscriptions_pk primary key (id)
+);
+
+create index if not exists webhook_subscriptions_user_idx on webhook_subscriptions (user_id);
+
+create table if not exists webhook_deliveries
+(
+    id               bigserial,
+    subscription_id  uuid not null references webhook_subscriptions (id) on delete cascade,
+    user_id          uuid not null,
+    event            text not null,
+    payload          jsonb not null,
+    status           text not null default 'pending',
+    attempts         integer not null default 0,
+    next_attempt_at  timestamptz not null default now(),
+    last_status_code integer,
+    last_error       text,
+    created_at       timestamptz not null default now(),
+    delivered_at     timestamptz,
+
+    constraint webhook_deliveries_pk primary key (id)
+);
+
+create index if not exists webhook_deliveries_subscription_idx on webhook_deliveries (subscription_id, id);
+create index if not exists webhook_deliveries_pending_idx on webhook_deliveries (next_attempt_at) where status = 'pending';
+-- +migrate Down
+drop table webhook_deliveries;
+drop table webhook_subscriptions;
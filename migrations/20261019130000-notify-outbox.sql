@@ -0,0 +1,18 @@
+-- +migrate Up
+-- +migrate StatementBegin
+create or replace function notify_outbox() returns trigger as $$
+begin
+    perform pg_notify('outbox_events', new.user_id::text);
+    return new;
+end;
+$$ language plpgsql;
+-- +migrate StatementEnd
+
+create trigger outbox_notify after insert on outbox
+    for each row execute function notify_outbox();
+
+create index if not exists outbox_user_idx on outbox (user_id, id);
+-- +migrate Down
+drop index if exists outbox_user_idx;
+drop trigger if exists outbox_notify on outbox;
+drop function if exists notify_outbox();
@@ -0,0 +1,18 @@
+-- +migrate Up
+create table if not exists idempotency_keys
+(
+    user_id         uuid not null,
+    key             text not null,
+    request_hash    text not null,
+    status_code     integer,
+    content_type    text,
+    body            bytea,
+    created_at      timestamptz not null,
+    expires_at      timestamptz not null,
+
+    constraint idempotency_keys_pk primary key (user_id, key)
+);
+
+create index if not exists idempotency_keys_expires_at_idx on idempotency_keys (expires_at);
+-- +migrate Down
+drop table idempotency_keys;
@@ -0,0 +1,28 @@
+-- +migrate Up
+create table if not exists sessions
+(
+    id              uuid default gen_random_uuid(),
+    user_id         uuid not null references users (id),
+    created_at      timestamptz not null default now(),
+    expires_at      timestamptz not null,
+    revoked_at      timestamptz,
+    revoke_reason   text,
+
+    constraint sessions_pk primary key (id)
+);
+
+create index if not exists sessions_user_idx on sessions (user_id) where revoked_at is null;
+create index if not exists sessions_revoked_at_idx on sessions (revoked_at) where revoked_at is not null;
+
+create table if not exists refresh_tokens
+(
+    token_hash      text not null,
+    session_id      uuid not null references sessions (id) on delete cascade,
+    created_at      timestamptz not null default now(),
+    used_at         timestamptz,
+
+    constraint refresh_tokens_pk primary key (token_hash)
+);
+-- +migrate Down
+drop table refresh_tokens;
+drop table sessions;
@@ -0,0 +1,12 @@
+-- +migrate Up
+create table if not exists attempt_counters
+(
+    key             text not null,
+    count           integer not null,
+    window_start    timestamptz not null,
+    blocked_until   timestamptz,
+
+    constraint attempt_counters_pk primary key (key)
+);
+-- +migrate Down
+drop table attempt_counters;
@@ -0,0 +1,18 @@
+-- +migrate Up
+alter table users add column if not exists blocked_at timestamptz;
+
+alter table ledger add column if not exists reason text;
+alter table ledger add column if not exists operator text;
+
+-- Corrections are not tied to an order.
+drop index if exists ledger_kind_order_uq;
+create unique index if not exists ledger_kind_order_uq on ledger (kind, order_number) where order_number <> '';
+-- +migrate Down
+drop index if exists ledger_kind_order_uq;
+delete from ledger where kind = 'correction';
+create unique index if not exists ledger_kind_order_uq on ledger (kind, order_number);
+
+alter table ledger drop column operator;
+alter table ledger drop column reason;
+
+alter table users drop column blocked_at;
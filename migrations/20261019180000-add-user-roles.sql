@@ -0,0 +1,5 @@
+-- +migrate Up
+alter table users add column if not exists roles text[] not null default '{user}'
+    check (roles <@ array['user', 'support', 'admin', 'service']);
+-- +migrate Down
+alter table users drop column roles;
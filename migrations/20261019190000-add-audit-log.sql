@@ -0,0 +1,33 @@
+-- +migrate Up
+create table if not exists audit_log
+(
+    id          bigserial,
+    created_at  timestamptz not null,
+    actor       text not null,
+    action      text not null,
+    target      text not null,
+    metadata    jsonb not null,
+    prev_hash   text not null,
+    hash        text not null,
+
+    constraint audit_log_pk primary key (id)
+);
+
+create index if not exists audit_log_actor_idx on audit_log (actor, id);
+create index if not exists audit_log_action_idx on audit_log (action, id);
+create index if not exists audit_log_target_idx on audit_log (target, id);
+
+-- The log is append-only, the hash chain detects changes made anyway.
+-- +migrate StatementBegin
+create or replace function audit_log_append_only() returns trigger as $$
+begin
+    raise exception 'audit_log is append-only';
+end;
+$$ language plpgsql;
+-- +migrate StatementEnd
+
+create trigger audit_log_append_only before update or delete on audit_log
+    for each row execute procedure audit_log_append_only();
+-- +migrate Down
+drop table audit_log;
+drop function audit_log_append_only();
@@ -0,0 +1,8 @@
+-- +migrate Up
+-- Amounts have two decimals, see internal/money; rounds existing ones
+-- half away from zero like the service does.
+alter table orders alter column accrual type numeric(19, 2);
+alter table ledger alter column amount type numeric(19, 2);
+-- +migrate Down
+alter table ledger alter column amount type numeric;
+alter table orders alter column accrual type numeric;
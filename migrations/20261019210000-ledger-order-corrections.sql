@@ -0,0 +1,10 @@
+-- +migrate Up
+-- Reconciliation may correct the accrual of an order more than once, only
+-- accruals and withdrawals are unique per order.
+drop index if exists ledger_kind_order_uq;
+create unique index if not exists ledger_kind_order_uq on ledger (kind, order_number) where kind in ('accrual', 'withdrawal');
+create index if not exists ledger_order_idx on ledger (order_number) where order_number <> '';
+-- +migrate Down
+drop index if exists ledger_order_idx;
+drop index if exists ledger_kind_order_uq;
+create unique index if not exists ledger_kind_order_uq on ledger (kind, order_number) where order_number <> '';
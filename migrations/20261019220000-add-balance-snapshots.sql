@@ -0,0 +1,17 @@
+-- +migrate Up
+create table if not exists balance_snapshots
+(
+    user_id         uuid not null,
+    current         numeric(19, 2) not null,
+    withdrawn       numeric(19, 2) not null,
+    last_entry_id   bigint not null,
+    updated_at      timestamptz not null default now(),
+
+    constraint balance_snapshots_pk primary key (user_id),
+    constraint balance_snapshots_user_fk foreign key (user_id) references users (id)
+);
+
+create index if not exists ledger_created_at_idx on ledger (created_at);
+-- +migrate Down
+drop index if exists ledger_created_at_idx;
+drop table balance_snapshots;
@@ -0,0 +1,31 @@
+-- +migrate Up
+create table if not exists credit_lots
+(
+    entry_id        bigint not null,
+    user_id         uuid not null,
+    order_number    text not null,
+    amount          numeric(19, 2) not null,
+    remaining       numeric(19, 2) not null,
+    created_at      timestamptz not null,
+
+    constraint credit_lots_pk primary key (entry_id),
+    constraint credit_lots_entry_fk foreign key (entry_id) references ledger (id),
+    constraint credit_lots_user_fk foreign key (user_id) references users (id)
+);
+
+create index if not exists credit_lots_user_idx on credit_lots (user_id, entry_id) where remaining > 0;
+create index if not exists credit_lots_created_at_idx on credit_lots (created_at) where remaining > 0;
+
+-- Opens a lot for each existing credit, the debits so far spent the
+-- oldest ones.
+insert into credit_lots (entry_id, user_id, order_number, amount, remaining, created_at)
+select c.id, c.user_id, c.order_number, c.amount,
+    least(c.amount, greatest(0, sum(c.amount) over (partition by c.user_id order by c.id) - coalesce(d.debited, 0))),
+    c.created_at
+from ledger c
+left join (select user_id, -sum(amount) as debited from ledger where amount < 0 group by user_id) d
+    on d.user_id = c.user_id
+where c.amount > 0
+on conflict do nothing;
+-- +migrate Down
+drop table credit_lots;
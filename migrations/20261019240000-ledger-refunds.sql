@@ -0,0 +1,7 @@
+-- +migrate Up
+-- A withdrawal is refunded at most once.
+drop index if exists ledger_kind_order_uq;
+create unique index if not exists ledger_kind_order_uq on ledger (kind, order_number) where kind in ('accrual', 'withdrawal', 'refund');
+-- +migrate Down
+drop index if exists ledger_kind_order_uq;
+create unique index if not exists ledger_kind_order_uq on ledger (kind, order_number) where kind in ('accrual', 'withdrawal');
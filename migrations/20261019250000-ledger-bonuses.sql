@@ -0,0 +1,9 @@
+-- +migrate Up
+alter table ledger add column if not exists rule_id text;
+
+-- A rule grants a bonus once per user and order, or once per user for
+-- the bonuses without an order.
+create unique index if not exists ledger_bonus_uq on ledger (rule_id, user_id, order_number) where kind = 'bonus';
+-- +migrate Down
+drop index if exists ledger_bonus_uq;
+alter table ledger drop column rule_id;
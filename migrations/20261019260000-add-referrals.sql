@@ -0,0 +1,32 @@
+-- +migrate Up
+create table if not exists referral_codes
+(
+    user_id         uuid not null,
+    code            text not null,
+    created_at      timestamptz not null default now(),
+
+    constraint referral_codes_pk primary key (user_id),
+    constraint referral_codes_code_uq unique (code),
+    constraint referral_codes_user_fk foreign key (user_id) references users (id)
+);
+
+create table if not exists referrals
+(
+    referred_id     uuid not null,
+    referrer_id     uuid not null,
+    status          text not null default 'PENDING',
+    order_number    text,
+    created_at      timestamptz not null default now(),
+    rewarded_at     timestamptz,
+
+    constraint referrals_pk primary key (referred_id),
+    constraint referrals_referred_fk foreign key (referred_id) references users (id),
+    constraint referrals_referrer_fk foreign key (referrer_id) references users (id),
+    constraint referrals_self_chk check (referrer_id <> referred_id)
+);
+
+create index if not exists referrals_referrer_idx on referrals (referrer_id, created_at);
+create index if not exists referrals_pending_idx on referrals ((referred_id::text)) where status = 'PENDING';
+-- +migrate Down
+drop table referrals;
+drop table referral_codes;
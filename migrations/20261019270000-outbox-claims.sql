@@ -0,0 +1,12 @@
+-- +migrate Up
+alter table outbox add column if not exists claimed_until timestamptz;
+alter table outbox add column if not exists dead_at timestamptz;
+
+drop index if exists outbox_pending_idx;
+create index if not exists outbox_pending_idx on outbox (user_id, id) where delivered_at is null and dead_at is null;
+-- +migrate Down
+drop index if exists outbox_pending_idx;
+create index if not exists outbox_pending_idx on outbox (id) where delivered_at is null;
+
+alter table outbox drop column if exists dead_at;
+alter table outbox drop column if exists claimed_until;
@@ -0,0 +1,6 @@
+-- +migrate Up
+-- Keys of admin token requests belong to operators, which are not users.
+alter table idempotency_keys alter column user_id type text using user_id::text;
+-- +migrate Down
+delete from idempotency_keys where user_id like 'operator:%';
+alter table idempotency_keys alter column user_id type uuid using user_id::uuid;
@@ -0,0 +1,9 @@
+-- +migrate Up
+-- The entry count lets reads tell a snapshot missing entries, e.g. of a
+-- transaction committed after the compaction, from a right one.
+alter table balance_snapshots add column if not exists entry_count bigint not null default 0;
+update balance_snapshots s set entry_count = (
+    select count(*) from ledger l where l.user_id = s.user_id and l.id <= s.last_entry_id
+);
+-- +migrate Down
+alter table balance_snapshots drop column if exists entry_count;
@@ -0,0 +1,27 @@
+-- +migrate Up
+-- What each debit spent from each credit lot, so that refunds give the
+-- points back to the lots they came from.
+create table if not exists lot_spends
+(
+    debit_entry_id  bigint not null,
+    lot_entry_id    bigint not null,
+    amount          numeric(19, 2) not null,
+
+    constraint lot_spends_pk primary key (debit_entry_id, lot_entry_id),
+    constraint lot_spends_debit_fk foreign key (debit_entry_id) references ledger (id),
+    constraint lot_spends_lot_fk foreign key (lot_entry_id) references credit_lots (entry_id)
+);
+
+-- The lots of past refunds expire as if opened with their withdrawal.
+update credit_lots l set created_at = w.created_at
+from ledger rf
+join ledger w on w.kind = 'withdrawal' and w.order_number = rf.order_number
+where rf.kind = 'refund' and l.entry_id = rf.id;
+
+-- Refunds are no longer negative withdrawals, the snapshots are rebuilt.
+alter table balance_snapshots add column if not exists refunded numeric(19, 2) not null default 0;
+delete from balance_snapshots;
+-- +migrate Down
+delete from balance_snapshots;
+alter table balance_snapshots drop column if exists refunded;
+drop table lot_spends;
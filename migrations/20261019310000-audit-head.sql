@@ -0,0 +1,17 @@
+-- +migrate Up
+-- The head of the audit hash chain. Appends lock its only row, so that
+-- each entry is chained to the one committed before.
+create table if not exists audit_head
+(
+    id      boolean not null default true,
+    hash    text not null,
+
+    constraint audit_head_pk primary key (id),
+    constraint audit_head_single_chk check (id)
+);
+
+insert into audit_head (hash)
+select coalesce((select hash from audit_log order by id desc limit 1), '')
+on conflict do nothing;
+-- +migrate Down
+drop table audit_head;
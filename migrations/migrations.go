@@ -0,0 +1,10 @@
+// Package migrations embeds the SQL migrations, so the service and the
+// integration tests apply exactly what sql-migrate applies from dbconfig.yml.
+package migrations
+
+import "embed"
+
+// FS holds the migration files.
+//
+//go:embed *.sql
+var FS embed.FS
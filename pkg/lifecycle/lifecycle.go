@@ -0,0 +1,183 @@
+// Package lifecycle starts the long-running components of a service in
+// registration order and stops them in reverse order, each one within its
+// own timeout.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/pkg/log"
+)
+
+const (
+	defaultStopTimeout = 5 * time.Second
+)
+
+// Hook describes a component managed by the Manager.
+type Hook struct {
+	// Name identifies the component in logs and errors.
+	Name string
+	// Start must not block: long-running work is started in a goroutine
+	// which reports a fatal error through Manager.Fail. Optional.
+	Start func(ctx context.Context) error
+	// Stop releases the component. The context is cancelled after
+	// StopTimeout. Optional.
+	Stop func(ctx context.Context) error
+	// StopTimeout overrides the default stop timeout of the Manager.
+	StopTimeout time.Duration
+}
+
+// StopError reports the components that failed to stop.
+type StopError struct {
+	Components []string
+}
+
+func (e StopError) Error() string {
+	return fmt.Sprintf("failed to stop components: %s", strings.Join(e.Components, ", "))
+}
+
+// Manager runs registered components.
+type Manager struct {
+	stopTimeout time.Duration
+
+	mu      sync.Mutex
+	hooks   []Hook
+	started int
+
+	failOnce sync.Once
+	failCh   chan error
+}
+
+// New returns a Manager that gives each component stopTimeout to stop
+// unless its Hook says otherwise. Zero means the default of 5 seconds.
+func New(stopTimeout time.Duration) *Manager {
+	if stopTimeout <= 0 {
+		stopTimeout = defaultStopTimeout
+	}
+
+	return &Manager{
+		stopTimeout: stopTimeout,
+		failCh:      make(chan error, 1),
+	}
+}
+
+// Register appends a component. Components are started in registration
+// order and stopped in reverse order.
+func (m *Manager) Register(h Hook) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.hooks = append(m.hooks, h)
+}
+
+// Fail reports a fatal runtime error of a component and makes Run stop
+// everything. Only the first error is kept.
+func (m *Manager) Fail(name string, err error) {
+	m.failOnce.Do(func() {
+		m.failCh <- fmt.Errorf("component %s failed: %w", name, err)
+	})
+}
+
+// Run starts all components, waits until ctx is done or a component fails
+// and stops the started components.
+//
+// Run returns nil only for a clean shutdown. A component failing to stop
+// makes it return a StopError. A component failing to start, or at
+// runtime through Fail, is an error too, even when everything stops
+// cleanly afterwards, so that a service exiting on Run's error does not
+// report success for a run that never served or was cut short.
+func (m *Manager) Run(ctx context.Context) error {
+	runErr := m.Start(ctx)
+	if runErr == nil {
+		select {
+		case <-ctx.Done():
+			log.Info(context.Background(), "shutdown requested")
+		case runErr = <-m.failCh:
+			log.Error(context.Background(), "shutting down after component failure", runErr)
+		}
+	}
+
+	if err := m.Stop(); err != nil {
+		return err
+	}
+
+	return runErr
+}
+
+// Start starts the components in registration order. If a component fails
+// to start the ones already started are left for Stop.
+func (m *Manager) Start(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, h := range m.hooks[m.started:] {
+		if h.Start != nil {
+			log.Info(ctx, "starting component", "component", h.Name)
+			if err := h.Start(ctx); err != nil {
+				return fmt.Errorf("failed to start component %s: %w", h.Name, err)
+			}
+		}
+		m.started++
+	}
+
+	log.Info(ctx, "all components started", "count", m.started)
+	return nil
+}
+
+// Stop stops the started components in reverse order. A component that
+// fails or times out does not prevent the others from stopping.
+func (m *Manager) Stop() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var failed []string
+	for i := m.started - 1; i >= 0; i-- {
+		h := m.hooks[i]
+		if h.Stop == nil {
+			continue
+		}
+
+		timeout := h.StopTimeout
+		if timeout <= 0 {
+			timeout = m.stopTimeout
+		}
+
+		log.Info(context.Background(), "stopping component", "component", h.Name, "timeout", timeout)
+		if err := stopWithTimeout(h.Stop, timeout); err != nil {
+			log.Error(context.Background(), "failed to stop component", err, "component", h.Name)
+			failed = append(failed, h.Name)
+			continue
+		}
+		log.Info(context.Background(), "component stopped", "component", h.Name)
+	}
+	m.started = 0
+
+	if len(failed) > 0 {
+		return StopError{Components: failed}
+	}
+
+	return nil
+}
+
+func stopWithTimeout(stop func(ctx context.Context) error, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- stop(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		// The stop function ignores its context, give up on it.
+		return errors.New("stop timed out")
+	}
+}
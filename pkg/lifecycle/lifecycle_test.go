@@ -0,0 +1,128 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager_StopsInReverseOrder(t *testing.T) {
+	var calls []string
+	record := func(call string) func(context.Context) error {
+		return func(context.Context) error {
+			calls = append(calls, call)
+			return nil
+		}
+	}
+
+	m := New(time.Second)
+	m.Register(Hook{Name: "db", Start: record("start db"), Stop: record("stop db")})
+	m.Register(Hook{Name: "poller", Start: record("start poller"), Stop: record("stop poller")})
+	m.Register(Hook{Name: "http", Start: record("start http"), Stop: record("stop http")})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	require.NoError(t, m.Run(ctx))
+	assert.Equal(t, []string{
+		"start db", "start poller", "start http",
+		"stop http", "stop poller", "stop db",
+	}, calls)
+}
+
+func TestManager_StopTimeout(t *testing.T) {
+	stopped := false
+
+	m := New(time.Second)
+	m.Register(Hook{
+		Name: "db",
+		Stop: func(context.Context) error {
+			stopped = true
+			return nil
+		},
+	})
+	m.Register(Hook{
+		Name:        "stuck",
+		StopTimeout: 10 * time.Millisecond,
+		Stop: func(context.Context) error {
+			select {}
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := m.Run(ctx)
+	var stopErr StopError
+	if assert.ErrorAs(t, err, &stopErr) {
+		assert.Equal(t, []string{"stuck"}, stopErr.Components)
+	}
+	assert.True(t, stopped)
+}
+
+func TestManager_StartFailure(t *testing.T) {
+	stopped := false
+
+	m := New(time.Second)
+	m.Register(Hook{
+		Name: "db",
+		Stop: func(context.Context) error {
+			stopped = true
+			return nil
+		},
+	})
+	m.Register(Hook{
+		Name: "http",
+		Start: func(context.Context) error {
+			return errors.New("address in use")
+		},
+		Stop: func(context.Context) error {
+			t.Error("component that failed to start must not be stopped")
+			return nil
+		},
+	})
+
+	err := m.Run(context.Background())
+	assert.EqualError(t, err, "failed to start component http: address in use")
+	assert.True(t, stopped)
+}
+
+func TestManager_Fail(t *testing.T) {
+	m := New(time.Second)
+	m.Register(Hook{
+		Name: "poller",
+		Start: func(context.Context) error {
+			go m.Fail("poller", errors.New("boom"))
+			return nil
+		},
+	})
+
+	err := m.Run(context.Background())
+	assert.EqualError(t, err, "component poller failed: boom")
+}
+
+func TestPeriodic(t *testing.T) {
+	calls := make(chan struct{}, 100)
+	h := Periodic("job", 5*time.Millisecond, func(ctx context.Context) error {
+		calls <- struct{}{}
+		return errors.New("keeps running")
+	})
+
+	require.NoError(t, h.Start(context.Background()))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-calls:
+		case <-time.After(time.Second):
+			t.Fatal("the job did not run")
+		}
+	}
+	require.NoError(t, h.Stop(context.Background()))
+
+	n := len(calls)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, n, len(calls), "the job runs after Stop")
+}
@@ -0,0 +1,59 @@
+package lifecycle
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/paramonies/ya-gophermart/pkg/log"
+)
+
+// Periodic returns the hook of a background job calling fn every
+// interval. Errors of fn are logged, the job keeps running. Stop cancels
+// the context of a running call and waits for it to return.
+func Periodic(name string, interval time.Duration, fn func(ctx context.Context) error) Hook {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+
+	return Hook{
+		Name: name,
+		Start: func(context.Context) error {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				ticker := time.NewTicker(interval)
+				defer ticker.Stop()
+
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+					}
+
+					if err := fn(ctx); err != nil && ctx.Err() == nil {
+						log.Error(ctx, "periodic job failed", err, "job", name)
+					}
+				}
+			}()
+			return nil
+		},
+		Stop: func(stopCtx context.Context) error {
+			cancel()
+
+			done := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+
+			select {
+			case <-done:
+				return nil
+			case <-stopCtx.Done():
+				return stopCtx.Err()
+			}
+		},
+	}
+}
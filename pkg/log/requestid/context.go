@@ -13,3 +13,8 @@ func FromContext(ctx context.Context) string {
 	}
 	return id
 }
+
+// NewContext returns a copy of ctx carrying the request ID.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, DefaultRequestIDKey, id) //nolint:staticcheck // the key is shared with pkg/log
+}
@@ -0,0 +1,153 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/accrualmock"
+	"github.com/paramonies/ya-gophermart/internal/money"
+)
+
+// TestEndToEnd follows a user from registration to a withdrawal, the
+// order being processed by the accrual simulator.
+func TestEndToEnd(t *testing.T) {
+	ctx := context.Background()
+	login := "e2e_" + randomSuffix()
+	const password = "End-to-end-1"
+	order, withdrawal := orderNumber(), orderNumber()
+
+	credentials := fmt.Sprintf(`{"login":%q,"password":%q}`, login, password)
+	resp := call(t, http.MethodPost, "/api/user/register", "", credentials)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = call(t, http.MethodPost, "/api/user/login", "", credentials)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	token := resp.Header.Get("Authorization")
+	require.True(t, strings.HasPrefix(token, "Bearer "))
+
+	harness.Accrual.Script(order,
+		accrualmock.Step{Status: accrualmock.StatusProcessing},
+		accrualmock.Step{Status: accrualmock.StatusProcessed, Accrual: money.FromUnits(500)})
+	resp = call(t, http.MethodPost, "/api/user/orders", token, order)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	var orders []struct {
+		Number  string       `json:"number"`
+		Status  string       `json:"status"`
+		Accrual money.Amount `json:"accrual"`
+	}
+	decode(t, call(t, http.MethodGet, "/api/user/orders", token, ""), &orders)
+	require.Len(t, orders, 1)
+	assert.Equal(t, "NEW", orders[0].Status)
+
+	require.NoError(t, harness.Sync.Run(ctx))
+	decode(t, call(t, http.MethodGet, "/api/user/orders", token, ""), &orders)
+	assert.Equal(t, "PROCESSING", orders[0].Status)
+
+	require.NoError(t, harness.Sync.Run(ctx))
+	decode(t, call(t, http.MethodGet, "/api/user/orders", token, ""), &orders)
+	assert.Equal(t, order, orders[0].Number)
+	assert.Equal(t, "PROCESSED", orders[0].Status)
+	assert.Equal(t, money.FromUnits(500), orders[0].Accrual)
+
+	var balance struct {
+		Current   money.Amount `json:"current"`
+		Withdrawn money.Amount `json:"withdrawn"`
+	}
+	decode(t, call(t, http.MethodGet, "/api/user/balance", token, ""), &balance)
+	assert.Equal(t, money.FromUnits(500), balance.Current)
+	assert.Zero(t, balance.Withdrawn)
+
+	resp = call(t, http.MethodPost, "/api/user/balance/withdraw", token,
+		fmt.Sprintf(`{"order":%q,"sum":600}`, withdrawal))
+	assert.Equal(t, http.StatusPaymentRequired, resp.StatusCode)
+	resp = call(t, http.MethodPost, "/api/user/balance/withdraw", token,
+		fmt.Sprintf(`{"order":%q,"sum":200}`, withdrawal))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	decode(t, call(t, http.MethodGet, "/api/user/balance", token, ""), &balance)
+	assert.Equal(t, money.FromUnits(300), balance.Current)
+	assert.Equal(t, money.FromUnits(200), balance.Withdrawn)
+
+	var withdrawals []struct {
+		Order string       `json:"order"`
+		Sum   money.Amount `json:"sum"`
+	}
+	decode(t, call(t, http.MethodGet, "/api/user/balance/withdrawals", token, ""), &withdrawals)
+	require.Len(t, withdrawals, 1)
+	assert.Equal(t, withdrawal, withdrawals[0].Order)
+	assert.Equal(t, money.FromUnits(200), withdrawals[0].Sum)
+}
+
+// call sends the request to the API, authenticated by token if not empty.
+// JSON bodies are sent as such, others as text. The body of the response
+// is read and closed.
+func call(t *testing.T, method, path, token, body string) *http.Response {
+	t.Helper()
+
+	r, err := http.NewRequest(method, harness.API.URL+path, strings.NewReader(body))
+	require.NoError(t, err)
+	if strings.HasPrefix(body, "{") {
+		r.Header.Set("Content-Type", "application/json")
+	} else if body != "" {
+		r.Header.Set("Content-Type", "text/plain")
+	}
+	if token != "" {
+		r.Header.Set("Authorization", token)
+	}
+
+	resp, err := http.DefaultClient.Do(r)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body = io.NopCloser(strings.NewReader(string(b)))
+	return resp
+}
+
+func decode(t *testing.T, resp *http.Response, v interface{}) {
+	t.Helper()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+}
+
+// orderNumber returns a random order number passing the Luhn check.
+func orderNumber() string {
+	digits := make([]int, 15)
+	for i := range digits {
+		digits[i] = rand.Intn(10)
+	}
+
+	sum := 0
+	for i := range digits {
+		d := digits[len(digits)-1-i]
+		// The check digit is appended, so the last digit is doubled.
+		if i%2 == 0 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+
+	var b strings.Builder
+	for _, d := range digits {
+		b.WriteByte(byte('0' + d))
+	}
+	b.WriteByte(byte('0' + (10-sum%10)%10))
+	return b.String()
+}
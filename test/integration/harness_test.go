@@ -0,0 +1,244 @@
+//go:build integration
+// +build integration
+
+// Package integration drives the real router against a throwaway
+// PostgreSQL and the accrual simulator.
+//
+// PostgreSQL comes from GOPHERMART_TEST_DATABASE_URI when set: a fresh
+// database is created on that server for the run and dropped afterwards.
+// Otherwise the image of build/db/Dockerfile is built and started with
+// docker. Run with:
+//
+//	make test_integration
+package integration
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"github.com/paramonies/ya-gophermart/internal/accrual"
+	"github.com/paramonies/ya-gophermart/internal/accrualmock"
+	"github.com/paramonies/ya-gophermart/internal/accrualsync"
+	"github.com/paramonies/ya-gophermart/internal/audit"
+	"github.com/paramonies/ya-gophermart/internal/auth"
+	"github.com/paramonies/ya-gophermart/internal/bruteforce"
+	"github.com/paramonies/ya-gophermart/internal/events"
+	"github.com/paramonies/ya-gophermart/internal/handlers"
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/internal/storage/postgres"
+)
+
+const (
+	databaseURIEnv = "GOPHERMART_TEST_DATABASE_URI"
+
+	dockerImage       = "ya-gophermart-postgres-it"
+	dockerPassword    = "123456"
+	dockerDatabase    = "gophermart"
+	dockerStartupWait = 60 * time.Second
+)
+
+// harness is shared by all the tests of the package.
+var harness struct {
+	DatabaseURI string
+	DB          *pgxpool.Pool
+	Store       *storage.Storage
+	API         *httptest.Server
+	Accrual     *accrualmock.Server
+	AccrualURL  string
+	// Sync polls Accrual for the pending orders of Store when run, the
+	// tests run it instead of a periodic job.
+	Sync *accrualsync.Syncer
+}
+
+func TestMain(m *testing.M) {
+	os.Exit(run(m))
+}
+
+func run(m *testing.M) int {
+	ctx := context.Background()
+
+	databaseURI, cleanup, err := startPostgres(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "integration: failed to start PostgreSQL: %v\n", err)
+		return 1
+	}
+	defer cleanup()
+
+	if _, err := postgres.Migrate(databaseURI); err != nil {
+		fmt.Fprintf(os.Stderr, "integration: %v\n", err)
+		return 1
+	}
+
+	pool, err := pgxpool.Connect(ctx, databaseURI)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "integration: failed to connect to PostgreSQL: %v\n", err)
+		return 1
+	}
+	defer pool.Close()
+
+	accrualServer, simulator := accrualmock.NewTestServer(accrualmock.Config{})
+	defer accrualServer.Close()
+
+	store, err := postgres.NewStorage(ctx, databaseURI, 5*time.Second)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "integration: %v\n", err)
+		return 1
+	}
+	defer store.Close(ctx)
+
+	authService := auth.NewService(store.Users, store.Sessions, auth.Config{
+		Secret: []byte("secret"),
+		// The default policy of the service.
+		Policy: auth.PasswordPolicy{MinLength: 8, MinClasses: 2, RejectCommon: true},
+	})
+	api := httptest.NewServer(handlers.NewRouter(handlers.Deps{
+		Storage: store,
+		Auth:    authService,
+		Guard:   bruteforce.NewGuard(store.Attempts, bruteforce.Config{}),
+		Audit:   audit.New(store.Audit),
+		Events:  events.NewHub(),
+	}))
+	defer api.Close()
+
+	harness.DatabaseURI = databaseURI
+	harness.DB = pool
+	harness.Store = store
+	harness.API = api
+	harness.Accrual = simulator
+	harness.AccrualURL = accrualServer.URL
+	harness.Sync = accrualsync.New(store.Orders, accrual.NewClient(accrualServer.URL, accrual.DefaultTimeout), nil, accrualsync.Config{})
+
+	return m.Run()
+}
+
+func startPostgres(ctx context.Context) (string, func(), error) {
+	if uri := os.Getenv(databaseURIEnv); uri != "" {
+		return createDatabase(ctx, uri)
+	}
+	return startDockerPostgres(ctx)
+}
+
+// createDatabase creates a uniquely named database on the server of
+// adminURI and returns its URI.
+func createDatabase(ctx context.Context, adminURI string) (string, func(), error) {
+	conn, err := pgx.Connect(ctx, adminURI)
+	if err != nil {
+		return "", nil, err
+	}
+	defer conn.Close(ctx)
+
+	name := "gophermart_it_" + randomSuffix()
+	if _, err := conn.Exec(ctx, "create database "+name); err != nil {
+		return "", nil, err
+	}
+
+	u, err := url.Parse(adminURI)
+	if err != nil {
+		return "", nil, err
+	}
+	u.Path = "/" + name
+
+	cleanup := func() {
+		conn, err := pgx.Connect(context.Background(), adminURI)
+		if err != nil {
+			return
+		}
+		defer conn.Close(context.Background())
+		_, _ = conn.Exec(context.Background(), "drop database if exists "+name+" with (force)")
+	}
+
+	return u.String(), cleanup, nil
+}
+
+// startDockerPostgres runs the image of build/db/Dockerfile on a random
+// host port and waits until it accepts connections.
+func startDockerPostgres(ctx context.Context) (string, func(), error) {
+	root := repoRoot()
+
+	if _, err := docker("build", "-q", "-t", dockerImage, "-f", filepath.Join(root, "build/db/Dockerfile"), root); err != nil {
+		return "", nil, err
+	}
+
+	id, err := docker("run", "-d", "--rm", "-P",
+		"-e", "POSTGRES_PASSWORD="+dockerPassword,
+		"-e", "POSTGRES_DB="+dockerDatabase,
+		"-v", filepath.Join(root, "build/db/scripts")+":/docker-entrypoint-initdb.d:ro",
+		dockerImage)
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() {
+		_, _ = docker("rm", "-f", id)
+	}
+
+	hostPort, err := docker("port", id, "5432/tcp")
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	// "docker port" may list an IPv4 and an IPv6 binding.
+	hostPort = strings.Replace(strings.Split(hostPort, "\n")[0], "0.0.0.0", "127.0.0.1", 1)
+
+	uri := fmt.Sprintf("postgresql://postgres:%s@%s/%s?sslmode=disable", dockerPassword, hostPort, dockerDatabase)
+	if err := waitForPostgres(ctx, uri); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	return uri, cleanup, nil
+}
+
+func waitForPostgres(ctx context.Context, uri string) error {
+	ctx, cancel := context.WithTimeout(ctx, dockerStartupWait)
+	defer cancel()
+
+	for {
+		conn, err := pgx.Connect(ctx, uri)
+		if err == nil {
+			err = conn.Ping(ctx)
+			conn.Close(ctx)
+			if err == nil {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("postgres is not ready: %w", err)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+func docker(args ...string) (string, error) {
+	out, err := exec.Command("docker", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("docker %s: %w: %s", args[0], err, out)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func repoRoot() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(file), "..", "..")
+}
+
+func randomSuffix() string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
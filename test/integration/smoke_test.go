@@ -0,0 +1,48 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSmoke_Migrations(t *testing.T) {
+	var exists bool
+	err := harness.DB.QueryRow(context.Background(),
+		"select exists (select from information_schema.tables where table_name = 'users')").Scan(&exists)
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestSmoke_Router(t *testing.T) {
+	resp, err := http.Post(harness.API.URL+"/api/user/register", "application/json",
+		strings.NewReader(`{"login":"smoke","password":"Smoke-test-1"}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("X-Request-Id"))
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Authorization"), "Bearer "))
+}
+
+func TestSmoke_Accrual(t *testing.T) {
+	resp, err := http.Get(harness.AccrualURL + "/api/orders/12345678903")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var body struct {
+		Order  string `json:"order"`
+		Status string `json:"status"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, "12345678903", body.Order)
+	assert.Equal(t, "REGISTERED", body.Status)
+}
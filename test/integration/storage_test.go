@@ -0,0 +1,33 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/paramonies/ya-gophermart/internal/storage"
+	"github.com/paramonies/ya-gophermart/internal/storage/postgres"
+	"github.com/paramonies/ya-gophermart/internal/storage/storagetest"
+)
+
+func TestPostgresStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) *storage.Storage {
+		ctx := context.Background()
+
+		_, err := harness.DB.Exec(ctx, "truncate referrals, referral_codes, credit_lots, balance_snapshots, audit_log, attempt_counters, refresh_tokens, sessions, idempotency_keys, webhook_deliveries, webhook_subscriptions, outbox, ledger, orders, users cascade")
+		require.NoError(t, err)
+		_, err = harness.DB.Exec(ctx, "update audit_head set hash = ''")
+		require.NoError(t, err)
+
+		s, err := postgres.NewStorage(ctx, harness.DatabaseURI, 5*time.Second)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = s.Close(ctx) })
+
+		return s
+	})
+}